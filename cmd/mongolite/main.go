@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -41,6 +44,7 @@ Examples:
 		Flags: []cli.Flag{
 			&cli.StringFlag{Name: "file", Value: "./mongolite.json", Usage: "data file path"},
 			&cli.StringFlag{Name: "db", Value: "test", Usage: "database name"},
+			&cli.BoolFlag{Name: "journal", Usage: "append writes to <file>.journal instead of rewriting the data file"},
 		},
 		Action: func(c *cli.Context) error {
 			if c.NArg() > 0 {
@@ -57,7 +61,7 @@ Examples:
 				},
 				Action: func(c *cli.Context) error {
 					addr := fmt.Sprintf(":%d", c.Int("port"))
-					return mongolite.ListenAndServe(addr, c.String("file"))
+					return mongolite.ListenAndServeWithOptions(addr, c.String("file"), mongolite.Options{Journal: c.Bool("journal")})
 				},
 			},
 			{
@@ -72,12 +76,14 @@ Examples:
 					&cli.StringFlag{Name: "projection-file", Usage: "projection document from file"},
 					&cli.Int64Flag{Name: "limit", Usage: "max documents to return"},
 					&cli.Int64Flag{Name: "skip", Usage: "documents to skip"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the query plan and execution stats instead of running the command"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("find requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -95,7 +101,7 @@ Examples:
 					if c.NArg() == 0 {
 						return fmt.Errorf("insert requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -113,7 +119,7 @@ Examples:
 					if c.NArg() == 0 {
 						return fmt.Errorf("insert-many requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -126,15 +132,18 @@ Examples:
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "filter", Value: "{}", Usage: "filter document (JSON)"},
 					&cli.StringFlag{Name: "filter-file", Usage: "filter document from file"},
-					&cli.StringFlag{Name: "update", Usage: "update document (JSON)"},
-					&cli.StringFlag{Name: "update-file", Usage: "update document from file"},
+					&cli.StringFlag{Name: "update", Usage: "update document or pipeline array (JSON)"},
+					&cli.StringFlag{Name: "update-file", Usage: "update document or pipeline array from file"},
+					&cli.StringFlag{Name: "array-filters", Usage: "arrayFilters array (JSON) for $[<identifier>] paths"},
 					&cli.BoolFlag{Name: "multi", Usage: "update multiple documents"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the query plan and execution stats instead of running the command"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("update requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -148,36 +157,84 @@ Examples:
 					&cli.StringFlag{Name: "filter", Value: "{}", Usage: "filter document (JSON)"},
 					&cli.StringFlag{Name: "filter-file", Usage: "filter document from file"},
 					&cli.BoolFlag{Name: "multi", Usage: "delete multiple documents"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the query plan and execution stats instead of running the command"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("delete requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
 					return doDelete(eng, c.String("db"), c.Args().First(), c, c.App.Writer)
 				},
 			},
+			{
+				Name:  "tx",
+				Usage: "apply insert/update/delete/findAndModify operations atomically",
+				Description: `Reads operations as a JSON array or ndjson from --ops, --ops-file or stdin and applies them all-or-nothing: either every operation succeeds and the data file is written once, or nothing is written and the failing operation is reported.
+
+Each operation names its "op" and "collection" (and optionally "db"):
+  {"op":"insert","collection":"steps","doc":{"step":4}}            (or "docs":[...])
+  {"op":"update","collection":"steps","filter":{"step":3},"update":{"$set":{"done":true}},"multi":false,"upsert":false}
+  {"op":"delete","collection":"steps","filter":{"step":1},"multi":false}
+  {"op":"findAndModify","collection":"counters","filter":{"_id":"steps"},"update":{"$inc":{"n":1}},"new":true,"upsert":true}
+
+One result line is printed per operation.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "ops", Usage: "operations (JSON array or ndjson)"},
+					&cli.StringFlag{Name: "ops-file", Usage: "operations from file"},
+				},
+				Action: func(c *cli.Context) error {
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doTx(eng, c.String("db"), c, c.App.Writer)
+				},
+			},
 			{
 				Name:  "aggregate",
 				Usage: "run an aggregation pipeline on a collection",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "pipeline", Usage: "pipeline array (JSON)"},
 					&cli.StringFlag{Name: "pipeline-file", Usage: "pipeline array from file"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the query plan and execution stats instead of running the command"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("aggregate requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
 					return doAggregate(eng, c.String("db"), c.Args().First(), c, c.App.Writer)
 				},
 			},
+			{
+				Name:  "watch",
+				Usage: "print change events as they happen",
+				Description: `Prints one ndjson change event per insert, update, replace, delete or drop in the collection, or in every collection of the database when none is named, until interrupted. Writes made by other processes sharing the data file are included; several writes another process makes to a document between two checks may be reported as a single update.
+
+--filter matches against the event, for example:
+  --filter '{"operationType":"update","fullDocument.status":"ready"}'`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "filter", Value: "{}", Usage: "filter on change events (JSON)"},
+					&cli.StringFlag{Name: "filter-file", Usage: "filter on change events from file"},
+					&cli.Int64Flag{Name: "limit", Usage: "exit after printing this many events"},
+				},
+				Action: func(c *cli.Context) error {
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doWatch(eng, c.String("db"), c.Args().First(), c, c.App.Writer)
+				},
+			},
 			{
 				Name:  "distinct",
 				Usage: "get distinct values for a field in a collection",
@@ -185,12 +242,13 @@ Examples:
 					&cli.StringFlag{Name: "field", Usage: "field name"},
 					&cli.StringFlag{Name: "filter", Value: "{}", Usage: "filter document (JSON)"},
 					&cli.StringFlag{Name: "filter-file", Usage: "filter document from file"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("distinct requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -203,12 +261,14 @@ Examples:
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "filter", Value: "{}", Usage: "filter document (JSON)"},
 					&cli.StringFlag{Name: "filter-file", Usage: "filter document from file"},
+					&cli.StringFlag{Name: "collation", Usage: "collation document (JSON) for string comparisons, e.g. {\"locale\":\"en\",\"strength\":2}"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the query plan and execution stats instead of running the command"},
 				},
 				Action: func(c *cli.Context) error {
 					if c.NArg() == 0 {
 						return fmt.Errorf("count requires a collection name")
 					}
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -219,7 +279,7 @@ Examples:
 				Name:  "list-dbs",
 				Usage: "list all databases",
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -230,13 +290,69 @@ Examples:
 				Name:  "list-collections",
 				Usage: "list collections in the database",
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
 					return doListCollections(eng, c.String("db"), c.App.Writer)
 				},
 			},
+			{
+				Name:  "create-collection",
+				Usage: "create a collection, optionally capped",
+				Description: `A capped collection keeps its documents in insertion order and removes the oldest once it holds more than --max documents or --size bytes of BSON, which makes it a rolling log:
+  mongolite create-collection log --capped --size 1048576 --max 1000`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "capped", Usage: "create a capped collection"},
+					&cli.Int64Flag{Name: "size", Usage: "maximum size of a capped collection in bytes"},
+					&cli.Int64Flag{Name: "max", Usage: "maximum number of documents in a capped collection"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("create-collection requires a collection name")
+					}
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doCreateCollection(eng, c.String("db"), c.Args().First(), c, c.App.Writer)
+				},
+			},
+			{
+				Name:  "create-view",
+				Usage: "create a read-only view defined by a pipeline on a collection or view",
+				Description: `find, count, distinct and aggregate on a view run its pipeline on the source first; writes to it fail:
+  mongolite create-view failing --view-on tests --pipeline '[{"$match":{"status":"fail"}}]'`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "view-on", Usage: "source collection or view"},
+					&cli.StringFlag{Name: "pipeline", Value: "[]", Usage: "aggregation pipeline (JSON array)"},
+					&cli.StringFlag{Name: "pipeline-file", Usage: "aggregation pipeline from file"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("create-view requires a view name")
+					}
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doCreateView(eng, c.String("db"), c.Args().First(), c, c.App.Writer)
+				},
+			},
+			{
+				Name:  "drop",
+				Usage: "drop a collection or view",
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return fmt.Errorf("drop requires a collection name")
+					}
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doDrop(eng, c.String("db"), c.Args().First(), c.App.Writer)
+				},
+			},
 			{
 				Name:  "set-schema",
 				Usage: "set schema for a collection",
@@ -246,7 +362,7 @@ Examples:
 					&cli.StringFlag{Name: "description", Usage: "description text"},
 				},
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -257,7 +373,7 @@ Examples:
 				Name:  "get-schema",
 				Usage: "get schema for a collection",
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -268,7 +384,7 @@ Examples:
 				Name:  "delete-schema",
 				Usage: "delete schema for a collection",
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
@@ -279,13 +395,24 @@ Examples:
 				Name:  "list-schemas",
 				Usage: "list all schemas",
 				Action: func(c *cli.Context) error {
-					eng, err := engine.New(c.String("file"))
+					eng, err := openEngine(c)
 					if err != nil {
 						return fmt.Errorf("open: %w", err)
 					}
 					return doListSchemas(eng, c.App.Writer)
 				},
 			},
+			{
+				Name:  "compact",
+				Usage: "fold the write journal into the data file",
+				Action: func(c *cli.Context) error {
+					eng, err := openEngine(c)
+					if err != nil {
+						return fmt.Errorf("open: %w", err)
+					}
+					return doCompact(eng, c.App.Writer)
+				},
+			},
 			{
 				Name:  "install-skill",
 				Usage: "install the Claude Code skill to ~/.claude/skills/mongolite/",
@@ -392,7 +519,17 @@ func doFind(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.Wr
 		}
 	}
 
-	results, err := eng.Find(dbName, collName, filterDoc, sortDoc, c.Int64("skip"), c.Int64("limit"))
+	collation, err := parseCollation(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("explain") {
+		x, err := eng.ExplainFind(dbName, collName, filterDoc, sortDoc, c.Int64("skip"), c.Int64("limit"), collation)
+		return writeExplain(w, x, err)
+	}
+
+	results, err := eng.Find(dbName, collName, filterDoc, sortDoc, c.Int64("skip"), c.Int64("limit"), collation)
 	if err != nil {
 		return fmt.Errorf("find: %w", err)
 	}
@@ -455,15 +592,44 @@ func doUpdate(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.
 	if err != nil {
 		return err
 	}
-	updateDoc, err := parseJSONArg(c.String("update"), c.String("update-file"))
+	updateStr, err := readArg(c.String("update"), c.String("update-file"))
+	if err != nil {
+		return err
+	}
+	var update interface{}
+	if strings.HasPrefix(strings.TrimSpace(updateStr), "[") {
+		var stages []bson.D
+		if err := bson.UnmarshalExtJSON([]byte(updateStr), false, &stages); err != nil {
+			return fmt.Errorf("parse update pipeline: %w", err)
+		}
+		update = stages
+	} else {
+		updateDoc, err := parseJSONArg(updateStr, "")
+		if err != nil {
+			return err
+		}
+		if len(updateDoc) == 0 {
+			return fmt.Errorf("update requires --update or --update-file")
+		}
+		update = updateDoc
+	}
+	var arrayFilters []bson.D
+	if s := c.String("array-filters"); s != "" {
+		if err := bson.UnmarshalExtJSON([]byte(s), false, &arrayFilters); err != nil {
+			return fmt.Errorf("parse array filters: %w", err)
+		}
+	}
+	collation, err := parseCollation(c)
 	if err != nil {
 		return err
 	}
-	if len(updateDoc) == 0 {
-		return fmt.Errorf("update requires --update or --update-file")
+
+	if c.Bool("explain") {
+		x, err := eng.ExplainUpdate(dbName, collName, filterDoc, c.Bool("multi"), collation)
+		return writeExplain(w, x, err)
 	}
 
-	matched, modified, _, err := eng.Update(dbName, collName, filterDoc, updateDoc, c.Bool("multi"), false)
+	matched, modified, _, err := eng.Update(dbName, collName, filterDoc, update, arrayFilters, c.Bool("multi"), false, collation)
 	if err != nil {
 		return fmt.Errorf("update: %w", err)
 	}
@@ -479,7 +645,17 @@ func doDelete(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.
 		return err
 	}
 
-	deleted, err := eng.Delete(dbName, collName, filterDoc, c.Bool("multi"))
+	collation, err := parseCollation(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("explain") {
+		x, err := eng.ExplainDelete(dbName, collName, filterDoc, c.Bool("multi"), collation)
+		return writeExplain(w, x, err)
+	}
+
+	deleted, err := eng.Delete(dbName, collName, filterDoc, c.Bool("multi"), collation)
 	if err != nil {
 		return fmt.Errorf("delete: %w", err)
 	}
@@ -499,8 +675,17 @@ func doAggregate(eng *engine.Engine, dbName, collName string, c *cli.Context, w
 	if err := bson.UnmarshalExtJSON([]byte(pipelineStr), false, &stages); err != nil {
 		return fmt.Errorf("parse pipeline: %w", err)
 	}
+	collation, err := parseCollation(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("explain") {
+		x, err := eng.ExplainAggregate(dbName, collName, stages, collation)
+		return writeExplain(w, x, err)
+	}
 
-	results, err := eng.Aggregate(dbName, collName, stages)
+	results, err := eng.Aggregate(dbName, collName, stages, collation)
 	if err != nil {
 		return fmt.Errorf("aggregate: %w", err)
 	}
@@ -512,6 +697,42 @@ func doAggregate(eng *engine.Engine, dbName, collName string, c *cli.Context, w
 	return nil
 }
 
+// doWatch prints change events on dbName.collName (every collection when
+// collName is empty) until the limit is reached or the collection or
+// database is dropped.
+func doWatch(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.Writer) error {
+	filterDoc, err := parseJSONArg(c.String("filter"), c.String("filter-file"))
+	if err != nil {
+		return err
+	}
+	stream, err := eng.Watch(dbName, collName, "")
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	defer stream.Close()
+
+	limit, printed := c.Int64("limit"), int64(0)
+	for !stream.Invalidated() {
+		events, err := stream.Next(time.Second)
+		if err != nil {
+			return fmt.Errorf("watch: %w", err)
+		}
+		for _, ev := range events {
+			doc := ev.Doc(true)
+			if !engine.MatchDoc(doc, filterDoc) {
+				continue
+			}
+			if err := writeDoc(w, doc); err != nil {
+				return err
+			}
+			if printed++; limit > 0 && printed >= limit {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
 func doDistinct(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.Writer) error {
 	field := c.String("field")
 	if field == "" {
@@ -522,7 +743,12 @@ func doDistinct(eng *engine.Engine, dbName, collName string, c *cli.Context, w i
 		return err
 	}
 
-	values, err := eng.Distinct(dbName, collName, field, filterDoc)
+	collation, err := parseCollation(c)
+	if err != nil {
+		return err
+	}
+
+	values, err := eng.Distinct(dbName, collName, field, filterDoc, collation)
 	if err != nil {
 		return fmt.Errorf("distinct: %w", err)
 	}
@@ -539,7 +765,17 @@ func doCount(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.W
 		return err
 	}
 
-	n, err := eng.Count(dbName, collName, filterDoc)
+	collation, err := parseCollation(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("explain") {
+		x, err := eng.ExplainCount(dbName, collName, filterDoc, collation)
+		return writeExplain(w, x, err)
+	}
+
+	n, err := eng.Count(dbName, collName, filterDoc, collation)
 	if err != nil {
 		return fmt.Errorf("count: %w", err)
 	}
@@ -561,9 +797,58 @@ func doListCollections(eng *engine.Engine, dbName string, w io.Writer) error {
 			return err
 		}
 	}
+	views := eng.Views(dbName)
+	names := make([]string, 0, len(views))
+	for name := range views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeJSON(w, bson.D{{Key: "name", Value: name}, {Key: "type", Value: "view"}, {Key: "viewOn", Value: views[name].ViewOn}}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func doCreateCollection(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.Writer) error {
+	var err error
+	if c.Bool("capped") {
+		err = eng.CreateCappedCollection(dbName, collName, engine.CappedOptions{Size: c.Int64("size"), Max: c.Int64("max")})
+	} else {
+		err = eng.CreateCollection(dbName, collName)
+	}
+	if err != nil {
+		return fmt.Errorf("create-collection: %w", err)
+	}
+	return writeJSON(w, bson.D{{Key: "ok", Value: 1}})
+}
+
+func doCreateView(eng *engine.Engine, dbName, name string, c *cli.Context, w io.Writer) error {
+	if c.String("view-on") == "" {
+		return fmt.Errorf("create-view requires --view-on")
+	}
+	pipelineStr, err := readArg(c.String("pipeline"), c.String("pipeline-file"))
+	if err != nil {
+		return err
+	}
+	var stages []bson.D
+	if err := bson.UnmarshalExtJSON([]byte(pipelineStr), false, &stages); err != nil {
+		return fmt.Errorf("parse pipeline: %w", err)
+	}
+	if err := eng.CreateView(dbName, name, c.String("view-on"), stages); err != nil {
+		return fmt.Errorf("create-view: %w", err)
+	}
+	return writeJSON(w, bson.D{{Key: "ok", Value: 1}})
+}
+
+func doDrop(eng *engine.Engine, dbName, name string, w io.Writer) error {
+	if err := eng.DropCollection(dbName, name); err != nil {
+		return fmt.Errorf("drop: %w", err)
+	}
+	return writeJSON(w, bson.D{{Key: "ok", Value: 1}})
+}
+
 // --- schema commands ---
 
 func doSetSchema(eng *engine.Engine, dbName, collName string, c *cli.Context, w io.Writer) error {
@@ -627,6 +912,14 @@ func doListSchemas(eng *engine.Engine, w io.Writer) error {
 	return nil
 }
 
+// doCompact folds the journal into the data file.
+func doCompact(eng *engine.Engine, w io.Writer) error {
+	if err := eng.Compact(); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return writeJSON(w, bson.D{{Key: "ok", Value: 1}})
+}
+
 // --- install-skill ---
 
 // installSkill writes the embedded Claude Code skill to ~/.claude/skills/mongolite/.
@@ -663,8 +956,199 @@ func installSkill() error {
 	})
 }
 
+// txOp is one operation of a tx command.
+type txOp struct {
+	Op           string      `bson:"op"`
+	DB           string      `bson:"db"`
+	Collection   string      `bson:"collection"`
+	Doc          bson.D      `bson:"doc"`
+	Docs         []bson.D    `bson:"docs"`
+	Filter       bson.D      `bson:"filter"`
+	Update       interface{} `bson:"update"` // update document or pipeline array
+	ArrayFilters []bson.D    `bson:"arrayFilters"`
+	Sort         bson.D      `bson:"sort"`
+	Multi        bool        `bson:"multi"`
+	Upsert       bool        `bson:"upsert"`
+	Remove       bool        `bson:"remove"`
+	New          bool        `bson:"new"`
+	Collation    bson.D      `bson:"collation"`
+}
+
+// txAttempts is how many times tx retries after another process wrote a
+// collection it was changing.
+const txAttempts = 3
+
+func doTx(eng *engine.Engine, dbName string, c *cli.Context, w io.Writer) error {
+	input, err := readArg(c.String("ops"), c.String("ops-file"))
+	if err != nil {
+		return err
+	}
+	if input == "" && c.String("ops-file") == "" {
+		data, err := io.ReadAll(c.App.Reader)
+		if err != nil {
+			return fmt.Errorf("read stdin: %w", err)
+		}
+		input = strings.TrimSpace(string(data))
+	}
+	ops, err := parseTxOps(input)
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return fmt.Errorf("tx requires operations via --ops, --ops-file or stdin")
+	}
+
+	for attempt := 1; ; attempt++ {
+		results, err := applyTx(eng, dbName, ops)
+		if errors.Is(err, engine.ErrWriteConflict) && attempt < txAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			if err := writeJSON(w, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// parseTxOps parses a JSON array or ndjson stream of operations.
+func parseTxOps(input string) ([]txOp, error) {
+	if strings.HasPrefix(input, "[") {
+		var ops []txOp
+		if err := bson.UnmarshalExtJSON([]byte(input), false, &ops); err != nil {
+			return nil, fmt.Errorf("parse ops: %w", err)
+		}
+		return ops, nil
+	}
+	var ops []txOp
+	for i, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var op txOp
+		if err := bson.UnmarshalExtJSON([]byte(line), false, &op); err != nil {
+			return nil, fmt.Errorf("parse ops line %d: %w", i+1, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// applyTx runs ops in one transaction and commits it. If an operation fails
+// the transaction is rolled back and the error names the operation.
+func applyTx(eng *engine.Engine, dbName string, ops []txOp) ([]bson.D, error) {
+	tx := eng.Begin()
+	var results []bson.D
+	for i, op := range ops {
+		res, err := applyTxOp(tx, dbName, op)
+		if err != nil {
+			_ = tx.Abort()
+			return nil, fmt.Errorf("tx: operation %d (%s) failed, nothing was written: %w", i, op.Op, err)
+		}
+		results = append(results, res)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("tx: commit: %w", err)
+	}
+	return results, nil
+}
+
+func applyTxOp(tx *engine.Txn, dbName string, op txOp) (bson.D, error) {
+	if op.DB != "" {
+		dbName = op.DB
+	}
+	if op.Collection == "" {
+		return nil, fmt.Errorf("missing collection")
+	}
+	var collation *engine.Collation
+	if op.Collation != nil {
+		var err error
+		if collation, err = engine.ParseCollation(op.Collation); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "insert":
+		docs := op.Docs
+		if len(op.Doc) > 0 {
+			docs = append([]bson.D{op.Doc}, docs...)
+		}
+		if len(docs) == 0 {
+			return nil, fmt.Errorf("insert requires doc or docs")
+		}
+		ids, err := tx.Insert(dbName, op.Collection, docs)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 1 {
+			return bson.D{{Key: "insertedId", Value: ids[0]}}, nil
+		}
+		return bson.D{{Key: "insertedCount", Value: len(ids)}}, nil
+	case "update":
+		if emptyUpdate(op.Update) {
+			return nil, fmt.Errorf("update requires update")
+		}
+		matched, modified, upsertedID, err := tx.Update(dbName, op.Collection, op.Filter, op.Update, op.ArrayFilters, op.Multi, op.Upsert, collation)
+		if err != nil {
+			return nil, err
+		}
+		res := bson.D{
+			{Key: "matchedCount", Value: matched},
+			{Key: "modifiedCount", Value: modified},
+		}
+		if upsertedID != nil {
+			res = append(res, bson.E{Key: "upsertedId", Value: upsertedID})
+		}
+		return res, nil
+	case "delete":
+		deleted, err := tx.Delete(dbName, op.Collection, op.Filter, op.Multi, collation)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "deletedCount", Value: deleted}}, nil
+	case "findAndModify":
+		if emptyUpdate(op.Update) && !op.Remove {
+			return nil, fmt.Errorf("findAndModify requires update or remove")
+		}
+		doc, err := tx.FindAndModify(dbName, op.Collection, op.Filter, op.Sort, op.Update, op.ArrayFilters, op.Remove, op.New, op.Upsert, collation)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			return bson.D{{Key: "value", Value: nil}}, nil
+		}
+		return bson.D{{Key: "value", Value: doc}}, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
 // --- helpers ---
 
+// emptyUpdate reports whether an update is missing or an empty document.
+func emptyUpdate(update interface{}) bool {
+	d, isDoc := update.(bson.D)
+	return update == nil || isDoc && len(d) == 0
+}
+
+// openEngine opens the data file named by the global --file flag and, as the
+// server's TTL monitor would, removes documents that TTL indexes have expired.
+func openEngine(c *cli.Context) (*engine.Engine, error) {
+	eng, err := engine.NewWithOptions(c.String("file"), engine.Options{Journal: c.Bool("journal")})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := eng.ExpireTTL(time.Now()); err != nil {
+		return nil, err
+	}
+	return eng, nil
+}
+
 func parseJSONArg(inline, filePath string) (bson.D, error) {
 	s, err := readArg(inline, filePath)
 	if err != nil {
@@ -680,6 +1164,20 @@ func parseJSONArg(inline, filePath string) (bson.D, error) {
 	return doc, nil
 }
 
+// parseCollation parses the --collation flag. Without it strings compare by
+// their bytes.
+func parseCollation(c *cli.Context) (*engine.Collation, error) {
+	s := c.String("collation")
+	if s == "" {
+		return nil, nil
+	}
+	var spec bson.D
+	if err := bson.UnmarshalExtJSON([]byte(s), false, &spec); err != nil {
+		return nil, fmt.Errorf("parse collation: %w", err)
+	}
+	return engine.ParseCollation(spec)
+}
+
 func readArg(inline, filePath string) (string, error) {
 	if filePath != "" {
 		data, err := os.ReadFile(filePath)
@@ -700,6 +1198,14 @@ func writeDoc(w io.Writer, doc bson.D) error {
 	return err
 }
 
+// writeExplain prints the output of an Explain* call with execution stats.
+func writeExplain(w io.Writer, x *engine.Explain, err error) error {
+	if err != nil {
+		return fmt.Errorf("explain: %w", err)
+	}
+	return writeDoc(w, x.Doc(engine.VerbosityExecutionStats))
+}
+
 func writeJSON(w io.Writer, doc bson.D) error {
 	data, err := bson.MarshalExtJSON(doc, false, false)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 
@@ -353,6 +354,31 @@ func TestDoInsert_PersistsToFile(t *testing.T) {
 	}
 }
 
+// TestDoInsert_SharedWithOpenEngine mimics `mongolite serve` holding the data
+// file open while CLI invocations write to it.
+func TestDoInsert_SharedWithOpenEngine(t *testing.T) {
+	server, f := newTestEngine(t)
+
+	if _, err := server.Insert("test", "steps", []bson.D{{{Key: "step", Value: int32(1)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runWith(t, f, "insert", "steps", "--doc", `{"step": 2}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Insert("test", "steps", []bson.D{{{Key: "step", Value: int32(3)}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runWith(t, f, "count", "steps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 1 || rows[0]["count"] != float64(3) {
+		t.Fatalf("expected count=3, got %v", rows)
+	}
+}
+
 func TestDoInsert_MissingDoc(t *testing.T) {
 	_, f := newTestEngine(t)
 	_, err := runWith(t, f, "insert", "users")
@@ -536,6 +562,80 @@ func TestDoUpdate_FilterAndUpdateFiles(t *testing.T) {
 	}
 }
 
+func TestDoUpdate_ArrayFilters(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "runs", []bson.D{{
+		{Key: "_id", Value: "r1"},
+		{Key: "steps", Value: bson.A{
+			bson.D{{Key: "name", Value: "build"}, {Key: "status", Value: "fail"}},
+			bson.D{{Key: "name", Value: "test"}, {Key: "status", Value: "fail"}},
+			bson.D{{Key: "name", Value: "lint"}, {Key: "status", Value: "pass"}},
+		}},
+	}})
+
+	out, err := runWith(t, f, "update",
+		"--filter", `{"_id": "r1"}`,
+		"--update", `{"$set": {"steps.$[s].status": "retry"}}`,
+		"--array-filters", `[{"s.status": "fail"}]`,
+		"runs",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); rows[0]["modifiedCount"].(float64) != 1 {
+		t.Fatalf("expected modifiedCount=1, got %v", rows[0])
+	}
+
+	findOut, err := runWith(t, f, "find", "--filter", `{"steps.status": "retry"}`, "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := decodeLines(t, findOut)
+	if len(found) != 1 {
+		t.Fatalf("expected the run to have retried steps, got %v", found)
+	}
+	steps := found[0]["steps"].([]any)
+	for i, want := range []string{"retry", "retry", "pass"} {
+		if got := steps[i].(map[string]any)["status"]; got != want {
+			t.Errorf("step %d status = %v, want %s", i, got, want)
+		}
+	}
+
+	if _, err := runWith(t, f, "update", "--update", `{"$set": {"steps.$[s].status": "x"}}`, "--array-filters", `[{"t.status": "x"}]`, "runs"); err == nil {
+		t.Fatal("expected an error for an array filter that does not match the update")
+	}
+}
+
+func TestDoUpdate_Pipeline(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "orders", []bson.D{
+		{{Key: "_id", Value: "o1"}, {Key: "a", Value: int32(2)}, {Key: "b", Value: int32(3)}, {Key: "tmp", Value: true}},
+	})
+
+	out, err := runWith(t, f, "update",
+		"--update", `[{"$set": {"total": {"$add": ["$a", "$b"]}}}, {"$unset": "tmp"}]`,
+		"orders",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); rows[0]["modifiedCount"].(float64) != 1 {
+		t.Fatalf("expected modifiedCount=1, got %v", rows[0])
+	}
+	findOut, err := runWith(t, f, "find", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := decodeLines(t, findOut)
+	if len(found) != 1 || found[0]["total"].(float64) != 5 || found[0]["tmp"] != nil {
+		t.Fatalf("expected total=5 without tmp, got %v", found)
+	}
+
+	if _, err := runWith(t, f, "update", "--update", `[{"$match": {}}]`, "orders"); err == nil {
+		t.Fatal("expected an error for a $match stage in an update pipeline")
+	}
+}
+
 // --- doDelete ---
 
 func TestDoDelete_Single(t *testing.T) {
@@ -687,6 +787,180 @@ func TestDoAggregate_PipelineFile(t *testing.T) {
 	}
 }
 
+func TestDoAggregate_OutAndMerge(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "orders", []bson.D{
+		{{Key: "city", Value: "NY"}, {Key: "amount", Value: int32(10)}},
+		{{Key: "city", Value: "LA"}, {Key: "amount", Value: int32(5)}},
+	})
+
+	out, err := runWith(t, f, "aggregate",
+		"--pipeline", `[{"$group": {"_id": "$city", "total": {"$sum": "$amount"}}}, {"$out": "totals"}]`,
+		"orders",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" {
+		t.Errorf("$out printed %q, want nothing", out)
+	}
+	if _, err := runWith(t, f, "aggregate",
+		"--pipeline", `[{"$match": {"city": "NY"}}, {"$group": {"_id": "$city", "orders": {"$sum": 1}}}, {"$merge": {"into": "totals"}}]`,
+		"orders",
+	); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runWith(t, f, "find", "totals", "--filter", `{"_id": "NY"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 1 || rows[0]["total"].(float64) != 10 || rows[0]["orders"].(float64) != 1 {
+		t.Fatalf("expected the merged NY total, got %v", rows)
+	}
+}
+
+func TestDoAggregate_LookupPipelineAndUnionWith(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "orders", []bson.D{
+		{{Key: "city", Value: "NY"}, {Key: "amount", Value: int32(10)}},
+		{{Key: "city", Value: "NY"}, {Key: "amount", Value: int32(40)}},
+		{{Key: "city", Value: "LA"}, {Key: "amount", Value: int32(5)}},
+	})
+	eng.Insert("test", "cities", []bson.D{
+		{{Key: "_id", Value: "NY"}, {Key: "min", Value: int32(20)}},
+		{{Key: "_id", Value: "LA"}, {Key: "min", Value: int32(1)}},
+	})
+	eng.Insert("archive", "cities", []bson.D{{{Key: "_id", Value: "SF"}, {Key: "min", Value: int32(0)}}})
+
+	out, err := runWith(t, f, "aggregate",
+		"--pipeline", `[
+			{"$unionWith": {"coll": {"db": "archive", "coll": "cities"}}},
+			{"$lookup": {"from": "orders", "let": {"city": "$_id", "min": "$min"}, "pipeline": [
+				{"$match": {"$expr": {"$and": [{"$eq": ["$city", "$$city"]}, {"$gte": ["$amount", "$$min"]}]}}}
+			], "as": "big"}},
+			{"$project": {"n": {"$size": "$big"}}},
+			{"$sort": {"_id": 1}}
+		]`,
+		"cities",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 3 || rows[0]["n"].(float64) != 1 || rows[1]["n"].(float64) != 1 || rows[2]["n"].(float64) != 0 {
+		t.Fatalf("expected LA 1, NY 1 and SF 0 orders, got %v", rows)
+	}
+}
+
+func TestDoAggregate_DensifyAndFill(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "samples", []bson.D{
+		{{Key: "hour", Value: int32(0)}, {Key: "load", Value: int32(10)}},
+		{{Key: "hour", Value: int32(3)}, {Key: "load", Value: int32(40)}},
+	})
+
+	out, err := runWith(t, f, "aggregate",
+		"--pipeline", `[
+			{"$densify": {"field": "hour", "range": {"step": 1, "bounds": "full"}}},
+			{"$fill": {"sortBy": {"hour": 1}, "output": {"load": {"method": "linear"}}}}
+		]`,
+		"samples",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 hours, got %v", rows)
+	}
+	for i, want := range []float64{10, 20, 30, 40} {
+		if rows[i]["hour"].(float64) != float64(i) || rows[i]["load"].(float64) != want {
+			t.Errorf("row %d = %v, want hour %d load %v", i, rows[i], i, want)
+		}
+	}
+}
+
+func TestDoFindAndAggregate_Dates(t *testing.T) {
+	eng, f := newTestEngine(t)
+	at := func(day int) bson.DateTime {
+		return bson.NewDateTimeFromTime(time.Date(2025, time.March, day, 12, 0, 0, 0, time.UTC))
+	}
+	eng.Insert("test", "logins", []bson.D{
+		{{Key: "user", Value: "ann"}, {Key: "at", Value: at(1)}},
+		{{Key: "user", Value: "bob"}, {Key: "at", Value: at(5)}},
+		{{Key: "user", Value: "cy"}, {Key: "at", Value: at(9)}},
+	})
+
+	// Extended JSON dates work in filters and print back as $date.
+	out, err := runWith(t, f, "find", "--filter", `{"at": {"$gte": {"$date": "2025-03-05T00:00:00Z"}}}`, "logins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 2 || rows[0]["user"] != "bob" || rows[1]["user"] != "cy" {
+		t.Fatalf("expected bob and cy, got %v", rows)
+	}
+	if d, _ := rows[0]["at"].(map[string]interface{}); d["$date"] != "2025-03-05T12:00:00Z" {
+		t.Errorf("at = %v, want {$date: 2025-03-05T12:00:00Z}", rows[0]["at"])
+	}
+
+	out, err = runWith(t, f, "aggregate",
+		"--pipeline", `[
+			{"$project": {"_id": 0, "user": 1,
+				"day": {"$dateToString": {"date": "$at", "format": "%Y-%m-%d %H:%M", "timezone": "Pacific/Auckland"}},
+				"weeks": {"$dateDiff": {"startDate": {"$date": "2025-03-01T00:00:00Z"}, "endDate": "$at", "unit": "week"}}}}
+		]`,
+		"logins",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = decodeLines(t, out)
+	// Noon UTC is one in the morning of the next day in Auckland.
+	for i, want := range []string{"2025-03-02 01:00", "2025-03-06 01:00", "2025-03-10 01:00"} {
+		if rows[i]["day"] != want || rows[i]["weeks"].(float64) != float64(i) {
+			t.Errorf("row %d = %v, want day %s weeks %d", i, rows[i], want, i)
+		}
+	}
+}
+
+func TestDoFindAndCount_Collation(t *testing.T) {
+	eng, f := newTestEngine(t)
+	eng.Insert("test", "users", []bson.D{
+		{{Key: "login", Value: "TestLogin"}, {Key: "sku", Value: "item10"}},
+		{{Key: "login", Value: "other"}, {Key: "sku", Value: "item2"}},
+	})
+
+	caseless := `{"locale": "en", "strength": 2}`
+	out, err := runWith(t, f, "find", "--filter", `{"login": "testlogin"}`, "--collation", caseless, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); len(rows) != 1 || rows[0]["login"] != "TestLogin" {
+		t.Fatalf("expected TestLogin, got %v", rows)
+	}
+	out, err = runWith(t, f, "count", "--filter", `{"login": "TESTLOGIN"}`, "--collation", caseless, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); rows[0]["count"].(float64) != 1 {
+		t.Errorf("expected count=1, got %v", rows[0])
+	}
+
+	out, err = runWith(t, f, "find", "--sort", `{"sku": 1}`, "--collation", `{"locale": "en", "numericOrdering": true}`, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); len(rows) != 2 || rows[0]["sku"] != "item2" {
+		t.Errorf("expected item2 first, got %v", rows)
+	}
+
+	if _, err := runWith(t, f, "find", "--collation", `{"strength": 2}`, "users"); err == nil {
+		t.Error("expected an error for a collation without a locale")
+	}
+}
+
 // --- doDistinct ---
 
 func TestDoDistinct_Basic(t *testing.T) {
@@ -933,6 +1207,236 @@ func TestDoSchema_RoundTrip(t *testing.T) {
 	}
 }
 
+// --- explain ---
+
+func TestRun_Explain(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "insert-many", "users", "--docs", `[{"_id":1,"age":30},{"_id":2,"age":40}]`); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runWith(t, f, "find", "users", "--filter", `{"_id":2}`, "--explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 1 {
+		t.Fatalf("expected one explain document, got %v", rows)
+	}
+	stats := rows[0]["executionStats"].(map[string]any)
+	if stats["nReturned"].(float64) != 1 || stats["totalDocsExamined"].(float64) != 1 {
+		t.Fatalf("unexpected executionStats: %v", stats)
+	}
+	plan := rows[0]["queryPlanner"].(map[string]any)["winningPlan"].(map[string]any)
+	if plan["inputStage"].(map[string]any)["indexName"] != "_id_" {
+		t.Fatalf("expected _id_ index scan, got %v", plan)
+	}
+
+	out, err = runWith(t, f, "delete", "users", "--filter", `{}`, "--multi", "--explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"nWouldDelete":2`) {
+		t.Fatalf("expected nWouldDelete 2, got %s", out)
+	}
+	out, _ = runWith(t, f, "count", "users")
+	if !strings.Contains(out, `"count":2`) {
+		t.Fatalf("explain must not delete, got %s", out)
+	}
+}
+
+// --- journal ---
+
+func TestRun_JournalAndCompact(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "--journal", "insert", "tasks", "--doc", `{"_id":"a"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runWith(t, f, "--journal", "insert", "tasks", "--doc", `{"_id":"b"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f + ".journal"); err != nil {
+		t.Fatalf("expected journal file: %v", err)
+	}
+
+	out, err := runWith(t, f, "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 1 || rows[0]["ok"].(float64) != 1 {
+		t.Fatalf("expected ok=1 from compact, got %v", rows)
+	}
+	if _, err := os.Stat(f + ".journal"); !os.IsNotExist(err) {
+		t.Fatalf("expected journal removed, stat err=%v", err)
+	}
+
+	data, _ := os.ReadFile(f)
+	if !strings.Contains(string(data), `"a"`) || !strings.Contains(string(data), `"b"`) {
+		t.Fatalf("expected both docs in data file, got %s", data)
+	}
+}
+
+func TestRun_Tx(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "insert", "steps", "--doc", `{"_id":3,"done":false}`); err != nil {
+		t.Fatal(err)
+	}
+	ops := `{"op":"update","collection":"steps","filter":{"_id":3},"update":{"$set":{"done":true}}}
+{"op":"insert","collection":"steps","doc":{"_id":4,"done":false}}
+{"op":"findAndModify","collection":"counters","filter":{"_id":"steps"},"update":{"$inc":{"n":1}},"new":true,"upsert":true}`
+	out, err := runWith(t, f, "tx", "--ops", ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 result lines, got %v", rows)
+	}
+	if rows[0]["modifiedCount"].(float64) != 1 {
+		t.Errorf("update result: %v", rows[0])
+	}
+	if v, _ := rows[2]["value"].(map[string]any); v["n"].(float64) != 1 {
+		t.Errorf("findAndModify result: %v", rows[2])
+	}
+
+	out, _ = runWith(t, f, "count", "steps", "--filter", `{"done":true}`)
+	if n := decodeLines(t, out)[0]["count"].(float64); n != 1 {
+		t.Errorf("expected 1 done step, got %v", n)
+	}
+}
+
+func TestRun_TxPipelineUpdate(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "insert", "steps", "--doc", `{"_id":1,"tries":1}`); err != nil {
+		t.Fatal(err)
+	}
+	ops := `{"op":"update","collection":"steps","filter":{"_id":1},"update":[{"$set":{"next":{"$multiply":["$tries",2]}}}]}`
+	if _, err := runWith(t, f, "tx", "--ops", ops); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := runWith(t, f, "count", "steps", "--filter", `{"next":2}`)
+	if n := decodeLines(t, out)[0]["count"].(float64); n != 1 {
+		t.Errorf("expected the pipeline update to set next=2, got count %v", n)
+	}
+}
+
+func TestRun_TxRollsBack(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "insert", "steps", "--doc", `{"_id":1}`); err != nil {
+		t.Fatal(err)
+	}
+	ops := `[
+		{"op":"insert","collection":"steps","doc":{"_id":2}},
+		{"op":"delete","collection":"steps","filter":{"_id":1}},
+		{"op":"insert","collection":"steps","doc":{"_id":2}}
+	]`
+	_, err := runWith(t, f, "tx", "--ops", ops)
+	if err == nil || !strings.Contains(err.Error(), "operation 2 (insert)") {
+		t.Fatalf("expected operation 2 to fail, got %v", err)
+	}
+
+	out, _ := runWith(t, f, "find", "steps")
+	rows := decodeLines(t, out)
+	if len(rows) != 1 || rows[0]["_id"].(float64) != 1 {
+		t.Fatalf("expected only the original doc, got %v", rows)
+	}
+}
+
+func TestRun_TxStdin(t *testing.T) {
+	_, f := newTestEngine(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = orig }()
+	go func() {
+		w.WriteString(`{"op":"insert","collection":"steps","docs":[{"a":1},{"a":2}]}` + "\n")
+		w.Close()
+	}()
+
+	out, err := runWith(t, f, "tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); len(rows) != 1 || rows[0]["insertedCount"].(float64) != 2 {
+		t.Fatalf("expected insertedCount 2, got %v", rows)
+	}
+}
+
+func TestRun_ExpiresTTLOnOpen(t *testing.T) {
+	eng, f := newTestEngine(t)
+	ttl := int64(60)
+	if err := eng.CreateIndexes("test", "sessions", []engine.IndexSpec{{Keys: bson.D{{Key: "seen", Value: int32(1)}}, ExpireAfterSeconds: &ttl}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := eng.Insert("test", "sessions", []bson.D{
+		{{Key: "_id", Value: "old"}, {Key: "seen", Value: bson.NewDateTimeFromTime(now.Add(-time.Hour))}},
+		{{Key: "_id", Value: "new"}, {Key: "seen", Value: bson.NewDateTimeFromTime(now)}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runWith(t, f, "find", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); len(rows) != 1 || rows[0]["_id"] != "new" {
+		t.Fatalf("expected only the unexpired doc, got %v", rows)
+	}
+}
+
+func TestRun_Watch(t *testing.T) {
+	_, f := newTestEngine(t)
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		var buf bytes.Buffer
+		err := run([]string{"--file", f, "--db", "test", "watch", "tasks", "--limit", "2", "--filter", `{"fullDocument.step":{"$gte":2}}`}, &buf)
+		done <- result{buf.String(), err}
+	}()
+
+	// Another process writes to the same file once the watch is running.
+	other, err := engine.New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := time.NewTicker(50 * time.Millisecond)
+	defer write.Stop()
+	timeout := time.After(5 * time.Second)
+	n := int32(0)
+	for {
+		select {
+		case r := <-done:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			rows := decodeLines(t, r.out)
+			if len(rows) != 2 || rows[0]["operationType"] != "insert" {
+				t.Fatalf("expected 2 insert events, got %v", rows)
+			}
+			doc, _ := rows[0]["fullDocument"].(map[string]any)
+			if step, _ := doc["step"].(float64); step < 2 {
+				t.Errorf("filter not applied: %v", rows[0])
+			}
+			return
+		case <-write.C:
+			n++
+			if _, err := other.Insert("test", "tasks", []bson.D{{{Key: "step", Value: n}}}); err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("watch did not report the writes")
+		}
+	}
+}
+
 // --- error paths via run() ---
 
 func TestRun_UnknownCommand(t *testing.T) {
@@ -1042,3 +1546,60 @@ func must(b []byte, err error) []byte {
 	}
 	return b
 }
+
+func TestRun_CreateCappedCollection(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "create-collection", "log", "--capped", "--size", "4096", "--max", "2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"3", "2", "1"} {
+		if _, err := runWith(t, f, "insert", "log", "--doc", `{"_id": "`+step+`"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := runWith(t, f, "find", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLines(t, out)
+	if len(rows) != 2 || rows[0]["_id"] != "2" || rows[1]["_id"] != "1" {
+		t.Fatalf("expected the 2 newest docs in insertion order, got %v", rows)
+	}
+	if _, err := runWith(t, f, "create-collection", "log", "--capped"); err == nil {
+		t.Error("expected an error for a capped collection without --size")
+	}
+}
+
+func TestRun_Views(t *testing.T) {
+	_, f := newTestEngine(t)
+	if _, err := runWith(t, f, "insert-many", "tests", "--docs", `[{"_id": "TestA", "status": "fail"}, {"_id": "TestB", "status": "pass"}]`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runWith(t, f, "create-view", "failing", "--view-on", "tests", "--pipeline", `[{"$match": {"status": "fail"}}]`); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runWith(t, f, "find", "failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := decodeLines(t, out); len(rows) != 1 || rows[0]["_id"] != "TestA" {
+		t.Fatalf("find on view = %v", rows)
+	}
+	if _, err := runWith(t, f, "insert", "failing", "--doc", `{"x": 1}`); err == nil {
+		t.Error("expected insert into a view to fail")
+	}
+	out, err = runWith(t, f, "list-collections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"type":"view"`) {
+		t.Errorf("list-collections does not report the view: %s", out)
+	}
+	if _, err := runWith(t, f, "drop", "failing"); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = runWith(t, f, "list-collections")
+	if strings.Contains(out, "failing") {
+		t.Errorf("view still listed after drop: %s", out)
+	}
+}
@@ -4,18 +4,31 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-// LookupFunc fetches documents from another collection for $lookup.
+// LookupFunc fetches the documents of a collection that match filter, for
+// stages such as $lookup that read other collections. An empty db means the
+// pipeline's own database.
 type LookupFunc func(db, coll string, filter bson.D) ([]bson.D, error)
 
 // RunPipeline executes an aggregation pipeline on the given documents.
 func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.D, error) {
+	return runPipeline(docs, pipeline, lookupFn, nil)
+}
+
+// runPipeline executes an aggregation pipeline, comparing strings under
+// collation in $match, $sort, group keys and sub-pipelines. Expressions,
+// such as those of $expr and $cond, compare strings by their bytes.
+func runPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc, collation *Collation) ([]bson.D, error) {
+	// $$NOW has the same value in every stage, including sub-pipelines.
+	if usesVar(pipeline, "NOW") {
+		pipeline = bindVars(pipeline, bson.D{{Key: "NOW", Value: bson.NewDateTimeFromTime(time.Now())}})
+	}
 	current := docs
 	for _, stage := range pipeline {
 		if len(stage) != 1 {
@@ -31,7 +44,10 @@ func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.
 			if !ok {
 				return nil, fmt.Errorf("$match requires a document")
 			}
-			current = FilterDocs(current, filter)
+			if err := checkRegexes(filter); err != nil {
+				return nil, err
+			}
+			current = filterDocs(current, filter, collation)
 
 		case "$limit":
 			limit := int(toInt64(stageVal))
@@ -54,7 +70,7 @@ func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.
 			}
 			sorted := make([]bson.D, len(current))
 			copy(sorted, current)
-			SortDocs(sorted, sortSpec)
+			sortDocs(sorted, sortSpec, collation)
 			current = sorted
 
 		case "$project":
@@ -140,7 +156,7 @@ func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.
 				{Key: "_id", Value: stageVal},
 				{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}},
 			}
-			current, err = groupDocs(current, groupSpec)
+			current, err = groupDocs(current, groupSpec, collation)
 			if err != nil {
 				return nil, err
 			}
@@ -161,7 +177,7 @@ func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.
 			if !ok {
 				return nil, fmt.Errorf("$group requires a document")
 			}
-			current, err = groupDocs(current, groupSpec)
+			current, err = groupDocs(current, groupSpec, collation)
 			if err != nil {
 				return nil, err
 			}
@@ -178,11 +194,91 @@ func RunPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc) ([]bson.
 			if !ok {
 				return nil, fmt.Errorf("$lookup requires a document")
 			}
-			current, err = lookupDocs(current, spec, lookupFn)
+			current, err = lookupDocs(current, spec, lookupFn, collation)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$graphLookup":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$graphLookup requires a document")
+			}
+			current, err = graphLookupDocs(current, spec, lookupFn)
 			if err != nil {
 				return nil, err
 			}
 
+		case "$unionWith":
+			current, err = unionWithDocs(current, stageVal, lookupFn, collation)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$facet":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$facet requires a document")
+			}
+			current, err = facetDocs(current, spec, lookupFn, collation)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$bucket":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$bucket requires a document")
+			}
+			current, err = bucketDocs(current, spec)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$bucketAuto":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$bucketAuto requires a document")
+			}
+			current, err = bucketAutoDocs(current, spec)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$setWindowFields":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$setWindowFields requires a document")
+			}
+			current, err = setWindowFieldsDocs(current, spec)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$densify":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$densify requires a document")
+			}
+			current, err = densifyDocs(current, spec)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$fill":
+			spec, ok := stageVal.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$fill requires a document")
+			}
+			current, err = fillDocs(current, spec)
+			if err != nil {
+				return nil, err
+			}
+
+		case "$out", "$merge":
+			// Engine.Aggregate runs these itself when they end the pipeline.
+			return nil, fmt.Errorf("%s can only be the final stage in the pipeline", stageOp)
+
 		default:
 			return nil, fmt.Errorf("unsupported pipeline stage: %s", stageOp)
 		}
@@ -321,7 +417,7 @@ func groupKeyString(key interface{}) string {
 	}
 }
 
-func groupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+func groupDocs(docs []bson.D, spec bson.D, collation *Collation) ([]bson.D, error) {
 	// Find _id expression
 	var idExpr interface{}
 	for _, s := range spec {
@@ -340,7 +436,9 @@ func groupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
 
 	for _, doc := range docs {
 		key := evalExpr(doc, idExpr)
-		keyStr := groupKeyString(key)
+		// Keys equal under the collation form one group, whose _id is the
+		// first key seen.
+		keyStr := groupKeyString(collation.keyValue(key))
 		idx, exists := groupIndex[keyStr]
 		if !exists {
 			idx = len(groups)
@@ -353,24 +451,28 @@ func groupDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
 	var result []bson.D
 	for _, g := range groups {
 		outDoc := bson.D{bson.E{Key: "_id", Value: g.id}}
-		for _, s := range spec {
-			if s.Key == "_id" {
-				continue
-			}
-			accSpec, ok := s.Value.(bson.D)
-			if !ok || len(accSpec) == 0 {
-				continue
-			}
-			accOp := accSpec[0].Key
-			accField := accSpec[0].Value
-			val := computeAccumulator(g.docs, accOp, accField)
-			outDoc = append(outDoc, bson.E{Key: s.Key, Value: val})
-		}
-		result = append(result, outDoc)
+		result = append(result, accumulate(outDoc, g.docs, spec))
 	}
 	return result, nil
 }
 
+// accumulate appends to outDoc a field for each {name: {$acc: expr}} entry of
+// spec other than _id, computed over docs.
+func accumulate(outDoc bson.D, docs []bson.D, spec bson.D) bson.D {
+	for _, s := range spec {
+		if s.Key == "_id" {
+			continue
+		}
+		accSpec, ok := s.Value.(bson.D)
+		if !ok || len(accSpec) == 0 {
+			continue
+		}
+		val := computeAccumulator(docs, accSpec[0].Key, accSpec[0].Value)
+		outDoc = append(outDoc, bson.E{Key: s.Key, Value: val})
+	}
+	return outDoc
+}
+
 func computeAccumulator(docs []bson.D, op string, field interface{}) interface{} {
 	switch op {
 	case "$sum":
@@ -539,46 +641,57 @@ func computeAccumulator(docs []bson.D, op string, field interface{}) interface{}
 	return nil
 }
 
-func lookupDocs(docs []bson.D, spec bson.D, lookupFn LookupFunc) ([]bson.D, error) {
-	if lookupFn == nil {
-		return nil, fmt.Errorf("$lookup not supported without lookup function")
+// facetDocs runs each {name: [stages]} sub-pipeline of spec on its own copy of
+// docs and returns a single document holding each result array under its
+// name.
+func facetDocs(docs []bson.D, spec bson.D, lookupFn LookupFunc, collation *Collation) ([]bson.D, error) {
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("$facet requires at least one output field")
 	}
-
-	var from, localField, foreignField, as string
-	for _, s := range spec {
-		switch s.Key {
-		case "from":
-			from, _ = s.Value.(string)
-		case "localField":
-			localField, _ = s.Value.(string)
-		case "foreignField":
-			foreignField, _ = s.Value.(string)
-		case "as":
-			as, _ = s.Value.(string)
-		}
-	}
-
-	var result []bson.D
-	for _, doc := range docs {
-		localVal, _ := GetField(doc, localField)
-		filter := bson.D{{Key: foreignField, Value: localVal}}
-		matched, err := lookupFn("", from, filter)
-		if err != nil {
-			return nil, err
+	out := bson.D{}
+	for _, f := range spec {
+		if f.Key == "" || strings.HasPrefix(f.Key, "$") || strings.Contains(f.Key, ".") {
+			return nil, fmt.Errorf("$facet output field %q must not be empty, start with '$' or contain '.'", f.Key)
+		}
+		stages, ok := f.Value.(bson.A)
+		if !ok || len(stages) == 0 {
+			return nil, fmt.Errorf("$facet field %q must be a non-empty array of pipeline stages", f.Key)
+		}
+		pipeline := make([]bson.D, 0, len(stages))
+		for _, st := range stages {
+			stage, ok := st.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$facet field %q must be a non-empty array of pipeline stages", f.Key)
+			}
+			if len(stage) == 1 {
+				switch stage[0].Key {
+				case "$facet", "$out", "$merge":
+					return nil, fmt.Errorf("%s is not allowed to be used within a $facet stage", stage[0].Key)
+				}
+			}
+			pipeline = append(pipeline, stage)
 		}
-		// Convert to bson.A
-		var matchedArr bson.A
-		for _, m := range matched {
-			matchedArr = append(matchedArr, m)
+		// Stages such as $set update documents in place, so each facet
+		// gets its own copy of the input.
+		input := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			d, err := CopyDoc(doc)
+			if err != nil {
+				return nil, err
+			}
+			input[i] = d
 		}
-		newDoc, err := CopyDoc(doc)
+		res, err := runPipeline(input, pipeline, lookupFn, collation)
 		if err != nil {
 			return nil, err
 		}
-		newDoc = SetField(newDoc, as, matchedArr)
-		result = append(result, newDoc)
+		arr := bson.A{}
+		for _, d := range res {
+			arr = append(arr, d)
+		}
+		out = append(out, bson.E{Key: f.Key, Value: arr})
 	}
-	return result, nil
+	return []bson.D{out}, nil
 }
 
 // ---- Expression Evaluator ----
@@ -591,14 +704,38 @@ func evalExpr(doc bson.D, expr interface{}) interface{} {
 	switch e := expr.(type) {
 	case string:
 		if strings.HasPrefix(e, "$$") {
-			// Variable reference ($$this, $$value, user vars)
-			varName := e[2:]
+			// Variable reference ($$this, $$value, user vars), optionally
+			// followed by a path into the variable's value ($$new.field).
+			varName, path, _ := strings.Cut(e[2:], ".")
 			// Look for "$$varName" key injected into doc by $filter/$map/$reduce
 			for _, elem := range doc {
 				if elem.Key == "$$"+varName {
-					return elem.Value
+					if path == "" {
+						return elem.Value
+					}
+					sub, _ := elem.Value.(bson.D)
+					v, _ := GetField(sub, path)
+					return v
 				}
 			}
+			if varName == "ROOT" || varName == "CURRENT" {
+				root := bson.D{}
+				for _, elem := range doc {
+					if !strings.HasPrefix(elem.Key, "$$") {
+						root = append(root, elem)
+					}
+				}
+				if path == "" {
+					return root
+				}
+				v, _ := GetField(root, path)
+				return v
+			}
+			if varName == "NOW" {
+				// RunPipeline binds $$NOW once per pipeline; this covers
+				// expressions evaluated outside one, such as $expr in find.
+				return bson.NewDateTimeFromTime(time.Now())
+			}
 			return nil
 		}
 		if strings.HasPrefix(e, "$") {
@@ -1475,32 +1612,28 @@ func evalOperator(doc bson.D, op string, args interface{}) interface{} {
 		if !ok {
 			return nil
 		}
-		var inputExpr interface{}
-		var sortBy bson.D
+		var inputExpr, sortBy interface{}
 		for _, e := range spec {
 			switch e.Key {
 			case "input":
 				inputExpr = e.Value
 			case "sortBy":
-				sortBy, _ = e.Value.(bson.D)
+				sortBy = e.Value
 			}
 		}
+		// sortBy is 1 or -1 to sort whole elements, or field directions,
+		// as in $push's $sort.
+		if checkPushSort(sortBy) != nil {
+			return nil
+		}
 		v := evalExpr(doc, inputExpr)
 		a, ok := v.(bson.A)
 		if !ok {
 			return nil
 		}
-		// Convert to []bson.D for sorting
 		sorted := make(bson.A, len(a))
 		copy(sorted, a)
-		sort.SliceStable(sorted, func(i, j int) bool {
-			di, oki := sorted[i].(bson.D)
-			dj, okj := sorted[j].(bson.D)
-			if oki && okj && len(sortBy) > 0 {
-				return compareDocs(di, dj, sortBy) < 0
-			}
-			return compareValues(sorted[i], sorted[j]) < 0
-		})
+		sortArray(sorted, sortBy)
 		return sorted
 
 	case "$arrayToObject":
@@ -1702,6 +1835,14 @@ func evalOperator(doc bson.D, op string, args interface{}) interface{} {
 				return nil
 			}
 			return id
+		case "date", "9":
+			if d := toDate(v); d != nil {
+				return d
+			}
+			if onErrorExpr != nil {
+				return evalExpr(doc, onErrorExpr)
+			}
+			return nil
 		}
 		return nil
 
@@ -1716,6 +1857,12 @@ func evalOperator(doc bson.D, op string, args interface{}) interface{} {
 			}
 		}
 		return result
+
+	// ---- Date ----
+	case "$year", "$month", "$dayOfMonth", "$dayOfYear", "$dayOfWeek", "$hour", "$minute", "$second",
+		"$millisecond", "$week", "$isoWeek", "$isoWeekYear", "$isoDayOfWeek", "$toDate",
+		"$dateToString", "$dateFromString", "$dateAdd", "$dateSubtract", "$dateDiff", "$dateTrunc":
+		return evalDateOperator(doc, op, args)
 	}
 
 	return nil
@@ -1867,6 +2014,8 @@ func bsonTypeName(v interface{}) string {
 		return "int"
 	case bson.Decimal128:
 		return "decimal"
+	case bson.DateTime:
+		return "date"
 	default:
 		return "undefined"
 	}
@@ -1897,6 +2046,8 @@ func valueToString(v interface{}) string {
 		return strconv.FormatFloat(n, 'g', -1, 64)
 	case bson.ObjectID:
 		return n.Hex()
+	case bson.DateTime:
+		return n.Time().UTC().Format("2006-01-02T15:04:05.000Z")
 	default:
 		return fmt.Sprintf("%v", v)
 	}
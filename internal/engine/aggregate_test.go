@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"math"
+	"reflect"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -35,6 +37,23 @@ func TestRunPipeline_StageMustHaveOneField(t *testing.T) {
 	}
 }
 
+func TestRunPipeline_MatchRegex(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "name", Value: "TestFind"}},
+		{{Key: "name", Value: "testInsert"}},
+		{{Key: "name", Value: "BenchmarkFind"}},
+	}
+	out, err := RunPipeline(docs, []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "^test"}, {Key: "$options", Value: "i"}}}}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 docs, got %d", len(out))
+	}
+}
+
 // ---- $group accumulators ----
 
 func TestGroupAccumulator_Avg(t *testing.T) {
@@ -324,9 +343,75 @@ func TestCompareValues_ObjectIDs(t *testing.T) {
 }
 
 func TestCompareValues_MixedTypes(t *testing.T) {
-	// incomparable types return 0
-	if compareValues("str", int32(1)) != 0 {
-		t.Fatal("mixed types should return 0")
+	// Values of different types compare by BSON type order.
+	order := []interface{}{
+		bson.MinKey{},
+		nil,
+		math.NaN(),
+		int32(-5),
+		2.5,
+		int64(3),
+		"",
+		"str",
+		bson.D{},
+		bson.D{{Key: "a", Value: int32(1)}},
+		bson.A{},
+		bson.A{int32(1)},
+		bson.Binary{Data: []byte{9}},
+		bson.Binary{Data: []byte{1, 2}},
+		bson.ObjectID{0x01},
+		false,
+		true,
+		bson.DateTime(-1),
+		bson.DateTime(0),
+		bson.Timestamp{T: 1, I: 5},
+		bson.Timestamp{T: 2, I: 0},
+		bson.Regex{Pattern: "a"},
+		bson.Regex{Pattern: "a", Options: "i"},
+		bson.MaxKey{},
+	}
+	for i := range order {
+		for j := range order {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := compareValues(order[i], order[j]); got != want {
+				t.Errorf("compareValues(%v, %v) = %d, want %d", order[i], order[j], got, want)
+			}
+		}
+	}
+	if compareValues(bson.Null{}, nil) != 0 || compareValues(bson.Undefined{}, nil) != 0 {
+		t.Error("null, undefined and missing should compare equal")
+	}
+	if compareValues(int64(1)<<62+1, float64(int64(1)<<62)) != 0 || compareValues(int64(1)<<62+1, int64(1)<<62) != 1 {
+		t.Error("large integers should compare exactly with each other")
+	}
+}
+
+func TestCompareValues_DocumentsAndArrays(t *testing.T) {
+	for _, c := range []struct {
+		a, b interface{}
+		want int
+	}{
+		// Documents compare field by field: value type, then name, then value.
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "a", Value: int32(2)}}, -1},
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "b", Value: int32(0)}}, -1},
+		{bson.D{{Key: "z", Value: int32(9)}}, bson.D{{Key: "a", Value: "x"}}, -1},
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: nil}}, -1},
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "a", Value: 1.0}}, 0},
+		{bson.D{{Key: "a", Value: bson.D{{Key: "b", Value: true}}}}, bson.D{{Key: "a", Value: bson.D{{Key: "b", Value: false}}}}, 1},
+		{bson.M{"b": int32(1), "a": int32(1)}, bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}}, 0},
+		// Arrays compare element by element, then by length.
+		{bson.A{int32(1), int32(2)}, bson.A{int32(1), int32(3)}, -1},
+		{bson.A{int32(1), int32(2)}, bson.A{int32(1)}, 1},
+		{bson.A{"a"}, bson.A{int32(5)}, 1},
+	} {
+		if got := compareValues(c.a, c.b); got != c.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", c.a, c.b, got, c.want)
+		}
 	}
 }
 
@@ -804,6 +889,44 @@ func TestEvalExpr_Size(t *testing.T) {
 	}
 }
 
+func TestEvalExpr_SortArray(t *testing.T) {
+	doc := bson.D{{Key: "arr", Value: bson.A{
+		"b", int32(3), bson.D{{Key: "k", Value: int32(2)}}, nil, 1.5, bson.A{int32(0)}, bson.D{{Key: "k", Value: int32(1)}},
+	}}}
+	sortArray := func(sortBy interface{}) interface{} {
+		return evalExpr(doc, bson.D{{Key: "$sortArray", Value: bson.D{{Key: "input", Value: "$arr"}, {Key: "sortBy", Value: sortBy}}}})
+	}
+	want := bson.A{nil, 1.5, int32(3), "b", bson.D{{Key: "k", Value: int32(1)}}, bson.D{{Key: "k", Value: int32(2)}}, bson.A{int32(0)}}
+	if got := sortArray(int32(1)); !reflect.DeepEqual(got, want) {
+		t.Errorf("ascending = %v, want %v", got, want)
+	}
+	if got := sortArray(int32(-1)).(bson.A); !reflect.DeepEqual(got[0], bson.A{int32(0)}) || got[6] != nil {
+		t.Errorf("descending = %v, want the array first and null last", got)
+	}
+	// By field, elements that are not documents sort as missing the field.
+	got := sortArray(bson.D{{Key: "k", Value: int32(-1)}}).(bson.A)
+	if !reflect.DeepEqual(got[:2], bson.A{bson.D{{Key: "k", Value: int32(2)}}, bson.D{{Key: "k", Value: int32(1)}}}) {
+		t.Errorf("by k descending = %v", got)
+	}
+	if got := sortArray(int32(2)); got != nil {
+		t.Errorf("invalid sortBy = %v, want null", got)
+	}
+}
+
+func TestEvalExpr_CompareAcrossTypes(t *testing.T) {
+	doc := bson.D{{Key: "s", Value: "10"}, {Key: "n", Value: int32(9)}}
+	// Expressions compare across types; query operators do not.
+	if got := evalExpr(doc, bson.D{{Key: "$gt", Value: bson.A{"$s", "$n"}}}); got != true {
+		t.Errorf("$gt string number = %v, want true", got)
+	}
+	if got := evalExpr(doc, bson.D{{Key: "$cmp", Value: bson.A{"$n", nil}}}); got != int32(1) {
+		t.Errorf("$cmp number null = %v, want 1", got)
+	}
+	if MatchDoc(doc, bson.D{{Key: "s", Value: bson.D{{Key: "$gt", Value: int32(1)}}}}) {
+		t.Error("query $gt matched a string against a number")
+	}
+}
+
 func TestEvalExpr_ArrayElemAt(t *testing.T) {
 	doc := bson.D{{Key: "arr", Value: bson.A{"a", "b", "c"}}}
 	result := evalExpr(doc, bson.D{{Key: "$arrayElemAt", Value: bson.A{"$arr", int32(1)}}})
@@ -1116,7 +1239,7 @@ func TestDistinct_Basic(t *testing.T) {
 		bson.D{{Key: "tag", Value: "python"}},
 		bson.D{{Key: "tag", Value: "go"}},
 	)
-	values, err := eng.Distinct("db", "coll", "tag", nil)
+	values, err := eng.Distinct("db", "coll", "tag", nil, nil)
 	if err != nil {
 		t.Fatalf("Distinct error: %v", err)
 	}
@@ -1132,7 +1255,7 @@ func TestDistinct_WithFilter(t *testing.T) {
 		bson.D{{Key: "tag", Value: "python"}, {Key: "active", Value: false}},
 		bson.D{{Key: "tag", Value: "go"}, {Key: "active", Value: false}},
 	)
-	values, err := eng.Distinct("db", "coll", "tag", bson.D{{Key: "active", Value: true}})
+	values, err := eng.Distinct("db", "coll", "tag", bson.D{{Key: "active", Value: true}}, nil)
 	if err != nil {
 		t.Fatalf("Distinct error: %v", err)
 	}
@@ -1141,9 +1264,28 @@ func TestDistinct_WithFilter(t *testing.T) {
 	}
 }
 
+func TestDistinct_ArrayElements(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "coll",
+		bson.D{{Key: "tags", Value: bson.A{"go", "db"}}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}, bson.D{{Key: "sku", Value: "B2"}}}}},
+		bson.D{{Key: "tags", Value: "go"}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}}}},
+	)
+	values, err := eng.Distinct("db", "coll", "tags", nil, nil)
+	if err != nil {
+		t.Fatalf("Distinct error: %v", err)
+	}
+	if len(values) != 2 {
+		t.Errorf("expected tags go and db, got %v", values)
+	}
+	values, _ = eng.Distinct("db", "coll", "items.sku", nil, nil)
+	if len(values) != 2 {
+		t.Errorf("expected skus A1 and B2, got %v", values)
+	}
+}
+
 func TestDistinct_NonexistentColl(t *testing.T) {
 	eng, _ := newEng(t)
-	values, err := eng.Distinct("db", "nosuch", "field", nil)
+	values, err := eng.Distinct("db", "nosuch", "field", nil, nil)
 	if err != nil || len(values) != 0 {
 		t.Fatalf("expected empty result for nonexistent coll, got %v err=%v", values, err)
 	}
@@ -1353,6 +1495,23 @@ func TestComputeAccumulator_Max_AllNilValues(t *testing.T) {
 	}
 }
 
+func TestComputeAccumulator_MinMax_MixedTypes(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "v", Value: "text"}},
+		{{Key: "v", Value: int32(100)}},
+		{{Key: "v", Value: nil}},
+		{{Key: "v", Value: bson.DateTime(0)}},
+		{{Key: "v", Value: bson.A{int32(1)}}},
+	}
+	// Null is ignored; otherwise the BSON type order decides.
+	if got := computeAccumulator(docs, "$min", "$v"); got != int32(100) {
+		t.Errorf("$min = %v, want 100", got)
+	}
+	if got := computeAccumulator(docs, "$max", "$v"); got != bson.DateTime(0) {
+		t.Errorf("$max = %v, want the date", got)
+	}
+}
+
 // 10. $count on empty docs returns 0
 func TestComputeAccumulator_Count_EmptyDocs(t *testing.T) {
 	result := computeAccumulator(nil, "$count", bson.D{})
@@ -1536,6 +1695,23 @@ func TestUnwindDocs_Normal(t *testing.T) {
 	}
 }
 
+// TestUnwindDocs_PositionalPath: a numeric segment reaches into an array element.
+func TestUnwindDocs_PositionalPath(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "items", Value: bson.A{bson.D{{Key: "tags", Value: bson.A{"a", "b"}}}}}},
+	}
+	out, err := unwindDocs(docs, "$items.0.tags")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 docs, got %d", len(out))
+	}
+	if v, _ := GetField(out[1], "items.0.tags"); v != "b" {
+		t.Fatalf("expected items.0.tags = b, got %v", v)
+	}
+}
+
 // TestUnwindDocs_MissingField: doc without the unwind field is skipped.
 func TestUnwindDocs_MissingField(t *testing.T) {
 	docs := []bson.D{
@@ -1631,11 +1807,11 @@ func TestCompareDocs_MultiKey_TieBreak(t *testing.T) {
 	a := bson.D{{Key: "x", Value: int32(1)}, {Key: "y", Value: int32(5)}}
 	b := bson.D{{Key: "x", Value: int32(1)}, {Key: "y", Value: int32(3)}}
 	spec := bson.D{{Key: "x", Value: int32(1)}, {Key: "y", Value: int32(1)}}
-	result := compareDocs(a, b, spec)
+	result := compareDocs(a, b, spec, nil)
 	if result <= 0 {
 		t.Fatalf("a.y=5 > b.y=3 with equal x: expected > 0, got %d", result)
 	}
-	result2 := compareDocs(b, a, spec)
+	result2 := compareDocs(b, a, spec, nil)
 	if result2 >= 0 {
 		t.Fatalf("b.y=3 < a.y=5 with equal x: expected < 0, got %d", result2)
 	}
@@ -1646,12 +1822,12 @@ func TestCompareDocs_Descending(t *testing.T) {
 	a := bson.D{{Key: "v", Value: int32(10)}}
 	b := bson.D{{Key: "v", Value: int32(3)}}
 	// Ascending: a(10) > b(3) → positive
-	asc := compareDocs(a, b, bson.D{{Key: "v", Value: int32(1)}})
+	asc := compareDocs(a, b, bson.D{{Key: "v", Value: int32(1)}}, nil)
 	if asc <= 0 {
 		t.Fatalf("ascending: expected a(10) > b(3), got %d", asc)
 	}
 	// Descending: a(10) should sort before b(3) → compareDocs returns negative
-	desc := compareDocs(a, b, bson.D{{Key: "v", Value: int32(-1)}})
+	desc := compareDocs(a, b, bson.D{{Key: "v", Value: int32(-1)}}, nil)
 	if desc >= 0 {
 		t.Fatalf("descending: expected a(10) before b(3), compareDocs should be < 0, got %d", desc)
 	}
@@ -1673,20 +1849,20 @@ func TestSortDocs_DescendingViaCompareDocs(t *testing.T) {
 	}
 }
 
-// TestCompareDocs_MissingField: compareValues(nil, nil) == 0; missing key on both sides.
+// TestCompareDocs_MissingField: a missing key sorts as null.
 func TestCompareDocs_MissingField(t *testing.T) {
 	// Both missing → 0
 	a := bson.D{{Key: "other", Value: "a"}}
 	b := bson.D{{Key: "other", Value: "b"}}
-	result := compareDocs(a, b, bson.D{{Key: "v", Value: int32(1)}})
+	result := compareDocs(a, b, bson.D{{Key: "v", Value: int32(1)}}, nil)
 	if result != 0 {
 		t.Fatalf("both docs missing sort key: expected 0, got %d", result)
 	}
-	// One missing, one present → compareValues(nil, value) returns 0 for mismatched types
+	// One missing, one present → missing sorts as null, before numbers
 	c := bson.D{{Key: "v", Value: int32(5)}}
-	result2 := compareDocs(a, c, bson.D{{Key: "v", Value: int32(1)}})
-	if result2 != 0 {
-		t.Fatalf("nil vs value: compareValues returns 0 for mismatched types, got %d", result2)
+	result2 := compareDocs(a, c, bson.D{{Key: "v", Value: int32(1)}}, nil)
+	if result2 != -1 {
+		t.Fatalf("nil vs value: expected missing to sort first, got %d", result2)
 	}
 }
 
@@ -1695,11 +1871,11 @@ func TestCompareDocs_MixedNumericTypes(t *testing.T) {
 	a := bson.D{{Key: "v", Value: int32(5)}}
 	b := bson.D{{Key: "v", Value: float64(5.5)}}
 	spec := bson.D{{Key: "v", Value: int32(1)}}
-	result := compareDocs(a, b, spec)
+	result := compareDocs(a, b, spec, nil)
 	if result >= 0 {
 		t.Fatalf("int32(5) < float64(5.5): expected compareDocs < 0, got %d", result)
 	}
-	result2 := compareDocs(b, a, spec)
+	result2 := compareDocs(b, a, spec, nil)
 	if result2 <= 0 {
 		t.Fatalf("float64(5.5) > int32(5): expected compareDocs > 0, got %d", result2)
 	}
@@ -1728,3 +1904,69 @@ func TestSortDocs_MultiKeyViaCompareDocs(t *testing.T) {
 		}
 	}
 }
+
+// ---- $facet ----
+
+func TestRunPipeline_Facet(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "status", Value: "pass"}, {Key: "pkg", Value: "api"}},
+		{{Key: "status", Value: "fail"}, {Key: "pkg", Value: "api"}},
+		{{Key: "status", Value: "pass"}, {Key: "pkg", Value: "db"}},
+	}
+	out, err := RunPipeline(docs, []bson.D{
+		{{Key: "$facet", Value: bson.D{
+			{Key: "byStatus", Value: bson.A{
+				bson.D{{Key: "$sortByCount", Value: "$status"}},
+			}},
+			{Key: "renamed", Value: bson.A{
+				bson.D{{Key: "$set", Value: bson.D{{Key: "pkg", Value: "x"}}}},
+			}},
+			{Key: "api", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "pkg", Value: "api"}}}},
+				bson.D{{Key: "$count", Value: "n"}},
+			}},
+			{Key: "none", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "pkg", Value: "web"}}}},
+			}},
+		}}},
+	}, nil)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("expected one document, got %v err=%v", out, err)
+	}
+	byStatus, _ := GetField(out[0], "byStatus")
+	if arr := byStatus.(bson.A); len(arr) != 2 {
+		t.Fatalf("byStatus = %v", arr)
+	} else if id, _ := GetField(arr[0].(bson.D), "_id"); id != "pass" {
+		t.Errorf("byStatus[0]._id = %v, want pass", id)
+	}
+	// The $set of one facet must not leak into the others or the input.
+	api, _ := GetField(out[0], "api")
+	if n, _ := GetField(api.(bson.A)[0].(bson.D), "n"); n != int64(2) {
+		t.Errorf("api count = %v, want 2", n)
+	}
+	if pkg, _ := GetField(docs[0], "pkg"); pkg != "api" {
+		t.Errorf("input changed: pkg = %v", pkg)
+	}
+	if none, _ := GetField(out[0], "none"); none == nil || len(none.(bson.A)) != 0 {
+		t.Errorf("none = %#v, want an empty array", none)
+	}
+}
+
+func TestRunPipeline_FacetErrors(t *testing.T) {
+	docs := []bson.D{{{Key: "x", Value: 1}}}
+	specs := map[string]interface{}{
+		"not a document": bson.A{},
+		"no fields":      bson.D{},
+		"empty pipeline": bson.D{{Key: "a", Value: bson.A{}}},
+		"bad name":       bson.D{{Key: "$a", Value: bson.A{bson.D{{Key: "$limit", Value: 1}}}}},
+		"nested facet": bson.D{{Key: "a", Value: bson.A{
+			bson.D{{Key: "$facet", Value: bson.D{{Key: "b", Value: bson.A{bson.D{{Key: "$limit", Value: 1}}}}}}},
+		}}},
+		"bad stage": bson.D{{Key: "a", Value: bson.A{bson.D{{Key: "$bogus", Value: 1}}}}},
+	}
+	for name, spec := range specs {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$facet", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// defaultBucketOutput is the output of $bucket and $bucketAuto when the
+// stage has no output field.
+var defaultBucketOutput = bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}
+
+// preferredNumbers are the series $bucketAuto's granularity option rounds
+// bucket boundaries to, as the multipliers in [1, 10) of each power of ten.
+var preferredNumbers = map[string][]float64{
+	"R5":  {1.0, 1.6, 2.5, 4.0, 6.3},
+	"R10": {1.0, 1.25, 1.6, 2.0, 2.5, 3.15, 4.0, 5.0, 6.3, 8.0},
+	"R20": {1.0, 1.12, 1.25, 1.4, 1.6, 1.8, 2.0, 2.24, 2.5, 2.8, 3.15, 3.55, 4.0, 4.5, 5.0, 5.6, 6.3, 7.1, 8.0, 9.0},
+	"R40": {1.0, 1.06, 1.12, 1.18, 1.25, 1.32, 1.4, 1.5, 1.6, 1.7, 1.8, 1.9, 2.0, 2.12, 2.24, 2.36, 2.5, 2.65, 2.8, 3.0,
+		3.15, 3.35, 3.55, 3.75, 4.0, 4.25, 4.5, 4.75, 5.0, 5.3, 5.6, 6.0, 6.3, 6.7, 7.1, 7.5, 8.0, 8.5, 9.0, 9.5},
+	"R80": {1.0, 1.03, 1.06, 1.09, 1.12, 1.15, 1.18, 1.22, 1.25, 1.28, 1.32, 1.36, 1.4, 1.45, 1.5, 1.55, 1.6, 1.65, 1.7, 1.75,
+		1.8, 1.85, 1.9, 1.95, 2.0, 2.06, 2.12, 2.18, 2.24, 2.3, 2.36, 2.43, 2.5, 2.58, 2.65, 2.72, 2.8, 2.9, 3.0, 3.07,
+		3.15, 3.25, 3.35, 3.45, 3.55, 3.65, 3.75, 3.87, 4.0, 4.12, 4.25, 4.37, 4.5, 4.62, 4.75, 4.87, 5.0, 5.15, 5.3, 5.45,
+		5.6, 5.8, 6.0, 6.15, 6.3, 6.5, 6.7, 6.9, 7.1, 7.3, 7.5, 7.75, 8.0, 8.25, 8.5, 8.75, 9.0, 9.25, 9.5, 9.75},
+	"1-2-5": {1.0, 2.0, 5.0},
+	"E6":    {1.0, 1.5, 2.2, 3.3, 4.7, 6.8},
+	"E12":   {1.0, 1.2, 1.5, 1.8, 2.2, 2.7, 3.3, 3.9, 4.7, 5.6, 6.8, 8.2},
+	"E24": {1.0, 1.1, 1.2, 1.3, 1.5, 1.6, 1.8, 2.0, 2.2, 2.4, 2.7, 3.0, 3.3, 3.6, 3.9, 4.3, 4.7, 5.1, 5.6, 6.2,
+		6.8, 7.5, 8.2, 9.1},
+	"E48": {1.0, 1.05, 1.1, 1.15, 1.21, 1.27, 1.33, 1.4, 1.47, 1.54, 1.62, 1.69, 1.78, 1.87, 1.96, 2.05, 2.15, 2.26, 2.37, 2.49,
+		2.61, 2.74, 2.87, 3.01, 3.16, 3.32, 3.48, 3.65, 3.83, 4.02, 4.22, 4.42, 4.64, 4.87, 5.11, 5.36, 5.62, 5.9, 6.19, 6.49,
+		6.81, 7.15, 7.5, 7.87, 8.25, 8.66, 9.09, 9.53},
+	"E96": {1.0, 1.02, 1.05, 1.07, 1.1, 1.13, 1.15, 1.18, 1.21, 1.24, 1.27, 1.3, 1.33, 1.37, 1.4, 1.43, 1.47, 1.5, 1.54, 1.58,
+		1.62, 1.65, 1.69, 1.74, 1.78, 1.82, 1.87, 1.91, 1.96, 2.0, 2.05, 2.1, 2.15, 2.21, 2.26, 2.32, 2.37, 2.43, 2.49, 2.55,
+		2.61, 2.67, 2.74, 2.8, 2.87, 2.94, 3.01, 3.09, 3.16, 3.24, 3.32, 3.4, 3.48, 3.57, 3.65, 3.74, 3.83, 3.92, 4.02, 4.12,
+		4.22, 4.32, 4.42, 4.53, 4.64, 4.75, 4.87, 4.99, 5.11, 5.23, 5.36, 5.49, 5.62, 5.76, 5.9, 6.04, 6.19, 6.34, 6.49, 6.65,
+		6.81, 6.98, 7.15, 7.32, 7.5, 7.68, 7.87, 8.06, 8.25, 8.45, 8.66, 8.87, 9.09, 9.31, 9.53, 9.76},
+	"E192": {1.0, 1.01, 1.02, 1.04, 1.05, 1.06, 1.07, 1.09, 1.1, 1.11, 1.13, 1.14, 1.15, 1.17, 1.18, 1.2, 1.21, 1.23, 1.24, 1.26,
+		1.27, 1.29, 1.3, 1.32, 1.33, 1.35, 1.37, 1.38, 1.4, 1.42, 1.43, 1.45, 1.47, 1.49, 1.5, 1.52, 1.54, 1.56, 1.58, 1.6,
+		1.62, 1.64, 1.65, 1.67, 1.69, 1.72, 1.74, 1.76, 1.78, 1.8, 1.82, 1.84, 1.87, 1.89, 1.91, 1.93, 1.96, 1.98, 2.0, 2.03,
+		2.05, 2.08, 2.1, 2.13, 2.15, 2.18, 2.21, 2.23, 2.26, 2.29, 2.32, 2.34, 2.37, 2.4, 2.43, 2.46, 2.49, 2.52, 2.55, 2.58,
+		2.61, 2.64, 2.67, 2.71, 2.74, 2.77, 2.8, 2.84, 2.87, 2.91, 2.94, 2.98, 3.01, 3.05, 3.09, 3.12, 3.16, 3.2, 3.24, 3.28,
+		3.32, 3.36, 3.4, 3.44, 3.48, 3.52, 3.57, 3.61, 3.65, 3.7, 3.74, 3.79, 3.83, 3.88, 3.92, 3.97, 4.02, 4.07, 4.12, 4.17,
+		4.22, 4.27, 4.32, 4.37, 4.42, 4.48, 4.53, 4.59, 4.64, 4.7, 4.75, 4.81, 4.87, 4.93, 4.99, 5.05, 5.11, 5.17, 5.23, 5.3,
+		5.36, 5.42, 5.49, 5.56, 5.62, 5.69, 5.76, 5.83, 5.9, 5.97, 6.04, 6.12, 6.19, 6.26, 6.34, 6.42, 6.49, 6.57, 6.65, 6.73,
+		6.81, 6.9, 6.98, 7.06, 7.15, 7.23, 7.32, 7.41, 7.5, 7.59, 7.68, 7.77, 7.87, 7.96, 8.06, 8.16, 8.25, 8.35, 8.45, 8.56,
+		8.66, 8.76, 8.87, 8.98, 9.09, 9.2, 9.31, 9.42, 9.53, 9.65, 9.76, 9.88},
+}
+
+// checkGroupBy returns an error unless expr is a field path or an expression
+// document, the forms MongoDB accepts for the groupBy of stage.
+func checkGroupBy(stage string, expr interface{}) error {
+	switch v := expr.(type) {
+	case string:
+		if strings.HasPrefix(v, "$") {
+			return nil
+		}
+	case bson.D:
+		return nil
+	}
+	return fmt.Errorf("the %s 'groupBy' field must be defined as a $-prefixed path or an expression", stage)
+}
+
+// bucketDocs groups docs into the buckets [boundaries[i], boundaries[i+1])
+// by their groupBy value. Each non-empty bucket becomes a document whose _id
+// is its lower boundary; documents outside every bucket go to the default
+// bucket, or are an error if the stage has none.
+func bucketDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var groupBy, def interface{}
+	var boundaries bson.A
+	output := defaultBucketOutput
+	hasDefault := false
+	for _, s := range spec {
+		switch s.Key {
+		case "groupBy":
+			groupBy = s.Value
+		case "boundaries":
+			b, ok := s.Value.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("the $bucket 'boundaries' field must be an array")
+			}
+			boundaries = b
+		case "default":
+			def, hasDefault = s.Value, true
+		case "output":
+			o, ok := s.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("the $bucket 'output' field must be a document")
+			}
+			output = o
+		default:
+			return nil, fmt.Errorf("unrecognized option to $bucket: %s", s.Key)
+		}
+	}
+	if err := checkGroupBy("$bucket", groupBy); err != nil {
+		return nil, err
+	}
+	if len(boundaries) < 2 {
+		return nil, fmt.Errorf("the $bucket 'boundaries' field must have at least 2 values")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if !sameType(boundaries[0], boundaries[i]) {
+			return nil, fmt.Errorf("all values in the $bucket 'boundaries' field must have the same type")
+		}
+		if compareValues(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("the $bucket 'boundaries' field must be sorted in ascending order")
+		}
+	}
+	lo, hi := boundaries[0], boundaries[len(boundaries)-1]
+	if hasDefault && sameType(def, lo) && compareValues(def, lo) >= 0 && compareValues(def, hi) < 0 {
+		return nil, fmt.Errorf("the $bucket 'default' field must be less than the lowest boundary or greater than or equal to the highest boundary")
+	}
+
+	buckets := make([][]bson.D, len(boundaries)-1)
+	var others []bson.D
+	for _, doc := range docs {
+		v := evalExpr(doc, groupBy)
+		// i is the first boundary above v, so v is in bucket i-1.
+		i := sort.Search(len(boundaries), func(i int) bool { return compareValues(v, boundaries[i]) < 0 })
+		if !sameType(v, lo) || i == 0 || i == len(boundaries) {
+			if !hasDefault {
+				return nil, fmt.Errorf("$bucket could not find a matching bucket for a document, and no default was specified")
+			}
+			others = append(others, doc)
+			continue
+		}
+		buckets[i-1] = append(buckets[i-1], doc)
+	}
+
+	var result []bson.D
+	for i, b := range buckets {
+		if len(b) > 0 {
+			result = append(result, accumulate(bson.D{{Key: "_id", Value: boundaries[i]}}, b, output))
+		}
+	}
+	if len(others) > 0 {
+		result = append(result, accumulate(bson.D{{Key: "_id", Value: def}}, others, output))
+		SortDocs(result, bson.D{{Key: "_id", Value: int32(1)}})
+	}
+	return result, nil
+}
+
+// bucketAutoDocs sorts docs by their groupBy value and splits them into at
+// most the requested number of buckets of about the same size. Documents with
+// equal values always share a bucket. Each bucket becomes a document whose
+// _id is {min, max}, where max is the next bucket's min, or for the last
+// bucket its largest value. With a granularity the boundaries are rounded to
+// that series of preferred numbers.
+func bucketAutoDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var groupBy interface{}
+	var buckets int64
+	output := defaultBucketOutput
+	granularity := ""
+	for _, s := range spec {
+		switch s.Key {
+		case "groupBy":
+			groupBy = s.Value
+		case "buckets":
+			if !isNumeric(s.Value) || toFloat64(s.Value) != math.Trunc(toFloat64(s.Value)) {
+				return nil, fmt.Errorf("the $bucketAuto 'buckets' field must be an integer")
+			}
+			buckets = toInt64(s.Value)
+		case "output":
+			o, ok := s.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("the $bucketAuto 'output' field must be a document")
+			}
+			output = o
+		case "granularity":
+			g, ok := s.Value.(string)
+			if _, known := preferredNumbers[g]; !ok || (!known && g != "POWERSOF2") {
+				return nil, fmt.Errorf("unknown $bucketAuto granularity: %v", s.Value)
+			}
+			granularity = g
+		default:
+			return nil, fmt.Errorf("unrecognized option to $bucketAuto: %s", s.Key)
+		}
+	}
+	if err := checkGroupBy("$bucketAuto", groupBy); err != nil {
+		return nil, err
+	}
+	if buckets <= 0 {
+		return nil, fmt.Errorf("the $bucketAuto 'buckets' field must be greater than 0")
+	}
+
+	type entry struct {
+		key interface{}
+		doc bson.D
+	}
+	entries := make([]entry, len(docs))
+	for i, doc := range docs {
+		entries[i] = entry{key: evalExpr(doc, groupBy), doc: doc}
+		if granularity == "" {
+			continue
+		}
+		if !isNumeric(entries[i].key) {
+			return nil, fmt.Errorf("$bucketAuto can specify a granularity only if all groupBy values are numeric, found %v", entries[i].key)
+		}
+		if f := toFloat64(entries[i].key); f < 0 || math.IsNaN(f) {
+			return nil, fmt.Errorf("$bucketAuto can specify a granularity only if all groupBy values are non-negative, found %v", entries[i].key)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].key, entries[j].key
+		if ra, rb := typeRank(a), typeRank(b); ra != rb {
+			return ra < rb
+		}
+		return compareValues(a, b) < 0
+	})
+
+	type bucket struct {
+		min, max interface{}
+		docs     []bson.D
+		rounded  bool // max is already rounded to the granularity
+	}
+	var result []bucket
+	size := int(math.Round(float64(len(entries)) / float64(buckets)))
+	if size < 1 {
+		size = 1
+	}
+	for i := 0; i < len(entries); {
+		last := int64(len(result)+1) == buckets
+		b := bucket{min: entries[i].key}
+		for ; i < len(entries) && (len(b.docs) < size || last); i++ {
+			b.docs = append(b.docs, entries[i].doc)
+			b.max = entries[i].key
+		}
+		if i < len(entries) {
+			if granularity != "" {
+				// The bucket takes every value below its rounded up max.
+				b.max, b.rounded = roundGranularity(granularity, b.max, true), true
+				for ; i < len(entries) && compareValues(entries[i].key, b.max) < 0; i++ {
+					b.docs = append(b.docs, entries[i].doc)
+				}
+			} else {
+				for ; i < len(entries) && valuesEqual(entries[i].key, b.max); i++ {
+					b.docs = append(b.docs, entries[i].doc)
+				}
+			}
+		}
+		result = append(result, b)
+	}
+	for i := range result {
+		switch {
+		case granularity != "" && i == 0:
+			result[i].min = roundGranularity(granularity, result[i].min, false)
+		case granularity != "":
+			result[i].min = result[i-1].max
+		case i+1 < len(result):
+			result[i].max = result[i+1].min
+		}
+	}
+	if l := len(result) - 1; granularity != "" && l >= 0 && !result[l].rounded {
+		result[l].max = roundGranularity(granularity, result[l].max, true)
+	}
+
+	out := make([]bson.D, 0, len(result))
+	for _, b := range result {
+		id := bson.D{{Key: "min", Value: b.min}, {Key: "max", Value: b.max}}
+		out = append(out, accumulate(bson.D{{Key: "_id", Value: id}}, b.docs, output))
+	}
+	return out, nil
+}
+
+// roundGranularity rounds the non-negative number v up to the next larger
+// number of the granularity's series, or down to the next smaller one. Zero
+// stays zero. POWERSOF2 keeps integers integral; the preferred number series
+// return doubles.
+func roundGranularity(granularity string, v interface{}, up bool) interface{} {
+	if toFloat64(v) == 0 {
+		return v
+	}
+	if granularity == "POWERSOF2" {
+		return roundPowerOf2(v, up)
+	}
+	series := preferredNumbers[granularity]
+	f := toFloat64(v)
+	// Find the power of ten e with series[0]*10^e <= f < series[0]*10^(e+1).
+	e := int(math.Floor(math.Log10(f)))
+	for series[0]*math.Pow10(e) > f {
+		e--
+	}
+	for series[0]*math.Pow10(e+1) <= f {
+		e++
+	}
+	scale := math.Pow10(e)
+	if up {
+		for _, s := range series {
+			if s*scale > f {
+				return s * scale
+			}
+		}
+		return series[0] * math.Pow10(e+1)
+	}
+	for i := len(series) - 1; i >= 0; i-- {
+		if series[i]*scale < f {
+			return series[i] * scale
+		}
+	}
+	return series[len(series)-1] * math.Pow10(e-1)
+}
+
+// roundPowerOf2 rounds v up to the next larger power of two, or down to the
+// next smaller one.
+func roundPowerOf2(v interface{}, up bool) interface{} {
+	if !isInt(v) {
+		frac, exp := math.Frexp(toFloat64(v))
+		if up {
+			return math.Ldexp(1, exp)
+		}
+		if frac == 0.5 {
+			return math.Ldexp(1, exp-2)
+		}
+		return math.Ldexp(1, exp-1)
+	}
+	n := uint64(toInt64(v))
+	var p uint64
+	switch {
+	case up:
+		p = 1 << bits.Len64(n)
+	case n > 1:
+		p = 1 << (bits.Len64(n-1) - 1)
+	}
+	if _, ok := v.(int32); ok && p <= math.MaxInt32 {
+		return int32(p)
+	}
+	return int64(p)
+}
@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// durations returns one document per value of last_execution_ms.
+func durations(ms ...interface{}) []bson.D {
+	var docs []bson.D
+	for i, v := range ms {
+		docs = append(docs, bson.D{{Key: "_id", Value: int32(i)}, {Key: "last_execution_ms", Value: v}})
+	}
+	return docs
+}
+
+// ---- $bucket ----
+
+func TestBucket(t *testing.T) {
+	docs := durations(int32(5), int32(12), int32(80), int32(99), int32(250), "n/a")
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$bucket", Value: bson.D{
+		{Key: "groupBy", Value: "$last_execution_ms"},
+		{Key: "boundaries", Value: bson.A{int32(0), int32(10), int32(100), int32(200)}},
+		{Key: "default", Value: "slow"},
+	}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		id    interface{}
+		count int64
+	}{{int32(0), 1}, {int32(10), 3}, {"slow", 2}}
+	if len(out) != len(want) {
+		t.Fatalf("got %v", out)
+	}
+	for i, w := range want {
+		id, _ := GetField(out[i], "_id")
+		count, _ := GetField(out[i], "count")
+		if id != w.id || count != w.count {
+			t.Errorf("bucket %d = %v, want _id %v count %d", i, out[i], w.id, w.count)
+		}
+	}
+}
+
+func TestBucket_Output(t *testing.T) {
+	docs := durations(int32(5), int32(15), int32(25))
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$bucket", Value: bson.D{
+		{Key: "groupBy", Value: "$last_execution_ms"},
+		{Key: "boundaries", Value: bson.A{int32(0), int32(20), int32(40)}},
+		{Key: "output", Value: bson.D{
+			{Key: "total", Value: bson.D{{Key: "$sum", Value: "$last_execution_ms"}}},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}},
+	}}}}, nil)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("got %v, err=%v", out, err)
+	}
+	if total, _ := GetField(out[0], "total"); total != int64(20) {
+		t.Errorf("total = %v, want 20", total)
+	}
+	if ids, _ := GetField(out[0], "ids"); len(ids.(bson.A)) != 2 {
+		t.Errorf("ids = %v", ids)
+	}
+	if _, ok := GetField(out[0], "count"); ok {
+		t.Error("count must only be added without an output field")
+	}
+}
+
+func TestBucket_Errors(t *testing.T) {
+	docs := durations(int32(5), int32(500))
+	bounds := bson.A{int32(0), int32(100)}
+	specs := map[string]bson.D{
+		"no default": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bounds}},
+		"groupBy not a path": {{Key: "groupBy", Value: "last_execution_ms"}, {Key: "boundaries", Value: bounds},
+			{Key: "default", Value: "x"}},
+		"one boundary": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bson.A{int32(0)}},
+			{Key: "default", Value: "x"}},
+		"unsorted": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bson.A{int32(10), int32(0)}},
+			{Key: "default", Value: "x"}},
+		"mixed types": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bson.A{int32(0), "z"}},
+			{Key: "default", Value: "x"}},
+		"default inside": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bounds},
+			{Key: "default", Value: int32(50)}},
+		"unknown option": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "boundaries", Value: bounds},
+			{Key: "default", Value: "x"}, {Key: "buckets", Value: int32(2)}},
+	}
+	for name, spec := range specs {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$bucket", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// ---- $bucketAuto ----
+
+// bucketBounds returns the _id.min and _id.max of each $bucketAuto result.
+func bucketBounds(out []bson.D) [][2]interface{} {
+	var bounds [][2]interface{}
+	for _, d := range out {
+		min, _ := GetField(d, "_id.min")
+		max, _ := GetField(d, "_id.max")
+		bounds = append(bounds, [2]interface{}{min, max})
+	}
+	return bounds
+}
+
+func TestBucketAuto(t *testing.T) {
+	docs := durations(int32(7), int32(1), int32(3), int32(3), int32(3), int32(9), int32(4), int32(8))
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$bucketAuto", Value: bson.D{
+		{Key: "groupBy", Value: "$last_execution_ms"},
+		{Key: "buckets", Value: int32(4)},
+	}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two per bucket, except that the three 3s stay together.
+	want := [][2]interface{}{{int32(1), int32(4)}, {int32(4), int32(8)}, {int32(8), int32(9)}}
+	got := bucketBounds(out)
+	if len(got) != len(want) {
+		t.Fatalf("buckets = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("bucket %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	for i, n := range []int64{4, 2, 2} {
+		if count, _ := GetField(out[i], "count"); count != n {
+			t.Errorf("bucket %d count = %v, want %d", i, count, n)
+		}
+	}
+}
+
+func TestBucketAuto_MoreBucketsThanValues(t *testing.T) {
+	docs := durations(int32(2), int32(2), int32(5))
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$bucketAuto", Value: bson.D{
+		{Key: "groupBy", Value: "$last_execution_ms"},
+		{Key: "buckets", Value: int32(10)},
+		{Key: "output", Value: bson.D{{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$last_execution_ms"}}}}},
+	}}}}, nil)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("got %v, err=%v", out, err)
+	}
+	if avg, _ := GetField(out[0], "avg"); avg != float64(2) {
+		t.Errorf("avg = %v, want 2", avg)
+	}
+	if got := bucketBounds(out); got[1] != [2]interface{}{int32(5), int32(5)} {
+		t.Errorf("last bucket = %v, want [5 5]", got[1])
+	}
+}
+
+func TestBucketAuto_Granularity(t *testing.T) {
+	docs := durations(int32(1), int32(3), int32(12), int32(30), int32(45), int32(260))
+	tests := []struct {
+		granularity string
+		want        [][2]interface{}
+	}{
+		{"R5", [][2]interface{}{{0.63, 4.0}, {4.0, 40.0}, {40.0, 400.0}}},
+		{"1-2-5", [][2]interface{}{{0.5, 5.0}, {5.0, 50.0}, {50.0, 500.0}}},
+		{"POWERSOF2", [][2]interface{}{{int32(0), int32(4)}, {int32(4), int32(32)}, {int32(32), int32(512)}}},
+	}
+	for _, tt := range tests {
+		out, err := RunPipeline(docs, []bson.D{{{Key: "$bucketAuto", Value: bson.D{
+			{Key: "groupBy", Value: "$last_execution_ms"},
+			{Key: "buckets", Value: int32(3)},
+			{Key: "granularity", Value: tt.granularity},
+		}}}}, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.granularity, err)
+		}
+		got := bucketBounds(out)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: buckets = %v, want %v", tt.granularity, got, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: bucket %d = %v, want %v", tt.granularity, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBucketAuto_Errors(t *testing.T) {
+	docs := durations(int32(5), int32(-1), "n/a")
+	specs := map[string]bson.D{
+		"no buckets":          {{Key: "groupBy", Value: "$last_execution_ms"}},
+		"zero buckets":        {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "buckets", Value: int32(0)}},
+		"fractional buckets":  {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "buckets", Value: 1.5}},
+		"unknown granularity": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "buckets", Value: int32(2)}, {Key: "granularity", Value: "R3"}},
+		"negative value": {{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "buckets", Value: int32(2)},
+			{Key: "granularity", Value: "R5"}},
+	}
+	for name, spec := range specs {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$bucketAuto", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := RunPipeline(durations("a", int32(1)), []bson.D{{{Key: "$bucketAuto", Value: bson.D{
+		{Key: "groupBy", Value: "$last_execution_ms"}, {Key: "buckets", Value: int32(2)}, {Key: "granularity", Value: "POWERSOF2"},
+	}}}}, nil); err == nil {
+		t.Error("non-numeric value with a granularity: expected an error")
+	}
+}
+
+func TestRoundGranularity(t *testing.T) {
+	sizes := map[string]int{"R5": 5, "R10": 10, "R20": 20, "R40": 40, "R80": 80, "1-2-5": 3,
+		"E6": 6, "E12": 12, "E24": 24, "E48": 48, "E96": 96, "E192": 192}
+	for g, n := range sizes {
+		series := preferredNumbers[g]
+		if len(series) != n {
+			t.Errorf("%s has %d numbers, want %d", g, len(series), n)
+		}
+		for i := 1; i < len(series); i++ {
+			if series[i] <= series[i-1] {
+				t.Errorf("%s is not ascending at %v", g, series[i])
+			}
+		}
+	}
+	tests := []struct {
+		granularity string
+		v           interface{}
+		up          bool
+		want        interface{}
+	}{
+		{"R10", 2.5, true, 3.15},
+		{"R10", 2.5, false, 2.0},
+		{"R10", 0.25, true, 0.315},
+		{"R10", 8.5, true, 10.0},
+		{"R10", 1.0, false, 0.8},
+		{"E12", int32(100), true, 120.0},
+		{"R5", int32(0), true, int32(0)},
+		{"POWERSOF2", int32(8), true, int32(16)},
+		{"POWERSOF2", int32(8), false, int32(4)},
+		{"POWERSOF2", int64(9), false, int64(8)},
+		{"POWERSOF2", int32(1), false, int32(0)},
+		{"POWERSOF2", 0.75, true, 1.0},
+		{"POWERSOF2", 0.5, false, 0.25},
+	}
+	for _, tt := range tests {
+		if got := roundGranularity(tt.granularity, tt.v, tt.up); got != tt.want {
+			t.Errorf("roundGranularity(%s, %v, up=%v) = %v (%T), want %v", tt.granularity, tt.v, tt.up, got, got, tt.want)
+		}
+	}
+}
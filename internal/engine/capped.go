@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var (
+	// ErrNotCapped is returned when a tailable cursor is opened on a
+	// collection that is not capped.
+	ErrNotCapped = errors.New("tailable cursor requested on non capped collection")
+	// ErrCappedPositionLost is returned when the document a tailable cursor
+	// stopped at has been removed, typically by the collection overflowing
+	// before the cursor caught up.
+	ErrCappedPositionLost = errors.New("capped position lost: the cursor's position was deleted from the capped collection")
+)
+
+// CreateCappedCollection creates a capped collection. Creating it again with
+// the same limits is a no-op; any other existing collection of that name is
+// a NamespaceExists error.
+func (e *Engine) CreateCappedCollection(db, coll string, opts CappedOptions) error {
+	if opts.Size <= 0 {
+		return commandErrorf(72, "InvalidOptions", "the 'size' field is required when 'capped' is true")
+	}
+	if opts.Max < 0 {
+		opts.Max = 0
+	}
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if c := e.collection(db, coll); c != nil {
+		if c.Capped != nil && *c.Capped == opts {
+			return nil
+		}
+		return namespaceExists(db, coll)
+	}
+	if e.view(db, coll) != nil {
+		return namespaceExists(db, coll)
+	}
+	c := e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+	c.Capped = &opts
+	e.record(journalEntry{Op: journalCreateColl, DB: db, Coll: coll, Capped: &opts})
+	return e.save()
+}
+
+// Capped returns the limits of db.coll, or nil if it is not a capped
+// collection.
+func (e *Engine) Capped(db, coll string) *CappedOptions {
+	_ = e.refresh()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c := e.collection(db, coll)
+	if c == nil || c.Capped == nil {
+		return nil
+	}
+	opts := *c.Capped
+	return &opts
+}
+
+// evictCapped removes the oldest documents of a capped collection until it
+// is within its document count and size limits, and returns them. The newest
+// document is always kept, even when it alone exceeds the size.
+func (c *Collection) evictCapped() []bson.D {
+	if c.Capped == nil || len(c.Documents) == 0 {
+		return nil
+	}
+	n := len(c.Documents)
+	keep := n
+	if c.Capped.Max > 0 && int64(keep) > c.Capped.Max {
+		keep = int(c.Capped.Max)
+	}
+	var size int64
+	for i := n - 1; i >= n-keep; i-- {
+		if raw, err := bson.Marshal(c.Documents[i]); err == nil {
+			size += int64(len(raw))
+		}
+		if size > c.Capped.Size && i < n-1 {
+			keep = n - 1 - i
+			break
+		}
+	}
+	if keep == n {
+		return nil
+	}
+	evicted := append([]bson.D(nil), c.Documents[:n-keep]...)
+	positions := make([]int, n-keep)
+	for i := range positions {
+		positions[i] = i
+	}
+	c.removeDocs(positions)
+	return evicted
+}
+
+// TailCursor reads a capped collection in insertion order and then waits for
+// documents inserted later, like a tailable MongoDB cursor. It is not safe
+// for concurrent use.
+type TailCursor struct {
+	e        *Engine
+	db, coll string
+	filter   bson.D
+	last     string // _id key of the last document examined; "" for none
+}
+
+// Tail opens a tailable cursor over the documents of the capped collection
+// db.coll that match filter.
+func (e *Engine) Tail(db, coll string, filter bson.D) (*TailCursor, error) {
+	if e.Capped(db, coll) == nil {
+		return nil, ErrNotCapped
+	}
+	if err := checkRegexes(filter); err != nil {
+		return nil, err
+	}
+	return &TailCursor{e: e, db: db, coll: coll, filter: filter}, nil
+}
+
+// Next returns up to n (0 means no limit) matching documents after the last
+// one examined, waiting up to wait for at least one to be inserted. It
+// returns ErrCappedPositionLost if the cursor's position has been removed
+// from the collection, or the collection dropped.
+func (t *TailCursor) Next(wait time.Duration, n int) ([]bson.D, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		// Picks up inserts made by other processes.
+		if err := t.e.refresh(); err != nil {
+			return nil, err
+		}
+		notify := t.e.changes.wait()
+		docs, err := t.scan(n)
+		if err != nil {
+			return nil, err
+		}
+		remaining := time.Until(deadline)
+		if len(docs) > 0 || remaining <= 0 {
+			return docs, nil
+		}
+		timer := time.NewTimer(min(remaining, changeStreamPoll))
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// scan returns up to n matching documents after the cursor's position and
+// advances it past the documents examined.
+func (t *TailCursor) scan(n int) ([]bson.D, error) {
+	t.e.mu.RLock()
+	defer t.e.mu.RUnlock()
+	c := t.e.collection(t.db, t.coll)
+	if c == nil || c.Capped == nil {
+		return nil, ErrCappedPositionLost
+	}
+	start := 0
+	if t.last != "" {
+		p, ok := c.position(t.last)
+		if !ok {
+			return nil, ErrCappedPositionLost
+		}
+		start = p + 1
+	}
+	var docs []bson.D
+	for i := start; i < len(c.Documents); i++ {
+		t.last = docIDKey(c.Documents[i])
+		if MatchDoc(c.Documents[i], t.filter) {
+			docs = append(docs, c.Documents[i])
+			if n > 0 && len(docs) == n {
+				break
+			}
+		}
+	}
+	return docs, nil
+}
+
+// position returns the position of the document with the given _id key.
+// Unlike indexState it never builds the indexes, so it is safe under the
+// read lock.
+func (c *Collection) position(id string) (int, bool) {
+	if c.ix != nil {
+		p, ok := c.ix.pos[id]
+		return p, ok
+	}
+	for i, doc := range c.Documents {
+		if docIDKey(doc) == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func docIDs(docs []bson.D) []interface{} {
+	var ids []interface{}
+	for _, d := range docs {
+		id, _ := GetField(d, "_id")
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestCappedCollection_Max(t *testing.T) {
+	eng, path := newEng(t)
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{Size: 1 << 20, Max: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Descending _ids: the collection must keep insertion order, not _id order.
+	for _, id := range []string{"e", "d", "c", "b", "a"} {
+		mustInsert(t, eng, "db", "log", bson.D{{Key: "_id", Value: id}})
+	}
+	for _, e := range []*Engine{eng, reloadEng(t, path)} {
+		docs, err := e.Find("db", "log", nil, nil, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := docIDs(docs); len(got) != 3 || got[0] != "c" || got[1] != "b" || got[2] != "a" {
+			t.Errorf("docs = %v, want [c b a]", got)
+		}
+	}
+	if opts := reloadEng(t, path).Capped("db", "log"); opts == nil || opts.Max != 3 {
+		t.Errorf("Capped = %v after reload", opts)
+	}
+}
+
+func TestCappedCollection_Size(t *testing.T) {
+	eng, _ := newEng(t)
+	doc := func(i int32) bson.D {
+		return bson.D{{Key: "_id", Value: i}, {Key: "pad", Value: "0123456789012345678901234567890123456789"}}
+	}
+	raw, _ := bson.Marshal(doc(0))
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{Size: int64(len(raw)) * 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(1); i <= 4; i++ {
+		mustInsert(t, eng, "db", "log", doc(i))
+	}
+	docs, _ := eng.Find("db", "log", nil, nil, 0, 0, nil)
+	if got := docIDs(docs); len(got) != 2 || got[0] != int32(3) || got[1] != int32(4) {
+		t.Errorf("docs = %v, want [3 4]", got)
+	}
+}
+
+func TestCappedCollection_Journal(t *testing.T) {
+	eng, path := newEng(t)
+	jeng, err := NewWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jeng.CreateCappedCollection("db", "log", CappedOptions{Size: 1 << 20, Max: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int32{3, 2, 1} {
+		mustInsert(t, jeng, "db", "log", bson.D{{Key: "_id", Value: id}})
+	}
+	docs, _ := eng.Find("db", "log", nil, nil, 0, 0, nil)
+	if got := docIDs(docs); len(got) != 2 || got[0] != int32(2) || got[1] != int32(1) {
+		t.Errorf("docs = %v, want [2 1]", got)
+	}
+	if eng.Capped("db", "log") == nil {
+		t.Error("capped options not replayed from the journal")
+	}
+}
+
+func TestCreateCappedCollection_Errors(t *testing.T) {
+	eng, _ := newEng(t)
+	var ce *CommandError
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{}); !errors.As(err, &ce) || ce.Code != 72 {
+		t.Errorf("no size: got %v, want InvalidOptions", err)
+	}
+	opts := CappedOptions{Size: 4096}
+	if err := eng.CreateCappedCollection("db", "log", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.CreateCappedCollection("db", "log", opts); err != nil {
+		t.Errorf("same options again: %v", err)
+	}
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{Size: 8192}); !errors.As(err, &ce) || ce.Code != 48 {
+		t.Errorf("other options: got %v, want NamespaceExists", err)
+	}
+	mustInsert(t, eng, "db", "plain", bson.D{{Key: "x", Value: 1}})
+	if err := eng.CreateCappedCollection("db", "plain", opts); !errors.As(err, &ce) || ce.Code != 48 {
+		t.Errorf("existing collection: got %v, want NamespaceExists", err)
+	}
+}
+
+// ---- TailCursor ----
+
+func TestTail(t *testing.T) {
+	eng, path := newEng(t)
+	if err := eng.CreateCappedCollection("db", "bus", CappedOptions{Size: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "bus",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "topic", Value: "a"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "topic", Value: "b"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "topic", Value: "a"}},
+	)
+	tail, err := eng.Tail("db", "bus", bson.D{{Key: "topic", Value: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := tail.Next(0, 1)
+	if err != nil || len(docs) != 1 || docIDs(docs)[0] != int32(1) {
+		t.Fatalf("first batch = %v, %v", docs, err)
+	}
+	docs, _ = tail.Next(0, 0)
+	if got := docIDs(docs); len(got) != 1 || got[0] != int32(3) {
+		t.Fatalf("second batch = %v, want [3]", got)
+	}
+	if docs, _ := tail.Next(0, 0); len(docs) != 0 {
+		t.Fatalf("caught up, got %v", docs)
+	}
+
+	// Next waits for a matching insert, here by another process.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		other := reloadEng(t, path)
+		other.Insert("db", "bus", []bson.D{{{Key: "_id", Value: int32(4)}, {Key: "topic", Value: "b"}}})
+		other.Insert("db", "bus", []bson.D{{{Key: "_id", Value: int32(5)}, {Key: "topic", Value: "a"}}})
+	}()
+	docs, err = tail.Next(5*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := docIDs(docs); len(got) != 1 || got[0] != int32(5) {
+		t.Errorf("awaited batch = %v, want [5]", got)
+	}
+}
+
+func TestTail_Errors(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "plain", bson.D{{Key: "x", Value: 1}})
+	if _, err := eng.Tail("db", "plain", nil); !errors.Is(err, ErrNotCapped) {
+		t.Errorf("plain collection: got %v, want ErrNotCapped", err)
+	}
+
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{Size: 1 << 20, Max: 2}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "log", bson.D{{Key: "_id", Value: int32(1)}})
+	tail, err := eng.Tail("db", "log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Next(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Two more inserts evict document 1, where the cursor stopped.
+	mustInsert(t, eng, "db", "log", bson.D{{Key: "_id", Value: int32(2)}}, bson.D{{Key: "_id", Value: int32(3)}})
+	if _, err := tail.Next(0, 0); !errors.Is(err, ErrCappedPositionLost) {
+		t.Errorf("got %v, want ErrCappedPositionLost", err)
+	}
+}
@@ -0,0 +1,443 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	// changeHistory is the number of recent change events an engine keeps
+	// for change streams to resume from.
+	changeHistory = 1000
+	// changeStreamPoll is how often a waiting change stream checks the data
+	// file for writes made by other processes.
+	changeStreamPoll = 100 * time.Millisecond
+)
+
+// ErrChangeHistoryLost is returned when a change stream is resumed from a
+// token that is no longer in the engine's change history, or that was issued
+// by another engine.
+var ErrChangeHistoryLost = errors.New("resume point may no longer be in the change history")
+
+// Change event operation types.
+const (
+	ChangeInsert       = "insert"
+	ChangeUpdate       = "update"
+	ChangeReplace      = "replace"
+	ChangeDelete       = "delete"
+	ChangeDrop         = "drop"
+	ChangeDropDatabase = "dropDatabase"
+	ChangeInvalidate   = "invalidate"
+)
+
+// ChangeEvent is one change to a document, collection or database, as
+// reported by a change stream.
+type ChangeEvent struct {
+	Token        string // resume token
+	Op           string // one of the Change* operation types
+	DB, Coll     string
+	DocumentKey  bson.D // {_id: ...} of the changed document
+	FullDocument bson.D // the document after an insert, update or replace
+	// UpdatedFields and RemovedFields describe an update by dotted path.
+	UpdatedFields bson.D
+	RemovedFields []string
+	WallTime      time.Time
+
+	seq uint64
+}
+
+// Doc returns the event as MongoDB formats it. Updates carry the document
+// after the change only when updateLookup is set.
+func (ev ChangeEvent) Doc(updateLookup bool) bson.D {
+	doc := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: ev.Token}}},
+		{Key: "operationType", Value: ev.Op},
+		{Key: "clusterTime", Value: bson.Timestamp{T: uint32(ev.WallTime.Unix()), I: uint32(ev.seq)}},
+		{Key: "wallTime", Value: bson.NewDateTimeFromTime(ev.WallTime)},
+	}
+	if ev.Op == ChangeInvalidate {
+		return doc
+	}
+	ns := bson.D{{Key: "db", Value: ev.DB}}
+	if ev.Coll != "" {
+		ns = append(ns, bson.E{Key: "coll", Value: ev.Coll})
+	}
+	doc = append(doc, bson.E{Key: "ns", Value: ns})
+	if ev.DocumentKey != nil {
+		doc = append(doc, bson.E{Key: "documentKey", Value: ev.DocumentKey})
+	}
+	switch ev.Op {
+	case ChangeInsert, ChangeReplace:
+		doc = append(doc, bson.E{Key: "fullDocument", Value: ev.FullDocument})
+	case ChangeUpdate:
+		removed := bson.A{}
+		for _, f := range ev.RemovedFields {
+			removed = append(removed, f)
+		}
+		updated := ev.UpdatedFields
+		if updated == nil {
+			updated = bson.D{}
+		}
+		doc = append(doc, bson.E{Key: "updateDescription", Value: bson.D{
+			{Key: "updatedFields", Value: updated},
+			{Key: "removedFields", Value: removed},
+			{Key: "truncatedArrays", Value: bson.A{}},
+		}})
+		if updateLookup {
+			doc = append(doc, bson.E{Key: "fullDocument", Value: ev.FullDocument})
+		}
+	}
+	return doc
+}
+
+// changeLog is an engine's recent change events. Events are numbered from 1
+// in the order they were published.
+type changeLog struct {
+	mu       sync.Mutex
+	epoch    int64         // identifies this engine's numbering in tokens
+	events   []ChangeEvent // the most recent changeHistory events
+	last     uint64        // number of the last event published
+	notify   chan struct{} // closed when events are published
+	watchers int           // open change streams
+}
+
+func (l *changeLog) init() {
+	if l.notify == nil {
+		l.epoch = time.Now().UnixNano()
+		l.notify = make(chan struct{})
+	}
+}
+
+func (l *changeLog) token(seq uint64) string {
+	return fmt.Sprintf("%016x%016x", uint64(l.epoch), seq)
+}
+
+// publish numbers events, adds them to the history and wakes waiting
+// streams.
+func (l *changeLog) publish(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	for _, ev := range events {
+		l.last++
+		ev.seq = l.last
+		ev.Token = l.token(ev.seq)
+		l.events = append(l.events, ev)
+	}
+	if n := len(l.events) - changeHistory; n > 0 {
+		l.events = append(l.events[:0:0], l.events[n:]...)
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// wait returns a channel closed by the next publish.
+func (l *changeLog) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.notify
+}
+
+func (l *changeLog) watched() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.watchers > 0
+}
+
+// since returns the events after seq and a channel closed by the next
+// publish.
+func (l *changeLog) since(seq uint64) ([]ChangeEvent, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if len(l.events) > 0 && seq+1 < l.events[0].seq {
+		return nil, nil, ErrChangeHistoryLost
+	}
+	i := sort.Search(len(l.events), func(i int) bool { return l.events[i].seq > seq })
+	return append([]ChangeEvent(nil), l.events[i:]...), l.notify, nil
+}
+
+// changeEvents converts the records of a save into change events.
+func changeEvents(entries []journalEntry, now time.Time) []ChangeEvent {
+	var events []ChangeEvent
+	for _, entry := range entries {
+		ev := ChangeEvent{DB: entry.DB, Coll: entry.Coll, WallTime: now}
+		switch entry.Op {
+		case journalPut:
+			id, _ := GetField(entry.Doc, "_id")
+			ev.DocumentKey = bson.D{{Key: "_id", Value: id}}
+			ev.FullDocument = entry.Doc
+			switch {
+			case entry.prev == nil:
+				ev.Op = ChangeInsert
+			case entry.replace:
+				ev.Op = ChangeReplace
+			default:
+				ev.Op = ChangeUpdate
+				ev.UpdatedFields, ev.RemovedFields = diffDocs(entry.prev, entry.Doc)
+				if len(ev.UpdatedFields) == 0 && len(ev.RemovedFields) == 0 {
+					continue
+				}
+			}
+		case journalDelete:
+			ev.Op = ChangeDelete
+			ev.DocumentKey = bson.D{{Key: "_id", Value: entry.ID}}
+		case journalDropColl:
+			ev.Op = ChangeDrop
+		case journalDropDatabase:
+			ev.Op = ChangeDropDatabase
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// diffStores returns the change events that turn prev into cur. Documents
+// are matched by _id; a changed document is reported as an update.
+func diffStores(prev, cur *Store, now time.Time) []ChangeEvent {
+	var entries []journalEntry
+	for _, db := range sortedKeys(prev.Databases) {
+		for _, coll := range sortedKeys(prev.Databases[db].Collections) {
+			if cur.Databases[db] == nil || cur.Databases[db].Collections[coll] == nil {
+				entries = append(entries, journalEntry{Op: journalDropColl, DB: db, Coll: coll})
+			}
+		}
+		if cur.Databases[db] == nil {
+			entries = append(entries, journalEntry{Op: journalDropDatabase, DB: db})
+		}
+	}
+	for _, db := range sortedKeys(cur.Databases) {
+		for _, coll := range sortedKeys(cur.Databases[db].Collections) {
+			c := cur.Databases[db].Collections[coll]
+			var old map[string]bson.D
+			if pd := prev.Databases[db]; pd != nil {
+				if pc := pd.Collections[coll]; pc != nil {
+					old = make(map[string]bson.D, len(pc.Documents))
+					for _, doc := range pc.Documents {
+						old[docIDKey(doc)] = doc
+					}
+				}
+			}
+			for _, doc := range c.Documents {
+				key := docIDKey(doc)
+				prevDoc, ok := old[key]
+				if !ok {
+					entries = append(entries, journalEntry{Op: journalPut, DB: db, Coll: coll, Doc: doc})
+					continue
+				}
+				delete(old, key)
+				entries = append(entries, journalEntry{Op: journalPut, DB: db, Coll: coll, Doc: doc, prev: prevDoc})
+			}
+			// What is left was deleted; report it in the old order.
+			if pd := prev.Databases[db]; pd != nil && pd.Collections[coll] != nil {
+				for _, doc := range pd.Collections[coll].Documents {
+					if _, gone := old[docIDKey(doc)]; gone {
+						id, _ := GetField(doc, "_id")
+						entries = append(entries, journalEntry{Op: journalDelete, DB: db, Coll: coll, ID: id})
+					}
+				}
+			}
+		}
+	}
+	return changeEvents(entries, now)
+}
+
+// diffDocs returns the fields of doc that differ from prev and the fields of
+// prev that doc no longer has. Embedded documents are compared field by
+// field and reported by dotted path; other values are reported whole.
+func diffDocs(prev, doc bson.D) (bson.D, []string) {
+	var updated bson.D
+	var removed []string
+	diffFields("", prev, doc, &updated, &removed)
+	return updated, removed
+}
+
+func diffFields(prefix string, prev, doc bson.D, updated *bson.D, removed *[]string) {
+	old := make(map[string]interface{}, len(prev))
+	for _, e := range prev {
+		old[e.Key] = e.Value
+	}
+	for _, e := range doc {
+		path := prefix + e.Key
+		ov, ok := old[e.Key]
+		delete(old, e.Key)
+		if ok {
+			pd, pok := ov.(bson.D)
+			nd, nok := e.Value.(bson.D)
+			if pok && nok {
+				diffFields(path+".", pd, nd, updated, removed)
+				continue
+			}
+			if sameValue(ov, e.Value) {
+				continue
+			}
+		}
+		*updated = append(*updated, bson.E{Key: path, Value: e.Value})
+	}
+	for _, e := range prev {
+		if _, gone := old[e.Key]; gone {
+			*removed = append(*removed, prefix+e.Key)
+		}
+	}
+}
+
+// sameValue reports whether a and b are equal, treating numbers of
+// different types as equal when their values are, as they are once the data
+// file has been reloaded.
+func sameValue(a, b interface{}) bool {
+	switch x := a.(type) {
+	case bson.D:
+		y, ok := b.(bson.D)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i].Key != y[i].Key || !sameValue(x[i].Value, y[i].Value) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		y, ok := b.(bson.A)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !sameValue(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return valuesEqual(a, b)
+}
+
+// ChangeStream reads the change events of a collection, a database or every
+// database. It is not safe for concurrent use.
+type ChangeStream struct {
+	e           *Engine
+	db, coll    string
+	last        uint64 // number of the last event examined
+	invalidated bool
+	closed      bool
+}
+
+// Watch opens a change stream on db.coll. An empty coll watches every
+// collection of db, and an empty db every database. The stream starts after
+// the event with the given resume token, or with the next change when the
+// token is empty.
+func (e *Engine) Watch(db, coll, resumeAfter string) (*ChangeStream, error) {
+	if err := e.refresh(); err != nil {
+		return nil, err
+	}
+	l := &e.changes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	s := &ChangeStream{e: e, db: db, coll: coll, last: l.last}
+	if resumeAfter != "" {
+		var epoch, seq uint64
+		if n, err := fmt.Sscanf(resumeAfter, "%016x%016x", &epoch, &seq); n != 2 || err != nil {
+			return nil, fmt.Errorf("invalid resume token %q", resumeAfter)
+		}
+		if int64(epoch) != l.epoch || seq > l.last {
+			return nil, ErrChangeHistoryLost
+		}
+		s.last = seq
+	}
+	l.watchers++
+	return s, nil
+}
+
+// ResumeToken returns the token to resume the stream after the last event it
+// examined.
+func (s *ChangeStream) ResumeToken() string {
+	s.e.changes.mu.Lock()
+	defer s.e.changes.mu.Unlock()
+	return s.e.changes.token(s.last)
+}
+
+// Invalidated reports whether the stream has ended because its collection or
+// database was dropped.
+func (s *ChangeStream) Invalidated() bool {
+	return s.invalidated
+}
+
+// Next returns the stream's next events, waiting up to wait for at least one.
+// It returns no events if none arrive in time or the stream has been
+// invalidated. A stream on a collection is invalidated when the collection
+// or its database is dropped, and one on a database when the database is
+// dropped; the last event returned is then an invalidate event.
+func (s *ChangeStream) Next(wait time.Duration) ([]ChangeEvent, error) {
+	deadline := time.Now().Add(wait)
+	for !s.invalidated && !s.closed {
+		// Picks up, and publishes, writes made by other processes.
+		if err := s.e.refresh(); err != nil {
+			return nil, err
+		}
+		events, notify, err := s.e.changes.since(s.last)
+		if err != nil {
+			return nil, err
+		}
+		var out []ChangeEvent
+		for _, ev := range events {
+			s.last = ev.seq
+			if !s.matches(ev) {
+				continue
+			}
+			out = append(out, ev)
+			if s.invalidatedBy(ev) {
+				s.invalidated = true
+				out = append(out, ChangeEvent{Token: ev.Token, Op: ChangeInvalidate, WallTime: ev.WallTime, seq: ev.seq})
+				break
+			}
+		}
+		remaining := time.Until(deadline)
+		if len(out) > 0 || remaining <= 0 {
+			return out, nil
+		}
+		timer := time.NewTimer(min(remaining, changeStreamPoll))
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	return nil, nil
+}
+
+func (s *ChangeStream) matches(ev ChangeEvent) bool {
+	if s.db != "" && ev.DB != s.db {
+		return false
+	}
+	return s.coll == "" || ev.Coll == s.coll
+}
+
+func (s *ChangeStream) invalidatedBy(ev ChangeEvent) bool {
+	if s.coll != "" {
+		return ev.Op == ChangeDrop
+	}
+	return s.db != "" && ev.Op == ChangeDropDatabase
+}
+
+// Close releases the stream.
+func (s *ChangeStream) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.e.changes.mu.Lock()
+	s.e.changes.watchers--
+	s.e.changes.mu.Unlock()
+}
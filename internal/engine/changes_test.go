@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// nextEvents reads from s until n events have arrived or a second passes.
+func nextEvents(t *testing.T, s *ChangeStream, n int) []ChangeEvent {
+	t.Helper()
+	var events []ChangeEvent
+	deadline := time.Now().Add(time.Second)
+	for len(events) < n && time.Now().Before(deadline) {
+		got, err := s.Next(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, got...)
+	}
+	if len(events) != n {
+		t.Fatalf("got %d events, want %d: %+v", len(events), n, events)
+	}
+	return events
+}
+
+func TestWatch_Writes(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "other", bson.D{{Key: "_id", Value: int32(9)}})
+	s, err := eng.Watch("db", "tasks", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	id := bson.D{{Key: "_id", Value: int32(1)}}
+	mustInsert(t, eng, "db", "tasks", bson.D{{Key: "_id", Value: int32(1)}, {Key: "state", Value: "ready"}, {Key: "meta", Value: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(2)}}}})
+	mustInsert(t, eng, "db", "other", bson.D{{Key: "_id", Value: int32(10)}})
+	if _, _, _, err := eng.Update("db", "tasks", id, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "state", Value: "claimed"}, {Key: "meta.a", Value: int32(5)}}},
+		{Key: "$unset", Value: bson.D{{Key: "meta.b", Value: ""}}},
+	}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A no-op update is not reported.
+	if _, _, _, err := eng.Update("db", "tasks", id, bson.D{{Key: "$set", Value: bson.D{{Key: "state", Value: "claimed"}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := eng.Update("db", "tasks", id, bson.D{{Key: "state", Value: "done"}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Delete("db", "tasks", id, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.DropCollection("db", "tasks"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := nextEvents(t, s, 6)
+	wantOps := []string{ChangeInsert, ChangeUpdate, ChangeReplace, ChangeDelete, ChangeDrop, ChangeInvalidate}
+	for i, ev := range events {
+		if ev.Op != wantOps[i] {
+			t.Errorf("event %d: op %q, want %q", i, ev.Op, wantOps[i])
+		}
+	}
+	upd := events[1]
+	if len(upd.UpdatedFields) != 2 || upd.UpdatedFields[0].Key != "state" || upd.UpdatedFields[1].Key != "meta.a" {
+		t.Errorf("updatedFields = %v", upd.UpdatedFields)
+	}
+	if len(upd.RemovedFields) != 1 || upd.RemovedFields[0] != "meta.b" {
+		t.Errorf("removedFields = %v", upd.RemovedFields)
+	}
+	if v, _ := GetField(events[2].FullDocument, "state"); v != "done" {
+		t.Errorf("replace fullDocument = %v", events[2].FullDocument)
+	}
+	if !s.Invalidated() {
+		t.Error("stream not invalidated by drop")
+	}
+	if got, _ := s.Next(10 * time.Millisecond); got != nil {
+		t.Errorf("invalidated stream returned %v", got)
+	}
+}
+
+func TestWatch_OtherProcess(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "tasks",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "n", Value: int64(1)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "n", Value: int64(2)}},
+	)
+	s, err := eng.Watch("db", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	other := reloadEng(t, path)
+	mustInsert(t, other, "db", "tasks", bson.D{{Key: "_id", Value: int32(3)}})
+	if _, _, _, err := other.Update("db", "tasks", bson.D{{Key: "_id", Value: int32(2)}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Delete("db", "tasks", bson.D{{Key: "_id", Value: int32(1)}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Document 1 is unchanged apart from how its numbers were reloaded, so
+	// only the real changes are reported.
+	events := nextEvents(t, s, 3)
+	if events[0].Op != ChangeUpdate || events[1].Op != ChangeInsert || events[2].Op != ChangeDelete {
+		t.Fatalf("ops = %s, %s, %s; want update, insert, delete", events[0].Op, events[1].Op, events[2].Op)
+	}
+	if n, _ := GetField(events[0].UpdatedFields, "n"); toInt64(n) != 3 {
+		t.Errorf("updatedFields = %v", events[0].UpdatedFields)
+	}
+
+	if err := other.DropDatabase("db"); err != nil {
+		t.Fatal(err)
+	}
+	events = nextEvents(t, s, 3)
+	if events[0].Op != ChangeDrop || events[1].Op != ChangeDropDatabase || events[2].Op != ChangeInvalidate {
+		t.Errorf("ops = %s, %s, %s; want drop, dropDatabase, invalidate", events[0].Op, events[1].Op, events[2].Op)
+	}
+}
+
+func TestWatch_Resume(t *testing.T) {
+	eng, _ := newEng(t)
+	s, err := eng.Watch("db", "c", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: int32(1)}})
+	first := nextEvents(t, s, 1)[0]
+	s.Close()
+
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: int32(2)}})
+	// Transactions publish their writes on commit.
+	txn := eng.Begin()
+	if _, err := txn.Insert("db", "c", []bson.D{{{Key: "_id", Value: int32(3)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = eng.Watch("db", "c", first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events := nextEvents(t, s, 2)
+	if id, _ := GetField(events[0].DocumentKey, "_id"); id != int32(2) {
+		t.Errorf("resumed at %v, want _id 2", events[0].DocumentKey)
+	}
+	if id, _ := GetField(events[1].DocumentKey, "_id"); id != int32(3) {
+		t.Errorf("second event %v, want _id 3", events[1].DocumentKey)
+	}
+
+	other, _ := newEng(t)
+	if _, err := other.Watch("db", "c", first.Token); !errors.Is(err, ErrChangeHistoryLost) {
+		t.Errorf("token from another engine: got %v, want ErrChangeHistoryLost", err)
+	}
+}
+
+func TestChangeEvent_Doc(t *testing.T) {
+	ev := ChangeEvent{
+		Token: "t", Op: ChangeUpdate, DB: "db", Coll: "c",
+		DocumentKey:   bson.D{{Key: "_id", Value: int32(1)}},
+		FullDocument:  bson.D{{Key: "_id", Value: int32(1)}, {Key: "a", Value: int32(2)}},
+		UpdatedFields: bson.D{{Key: "a", Value: int32(2)}},
+		WallTime:      time.Unix(100, 0),
+	}
+	doc := ev.Doc(false)
+	for _, key := range []string{"_id", "operationType", "clusterTime", "wallTime", "ns", "documentKey", "updateDescription"} {
+		if _, ok := GetField(doc, key); !ok {
+			t.Errorf("missing %s in %v", key, doc)
+		}
+	}
+	if _, ok := GetField(doc, "fullDocument"); ok {
+		t.Error("update event has fullDocument without updateLookup")
+	}
+	if _, ok := GetField(ev.Doc(true), "fullDocument"); !ok {
+		t.Error("update event lacks fullDocument with updateLookup")
+	}
+}
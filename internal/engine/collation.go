@@ -0,0 +1,392 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Collation holds the options of a MongoDB collation document, which makes
+// string comparisons language-aware: case- and accent-insensitive at lower
+// strengths, and numeric on digit runs with NumericOrdering. A nil
+// *Collation compares strings by their bytes, as the "simple" locale does.
+//
+// Every locale uses the same root ordering: letters are compared by their
+// base letter first, then accents, then case, as in ICU's root collation.
+// Language-specific tailorings, such as Swedish sorting "ä" after "z", are
+// not applied.
+type Collation struct {
+	Locale          string
+	CaseLevel       bool
+	CaseFirst       string // "upper", "lower" or "off"
+	Strength        int    // 1 to 5; 3 compares base letters, accents and case
+	NumericOrdering bool
+	Alternate       string // "non-ignorable" or "shifted"
+	MaxVariable     string // "punct" or "space"; what "shifted" ignores
+	Normalization   bool
+	Backwards       bool // compare accents from the end of the string
+}
+
+// ParseCollation parses the collation document of a command. It returns nil
+// for the "simple" locale, which compares strings by their bytes.
+func ParseCollation(spec bson.D) (*Collation, error) {
+	c := &Collation{CaseFirst: "off", Strength: 3, Alternate: "non-ignorable", MaxVariable: "punct"}
+	hasLocale := false
+	for _, e := range spec {
+		var err error
+		switch e.Key {
+		case "locale":
+			c.Locale, err = collationString(e)
+			hasLocale = true
+		case "caseLevel":
+			c.CaseLevel, err = collationBool(e)
+		case "caseFirst":
+			c.CaseFirst, err = collationString(e)
+			if err == nil && c.CaseFirst != "upper" && c.CaseFirst != "lower" && c.CaseFirst != "off" {
+				err = fmt.Errorf("collation caseFirst must be 'upper', 'lower' or 'off', got %q", c.CaseFirst)
+			}
+		case "strength":
+			if !isNumeric(e.Value) || toFloat64(e.Value) != float64(toInt64(e.Value)) {
+				err = fmt.Errorf("collation strength must be an integer")
+			} else if c.Strength = int(toInt64(e.Value)); c.Strength < 1 || c.Strength > 5 {
+				err = fmt.Errorf("collation strength must be between 1 and 5, got %d", c.Strength)
+			}
+		case "numericOrdering":
+			c.NumericOrdering, err = collationBool(e)
+		case "alternate":
+			c.Alternate, err = collationString(e)
+			if err == nil && c.Alternate != "non-ignorable" && c.Alternate != "shifted" {
+				err = fmt.Errorf("collation alternate must be 'non-ignorable' or 'shifted', got %q", c.Alternate)
+			}
+		case "maxVariable":
+			c.MaxVariable, err = collationString(e)
+			if err == nil && c.MaxVariable != "punct" && c.MaxVariable != "space" {
+				err = fmt.Errorf("collation maxVariable must be 'punct' or 'space', got %q", c.MaxVariable)
+			}
+		case "normalization":
+			c.Normalization, err = collationBool(e)
+		case "backwards":
+			c.Backwards, err = collationBool(e)
+		case "version":
+			// Reported by listIndexes; the ordering does not depend on it.
+			_, err = collationString(e)
+		default:
+			err = fmt.Errorf("unknown collation field %q", e.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !hasLocale {
+		return nil, fmt.Errorf("collation must specify a locale")
+	}
+	if c.Locale == "simple" {
+		if len(spec) > 1 {
+			return nil, fmt.Errorf("collation with locale 'simple' takes no other options")
+		}
+		return nil, nil
+	}
+	if !validLocale(c.Locale) {
+		return nil, fmt.Errorf("invalid collation locale %q", c.Locale)
+	}
+	return c, nil
+}
+
+func collationString(e bson.E) (string, error) {
+	s, ok := e.Value.(string)
+	if !ok {
+		return "", fmt.Errorf("collation %s must be a string", e.Key)
+	}
+	return s, nil
+}
+
+func collationBool(e bson.E) (bool, error) {
+	b, ok := e.Value.(bool)
+	if !ok {
+		return false, fmt.Errorf("collation %s must be a boolean", e.Key)
+	}
+	return b, nil
+}
+
+// validLocale reports whether s looks like an ICU locale: a two- or
+// three-letter language, optional alphanumeric subtags, and optional
+// "@key=value" keywords, as in "en", "en_US" or "de@collation=phonebook".
+func validLocale(s string) bool {
+	base, _, _ := strings.Cut(s, "@")
+	for i, part := range strings.FieldsFunc(base, func(r rune) bool { return r == '_' || r == '-' }) {
+		for _, r := range part {
+			if r > unicode.MaxASCII || !(unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+				return false
+			}
+		}
+		if i == 0 && (len(part) < 2 || len(part) > 3) {
+			return false
+		}
+	}
+	return base != "" && !strings.HasPrefix(base, "_") && !strings.HasPrefix(base, "-")
+}
+
+// Doc returns the collation with every option spelled out, as listIndexes
+// reports it.
+func (c *Collation) Doc() bson.D {
+	if c == nil {
+		return nil
+	}
+	return bson.D{
+		{Key: "locale", Value: c.Locale},
+		{Key: "caseLevel", Value: c.CaseLevel},
+		{Key: "caseFirst", Value: c.CaseFirst},
+		{Key: "strength", Value: int32(c.Strength)},
+		{Key: "numericOrdering", Value: c.NumericOrdering},
+		{Key: "alternate", Value: c.Alternate},
+		{Key: "maxVariable", Value: c.MaxVariable},
+		{Key: "normalization", Value: c.Normalization},
+		{Key: "backwards", Value: c.Backwards},
+		{Key: "version", Value: "57.1"},
+	}
+}
+
+// sameCollation reports whether a and b order strings the same way.
+func sameCollation(a, b *Collation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Primary weight groups, in root collation order. Every primary weight
+// starts with its group byte, and level separators sort below all of them.
+const (
+	levelSeparator = 0x01
+	groupSpace     = 0x03
+	groupPunct     = 0x04
+	groupSymbol    = 0x05
+	groupDigit     = 0x06
+	groupLetter    = 0x07
+)
+
+// collationElement is one unit of a sort key: a base character, or a run
+// of digits under numeric ordering, with its accents and case.
+type collationElement struct {
+	primary  []byte
+	accents  []rune
+	upper    bool
+	variable bool // ignored at the first three levels when shifted
+}
+
+// key returns the sort key of s: byte strings that compare, with
+// strings.Compare, as the collation orders the strings. The key holds one
+// level per strength: base characters, then accents, then case, then the
+// characters ignored as variable, then the string itself.
+func (c *Collation) key(s string) string {
+	elems := c.elements(s)
+	shifted := c.Alternate == "shifted"
+	var b []byte
+	for _, el := range elems {
+		if !(shifted && el.variable) {
+			b = append(b, el.primary...)
+		}
+	}
+	if c.Strength >= 2 {
+		var weights [][]byte
+		for _, el := range elems {
+			if shifted && el.variable {
+				continue
+			}
+			w := []byte{0x02, 0x00}
+			if len(el.accents) > 0 {
+				w = w[:0]
+				for _, a := range el.accents {
+					w = append(w, byte(a>>8), byte(a))
+				}
+			}
+			weights = append(weights, w)
+		}
+		if c.Backwards {
+			for i, j := 0, len(weights)-1; i < j; i, j = i+1, j-1 {
+				weights[i], weights[j] = weights[j], weights[i]
+			}
+		}
+		b = append(b, levelSeparator)
+		for _, w := range weights {
+			b = append(b, w...)
+		}
+	}
+	caseWeights := func() {
+		b = append(b, levelSeparator)
+		for _, el := range elems {
+			if shifted && el.variable {
+				continue
+			}
+			// Lowercase sorts first unless caseFirst is "upper".
+			if el.upper == (c.CaseFirst == "upper") {
+				b = append(b, 0x02)
+			} else {
+				b = append(b, 0x03)
+			}
+		}
+	}
+	if c.CaseLevel {
+		caseWeights()
+	}
+	if c.Strength >= 3 {
+		caseWeights()
+	}
+	if c.Strength >= 4 && shifted {
+		b = append(b, levelSeparator)
+		for _, el := range elems {
+			if el.variable {
+				b = append(b, el.primary...)
+			} else {
+				b = append(b, 0xff)
+			}
+		}
+	}
+	if c.Strength == 5 {
+		b = append(b, levelSeparator)
+		b = append(b, s...)
+	}
+	return string(b)
+}
+
+// elements splits s into the collation elements its sort key is built
+// from.
+func (c *Collation) elements(s string) []collationElement {
+	var elems []collationElement
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if c.NumericOrdering && r >= '0' && r <= '9' {
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			// Digit runs compare as numbers: by length without leading
+			// zeros, then digit by digit.
+			digits := strings.TrimLeft(s[i:j], "0")
+			if digits == "" {
+				digits = "0"
+			}
+			w := append([]byte{groupDigit, byte(len(digits) >> 8), byte(len(digits))}, digits...)
+			elems = append(elems, collationElement{primary: w})
+			i = j
+			continue
+		}
+		i += size
+		if unicode.Is(unicode.Mn, r) {
+			// A combining mark accents the character before it.
+			if n := len(elems); n > 0 {
+				elems[n-1].accents = append(elems[n-1].accents, r)
+			}
+			continue
+		}
+		lower := unicode.ToLower(r)
+		upper := lower != r
+		switch lower {
+		case 'ß':
+			elems = append(elems, letterElement('s', upper), letterElement('s', upper))
+			continue
+		case 'æ':
+			elems = append(elems, letterElement('a', upper), letterElement('e', upper))
+			continue
+		case 'œ':
+			elems = append(elems, letterElement('o', upper), letterElement('e', upper))
+			continue
+		}
+		if d, ok := decomposed[lower]; ok {
+			el := letterElement(d.base, upper)
+			el.accents = []rune{d.mark}
+			elems = append(elems, el)
+			continue
+		}
+		group := byte(groupSymbol)
+		variable := false
+		switch {
+		case unicode.IsSpace(r):
+			group, variable = groupSpace, true
+		case unicode.IsPunct(r):
+			group, variable = groupPunct, c.MaxVariable == "punct"
+		case unicode.IsDigit(r):
+			group = groupDigit
+		case unicode.IsLetter(r):
+			group = groupLetter
+		}
+		elems = append(elems, collationElement{
+			primary:  []byte{group, byte(lower >> 16), byte(lower >> 8), byte(lower)},
+			upper:    upper,
+			variable: variable,
+		})
+	}
+	return elems
+}
+
+func letterElement(base rune, upper bool) collationElement {
+	return collationElement{primary: []byte{groupLetter, 0, 0, byte(base)}, upper: upper}
+}
+
+// decomposed maps the accented lowercase letters of Latin-1 and Latin
+// Extended-A to their base letter and combining mark, so that "é" and
+// "é" compare equal and both differ from "e" only in their accent.
+var decomposed = map[rune]struct{ base, mark rune }{
+	'à': {'a', '\u0300'}, 'á': {'a', '\u0301'}, 'â': {'a', '\u0302'}, 'ã': {'a', '\u0303'}, 'ä': {'a', '\u0308'}, 'å': {'a', '\u030a'}, 'ā': {'a', '\u0304'}, 'ă': {'a', '\u0306'}, 'ą': {'a', '\u0328'},
+	'ç': {'c', '\u0327'}, 'ć': {'c', '\u0301'}, 'ĉ': {'c', '\u0302'}, 'ċ': {'c', '\u0307'}, 'č': {'c', '\u030c'},
+	'ď': {'d', '\u030c'}, 'đ': {'d', '\u0338'},
+	'è': {'e', '\u0300'}, 'é': {'e', '\u0301'}, 'ê': {'e', '\u0302'}, 'ë': {'e', '\u0308'}, 'ē': {'e', '\u0304'}, 'ĕ': {'e', '\u0306'}, 'ė': {'e', '\u0307'}, 'ę': {'e', '\u0328'}, 'ě': {'e', '\u030c'},
+	'ĝ': {'g', '\u0302'}, 'ğ': {'g', '\u0306'}, 'ġ': {'g', '\u0307'}, 'ģ': {'g', '\u0327'},
+	'ĥ': {'h', '\u0302'}, 'ħ': {'h', '\u0338'},
+	'ì': {'i', '\u0300'}, 'í': {'i', '\u0301'}, 'î': {'i', '\u0302'}, 'ï': {'i', '\u0308'}, 'ĩ': {'i', '\u0303'}, 'ī': {'i', '\u0304'}, 'ĭ': {'i', '\u0306'}, 'į': {'i', '\u0328'},
+	'ĵ': {'j', '\u0302'},
+	'ķ': {'k', '\u0327'},
+	'ĺ': {'l', '\u0301'}, 'ļ': {'l', '\u0327'}, 'ľ': {'l', '\u030c'}, 'ł': {'l', '\u0338'},
+	'ñ': {'n', '\u0303'}, 'ń': {'n', '\u0301'}, 'ņ': {'n', '\u0327'}, 'ň': {'n', '\u030c'},
+	'ò': {'o', '\u0300'}, 'ó': {'o', '\u0301'}, 'ô': {'o', '\u0302'}, 'õ': {'o', '\u0303'}, 'ö': {'o', '\u0308'}, 'ō': {'o', '\u0304'}, 'ŏ': {'o', '\u0306'}, 'ő': {'o', '\u030b'}, 'ø': {'o', '\u0338'},
+	'ŕ': {'r', '\u0301'}, 'ŗ': {'r', '\u0327'}, 'ř': {'r', '\u030c'},
+	'ś': {'s', '\u0301'}, 'ŝ': {'s', '\u0302'}, 'ş': {'s', '\u0327'}, 'š': {'s', '\u030c'},
+	'ţ': {'t', '\u0327'}, 'ť': {'t', '\u030c'}, 'ŧ': {'t', '\u0338'},
+	'ù': {'u', '\u0300'}, 'ú': {'u', '\u0301'}, 'û': {'u', '\u0302'}, 'ü': {'u', '\u0308'}, 'ũ': {'u', '\u0303'}, 'ū': {'u', '\u0304'}, 'ŭ': {'u', '\u0306'}, 'ů': {'u', '\u030a'}, 'ű': {'u', '\u030b'}, 'ų': {'u', '\u0328'},
+	'ŵ': {'w', '\u0302'},
+	'ý': {'y', '\u0301'}, 'ÿ': {'y', '\u0308'}, 'ŷ': {'y', '\u0302'},
+	'ź': {'z', '\u0301'}, 'ż': {'z', '\u0307'}, 'ž': {'z', '\u030c'},
+}
+
+// compareStrings compares two strings under the collation, or by their
+// bytes if c is nil.
+func (c *Collation) compareStrings(a, b string) int {
+	if c == nil {
+		return strings.Compare(a, b)
+	}
+	return strings.Compare(c.key(a), c.key(b))
+}
+
+// keyValue returns v with every string replaced by its sort key, so that
+// values equal under the collation are deeply equal. It returns v itself
+// if c is nil.
+func (c *Collation) keyValue(v interface{}) interface{} {
+	if c == nil {
+		return v
+	}
+	switch x := v.(type) {
+	case string:
+		return c.key(x)
+	case bson.Symbol:
+		return c.key(string(x))
+	case bson.D:
+		out := make(bson.D, len(x))
+		for i, e := range x {
+			out[i] = bson.E{Key: e.Key, Value: c.keyValue(e.Value)}
+		}
+		return out
+	case bson.M:
+		d, _ := documentValue(x)
+		return c.keyValue(d)
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, e := range x {
+			out[i] = c.keyValue(e)
+		}
+		return out
+	}
+	return v
+}
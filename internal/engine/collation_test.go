@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// mustCollation parses spec, failing the test on error.
+func mustCollation(t *testing.T, spec bson.D) *Collation {
+	t.Helper()
+	c, err := ParseCollation(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func enStrength(level int32) bson.D {
+	return bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: level}}
+}
+
+// ---- Parsing ----
+
+func TestParseCollation(t *testing.T) {
+	c := mustCollation(t, bson.D{{Key: "locale", Value: "fr_CA"}, {Key: "numericOrdering", Value: true}})
+	if c.Strength != 3 || !c.NumericOrdering || c.CaseFirst != "off" || c.Alternate != "non-ignorable" {
+		t.Errorf("parsed %+v, want strength 3, numericOrdering and defaults", c)
+	}
+	if v, _ := GetField(c.Doc(), "locale"); v != "fr_CA" {
+		t.Errorf("Doc locale = %v, want fr_CA", v)
+	}
+	if c := mustCollation(t, bson.D{{Key: "locale", Value: "simple"}}); c != nil {
+		t.Errorf("simple locale parsed to %+v, want nil", c)
+	}
+
+	bad := []bson.D{
+		{},
+		{{Key: "strength", Value: int32(2)}},
+		{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(6)}},
+		{{Key: "locale", Value: "en"}, {Key: "caseFirst", Value: "sideways"}},
+		{{Key: "locale", Value: "en"}, {Key: "numericOrdering", Value: "yes"}},
+		{{Key: "locale", Value: "en"}, {Key: "colour", Value: true}},
+		{{Key: "locale", Value: "simple"}, {Key: "strength", Value: int32(1)}},
+		{{Key: "locale", Value: "not a locale"}},
+	}
+	for _, spec := range bad {
+		if _, err := ParseCollation(spec); err == nil {
+			t.Errorf("ParseCollation(%v) succeeded, want an error", spec)
+		}
+	}
+}
+
+// ---- String order ----
+
+func TestCollation_CompareStrings(t *testing.T) {
+	tests := []struct {
+		spec bson.D
+		a, b string
+		want int
+	}{
+		{enStrength(1), "resume", "Résumé", 0},
+		{enStrength(2), "testlogin", "TestLogin", 0},
+		{enStrength(2), "resume", "résumé", -1},
+		{enStrength(3), "testlogin", "TestLogin", -1},
+		{enStrength(3), "apple", "Banana", -1},
+		{enStrength(3), "Straße", "strasse", 1},
+		{enStrength(1), "Straße", "strasse", 0},
+		{bson.D{{Key: "locale", Value: "en"}, {Key: "caseFirst", Value: "upper"}}, "Apple", "apple", -1},
+		{bson.D{{Key: "locale", Value: "en"}, {Key: "numericOrdering", Value: true}}, "item2", "item10", -1},
+		{bson.D{{Key: "locale", Value: "en"}, {Key: "numericOrdering", Value: true}}, "item007", "item7", 0},
+		{bson.D{{Key: "locale", Value: "en"}}, "item2", "item10", 1},
+		{bson.D{{Key: "locale", Value: "en"}, {Key: "alternate", Value: "shifted"}, {Key: "strength", Value: int32(3)}}, "e-mail", "email", 0},
+	}
+	for _, tt := range tests {
+		c := mustCollation(t, tt.spec)
+		if got := c.compareStrings(tt.a, tt.b); got != tt.want {
+			t.Errorf("%v: compare(%q, %q) = %d, want %d", tt.spec, tt.a, tt.b, got, tt.want)
+		}
+		if got := c.compareStrings(tt.b, tt.a); got != -tt.want {
+			t.Errorf("%v: compare(%q, %q) = %d, want %d", tt.spec, tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+// ---- Commands ----
+
+func seedLogins(t *testing.T, eng *Engine) {
+	t.Helper()
+	mustInsert(t, eng, "db", "users",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "login", Value: "TestLogin"}, {Key: "sku", Value: "item10"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "login", Value: "other"}, {Key: "sku", Value: "item2"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "login", Value: "TESTLOGIN"}, {Key: "sku", Value: "item1"}},
+	)
+}
+
+func TestCollation_Find(t *testing.T) {
+	eng, _ := newEng(t)
+	seedLogins(t, eng)
+	filter := bson.D{{Key: "login", Value: "testlogin"}}
+
+	docs, err := eng.Find("db", "users", filter, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("binary comparison found %v, want nothing", docIDs(docs))
+	}
+	ci := mustCollation(t, enStrength(2))
+	docs, _ = eng.Find("db", "users", filter, nil, 0, 0, ci)
+	if got, want := docIDs(docs), []interface{}{int32(1), int32(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("strength 2 ids = %v, want %v", got, want)
+	}
+	in := bson.D{{Key: "login", Value: bson.D{{Key: "$in", Value: bson.A{"OTHER"}}}}}
+	if docs, _ = eng.Find("db", "users", in, nil, 0, 0, ci); !reflect.DeepEqual(docIDs(docs), []interface{}{int32(2)}) {
+		t.Errorf("$in ids = %v, want [2]", docIDs(docs))
+	}
+
+	numeric := mustCollation(t, bson.D{{Key: "locale", Value: "en"}, {Key: "numericOrdering", Value: true}})
+	docs, _ = eng.Find("db", "users", bson.D{}, bson.D{{Key: "sku", Value: int32(1)}}, 0, 0, numeric)
+	if got, want := fieldValues(docs, "sku"), []interface{}{"item1", "item2", "item10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("numeric sort = %v, want %v", got, want)
+	}
+	gt := bson.D{{Key: "sku", Value: bson.D{{Key: "$gt", Value: "item9"}}}}
+	if docs, _ = eng.Find("db", "users", gt, nil, 0, 0, numeric); !reflect.DeepEqual(docIDs(docs), []interface{}{int32(1)}) {
+		t.Errorf("$gt item9 ids = %v, want [1]", docIDs(docs))
+	}
+}
+
+func TestCollation_CountDistinctWrites(t *testing.T) {
+	eng, _ := newEng(t)
+	seedLogins(t, eng)
+	ci := mustCollation(t, enStrength(2))
+	filter := bson.D{{Key: "login", Value: "testlogin"}}
+
+	if n, err := eng.Count("db", "users", filter, ci); err != nil || n != 2 {
+		t.Errorf("count = %d, %v, want 2", n, err)
+	}
+	values, err := eng.Distinct("db", "users", "login", nil, ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"TestLogin", "other"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("distinct = %v, want %v", values, want)
+	}
+
+	matched, modified, _, err := eng.Update("db", "users", filter, bson.D{{Key: "$set", Value: bson.D{{Key: "seen", Value: true}}}}, nil, true, false, ci)
+	if err != nil || matched != 2 || modified != 2 {
+		t.Errorf("update = %d/%d, %v, want 2/2", matched, modified, err)
+	}
+	n, err := eng.Delete("db", "users", bson.D{{Key: "login", Value: "OTHER"}}, true, ci)
+	if err != nil || n != 1 {
+		t.Errorf("delete = %d, %v, want 1", n, err)
+	}
+}
+
+func TestCollation_Group(t *testing.T) {
+	eng, _ := newEng(t)
+	seedLogins(t, eng)
+	pipeline := []bson.D{
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$login"}, {Key: "n", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+	}
+	docs, err := eng.Aggregate("db", "users", pipeline, mustCollation(t, enStrength(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := docIDs(docs), []interface{}{"other", "TestLogin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("group ids = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(docs, "n"), []interface{}{int64(1), int64(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("group counts = %v, want %v", got, want)
+	}
+}
+
+// ---- Indexes ----
+
+func TestCollation_Index(t *testing.T) {
+	eng, _ := newEng(t)
+	seedLogins(t, eng)
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{
+		Name:      "login_1",
+		Keys:      bson.D{{Key: "login", Value: int32(1)}},
+		Collation: enStrength(2),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	c := indexedColl(t, eng, "db", "users")
+	filter := bson.D{{Key: "login", Value: "testlogin"}}
+
+	ci := mustCollation(t, enStrength(2))
+	positions, plan := c.candidates(filter, ci)
+	if plan.indexName() != "login_1" || len(positions) != 2 {
+		t.Errorf("same collation: got index %q with %d candidates, want login_1 with 2", plan.indexName(), len(positions))
+	}
+	if _, plan := c.candidates(filter, nil); plan.indexName() != "" {
+		t.Errorf("binary query used %q, want a collection scan", plan.indexName())
+	}
+	if _, plan := c.candidates(filter, mustCollation(t, enStrength(1))); plan.indexName() != "" {
+		t.Errorf("strength 1 query used %q, want a collection scan", plan.indexName())
+	}
+	// Non-string predicates do not depend on the collation.
+	if _, plan := c.candidates(bson.D{{Key: "login", Value: int32(5)}}, nil); plan.indexName() != "login_1" {
+		t.Errorf("numeric query used %q, want login_1", plan.indexName())
+	}
+
+	// The stored spec spells out the collation's options.
+	ix := c.Indexes[len(c.Indexes)-1]
+	if v, _ := GetField(ix.Collation, "strength"); v != int32(2) {
+		t.Errorf("stored strength = %v, want 2", v)
+	}
+	if v, _ := GetField(ix.Collation, "caseFirst"); v != "off" {
+		t.Errorf("stored caseFirst = %v, want off", v)
+	}
+}
+
+func TestCollation_UniqueIndex(t *testing.T) {
+	eng, _ := newEng(t)
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{
+		Name:      "email_1",
+		Keys:      bson.D{{Key: "email", Value: int32(1)}},
+		Unique:    true,
+		Collation: enStrength(2),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "users", bson.D{{Key: "_id", Value: int32(1)}, {Key: "email", Value: "Ann@Example.com"}})
+	_, err := eng.Insert("db", "users", []bson.D{{{Key: "_id", Value: int32(2)}, {Key: "email", Value: "ann@example.com"}}})
+	assertDupKey(t, err, "email_1")
+
+	err = eng.CreateIndexes("db", "users", []IndexSpec{{
+		Name:      "bad",
+		Keys:      bson.D{{Key: "x", Value: int32(1)}},
+		Collation: bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(9)}},
+	}})
+	if ie, ok := err.(*CommandError); !ok || ie.Code != 2 {
+		t.Errorf("invalid collation error = %v, want BadValue", err)
+	}
+}
@@ -0,0 +1,619 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Olson timezone arguments work without a system zoneinfo database
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// defaultDateFormat is the $dateToString format when none is given.
+const defaultDateFormat = "%Y-%m-%dT%H:%M:%S.%LZ"
+
+// toTime converts a date-like value to a UTC time: a date, the creation time
+// of an ObjectID, or the seconds of a timestamp.
+func toTime(v interface{}) (time.Time, bool) {
+	switch d := v.(type) {
+	case bson.DateTime:
+		return d.Time().UTC(), true
+	case bson.ObjectID:
+		return d.Timestamp().UTC(), true
+	case bson.Timestamp:
+		return time.Unix(int64(d.T), 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// parseTimezone parses a timezone argument: an Olson name such as
+// "Europe/Paris", or a UTC offset "+hh", "+hhmm" or "+hh:mm". A missing
+// timezone is UTC.
+func parseTimezone(v interface{}) (*time.Location, bool) {
+	if v == nil {
+		return time.UTC, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		off, ok := parseOffset(s)
+		if !ok {
+			return nil, false
+		}
+		return time.FixedZone(s, off), true
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, false
+	}
+	return loc, true
+}
+
+// parseOffset parses "+hh", "+hhmm" or "+hh:mm" into seconds east of UTC.
+func parseOffset(s string) (int, bool) {
+	if len(s) < 3 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	digits := s[1:]
+	if len(digits) == 5 && digits[2] == ':' {
+		digits = digits[:2] + digits[3:]
+	}
+	if len(digits) != 2 && len(digits) != 4 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, false
+	}
+	h, m := n, 0
+	if len(digits) == 4 {
+		h, m = n/100, n%100
+	}
+	if m >= 60 {
+		return 0, false
+	}
+	off := h*3600 + m*60
+	if s[0] == '-' {
+		off = -off
+	}
+	return off, true
+}
+
+// parseStartOfWeek parses the startOfWeek argument of $dateDiff and
+// $dateTrunc: a day name or its three-letter abbreviation. The default is
+// Sunday.
+func parseStartOfWeek(v interface{}) (time.Weekday, bool) {
+	if v == nil {
+		return time.Sunday, true
+	}
+	s, _ := v.(string)
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// dateOperand evaluates the argument of a date part operator such as $year:
+// a date expression, or {date, timezone}. It returns the date in the
+// timezone.
+func dateOperand(doc bson.D, args interface{}) (time.Time, bool) {
+	dateExpr, tzExpr := args, interface{}(nil)
+	if a, ok := args.(bson.A); ok && len(a) == 1 {
+		dateExpr = a[0]
+	}
+	if d, ok := args.(bson.D); ok && len(d) > 0 && !strings.HasPrefix(d[0].Key, "$") {
+		dateExpr = nil
+		for _, f := range d {
+			switch f.Key {
+			case "date":
+				dateExpr = f.Value
+			case "timezone":
+				tzExpr = f.Value
+			default:
+				return time.Time{}, false
+			}
+		}
+	}
+	t, ok := toTime(evalExpr(doc, dateExpr))
+	if !ok {
+		return time.Time{}, false
+	}
+	loc, ok := parseTimezone(evalExpr(doc, tzExpr))
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.In(loc), true
+}
+
+// datePart returns the part of t that a date part operator such as $year
+// extracts.
+func datePart(op string, t time.Time) interface{} {
+	switch op {
+	case "$year":
+		return int32(t.Year())
+	case "$month":
+		return int32(t.Month())
+	case "$dayOfMonth":
+		return int32(t.Day())
+	case "$dayOfYear":
+		return int32(t.YearDay())
+	case "$dayOfWeek":
+		return int32(t.Weekday()) + 1
+	case "$hour":
+		return int32(t.Hour())
+	case "$minute":
+		return int32(t.Minute())
+	case "$second":
+		return int32(t.Second())
+	case "$millisecond":
+		return int32(t.Nanosecond() / 1e6)
+	case "$week":
+		return int32(sundayWeek(t))
+	case "$isoWeek":
+		_, w := t.ISOWeek()
+		return int32(w)
+	case "$isoWeekYear":
+		y, _ := t.ISOWeek()
+		return int64(y)
+	case "$isoDayOfWeek":
+		return int32(isoWeekday(t))
+	}
+	return nil
+}
+
+// sundayWeek returns the week of the year of t, 0 to 53, where weeks start
+// on Sunday and the days before the first Sunday are in week 0.
+func sundayWeek(t time.Time) int {
+	return (t.YearDay() - 1 + 7 - int(t.Weekday())) / 7
+}
+
+// isoWeekday returns the ISO 8601 day of the week of t, Monday 1 to Sunday 7.
+func isoWeekday(t time.Time) int {
+	return (int(t.Weekday())+6)%7 + 1
+}
+
+// formatDate formats t with a $dateToString format string.
+func formatDate(t time.Time, format string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if i++; i == len(format) {
+			return "", false
+		}
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'L':
+			fmt.Fprintf(&b, "%03d", t.Nanosecond()/1e6)
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'w':
+			fmt.Fprintf(&b, "%d", int(t.Weekday())+1)
+		case 'u':
+			fmt.Fprintf(&b, "%d", isoWeekday(t))
+		case 'U':
+			fmt.Fprintf(&b, "%02d", sundayWeek(t))
+		case 'V':
+			_, w := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", w)
+		case 'G':
+			y, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%04d", y)
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			_, off := t.Zone()
+			fmt.Fprintf(&b, "%+d", off/60)
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+// isoLayouts are the layouts $dateFromString and $toDate accept without a
+// format: ISO 8601 dates and times, with or without a UTC offset. Go parses
+// a fractional second after the seconds even when the layout has none.
+var isoLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseDate parses s as a date in loc, with a $dateFromString format or, if
+// format is empty, as ISO 8601. An offset in s overrides loc.
+func parseDate(s, format string, loc *time.Location) (time.Time, bool) {
+	if format == "" {
+		for _, layout := range isoLayouts {
+			if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+				return t.UTC(), true
+			}
+		}
+		return time.Time{}, false
+	}
+
+	year, month, day, hour, minute, sec, ms, yday := 1970, 1, 1, 0, 0, 0, 0, 0
+	pos := 0
+	// num reads between 1 and max digits.
+	num := func(max int) (int, bool) {
+		start := pos
+		for pos < len(s) && pos-start < max && s[pos] >= '0' && s[pos] <= '9' {
+			pos++
+		}
+		if pos == start {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(s[start:pos])
+		return n, true
+	}
+	ok := true
+	for i := 0; i < len(format) && ok; i++ {
+		if format[i] != '%' {
+			ok = pos < len(s) && s[pos] == format[i]
+			pos++
+			continue
+		}
+		if i++; i == len(format) {
+			return time.Time{}, false
+		}
+		switch format[i] {
+		case 'Y':
+			year, ok = num(4)
+		case 'm':
+			month, ok = num(2)
+		case 'd':
+			day, ok = num(2)
+		case 'H':
+			hour, ok = num(2)
+		case 'M':
+			minute, ok = num(2)
+		case 'S':
+			sec, ok = num(2)
+		case 'L':
+			start := pos
+			if ms, ok = num(3); ok {
+				for n := pos - start; n < 3; n++ {
+					ms *= 10
+				}
+			}
+		case 'j':
+			yday, ok = num(3)
+		case 'z':
+			end := pos + 1
+			for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == ':') {
+				end++
+			}
+			var off int
+			if pos < len(s) && s[pos] == 'Z' {
+				end = pos + 1
+			} else if off, ok = parseOffset(s[pos:min(end, len(s))]); !ok {
+				break
+			}
+			loc, pos = time.FixedZone("", off), end
+		case 'Z':
+			sign := 1
+			if pos < len(s) && (s[pos] == '+' || s[pos] == '-') {
+				if s[pos] == '-' {
+					sign = -1
+				}
+				pos++
+			}
+			var mins int
+			if mins, ok = num(4); ok {
+				loc = time.FixedZone("", sign*mins*60)
+			}
+		case 'b', 'B':
+			ok = false
+			for m := time.January; m <= time.December && !ok; m++ {
+				for _, name := range []string{m.String(), m.String()[:3]} {
+					if len(s)-pos >= len(name) && strings.EqualFold(s[pos:pos+len(name)], name) {
+						month, pos, ok = int(m), pos+len(name), true
+						break
+					}
+				}
+			}
+		case '%':
+			ok = pos < len(s) && s[pos] == '%'
+			pos++
+		default:
+			return time.Time{}, false
+		}
+	}
+	if !ok || pos != len(s) {
+		return time.Time{}, false
+	}
+	if yday > 0 {
+		month, day = 1, yday
+	}
+	t := time.Date(year, time.Month(month), day, hour, minute, sec, ms*1e6, loc)
+	// Reject out-of-range fields, which time.Date would normalise.
+	if hour > 23 || minute > 59 || sec > 59 || (yday == 0 && (t.Month() != time.Month(month) || t.Day() != day)) || (yday > 0 && t.Year() != year) {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// dateAdd adds amount units to t in t's location. Adding months, quarters or
+// years keeps the day of the month, clamped to the last day of the target
+// month as MongoDB does, so January 31 plus one month is February 28.
+func dateAdd(t time.Time, unit string, amount int64) (time.Time, bool) {
+	if months, ok := calendarMonths[unit]; ok {
+		return addMonths(t, int(amount)*months), true
+	}
+	switch unit {
+	case "week":
+		return t.AddDate(0, 0, int(amount)*7), true
+	case "day":
+		return t.AddDate(0, 0, int(amount)), true
+	}
+	ms, ok := unitMillis[unit]
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.Add(time.Duration(amount) * time.Duration(ms) * time.Millisecond), true
+}
+
+// dateDiff returns the number of unit boundaries between a and b, which are
+// in the same location: the difference of their years for "year", of their
+// calendar days for "day", and so on. Weeks start on startOfWeek.
+func dateDiff(a, b time.Time, unit string, startOfWeek time.Weekday) (int64, bool) {
+	switch unit {
+	case "year":
+		return int64(b.Year() - a.Year()), true
+	case "quarter":
+		quarter := func(t time.Time) int64 { return int64(t.Year())*4 + int64(t.Month()-1)/3 }
+		return quarter(b) - quarter(a), true
+	case "month":
+		month := func(t time.Time) int64 { return int64(t.Year())*12 + int64(t.Month()) }
+		return month(b) - month(a), true
+	case "week":
+		ref := weekReference(startOfWeek)
+		return floorDiv(dayNumber(b)-ref, 7) - floorDiv(dayNumber(a)-ref, 7), true
+	case "day":
+		return dayNumber(b) - dayNumber(a), true
+	}
+	ms, ok := unitMillis[unit]
+	if !ok {
+		return 0, false
+	}
+	return floorDiv(wallMillis(b), int64(ms)) - floorDiv(wallMillis(a), int64(ms)), true
+}
+
+// dateTrunc rounds t down, in t's location, to the start of its bin of
+// binSize units. Bins are counted from 2000-01-01, or for weeks from the
+// first startOfWeek of 2000.
+func dateTrunc(t time.Time, unit string, binSize int64, startOfWeek time.Weekday) (time.Time, bool) {
+	loc := t.Location()
+	if months, ok := calendarMonths[unit]; ok {
+		size := binSize * int64(months)
+		bin := floorDiv(int64(t.Year()-2000)*12+int64(t.Month()-1), size) * size
+		year := floorDiv(bin, 12)
+		return time.Date(2000+int(year), time.Month(bin-year*12+1), 1, 0, 0, 0, 0, loc), true
+	}
+	switch unit {
+	case "week", "day":
+		size, ref := binSize, dayNumber(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		if unit == "week" {
+			size, ref = binSize*7, weekReference(startOfWeek)
+		}
+		d := time.Unix((ref+floorDiv(dayNumber(t)-ref, size)*size)*86400, 0).UTC()
+		return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc), true
+	}
+	ms, ok := unitMillis[unit]
+	if !ok {
+		return time.Time{}, false
+	}
+	size := int64(ms) * binSize
+	ref := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	d := time.UnixMilli(ref + floorDiv(wallMillis(t)-ref, size)*size).UTC()
+	return time.Date(d.Year(), d.Month(), d.Day(), d.Hour(), d.Minute(), d.Second(), d.Nanosecond(), loc), true
+}
+
+// dayNumber returns the number of calendar days from 1970-01-01 to t's
+// date in t's location.
+func dayNumber(t time.Time) int64 {
+	return floorDiv(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix(), 86400)
+}
+
+// weekReference returns the dayNumber of the first startOfWeek day of 2000;
+// 2000-01-02 was a Sunday.
+func weekReference(startOfWeek time.Weekday) int64 {
+	return dayNumber(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)) + int64(startOfWeek)
+}
+
+// wallMillis returns t's wall clock time in its location as milliseconds
+// since the epoch, so units are counted in local time.
+func wallMillis(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).UnixMilli()
+}
+
+// floorDiv divides a by the positive b, rounding toward negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// evalDateOperator evaluates the date expression operators. Like the other
+// operators, it returns null for arguments it cannot use.
+func evalDateOperator(doc bson.D, op string, args interface{}) interface{} {
+	switch op {
+	case "$year", "$month", "$dayOfMonth", "$dayOfYear", "$dayOfWeek", "$hour", "$minute", "$second",
+		"$millisecond", "$week", "$isoWeek", "$isoWeekYear", "$isoDayOfWeek":
+		t, ok := dateOperand(doc, args)
+		if !ok {
+			return nil
+		}
+		return datePart(op, t)
+
+	case "$toDate":
+		return toDate(evalExpr(doc, args))
+	}
+
+	spec, ok := args.(bson.D)
+	if !ok {
+		return nil
+	}
+	arg := make(map[string]interface{}, len(spec))
+	for _, f := range spec {
+		arg[f.Key] = f.Value
+	}
+	loc, ok := parseTimezone(evalExpr(doc, arg["timezone"]))
+	if !ok {
+		return nil
+	}
+	startOfWeek, ok := parseStartOfWeek(evalExpr(doc, arg["startOfWeek"]))
+	if !ok {
+		return nil
+	}
+	unit, _ := evalExpr(doc, arg["unit"]).(string)
+
+	switch op {
+	case "$dateToString":
+		v := evalExpr(doc, arg["date"])
+		if v == nil {
+			if onNull, ok := arg["onNull"]; ok {
+				return evalExpr(doc, onNull)
+			}
+			return nil
+		}
+		t, ok := toTime(v)
+		if !ok {
+			return nil
+		}
+		format := defaultDateFormat
+		if f, ok := arg["format"]; ok {
+			if format, ok = evalExpr(doc, f).(string); !ok {
+				return nil
+			}
+		}
+		s, ok := formatDate(t.In(loc), format)
+		if !ok {
+			return nil
+		}
+		return s
+
+	case "$dateFromString":
+		v := evalExpr(doc, arg["dateString"])
+		if v == nil {
+			if onNull, ok := arg["onNull"]; ok {
+				return evalExpr(doc, onNull)
+			}
+			return nil
+		}
+		s, _ := v.(string)
+		format := ""
+		if f, ok := arg["format"]; ok {
+			format, _ = evalExpr(doc, f).(string)
+		}
+		t, ok := parseDate(s, format, loc)
+		if !ok {
+			if onError, ok := arg["onError"]; ok {
+				return evalExpr(doc, onError)
+			}
+			return nil
+		}
+		return bson.NewDateTimeFromTime(t)
+
+	case "$dateAdd", "$dateSubtract":
+		start, ok := toTime(evalExpr(doc, arg["startDate"]))
+		amount := evalExpr(doc, arg["amount"])
+		if !ok || !isNumeric(amount) || toFloat64(amount) != float64(toInt64(amount)) {
+			return nil
+		}
+		n := toInt64(amount)
+		if op == "$dateSubtract" {
+			n = -n
+		}
+		t, ok := dateAdd(start.In(loc), unit, n)
+		if !ok {
+			return nil
+		}
+		return bson.NewDateTimeFromTime(t)
+
+	case "$dateDiff":
+		start, ok1 := toTime(evalExpr(doc, arg["startDate"]))
+		end, ok2 := toTime(evalExpr(doc, arg["endDate"]))
+		if !ok1 || !ok2 {
+			return nil
+		}
+		n, ok := dateDiff(start.In(loc), end.In(loc), unit, startOfWeek)
+		if !ok {
+			return nil
+		}
+		return n
+
+	case "$dateTrunc":
+		t, ok := toTime(evalExpr(doc, arg["date"]))
+		if !ok {
+			return nil
+		}
+		binSize := int64(1)
+		if b, ok := arg["binSize"]; ok {
+			v := evalExpr(doc, b)
+			if !isNumeric(v) || toInt64(v) < 1 || toFloat64(v) != float64(toInt64(v)) {
+				return nil
+			}
+			binSize = toInt64(v)
+		}
+		t, ok = dateTrunc(t.In(loc), unit, binSize, startOfWeek)
+		if !ok {
+			return nil
+		}
+		return bson.NewDateTimeFromTime(t)
+	}
+	return nil
+}
+
+// toDate converts v to a date as $toDate does: dates, ObjectIDs and
+// timestamps by their time, numbers as milliseconds since the epoch and
+// strings as ISO 8601.
+func toDate(v interface{}) interface{} {
+	if t, ok := toTime(v); ok {
+		return bson.NewDateTimeFromTime(t)
+	}
+	switch x := v.(type) {
+	case string:
+		if t, ok := parseDate(x, "", time.UTC); ok {
+			return bson.NewDateTimeFromTime(t)
+		}
+		return nil
+	}
+	if isNumeric(v) {
+		return bson.DateTime(toInt64(v))
+	}
+	return nil
+}
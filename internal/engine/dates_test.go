@@ -0,0 +1,357 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func date(year int, month time.Month, day, hour, min int) bson.DateTime {
+	return bson.NewDateTimeFromTime(time.Date(year, month, day, hour, min, 0, 0, time.UTC))
+}
+
+// evalDate evaluates a single expression against doc.
+func evalDate(t *testing.T, doc bson.D, expr interface{}) interface{} {
+	t.Helper()
+	out, err := RunPipeline([]bson.D{doc}, []bson.D{{{Key: "$project", Value: bson.D{
+		{Key: "_id", Value: int32(0)},
+		{Key: "v", Value: expr},
+	}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := GetField(out[0], "v")
+	return v
+}
+
+// ---- Comparison and sorting ----
+
+func TestDates_QueryAndSort(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "events",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "at", Value: date(2025, time.March, 2, 9, 0)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "at", Value: date(2024, time.December, 31, 23, 0)}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "at", Value: date(2025, time.January, 15, 12, 0)}},
+		bson.D{{Key: "_id", Value: int32(4)}, {Key: "at", Value: "2025-02-01"}},
+	)
+	eng = reloadEng(t, path)
+
+	isDate := bson.D{{Key: "at", Value: bson.D{{Key: "$type", Value: "date"}}}}
+	docs, err := eng.Find("db", "events", isDate, bson.D{{Key: "at", Value: int32(-1)}}, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := docIDs(docs), []interface{}{int32(1), int32(3), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sorted ids = %v, want %v", got, want)
+	}
+
+	// Range queries compare dates with dates only, so the string is skipped.
+	in2025 := bson.D{{Key: "at", Value: bson.D{
+		{Key: "$gte", Value: date(2025, time.January, 1, 0, 0)},
+		{Key: "$lt", Value: date(2026, time.January, 1, 0, 0)},
+	}}}
+	docs, _ = eng.Find("db", "events", in2025, bson.D{{Key: "at", Value: int32(1)}}, 0, 0, nil)
+	if got, want := docIDs(docs), []interface{}{int32(3), int32(1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("2025 ids = %v, want %v", got, want)
+	}
+	// The same range query uses an index on the field.
+	if err := eng.CreateIndexes("db", "events", []IndexSpec{{Name: "at_1", Keys: bson.D{{Key: "at", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	x, err := eng.ExplainFind("db", "events", in2025, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Index == nil || x.NReturned != 2 || x.KeysExamined != 2 {
+		t.Errorf("explain = index %v, %d returned, %d keys examined; want at_1, 2, 2", x.Index, x.NReturned, x.KeysExamined)
+	}
+	if want := "[new Date(1735689600000), new Date(1767225600000))"; len(x.IndexBounds) != 1 || x.IndexBounds[0] != want {
+		t.Errorf("bounds = %v, want %s", x.IndexBounds, want)
+	}
+}
+
+func TestDates_GroupByDay(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "orders",
+		bson.D{{Key: "at", Value: date(2025, time.March, 1, 8, 0)}, {Key: "total", Value: int32(10)}},
+		bson.D{{Key: "at", Value: date(2025, time.March, 1, 23, 30)}, {Key: "total", Value: int32(5)}},
+		bson.D{{Key: "at", Value: date(2025, time.March, 2, 0, 30)}, {Key: "total", Value: int32(7)}},
+	)
+	run := func(timezone string) []bson.D {
+		t.Helper()
+		docs, err := eng.Aggregate("db", "orders", []bson.D{
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+					{Key: "format", Value: "%Y-%m-%d"}, {Key: "date", Value: "$at"}, {Key: "timezone", Value: timezone},
+				}}}},
+				{Key: "total", Value: bson.D{{Key: "$sum", Value: "$total"}}},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return docs
+	}
+	if got, want := fieldValues(run("UTC"), "total"), []interface{}{int64(15), int64(7)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UTC totals = %v, want %v", got, want)
+	}
+	// Two hours east of UTC, the late order of March 1st falls on March 2nd.
+	docs := run("+02:00")
+	if got, want := fieldValues(docs, "_id"), []interface{}{"2025-03-01", "2025-03-02"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("+02:00 days = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(docs, "total"), []interface{}{int64(10), int64(12)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("+02:00 totals = %v, want %v", got, want)
+	}
+
+	// $dateTrunc groups by day without formatting.
+	docs, err := eng.Aggregate("db", "orders", []bson.D{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{{Key: "date", Value: "$at"}, {Key: "unit", Value: "day"}}}}},
+			{Key: "n", Value: bson.D{{Key: "$sum", Value: int32(1)}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fieldValues(docs, "_id"), []interface{}{date(2025, time.March, 1, 0, 0), date(2025, time.March, 2, 0, 0)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("truncated days = %v, want %v", got, want)
+	}
+}
+
+// ---- Date expression operators ----
+
+func TestDateParts(t *testing.T) {
+	// Sunday, 2023-01-01 01:02:03.456 UTC.
+	at := bson.NewDateTimeFromTime(time.Date(2023, time.January, 1, 1, 2, 3, 456e6, time.UTC))
+	doc := bson.D{{Key: "at", Value: at}}
+	for op, want := range map[string]interface{}{
+		"$year":         int32(2023),
+		"$month":        int32(1),
+		"$dayOfMonth":   int32(1),
+		"$dayOfYear":    int32(1),
+		"$dayOfWeek":    int32(1),
+		"$hour":         int32(1),
+		"$minute":       int32(2),
+		"$second":       int32(3),
+		"$millisecond":  int32(456),
+		"$week":         int32(1),
+		"$isoWeek":      int32(52),
+		"$isoWeekYear":  int64(2022),
+		"$isoDayOfWeek": int32(7),
+	} {
+		if got := evalDate(t, doc, bson.D{{Key: op, Value: "$at"}}); got != want {
+			t.Errorf("%s = %v (%T), want %v (%T)", op, got, got, want, want)
+		}
+	}
+
+	// In New York it is still Saturday, December 31st.
+	inNY := func(op string) interface{} {
+		return evalDate(t, doc, bson.D{{Key: op, Value: bson.D{{Key: "date", Value: "$at"}, {Key: "timezone", Value: "America/New_York"}}}})
+	}
+	if got := inNY("$year"); got != int32(2022) {
+		t.Errorf("$year in New York = %v, want 2022", got)
+	}
+	if got := inNY("$dayOfWeek"); got != int32(7) {
+		t.Errorf("$dayOfWeek in New York = %v, want 7", got)
+	}
+	if got := evalDate(t, doc, bson.D{{Key: "$hour", Value: bson.D{{Key: "date", Value: "$at"}, {Key: "timezone", Value: "+0530"}}}}); got != int32(6) {
+		t.Errorf("$hour at +0530 = %v, want 6", got)
+	}
+
+	// An ObjectID is a date, its creation time; other values give null.
+	id := bson.NewObjectIDFromTimestamp(time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC))
+	if got := evalDate(t, bson.D{{Key: "id", Value: id}}, bson.D{{Key: "$year", Value: "$id"}}); got != int32(2021) {
+		t.Errorf("$year of ObjectID = %v, want 2021", got)
+	}
+	for _, bad := range []interface{}{"$missing", "2023-01-01", bson.D{{Key: "date", Value: "$at"}, {Key: "timezone", Value: "Mars/Base"}}} {
+		if got := evalDate(t, doc, bson.D{{Key: "$year", Value: bad}}); got != nil {
+			t.Errorf("$year of %v = %v, want null", bad, got)
+		}
+	}
+}
+
+func TestDateToStringAndFromString(t *testing.T) {
+	at := bson.NewDateTimeFromTime(time.Date(2024, time.February, 29, 13, 5, 9, 7e6, time.UTC))
+	doc := bson.D{{Key: "at", Value: at}}
+	toString := func(args ...bson.E) interface{} {
+		return evalDate(t, doc, bson.D{{Key: "$dateToString", Value: append(bson.D{{Key: "date", Value: "$at"}}, args...)}})
+	}
+	if got, want := toString(), "2024-02-29T13:05:09.007Z"; got != want {
+		t.Errorf("default format = %v, want %v", got, want)
+	}
+	format := bson.E{Key: "format", Value: "%d %b %Y %H:%M %z, day %j, week %U/%V, %% done"}
+	if got, want := toString(format, bson.E{Key: "timezone", Value: "Asia/Tokyo"}), "29 Feb 2024 22:05 +0900, day 060, week 08/09, % done"; got != want {
+		t.Errorf("formatted = %q, want %q", got, want)
+	}
+	if got := evalDate(t, doc, bson.D{{Key: "$dateToString", Value: bson.D{{Key: "date", Value: "$none"}, {Key: "onNull", Value: "never"}}}}); got != "never" {
+		t.Errorf("onNull = %v, want never", got)
+	}
+	if got := evalDate(t, doc, bson.D{{Key: "$toString", Value: "$at"}}); got != "2024-02-29T13:05:09.007Z" {
+		t.Errorf("$toString = %v", got)
+	}
+
+	fromString := func(s string, args ...bson.E) interface{} {
+		return evalDate(t, doc, bson.D{{Key: "$dateFromString", Value: append(bson.D{{Key: "dateString", Value: s}}, args...)}})
+	}
+	for s, want := range map[string]bson.DateTime{
+		"2024-02-29T13:05:09.007Z":      at,
+		"2024-02-29T15:05:09.007+02:00": at,
+		"2024-02-29":                    date(2024, time.February, 29, 0, 0),
+		"2024-02-29 13:05:09":           date(2024, time.February, 29, 13, 5) + 9000,
+	} {
+		if got := fromString(s); got != want {
+			t.Errorf("$dateFromString %q = %v, want %v", s, got, want)
+		}
+	}
+	// A timezone applies to strings without an offset.
+	if got, want := fromString("2024-07-01T12:00:00", bson.E{Key: "timezone", Value: "Europe/Paris"}), date(2024, time.July, 1, 10, 0); got != want {
+		t.Errorf("Paris noon = %v, want %v", got, want)
+	}
+	dmy := bson.E{Key: "format", Value: "%d/%m/%Y %H:%M"}
+	if got, want := fromString("29/02/2024 13:05", dmy), date(2024, time.February, 29, 13, 5); got != want {
+		t.Errorf("formatted parse = %v, want %v", got, want)
+	}
+	if got := fromString("30/02/2024 13:05", dmy); got != nil {
+		t.Errorf("February 30th parsed as %v, want null", got)
+	}
+	if got := fromString("not a date", bson.E{Key: "onError", Value: "bad"}); got != "bad" {
+		t.Errorf("onError = %v, want bad", got)
+	}
+
+	if got := evalDate(t, doc, bson.D{{Key: "$toDate", Value: "2024-02-29T13:05:09.007Z"}}); got != at {
+		t.Errorf("$toDate of string = %v, want %v", got, at)
+	}
+	if got := evalDate(t, doc, bson.D{{Key: "$toDate", Value: int64(at)}}); got != at {
+		t.Errorf("$toDate of millis = %v, want %v", got, at)
+	}
+	if got := evalDate(t, doc, bson.D{{Key: "$convert", Value: bson.D{{Key: "input", Value: "x"}, {Key: "to", Value: "date"}, {Key: "onError", Value: int32(0)}}}}); got != int32(0) {
+		t.Errorf("$convert onError = %v, want 0", got)
+	}
+}
+
+func TestDateArithmetic(t *testing.T) {
+	doc := bson.D{
+		{Key: "start", Value: date(2025, time.January, 31, 22, 0)},
+		{Key: "end", Value: date(2025, time.March, 3, 1, 30)},
+	}
+	add := func(op, unit string, amount interface{}, extra ...bson.E) interface{} {
+		return evalDate(t, doc, bson.D{{Key: op, Value: append(bson.D{
+			{Key: "startDate", Value: "$start"}, {Key: "unit", Value: unit}, {Key: "amount", Value: amount},
+		}, extra...)}})
+	}
+	for _, c := range []struct {
+		op, unit string
+		amount   interface{}
+		want     interface{}
+	}{
+		{"$dateAdd", "month", int32(1), date(2025, time.February, 28, 22, 0)},
+		{"$dateAdd", "quarter", int64(1), date(2025, time.April, 30, 22, 0)},
+		{"$dateAdd", "year", 1.0, date(2026, time.January, 31, 22, 0)},
+		{"$dateAdd", "week", int32(2), date(2025, time.February, 14, 22, 0)},
+		{"$dateAdd", "hour", int32(3), date(2025, time.February, 1, 1, 0)},
+		{"$dateSubtract", "month", int32(2), date(2024, time.November, 30, 22, 0)},
+		{"$dateSubtract", "minute", int32(90), date(2025, time.January, 31, 20, 30)},
+		{"$dateAdd", "day", 1.5, nil},
+		{"$dateAdd", "fortnight", int32(1), nil},
+	} {
+		if got := add(c.op, c.unit, c.amount); got != c.want {
+			t.Errorf("%s %v %s = %v, want %v", c.op, c.amount, c.unit, got, c.want)
+		}
+	}
+	// A day in New York across the start of daylight saving time is 23 hours.
+	dst := bson.D{{Key: "$dateAdd", Value: bson.D{
+		{Key: "startDate", Value: date(2025, time.March, 8, 17, 0)}, {Key: "unit", Value: "day"}, {Key: "amount", Value: int32(1)},
+		{Key: "timezone", Value: "America/New_York"},
+	}}}
+	if got, want := evalDate(t, doc, dst), date(2025, time.March, 9, 16, 0); got != want {
+		t.Errorf("New York $dateAdd = %v, want %v", got, want)
+	}
+
+	diff := func(unit string, extra ...bson.E) interface{} {
+		return evalDate(t, doc, bson.D{{Key: "$dateDiff", Value: append(bson.D{
+			{Key: "startDate", Value: "$start"}, {Key: "endDate", Value: "$end"}, {Key: "unit", Value: unit},
+		}, extra...)}})
+	}
+	// Boundaries crossed, not whole units elapsed.
+	for unit, want := range map[string]int64{"year": 0, "quarter": 0, "month": 2, "week": 5, "day": 31, "hour": 723, "minute": 43410} {
+		if got := diff(unit); got != want {
+			t.Errorf("$dateDiff in %ss = %v, want %d", unit, got, want)
+		}
+	}
+	if got := diff("week", bson.E{Key: "startOfWeek", Value: "monday"}); got != int64(5) {
+		t.Errorf("$dateDiff in Monday weeks = %v, want 5", got)
+	}
+	if got := diff("day", bson.E{Key: "timezone", Value: "+05:00"}); got != int64(30) {
+		t.Errorf("$dateDiff in days at +05:00 = %v, want 30", got)
+	}
+}
+
+func TestDateTrunc(t *testing.T) {
+	// Wednesday, 2025-05-14 10:47 UTC.
+	doc := bson.D{{Key: "at", Value: date(2025, time.May, 14, 10, 47)}}
+	trunc := func(unit string, extra ...bson.E) interface{} {
+		return evalDate(t, doc, bson.D{{Key: "$dateTrunc", Value: append(bson.D{{Key: "date", Value: "$at"}, {Key: "unit", Value: unit}}, extra...)}})
+	}
+	bin := func(n int32) bson.E { return bson.E{Key: "binSize", Value: n} }
+	for _, c := range []struct {
+		name string
+		got  interface{}
+		want bson.DateTime
+	}{
+		{"year", trunc("year"), date(2025, time.January, 1, 0, 0)},
+		{"quarter", trunc("quarter"), date(2025, time.April, 1, 0, 0)},
+		{"2 months", trunc("month", bin(2)), date(2025, time.May, 1, 0, 0)},
+		{"5 months", trunc("month", bin(5)), date(2025, time.January, 1, 0, 0)},
+		{"week", trunc("week"), date(2025, time.May, 11, 0, 0)},
+		{"monday week", trunc("week", bson.E{Key: "startOfWeek", Value: "Mon"}), date(2025, time.May, 12, 0, 0)},
+		{"day", trunc("day"), date(2025, time.May, 14, 0, 0)},
+		{"15 minutes", trunc("minute", bin(15)), date(2025, time.May, 14, 10, 45)},
+		{"6 hours", trunc("hour", bin(6)), date(2025, time.May, 14, 6, 0)},
+		{"day in Los Angeles", trunc("day", bson.E{Key: "timezone", Value: "America/Los_Angeles"}), date(2025, time.May, 14, 7, 0)},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if got := trunc("day", bin(0)); got != nil {
+		t.Errorf("binSize 0 = %v, want null", got)
+	}
+}
+
+func TestNow(t *testing.T) {
+	before := bson.NewDateTimeFromTime(time.Now())
+	docs := []bson.D{{{Key: "_id", Value: int32(1)}}, {{Key: "_id", Value: int32(2)}}}
+	out, err := RunPipeline(docs, []bson.D{
+		{{Key: "$addFields", Value: bson.D{{Key: "now", Value: "$$NOW"}}}},
+		{{Key: "$facet", Value: bson.D{{Key: "later", Value: bson.A{
+			bson.D{{Key: "$project", Value: bson.D{{Key: "same", Value: bson.D{{Key: "$eq", Value: bson.A{"$now", "$$NOW"}}}}}}},
+		}}}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, _ := GetField(out[0], "later")
+	for _, d := range later.(bson.A) {
+		if same, _ := GetField(d.(bson.D), "same"); same != true {
+			t.Errorf("$$NOW changed within a pipeline: %v", d)
+		}
+	}
+
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "jobs",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "due", Value: bson.NewDateTimeFromTime(before.Time().Add(-time.Hour))}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "due", Value: bson.NewDateTimeFromTime(before.Time().Add(time.Hour))}},
+	)
+	overdue, err := eng.Find("db", "jobs", bson.D{{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$due", "$$NOW"}}}}}, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := docIDs(overdue), []interface{}{int32(1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("overdue = %v, want %v", got, want)
+	}
+}
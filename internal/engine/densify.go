@@ -0,0 +1,414 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// maxDensifyDocs caps the documents one $densify stage may generate, as
+// MongoDB does, so a small step over a wide range fails instead of
+// exhausting memory.
+const maxDensifyDocs = 500000
+
+// densifySpec is a parsed $densify stage.
+type densifySpec struct {
+	field           string
+	partitionFields []string
+	step            interface{}
+	unit            string
+	bounds          string      // "full", "partition" or "" for explicit bounds
+	lo              interface{} // the explicit lower bound
+	loKey, hiKey    float64     // explicit bounds as windowKey numbers; hiKey is exclusive
+}
+
+func parseDensify(spec bson.D) (*densifySpec, error) {
+	d := &densifySpec{}
+	var rangeSpec bson.D
+	for _, f := range spec {
+		switch f.Key {
+		case "field":
+			d.field, _ = f.Value.(string)
+		case "partitionByFields":
+			arr, ok := f.Value.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("$densify 'partitionByFields' must be an array of field names")
+			}
+			for _, v := range arr {
+				s, ok := v.(string)
+				if !ok || s == "" {
+					return nil, fmt.Errorf("$densify 'partitionByFields' must be an array of field names")
+				}
+				d.partitionFields = append(d.partitionFields, s)
+			}
+		case "range":
+			r, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$densify 'range' must be a document")
+			}
+			rangeSpec = r
+		default:
+			return nil, fmt.Errorf("$densify: unknown argument %q", f.Key)
+		}
+	}
+	if d.field == "" || rangeSpec == nil {
+		return nil, fmt.Errorf("$densify requires a 'field' name and a 'range'")
+	}
+	for _, pf := range d.partitionFields {
+		if pf == d.field {
+			return nil, fmt.Errorf("$densify 'field' must not be one of the 'partitionByFields'")
+		}
+	}
+
+	var bounds interface{}
+	for _, f := range rangeSpec {
+		switch f.Key {
+		case "step":
+			d.step = f.Value
+		case "unit":
+			unit, ok := f.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("$densify 'unit' must be a string")
+			}
+			if err := checkUnit("$densify", unit); err != nil {
+				return nil, err
+			}
+			d.unit = unit
+		case "bounds":
+			bounds = f.Value
+		default:
+			return nil, fmt.Errorf("$densify: unknown range argument %q", f.Key)
+		}
+	}
+	if !isNumeric(d.step) || toFloat64(d.step) <= 0 {
+		return nil, fmt.Errorf("$densify 'step' must be a positive number")
+	}
+	if d.unit != "" && !isInt(d.step) {
+		return nil, fmt.Errorf("$densify 'step' must be an integer when 'unit' is set")
+	}
+	switch b := bounds.(type) {
+	case string:
+		if b != "full" && b != "partition" {
+			return nil, fmt.Errorf("$densify 'bounds' must be \"full\", \"partition\" or a [lower, upper] array")
+		}
+		d.bounds = b
+	case bson.A:
+		if len(b) != 2 {
+			return nil, fmt.Errorf("$densify 'bounds' must be \"full\", \"partition\" or a [lower, upper] array")
+		}
+		d.lo = b[0]
+		for i, v := range b {
+			key, isDate, ok := windowKey(v)
+			if !ok || isDate != (d.unit != "") {
+				return nil, fmt.Errorf("$densify bounds must be dates when 'unit' is set and numbers otherwise")
+			}
+			if i == 0 {
+				d.loKey = key
+			} else {
+				d.hiKey = key
+			}
+		}
+		if d.loKey > d.hiKey {
+			return nil, fmt.Errorf("$densify lower bound must not be greater than the upper bound")
+		}
+	default:
+		return nil, fmt.Errorf("$densify requires 'bounds'")
+	}
+	return d, nil
+}
+
+// densifyDocs adds documents so that, within each partition, field takes
+// every value from the lower bound in steps of step. Added documents hold
+// only field and the partition fields. Documents without field are passed
+// through first; the rest come out sorted by field within each partition.
+func densifyDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	d, err := parseDensify(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var result, present []bson.D
+	var minDoc, maxDoc interface{}
+	var minKey, maxKey float64
+	for i := range docs {
+		v, _ := GetField(docs[i], d.field)
+		if v == nil {
+			result = append(result, docs[i])
+			continue
+		}
+		key, isDate, ok := windowKey(v)
+		if !ok || isDate != (d.unit != "") {
+			return nil, fmt.Errorf("$densify: %s must be a date when 'unit' is set and a number otherwise, got %v", d.field, v)
+		}
+		present = append(present, docs[i])
+		if minDoc == nil || key < minKey {
+			minDoc, minKey = v, key
+		}
+		if maxDoc == nil || key > maxKey {
+			maxDoc, maxKey = v, key
+		}
+	}
+	keyOf := func(doc bson.D) float64 {
+		v, _ := GetField(doc, d.field)
+		key, _, _ := windowKey(v)
+		return key
+	}
+
+	parts := partitionDocs(present, func(doc bson.D) interface{} {
+		key := bson.D{}
+		for _, pf := range d.partitionFields {
+			v, _ := GetField(doc, pf)
+			key = append(key, bson.E{Key: pf, Value: v})
+		}
+		return key
+	}, nil)
+	generated := 0
+	for _, p := range parts {
+		sort.SliceStable(p.docs, func(i, j int) bool { return keyOf(p.docs[i]) < keyOf(p.docs[j]) })
+
+		lo, loKey, hiKey, inclusive := d.lo, d.loKey, d.hiKey, false
+		switch d.bounds {
+		case "full":
+			lo, loKey, hiKey, inclusive = minDoc, minKey, maxKey, true
+		case "partition":
+			first, _ := GetField(p.docs[0], d.field)
+			lo, loKey, hiKey, inclusive = first, keyOf(p.docs[0]), keyOf(p.docs[len(p.docs)-1]), true
+		}
+
+		i := 0
+		for k := int64(0); ; k++ {
+			v := d.stepFrom(loKey, k)
+			if v > hiKey || (v == hiKey && !inclusive) {
+				break
+			}
+			exists := false
+			for ; i < len(p.docs) && keyOf(p.docs[i]) <= v; i++ {
+				exists = exists || keyOf(p.docs[i]) == v
+				result = append(result, p.docs[i])
+			}
+			if exists {
+				continue
+			}
+			if generated++; generated > maxDensifyDocs {
+				return nil, fmt.Errorf("$densify would generate more than %d documents", maxDensifyDocs)
+			}
+			doc := SetField(bson.D{}, d.field, d.value(v, lo))
+			for _, pk := range p.key.(bson.D) {
+				if pk.Value != nil {
+					doc = SetField(doc, pk.Key, pk.Value)
+				}
+			}
+			result = append(result, doc)
+		}
+		result = append(result, p.docs[i:]...)
+	}
+	return result, nil
+}
+
+// stepFrom returns the k-th value of the sequence that starts at lo.
+func (d *densifySpec) stepFrom(lo float64, k int64) float64 {
+	if d.unit != "" {
+		return addUnits(lo, k*toInt64(d.step), d.unit)
+	}
+	return lo + float64(k)*toFloat64(d.step)
+}
+
+// value converts a generated key back to a field value: a date, an integer
+// of the lower bound's type when the lower bound and step are integers, or
+// a double.
+func (d *densifySpec) value(key float64, lo interface{}) interface{} {
+	switch {
+	case d.unit != "":
+		return bson.DateTime(int64(key))
+	case isInt(lo) && isInt(d.step):
+		if _, ok := lo.(int32); ok && key >= -1<<31 && key < 1<<31 {
+			return int32(key)
+		}
+		return int64(key)
+	default:
+		return key
+	}
+}
+
+// fillOutput is one output field of $fill.
+type fillOutput struct {
+	field  string
+	value  interface{} // the expression for {value: expr}
+	method string      // "locf", "linear" or "" for {value: expr}
+}
+
+// fillDocs replaces null and missing values of the output fields: with an
+// expression, the last non-null value (locf), or by linear interpolation
+// between the surrounding values along the sortBy field.
+func fillDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var partitionBy interface{}
+	var partitionFields []string
+	var sortBy bson.D
+	var outputs []fillOutput
+	hasPartitionBy := false
+	for _, f := range spec {
+		switch f.Key {
+		case "partitionBy":
+			partitionBy, hasPartitionBy = f.Value, true
+		case "partitionByFields":
+			arr, ok := f.Value.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("$fill 'partitionByFields' must be an array of field names")
+			}
+			for _, v := range arr {
+				s, ok := v.(string)
+				if !ok || s == "" {
+					return nil, fmt.Errorf("$fill 'partitionByFields' must be an array of field names")
+				}
+				partitionFields = append(partitionFields, s)
+			}
+		case "sortBy":
+			s, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$fill 'sortBy' must be a document")
+			}
+			sortBy = s
+		case "output":
+			o, ok := f.Value.(bson.D)
+			if !ok || len(o) == 0 {
+				return nil, fmt.Errorf("$fill 'output' must be a non-empty document")
+			}
+			for _, of := range o {
+				out, err := parseFillOutput(of)
+				if err != nil {
+					return nil, err
+				}
+				outputs = append(outputs, out)
+			}
+		default:
+			return nil, fmt.Errorf("$fill: unknown argument %q", f.Key)
+		}
+	}
+	if outputs == nil {
+		return nil, fmt.Errorf("$fill requires an 'output' field")
+	}
+	if hasPartitionBy && partitionFields != nil {
+		return nil, fmt.Errorf("$fill accepts 'partitionBy' or 'partitionByFields', not both")
+	}
+	for _, o := range outputs {
+		switch {
+		case o.method != "" && len(sortBy) == 0:
+			return nil, fmt.Errorf("$fill method %q requires a sortBy", o.method)
+		case o.method == "linear" && len(sortBy) != 1:
+			return nil, fmt.Errorf("$fill method \"linear\" requires a sortBy with exactly one field")
+		}
+	}
+
+	parts := partitionDocs(docs, func(doc bson.D) interface{} {
+		if partitionFields == nil {
+			return evalExpr(doc, partitionBy)
+		}
+		key := bson.D{}
+		for _, pf := range partitionFields {
+			v, _ := GetField(doc, pf)
+			key = append(key, bson.E{Key: pf, Value: v})
+		}
+		return key
+	}, sortBy)
+	var result []bson.D
+	for _, p := range parts {
+		filled := make([]bson.D, len(p.docs))
+		for i, doc := range p.docs {
+			c, err := CopyDoc(doc)
+			if err != nil {
+				return nil, err
+			}
+			filled[i] = c
+		}
+		for _, o := range outputs {
+			if err := o.fill(p.docs, filled, sortBy); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, filled...)
+	}
+	return result, nil
+}
+
+func parseFillOutput(f bson.E) (fillOutput, error) {
+	o := fillOutput{field: f.Key}
+	d, ok := f.Value.(bson.D)
+	if !ok || len(d) != 1 {
+		return o, fmt.Errorf("$fill output field %q must be {value: <expression>} or {method: <method>}", f.Key)
+	}
+	switch d[0].Key {
+	case "value":
+		o.value = d[0].Value
+	case "method":
+		m, _ := d[0].Value.(string)
+		if m != "locf" && m != "linear" {
+			return o, fmt.Errorf("$fill method must be \"locf\" or \"linear\", got %v", d[0].Value)
+		}
+		o.method = m
+	default:
+		return o, fmt.Errorf("$fill output field %q must be {value: <expression>} or {method: <method>}", f.Key)
+	}
+	return o, nil
+}
+
+// fill sets the output field of each document of filled, copies of the
+// sorted partition docs, whose value in docs is null or missing.
+func (o fillOutput) fill(docs, filled []bson.D, sortBy bson.D) error {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		values[i], _ = GetField(doc, o.field)
+	}
+	switch o.method {
+	case "":
+		for i, doc := range docs {
+			if values[i] == nil {
+				filled[i] = SetField(filled[i], o.field, evalExpr(doc, o.value))
+			}
+		}
+
+	case "locf":
+		var last interface{}
+		for i, v := range values {
+			if v != nil {
+				last = v
+			} else if last != nil {
+				filled[i] = SetField(filled[i], o.field, last)
+			}
+		}
+
+	case "linear":
+		keys := make([]float64, len(docs))
+		for i, doc := range docs {
+			v, _ := GetField(doc, sortBy[0].Key)
+			key, _, ok := windowKey(v)
+			if !ok {
+				return fmt.Errorf("$fill: linear fill requires a number or date sortBy field, got %v", v)
+			}
+			keys[i] = key
+			if values[i] != nil && !isNumeric(values[i]) {
+				return fmt.Errorf("$fill: linear fill requires numeric values of %s, got %v", o.field, values[i])
+			}
+		}
+		// Fill each run of nulls that has a value on both sides.
+		prev := -1
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			if prev >= 0 && i-prev > 1 {
+				x0, y0 := keys[prev], toFloat64(values[prev])
+				x1, y1 := keys[i], toFloat64(v)
+				for j := prev + 1; j < i; j++ {
+					y := y0
+					if x1 != x0 {
+						y = y0 + (y1-y0)*(keys[j]-x0)/(x1-x0)
+					}
+					filled[j] = SetField(filled[j], o.field, y)
+				}
+			}
+			prev = i
+		}
+	}
+	return nil
+}
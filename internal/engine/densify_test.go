@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ---- $densify ----
+
+func TestDensify_Numbers(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "suite", Value: "api"}, {Key: "run", Value: int32(1)}, {Key: "ms", Value: int32(10)}},
+		{{Key: "suite", Value: "api"}, {Key: "run", Value: int32(4)}, {Key: "ms", Value: int32(40)}},
+		{{Key: "suite", Value: "db"}, {Key: "run", Value: int32(2)}, {Key: "ms", Value: int32(20)}},
+		{{Key: "suite", Value: "db"}, {Key: "ms", Value: int32(5)}},
+	}
+	densify := func(bounds interface{}) []bson.D {
+		t.Helper()
+		out, err := RunPipeline(docs, []bson.D{{{Key: "$densify", Value: bson.D{
+			{Key: "field", Value: "run"},
+			{Key: "partitionByFields", Value: bson.A{"suite"}},
+			{Key: "range", Value: bson.D{{Key: "step", Value: int32(1)}, {Key: "bounds", Value: bounds}}},
+		}}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// The document without a run passes through first; "full" spans 1 to 4
+	// in every partition.
+	out := densify("full")
+	if got, want := fieldValues(out, "run"), []interface{}{nil, int32(1), int32(2), int32(3), int32(4), int32(1), int32(2), int32(3), int32(4)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("full runs = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "suite"), []interface{}{"db", "api", "api", "api", "api", "db", "db", "db", "db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("full suites = %v, want %v", got, want)
+	}
+	if got, _ := GetField(out[2], "ms"); got != nil {
+		t.Errorf("generated document has ms %v, want only run and suite", got)
+	}
+
+	out = densify("partition")
+	if got, want := fieldValues(out, "run"), []interface{}{nil, int32(1), int32(2), int32(3), int32(4), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("partition runs = %v, want %v", got, want)
+	}
+
+	// Explicit bounds exclude the upper bound and keep documents outside.
+	out = densify(bson.A{int32(0), int32(3)})
+	if got, want := fieldValues(out, "run"), []interface{}{nil, int32(0), int32(1), int32(2), int32(4), int32(0), int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("explicit runs = %v, want %v", got, want)
+	}
+}
+
+func TestDensify_Dates(t *testing.T) {
+	month := func(m time.Month) bson.DateTime {
+		return bson.NewDateTimeFromTime(time.Date(2025, m, 31, 0, 0, 0, 0, time.UTC))
+	}
+	docs := []bson.D{
+		{{Key: "at", Value: month(time.March)}},
+		{{Key: "at", Value: month(time.January)}},
+	}
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$densify", Value: bson.D{
+		{Key: "field", Value: "at"},
+		{Key: "range", Value: bson.D{{Key: "step", Value: int32(1)}, {Key: "unit", Value: "month"}, {Key: "bounds", Value: "full"}}},
+	}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Months are added to the lower bound and clamp to the end of the month,
+	// so the sequence is January 31st, February 28th, March 31st.
+	feb := bson.NewDateTimeFromTime(time.Date(2025, time.February, 28, 0, 0, 0, 0, time.UTC))
+	if got, want := fieldValues(out, "at"), []interface{}{month(time.January), feb, month(time.March)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("at = %v, want %v", got, want)
+	}
+}
+
+func TestDensify_Errors(t *testing.T) {
+	docs := []bson.D{{{Key: "n", Value: int32(1)}}, {{Key: "n", Value: "x"}}}
+	rng := func(fields ...bson.E) bson.E { return bson.E{Key: "range", Value: bson.D(fields)} }
+	step := bson.E{Key: "step", Value: int32(1)}
+	full := bson.E{Key: "bounds", Value: "full"}
+	for name, spec := range map[string]bson.D{
+		"no field":         {rng(step, full)},
+		"no range":         {{Key: "field", Value: "n"}},
+		"zero step":        {{Key: "field", Value: "n"}, rng(bson.E{Key: "step", Value: int32(0)}, full)},
+		"bad bounds":       {{Key: "field", Value: "n"}, rng(step, bson.E{Key: "bounds", Value: "all"})},
+		"inverted bounds":  {{Key: "field", Value: "n"}, rng(step, bson.E{Key: "bounds", Value: bson.A{int32(5), int32(1)}})},
+		"unit on numbers":  {{Key: "field", Value: "n"}, rng(step, bson.E{Key: "unit", Value: "day"}, bson.E{Key: "bounds", Value: bson.A{int32(1), int32(5)}})},
+		"partition field":  {{Key: "field", Value: "n"}, {Key: "partitionByFields", Value: bson.A{"n"}}, rng(step, full)},
+		"string values":    {{Key: "field", Value: "n"}, rng(step, full)},
+		"too many results": {{Key: "field", Value: "n"}, rng(bson.E{Key: "step", Value: 1e-9}, bson.E{Key: "bounds", Value: bson.A{int32(0), int32(1)}})},
+	} {
+		input := docs
+		if name != "string values" {
+			input = docs[:1]
+		}
+		if _, err := RunPipeline(input, []bson.D{{{Key: "$densify", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// ---- $fill ----
+
+func TestFill(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "test", Value: "login"}, {Key: "run", Value: int32(4)}, {Key: "ms", Value: int32(40)}, {Key: "status", Value: "pass"}},
+		{{Key: "test", Value: "login"}, {Key: "run", Value: int32(1)}, {Key: "ms", Value: int32(10)}, {Key: "status", Value: "fail"}},
+		{{Key: "test", Value: "login"}, {Key: "run", Value: int32(2)}, {Key: "ms", Value: nil}},
+		{{Key: "test", Value: "login"}, {Key: "run", Value: int32(3)}},
+		{{Key: "test", Value: "search"}, {Key: "run", Value: int32(1)}},
+		{{Key: "test", Value: "search"}, {Key: "run", Value: int32(2)}, {Key: "ms", Value: int32(7)}},
+	}
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$fill", Value: bson.D{
+		{Key: "partitionByFields", Value: bson.A{"test"}},
+		{Key: "sortBy", Value: bson.D{{Key: "run", Value: int32(1)}}},
+		{Key: "output", Value: bson.D{
+			{Key: "ms", Value: bson.D{{Key: "method", Value: "linear"}}},
+			{Key: "status", Value: bson.D{{Key: "method", Value: "locf"}}},
+			{Key: "note", Value: bson.D{{Key: "value", Value: bson.D{{Key: "$concat", Value: bson.A{"$test", " not noted"}}}}}},
+		}},
+	}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fieldValues(out, "run"), []interface{}{int32(1), int32(2), int32(3), int32(4), int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("run = %v, want %v", got, want)
+	}
+	// A gap at the start of a partition has nothing to interpolate from.
+	if got, want := fieldValues(out, "ms"), []interface{}{int32(10), 20.0, 30.0, int32(40), nil, int32(7)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ms = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "status"), []interface{}{"fail", "fail", "fail", "pass", nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "note")[4], "search not noted"; got != want {
+		t.Errorf("note = %v, want %q", got, want)
+	}
+	if _, ok := GetField(docs[2], "note"); ok {
+		t.Error("$fill modified its input documents")
+	}
+}
+
+func TestFill_Errors(t *testing.T) {
+	docs := []bson.D{{{Key: "n", Value: int32(1)}}}
+	sortByN := bson.E{Key: "sortBy", Value: bson.D{{Key: "n", Value: int32(1)}}}
+	output := func(spec bson.D) bson.E { return bson.E{Key: "output", Value: bson.D{{Key: "x", Value: spec}}} }
+	for name, spec := range map[string]bson.D{
+		"no output":           {sortByN},
+		"locf without sort":   {output(bson.D{{Key: "method", Value: "locf"}})},
+		"linear on two keys":  {{Key: "sortBy", Value: bson.D{{Key: "n", Value: int32(1)}, {Key: "m", Value: int32(1)}}}, output(bson.D{{Key: "method", Value: "linear"}})},
+		"unknown method":      {sortByN, output(bson.D{{Key: "method", Value: "mean"}})},
+		"value and method":    {sortByN, output(bson.D{{Key: "value", Value: int32(0)}, {Key: "method", Value: "locf"}})},
+		"both partition args": {{Key: "partitionBy", Value: "$n"}, {Key: "partitionByFields", Value: bson.A{"n"}}, output(bson.D{{Key: "value", Value: int32(0)}})},
+	} {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$fill", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
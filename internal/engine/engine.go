@@ -3,7 +3,9 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -11,8 +13,11 @@ import (
 // SetSchema upserts a schema (and optional description) for a db+collection pair.
 // coll may be empty to set a db-level description without a collection schema.
 func (e *Engine) SetSchema(db, coll string, schema json.RawMessage, description string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	c := e.data.GetOrCreateDB(schemaInternalDB).GetOrCreateColl(schemaInternalColl)
 
@@ -36,7 +41,8 @@ func (e *Engine) SetSchema(db, coll string, schema json.RawMessage, description
 			if description != "" {
 				newDoc = append(newDoc, bson.E{Key: "description", Value: description})
 			}
-			c.Documents[i] = newDoc
+			c.replaceDoc(i, newDoc)
+			e.recordUpdate(schemaInternalDB, schemaInternalColl, doc, newDoc, true)
 			return e.save()
 		}
 	}
@@ -54,13 +60,17 @@ func (e *Engine) SetSchema(db, coll string, schema json.RawMessage, description
 		newDoc = append(newDoc, bson.E{Key: "description", Value: description})
 	}
 	newDoc = ensureID(newDoc)
-	c.Documents = append(c.Documents, newDoc)
+	c.insertDoc(newDoc)
+	e.recordPut(schemaInternalDB, schemaInternalColl, newDoc)
 	return e.save()
 }
 
 // GetSchema returns the schema JSON and description for a db+collection pair.
 // coll may be empty for db-level entries. Returns nil schema if not found.
 func (e *Engine) GetSchema(db, coll string) (json.RawMessage, string, error) {
+	if err := e.refresh(); err != nil {
+		return nil, "", err
+	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 	return e.getSchemaAndDescLocked(db, coll)
@@ -68,8 +78,11 @@ func (e *Engine) GetSchema(db, coll string) (json.RawMessage, string, error) {
 
 // DeleteSchema removes the schema entry for a db+collection pair.
 func (e *Engine) DeleteSchema(db, coll string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	schDB := e.data.Databases[schemaInternalDB]
 	if schDB == nil {
@@ -80,21 +93,19 @@ func (e *Engine) DeleteSchema(db, coll string) error {
 		return nil
 	}
 
-	var kept []bson.D
-	deleted := false
-	for _, doc := range schColl.Documents {
+	var deleted []int
+	for i, doc := range schColl.Documents {
 		dbVal, _ := GetField(doc, "db")
 		collVal, _ := GetField(doc, "collection")
 		dbStr, _ := dbVal.(string)
 		collStr, _ := collVal.(string)
 		if dbStr == db && collStr == coll {
-			deleted = true
-			continue
+			deleted = append(deleted, i)
+			e.recordDelete(schemaInternalDB, schemaInternalColl, doc)
 		}
-		kept = append(kept, doc)
 	}
-	if deleted {
-		schColl.Documents = kept
+	if len(deleted) > 0 {
+		schColl.removeDocs(deleted)
 		return e.save()
 	}
 	return nil
@@ -102,6 +113,7 @@ func (e *Engine) DeleteSchema(db, coll string) error {
 
 // ListSchemas returns all schema documents.
 func (e *Engine) ListSchemas() []bson.D {
+	_ = e.refresh() // on error keep serving the last loaded state
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -120,15 +132,15 @@ func (e *Engine) ListSchemas() []bson.D {
 
 // getSchemaLocked returns the schema JSON for a db+collection pair.
 // Must be called while the engine lock is held.
-func (e *Engine) getSchemaLocked(db, coll string) (json.RawMessage, error) {
-	schema, _, err := e.getSchemaAndDescLocked(db, coll)
+func (s *state) getSchemaLocked(db, coll string) (json.RawMessage, error) {
+	schema, _, err := s.getSchemaAndDescLocked(db, coll)
 	return schema, err
 }
 
 // getSchemaAndDescLocked returns schema JSON and description for a db+collection pair.
 // Must be called while the engine lock is held.
-func (e *Engine) getSchemaAndDescLocked(db, coll string) (json.RawMessage, string, error) {
-	schDB := e.data.Databases[schemaInternalDB]
+func (s *state) getSchemaAndDescLocked(db, coll string) (json.RawMessage, string, error) {
+	schDB := s.data.Databases[schemaInternalDB]
 	if schDB == nil {
 		return nil, "", nil
 	}
@@ -165,29 +177,262 @@ func (e *Engine) getSchemaAndDescLocked(db, coll string) (json.RawMessage, strin
 }
 
 type Engine struct {
-	mu       sync.RWMutex
-	data     *Store
+	mu sync.RWMutex
+	state
 	filePath string
+	lockPath string
+	stamp    storeStamp // on-disk state last loaded or saved by this engine
+	stale    bool       // memory holds changes of a failed write; reload
+
+	journal          bool // append writes to the journal file
+	compactThreshold int
+	changes          changeLog
+	journalRecords   int // records in the journal file
+}
+
+// state is a store together with the journal records describing the changes
+// made to it since the last save. Reads and writes are implemented on state
+// so that the engine and its transactions share them.
+type state struct {
+	data    *Store
+	pending []journalEntry // records for the next save
+
+	// onRead, when set, is called with every collection looked up, so a
+	// transaction can tell which collections its operations read.
+	onRead func(db, coll string)
+}
+
+// collection returns the named collection, or nil if it does not exist.
+func (s *state) collection(db, coll string) *Collection {
+	if s.onRead != nil {
+		s.onRead(db, coll)
+	}
+	d := s.data.Databases[db]
+	if d == nil {
+		return nil
+	}
+	return d.Collections[coll]
+}
+
+// Options configures an Engine.
+type Options struct {
+	// Journal makes writes append ndjson records to <file>.journal instead of
+	// rewriting the whole data file. The journal is replayed on load and
+	// folded back into the data file once it grows past CompactThreshold.
+	Journal bool
+	// CompactThreshold is the number of journal records that triggers a
+	// compaction. Zero means DefaultCompactThreshold.
+	CompactThreshold int
 }
 
 func New(filePath string) (*Engine, error) {
-	store, err := LoadStore(filePath)
+	return NewWithOptions(filePath, Options{})
+}
+
+// NewWithOptions opens the data file at filePath with the given options.
+func NewWithOptions(filePath string, opts Options) (*Engine, error) {
+	e := &Engine{
+		filePath:         filePath,
+		lockPath:         filePath + ".lock",
+		journal:          opts.Journal,
+		compactThreshold: opts.CompactThreshold,
+	}
+	if e.compactThreshold <= 0 {
+		e.compactThreshold = DefaultCompactThreshold
+	}
+	f, err := lockFile(e.lockPath, false)
 	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(f)
+	if err := e.load(); err != nil {
 		return nil, fmt.Errorf("load store: %w", err)
 	}
-	return &Engine{data: store, filePath: filePath}, nil
+	return e, nil
+}
+
+// load reads the data file and its journal into memory, discarding any
+// unsaved journal records. Callers must hold the file lock.
+func (e *Engine) load() error {
+	stamp, err := statStore(e.filePath)
+	if err != nil {
+		return err
+	}
+	store, n, err := loadStore(e.filePath)
+	if err != nil {
+		return err
+	}
+	buildStoreIndexes(store)
+	if e.data != nil {
+		carryVersions(e.data, store)
+	}
+	e.data = store
+	e.stamp = stamp
+	e.journalRecords = n
+	e.pending = nil
+	e.stale = false
+	return nil
 }
 
+// save persists the pending changes and publishes them to change streams.
 func (e *Engine) save() error {
-	return SaveStore(e.filePath, e.data)
+	pending := e.pending
+	if err := e.persist(); err != nil {
+		return err
+	}
+	e.changes.publish(changeEvents(pending, time.Now()))
+	return nil
 }
 
-// Insert adds documents to a collection. Returns the generated _id values.
-func (e *Engine) Insert(db, coll string, docs []bson.D) ([]interface{}, error) {
+// persist writes the pending changes. A journaling engine appends them to the
+// journal until it reaches the compaction threshold; otherwise the whole
+// store is rewritten and any journal is folded in.
+func (e *Engine) persist() error {
+	if e.journal && e.journalRecords+len(e.pending) < e.compactThreshold {
+		if err := appendJournal(journalPath(e.filePath), e.data.Generation, e.pending); err != nil {
+			return err
+		}
+		e.journalRecords += len(e.pending)
+		e.pending = nil
+		return e.updateStamp()
+	}
+	return e.writeStore()
+}
+
+// writeStore rewrites the data file from memory and removes the journal.
+// The rewrite starts a new generation, so a journal a crash leaves behind is
+// not replayed over it.
+func (e *Engine) writeStore() error {
+	if err := SaveStore(e.filePath, e.data); err != nil {
+		return err
+	}
+	if err := removeJournal(journalPath(e.filePath)); err != nil {
+		return err
+	}
+	e.journalRecords = 0
+	e.pending = nil
+	return e.updateStamp()
+}
+
+func (e *Engine) updateStamp() error {
+	stamp, err := statStore(e.filePath)
+	if err != nil {
+		return err
+	}
+	e.stamp = stamp
+	return nil
+}
+
+// lockWrite acquires the engine write lock and an exclusive lock on the
+// sidecar lock file, then reloads the store if another process has written
+// to the data file since this engine last saw it. The returned function
+// releases both locks, first discarding the changes of a write that failed
+// before saving them.
+func (e *Engine) lockWrite() (func(), error) {
+	e.mu.Lock()
+	f, err := lockFile(e.lockPath, true)
+	if err != nil {
+		e.mu.Unlock()
+		return nil, err
+	}
+	unlock := func() {
+		if len(e.pending) > 0 {
+			e.discard()
+		}
+		unlockFile(f)
+		e.mu.Unlock()
+	}
+	if err := e.reloadIfChanged(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// discard drops unsaved changes, such as the documents a multi-document
+// insert added before one of them failed, by reloading the store. The file
+// lock is still held, so the store on disk is the one the write started
+// from. If the reload fails, the next read or write retries it.
+func (e *Engine) discard() {
+	if err := e.load(); err != nil {
+		e.pending = nil
+		e.stale = true
+	}
+}
+
+// refresh reloads the store if another process has written to the data file.
+// Read paths call it before taking the engine read lock.
+func (e *Engine) refresh() error {
+	stamp, err := statStore(e.filePath)
+	if err != nil {
+		return err
+	}
+	e.mu.RLock()
+	same := stamp.equal(e.stamp) && !e.stale
+	e.mu.RUnlock()
+	if same {
+		return nil
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	f, err := lockFile(e.lockPath, false)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	return e.reloadIfChanged()
+}
 
-	c := e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+// reloadIfChanged re-reads the data file when its stamp differs from the one
+// this engine last loaded or saved, or when a failed write could not be
+// discarded. Callers must hold e.mu and the file lock.
+func (e *Engine) reloadIfChanged() error {
+	stamp, err := statStore(e.filePath)
+	if err != nil {
+		return err
+	}
+	if stamp.equal(e.stamp) && !e.stale {
+		return nil
+	}
+	prev, stale := e.data, e.stale
+	if err := e.load(); err != nil {
+		return fmt.Errorf("reload store: %w", err)
+	}
+	// Another process wrote the file; its changes can only be recovered by
+	// comparing the two versions, so only do so for open change streams.
+	// Memory left stale by a failed write is not a version to compare with.
+	if !stale && e.changes.watched() {
+		e.changes.publish(diffStores(prev, e.data, time.Now()))
+	}
+	return nil
+}
+
+// Insert adds documents to a collection. Returns the generated _id values.
+func (e *Engine) Insert(db, coll string, docs []bson.D) ([]interface{}, error) {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := e.writable(db, coll); err != nil {
+		return nil, err
+	}
+	ids, err := e.insert(db, coll, docs)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.save(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *state) insert(db, coll string, docs []bson.D) ([]interface{}, error) {
+	// The collection is created with its first document, so an insert that
+	// fails does not leave an empty one behind.
+	c := s.collection(db, coll)
 	var ids []interface{}
 
 	for _, doc := range docs {
@@ -195,12 +440,14 @@ func (e *Engine) Insert(db, coll string, docs []bson.D) ([]interface{}, error) {
 		id, _ := GetField(doc, "_id")
 		ids = append(ids, id)
 
-		if err := CheckUniqueIndex(c.Documents, c.Indexes, doc); err != nil {
-			return nil, err
+		if c != nil {
+			if err := c.checkUnique(db+"."+coll, doc, ""); err != nil {
+				return nil, err
+			}
 		}
 
 		if db != schemaInternalDB {
-			schema, err := e.getSchemaLocked(db, coll)
+			schema, err := s.getSchemaLocked(db, coll)
 			if err != nil {
 				return nil, err
 			}
@@ -211,33 +458,43 @@ func (e *Engine) Insert(db, coll string, docs []bson.D) ([]interface{}, error) {
 			}
 		}
 
-		c.Documents = append(c.Documents, doc)
+		if c == nil {
+			c = s.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+		}
+		s.insertDoc(db, coll, c, doc)
 	}
+	return ids, nil
+}
 
-	if err := e.save(); err != nil {
-		return nil, err
+// insertDoc adds doc to c and records it, then removes the oldest documents
+// of a capped collection that no longer fit.
+func (s *state) insertDoc(db, coll string, c *Collection, doc bson.D) {
+	c.insertDoc(doc)
+	s.recordPut(db, coll, doc)
+	for _, old := range c.evictCapped() {
+		s.recordDelete(db, coll, old)
 	}
-	return ids, nil
 }
 
-// Find queries documents in a collection.
-func (e *Engine) Find(db, coll string, filter bson.D, sort bson.D, skip, limit int64) ([]bson.D, error) {
+// Find queries documents in a collection. A non-nil collation compares
+// strings in the filter and the sort under that collation.
+func (e *Engine) Find(db, coll string, filter bson.D, sort bson.D, skip, limit int64, collation *Collation) ([]bson.D, error) {
+	if err := e.refresh(); err != nil {
+		return nil, err
+	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	return e.find(db, coll, filter, sort, skip, limit, collation)
+}
 
-	d := e.data.Databases[db]
-	if d == nil {
-		return nil, nil
-	}
-	c := d.Collections[coll]
-	if c == nil {
-		return nil, nil
+func (s *state) find(db, coll string, filter bson.D, sort bson.D, skip, limit int64, collation *Collation) ([]bson.D, error) {
+	results, err := s.matching(db, coll, filter, collation)
+	if err != nil {
+		return nil, err
 	}
 
-	results := FilterDocs(c.Documents, filter)
-
 	if len(sort) > 0 {
-		SortDocs(results, sort)
+		sortDocs(results, sort, collation)
 	}
 
 	if skip > 0 {
@@ -255,24 +512,56 @@ func (e *Engine) Find(db, coll string, filter bson.D, sort bson.D, skip, limit i
 }
 
 // Update modifies documents. Returns (matchedCount, modifiedCount, upsertedID, error).
-func (e *Engine) Update(db, coll string, filter, update bson.D, multi, upsert bool) (int64, int64, interface{}, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// update is an update document (bson.D) or a pipeline-style update: a list
+// of $set, $unset, $addFields, $project, $replaceRoot and $replaceWith
+// stages given as []bson.D or bson.A. The filter, the positional operator
+// and arrayFilters compare strings under collation if it is non-nil.
+func (e *Engine) Update(db, coll string, filter bson.D, update interface{}, arrayFilters []bson.D, multi, upsert bool, collation *Collation) (int64, int64, interface{}, error) {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer unlock()
 
-	c := e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+	if err := e.writable(db, coll); err != nil {
+		return 0, 0, nil, err
+	}
+	matched, modified, upsertedID, err := e.update(db, coll, filter, update, arrayFilters, multi, upsert, collation)
+	if err != nil {
+		return matched, modified, upsertedID, err
+	}
+	if matched > 0 || upsertedID != nil {
+		if err := e.save(); err != nil {
+			return matched, modified, upsertedID, err
+		}
+	}
+	return matched, modified, upsertedID, nil
+}
+
+func (s *state) update(db, coll string, filter bson.D, update interface{}, arrayFilters []bson.D, multi, upsert bool, collation *Collation) (int64, int64, interface{}, error) {
+	if err := checkRegexes(filter); err != nil {
+		return 0, 0, nil, err
+	}
+	u, ops, err := newUpdateContext(filter, update, arrayFilters, collation)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	c := s.data.GetOrCreateDB(db).GetOrCreateColl(coll)
 	var matched, modified int64
 
-	for i, doc := range c.Documents {
-		if !MatchDoc(doc, filter) {
+	positions, _ := c.candidates(filter, collation)
+	for _, i := range positions {
+		doc := c.Documents[i]
+		if !matchDoc(doc, filter, collation) {
 			continue
 		}
 		matched++
-		updated, err := ApplyUpdate(doc, update)
+		updated, err := applyUpdate(doc, ops, u)
 		if err != nil {
 			return matched, modified, nil, err
 		}
 		if db != schemaInternalDB {
-			schema, err := e.getSchemaLocked(db, coll)
+			schema, err := s.getSchemaLocked(db, coll)
 			if err != nil {
 				return matched, modified, nil, err
 			}
@@ -282,7 +571,11 @@ func (e *Engine) Update(db, coll string, filter, update bson.D, multi, upsert bo
 				}
 			}
 		}
-		c.Documents[i] = updated
+		if err := c.checkUnique(db+"."+coll, updated, docIDKey(doc)); err != nil {
+			return matched, modified, nil, err
+		}
+		c.replaceDoc(i, updated)
+		s.recordUpdate(db, coll, doc, updated, isReplacement(ops))
 		modified++
 		if !multi {
 			break
@@ -292,21 +585,14 @@ func (e *Engine) Update(db, coll string, filter, update bson.D, multi, upsert bo
 	// Upsert: insert if nothing matched
 	var upsertedID interface{}
 	if matched == 0 && upsert {
-		newDoc := bson.D{}
-		// Apply filter fields as initial values
-		for _, f := range filter {
-			if f.Key[0] != '$' {
-				newDoc = SetField(newDoc, f.Key, f.Value)
-			}
-		}
-		var err error
-		newDoc, err = ApplyUpdate(newDoc, update)
+		u.insert = true
+		newDoc, err := applyUpdate(upsertSeed(filter), ops, u)
 		if err != nil {
 			return 0, 0, nil, err
 		}
 		newDoc = ensureID(newDoc)
 		if db != schemaInternalDB {
-			schema, err := e.getSchemaLocked(db, coll)
+			schema, err := s.getSchemaLocked(db, coll)
 			if err != nil {
 				return 0, 0, nil, err
 			}
@@ -316,66 +602,85 @@ func (e *Engine) Update(db, coll string, filter, update bson.D, multi, upsert bo
 				}
 			}
 		}
+		if err := c.checkUnique(db+"."+coll, newDoc, ""); err != nil {
+			return 0, 0, nil, err
+		}
 		upsertedID, _ = GetField(newDoc, "_id")
-		c.Documents = append(c.Documents, newDoc)
+		s.insertDoc(db, coll, c, newDoc)
 	}
 
-	if matched > 0 || upsertedID != nil {
-		if err := e.save(); err != nil {
-			return matched, modified, upsertedID, err
-		}
-	}
 	return matched, modified, upsertedID, nil
 }
 
 // Delete removes documents. Returns the number deleted.
-func (e *Engine) Delete(db, coll string, filter bson.D, multi bool) (int64, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+func (e *Engine) Delete(db, coll string, filter bson.D, multi bool, collation *Collation) (int64, error) {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
 
-	d := e.data.Databases[db]
-	if d == nil {
-		return 0, nil
+	if err := e.writable(db, coll); err != nil {
+		return 0, err
 	}
-	c := d.Collections[coll]
+	n, err := e.remove(db, coll, filter, multi, collation)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if err := e.save(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *state) remove(db, coll string, filter bson.D, multi bool, collation *Collation) (int64, error) {
+	if err := checkRegexes(filter); err != nil {
+		return 0, err
+	}
+	c := s.collection(db, coll)
 	if c == nil {
 		return 0, nil
 	}
 
-	var kept []bson.D
-	var deleted int64
-	for i, doc := range c.Documents {
-		if MatchDoc(doc, filter) {
-			deleted++
-			if !multi {
-				// Keep remaining docs after this one
-				kept = append(kept, c.Documents[i+1:]...)
-				break
-			}
-		} else {
-			kept = append(kept, doc)
+	var deleted []int
+	positions, _ := c.candidates(filter, collation)
+	for _, i := range positions {
+		doc := c.Documents[i]
+		if !matchDoc(doc, filter, collation) {
+			continue
 		}
-	}
-
-	if deleted > 0 {
-		c.Documents = kept
-		if err := e.save(); err != nil {
-			return deleted, err
+		deleted = append(deleted, i)
+		s.recordDelete(db, coll, doc)
+		if !multi {
+			break
 		}
 	}
-	return deleted, nil
+
+	c.removeDocs(deleted)
+	return int64(len(deleted)), nil
 }
 
 // Count returns the number of matching documents.
-func (e *Engine) Count(db, coll string, filter bson.D) (int64, error) {
+func (e *Engine) Count(db, coll string, filter bson.D, collation *Collation) (int64, error) {
+	if err := e.refresh(); err != nil {
+		return 0, err
+	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	return e.count(db, coll, filter, collation)
+}
 
-	d := e.data.Databases[db]
-	if d == nil {
-		return 0, nil
+func (s *state) count(db, coll string, filter bson.D, collation *Collation) (int64, error) {
+	if err := checkRegexes(filter); err != nil {
+		return 0, err
 	}
-	c := d.Collections[coll]
+	if s.view(db, coll) != nil {
+		docs, err := s.matching(db, coll, filter, collation)
+		return int64(len(docs)), err
+	}
+	c := s.collection(db, coll)
 	if c == nil {
 		return 0, nil
 	}
@@ -384,117 +689,151 @@ func (e *Engine) Count(db, coll string, filter bson.D) (int64, error) {
 		return int64(len(c.Documents)), nil
 	}
 	var count int64
-	for _, doc := range c.Documents {
-		if MatchDoc(doc, filter) {
+	positions, _ := c.candidates(filter, collation)
+	for _, i := range positions {
+		if matchDoc(c.Documents[i], filter, collation) {
 			count++
 		}
 	}
 	return count, nil
 }
 
-// FindAndModify finds a single document and modifies or removes it.
-func (e *Engine) FindAndModify(db, coll string, filter bson.D, sort bson.D, update bson.D, remove bool, returnNew bool, upsert bool) (bson.D, error) {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// FindAndModify finds a single document and modifies or removes it. update
+// takes the same forms as in Update.
+func (e *Engine) FindAndModify(db, coll string, filter bson.D, sort bson.D, update interface{}, arrayFilters []bson.D, remove bool, returnNew bool, upsert bool, collation *Collation) (bson.D, error) {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	c := e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+	if err := e.writable(db, coll); err != nil {
+		return nil, err
+	}
+	doc, err := e.findAndModify(db, coll, filter, sort, update, arrayFilters, remove, returnNew, upsert, collation)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	if err := e.save(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// findAndModify returns nil without changing anything when no document
+// matches and no upsert happens.
+func (s *state) findAndModify(db, coll string, filter bson.D, sort bson.D, update interface{}, arrayFilters []bson.D, remove bool, returnNew bool, upsert bool, collation *Collation) (bson.D, error) {
+	if err := checkRegexes(filter); err != nil {
+		return nil, err
+	}
+	var u *updateContext
+	var ops bson.D
+	if !remove {
+		var err error
+		if u, ops, err = newUpdateContext(filter, update, arrayFilters, collation); err != nil {
+			return nil, err
+		}
+	}
+	c := s.data.GetOrCreateDB(db).GetOrCreateColl(coll)
 
 	// Find matching documents
-	matches := FilterDocs(c.Documents, filter)
+	matches := c.find(filter, collation)
 	if len(sort) > 0 {
-		SortDocs(matches, sort)
+		sortDocs(matches, sort, collation)
 	}
 
 	if len(matches) == 0 {
 		if !upsert || remove {
 			return nil, nil
 		}
-		// Upsert
-		newDoc := bson.D{}
-		for _, f := range filter {
-			if f.Key[0] != '$' {
-				newDoc = SetField(newDoc, f.Key, f.Value)
-			}
-		}
-		var err error
-		newDoc, err = ApplyUpdate(newDoc, update)
+		u.insert = true
+		newDoc, err := applyUpdate(upsertSeed(filter), ops, u)
 		if err != nil {
 			return nil, err
 		}
 		newDoc = ensureID(newDoc)
-		c.Documents = append(c.Documents, newDoc)
-		if err := e.save(); err != nil {
+		if err := c.checkUnique(db+"."+coll, newDoc, ""); err != nil {
 			return nil, err
 		}
+		s.insertDoc(db, coll, c, newDoc)
 		return newDoc, nil
 	}
 
-	target := matches[0]
-	// Find the actual index in the collection
-	for i, doc := range c.Documents {
-		targetID, _ := GetField(target, "_id")
-		docID, _ := GetField(doc, "_id")
-		if valuesEqual(targetID, docID) {
-			if remove {
-				preDoc := c.Documents[i]
-				c.Documents = append(c.Documents[:i], c.Documents[i+1:]...)
-				if err := e.save(); err != nil {
-					return nil, err
-				}
-				return preDoc, nil
-			}
-			preDoc, err := CopyDoc(c.Documents[i])
-			if err != nil {
-				return nil, err
-			}
-			updated, err := ApplyUpdate(c.Documents[i], update)
-			if err != nil {
-				return nil, err
-			}
-			c.Documents[i] = updated
-			if err := e.save(); err != nil {
-				return nil, err
-			}
-			if returnNew {
-				return updated, nil
-			}
-			return preDoc, nil
-		}
+	// Find the target's position in the collection
+	i, ok := c.indexState().pos[docIDKey(matches[0])]
+	if !ok {
+		return nil, nil
+	}
+	if remove {
+		preDoc := c.Documents[i]
+		c.removeDocs([]int{i})
+		s.recordDelete(db, coll, preDoc)
+		return preDoc, nil
 	}
-	return nil, nil
+	preDoc, err := CopyDoc(c.Documents[i])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := applyUpdate(c.Documents[i], ops, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkUnique(db+"."+coll, updated, docIDKey(preDoc)); err != nil {
+		return nil, err
+	}
+	c.replaceDoc(i, updated)
+	s.recordUpdate(db, coll, preDoc, updated, isReplacement(ops))
+	if returnNew {
+		return updated, nil
+	}
+	return preDoc, nil
 }
 
-// Aggregate runs an aggregation pipeline.
-func (e *Engine) Aggregate(db, coll string, pipeline []bson.D) ([]bson.D, error) {
+// Aggregate runs an aggregation pipeline. A pipeline that ends in $out or
+// $merge writes its results to that stage's target collection under the
+// write lock and returns no documents. A non-nil collation applies to
+// every stage that compares strings, such as $match, $sort and $group.
+func (e *Engine) Aggregate(db, coll string, pipeline []bson.D, collation *Collation) ([]bson.D, error) {
+	if _, ok := writeStage(pipeline); ok {
+		return nil, e.aggregateInto(db, coll, pipeline, collation)
+	}
+	if err := e.refresh(); err != nil {
+		return nil, err
+	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	return e.aggregate(db, coll, pipeline, collation)
+}
 
-	d := e.data.Databases[db]
-	if d == nil {
-		return nil, nil
+func (s *state) aggregate(db, coll string, pipeline []bson.D, collation *Collation) ([]bson.D, error) {
+	// A view runs its pipeline first, on the collection it resolves to.
+	coll, viewPipeline, err := s.resolveView(db, coll)
+	if err != nil {
+		return nil, err
 	}
-	c := d.Collections[coll]
+	pipeline = append(viewPipeline, pipeline...)
+	c := s.collection(db, coll)
 	if c == nil {
 		return nil, nil
 	}
 
-	// Copy docs to avoid mutations
-	docs := make([]bson.D, len(c.Documents))
-	copy(docs, c.Documents)
-
-	lookupFn := func(_, lookupColl string, filter bson.D) ([]bson.D, error) {
-		lc := d.Collections[lookupColl]
-		if lc == nil {
-			return nil, nil
-		}
-		return FilterDocs(lc.Documents, filter), nil
+	// Copy docs to avoid mutations. A leading $match narrows the input
+	// through the indexes; the stage itself still runs in the pipeline.
+	var docs []bson.D
+	if len(pipeline) > 0 && len(pipeline[0]) == 1 && pipeline[0][0].Key == "$match" {
+		filter, _ := pipeline[0][0].Value.(bson.D)
+		docs = c.find(filter, collation)
+	} else {
+		docs = make([]bson.D, len(c.Documents))
+		copy(docs, c.Documents)
 	}
 
-	return RunPipeline(docs, pipeline, lookupFn)
+	return runPipeline(docs, pipeline, s.lookupFunc(db, collation), collation)
 }
 
 // ListDatabases returns all database names, excluding internal namespaces.
 func (e *Engine) ListDatabases() []string {
+	_ = e.refresh() // on error keep serving the last loaded state
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -510,15 +849,28 @@ func (e *Engine) ListDatabases() []string {
 
 // DropDatabase removes a database.
 func (e *Engine) DropDatabase(db string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	d := e.data.Databases[db]
+	if d == nil {
+		return nil
+	}
+	// Record each collection's drop too, for change streams on them.
+	for _, coll := range sortedKeys(d.Collections) {
+		e.record(journalEntry{Op: journalDropColl, DB: db, Coll: coll})
+	}
 	delete(e.data.Databases, db)
+	e.record(journalEntry{Op: journalDropDatabase, DB: db})
 	return e.save()
 }
 
 // ListCollections returns collection names for a database.
 func (e *Engine) ListCollections(db string) []string {
+	_ = e.refresh() // on error keep serving the last loaded state
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -535,53 +887,103 @@ func (e *Engine) ListCollections(db string) []string {
 
 // CreateCollection creates an empty collection.
 func (e *Engine) CreateCollection(db, coll string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	if e.view(db, coll) != nil {
+		return namespaceExists(db, coll)
+	}
 	e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+	e.record(journalEntry{Op: journalCreateColl, DB: db, Coll: coll})
 	return e.save()
 }
 
-// DropCollection removes a collection.
+// DropCollection removes a collection or view.
 func (e *Engine) DropCollection(db, coll string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	if e.view(db, coll) != nil {
+		delete(e.data.Databases[db].Views, coll)
+		e.record(journalEntry{Op: journalDropView, DB: db, Coll: coll})
+		return e.save()
+	}
 	d := e.data.Databases[db]
-	if d == nil {
+	if d == nil || d.Collections[coll] == nil {
 		return nil
 	}
 	delete(d.Collections, coll)
+	e.record(journalEntry{Op: journalDropColl, DB: db, Coll: coll})
 	return e.save()
 }
 
 // CreateIndexes adds index specifications to a collection.
 func (e *Engine) CreateIndexes(db, coll string, specs []IndexSpec) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := e.writable(db, coll); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if err := checkIndexSpec(spec); err != nil {
+			return err
+		}
+	}
 
 	c := e.data.GetOrCreateDB(db).GetOrCreateColl(coll)
+	prev := c.Indexes
 	for _, spec := range specs {
 		if spec.Name == "" {
 			spec.Name = DefaultIndexName(spec.Keys)
 		}
-		// Check for duplicate index name
+		collation, _ := ParseCollation(spec.Collation)
+		spec.Collation = collation.Doc()
+		// Creating an existing index again is a no-op, but not with other
+		// keys or options.
 		found := false
 		for _, existing := range c.Indexes {
 			if existing.Name == spec.Name {
+				if !sameIndex(existing, spec) {
+					c.Indexes = prev
+					return commandErrorf(85, "IndexOptionsConflict",
+						"an existing index has the same name as the requested index but different keys or options: %s", spec.Name)
+				}
 				found = true
 				break
 			}
 		}
 		if !found {
-			c.Indexes = append(c.Indexes, spec)
+			c.Indexes = append(c.Indexes[:len(c.Indexes):len(c.Indexes)], spec)
+		}
+	}
+	c.buildIndexes()
+	// A unique index cannot be built over documents that already share a
+	// key; leave the collection as it was. The new indexes follow _id and
+	// the existing ones.
+	for _, idx := range c.ix.indexes[1+len(prev):] {
+		if err := c.checkUniqueIndex(db+"."+coll, idx); err != nil {
+			c.Indexes = prev
+			c.buildIndexes()
+			return err
 		}
 	}
+	e.recordIndexes(db, coll, c.Indexes)
 	return e.save()
 }
 
 // ListIndexes returns indexes for a collection.
 func (e *Engine) ListIndexes(db, coll string) []IndexSpec {
+	_ = e.refresh() // on error keep serving the last loaded state
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
@@ -601,8 +1003,11 @@ func (e *Engine) ListIndexes(db, coll string) []IndexSpec {
 
 // DropIndexes removes an index by name. Use "*" to drop all non-_id indexes.
 func (e *Engine) DropIndexes(db, coll string, name string) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	d := e.data.Databases[db]
 	if d == nil {
@@ -615,49 +1020,100 @@ func (e *Engine) DropIndexes(db, coll string, name string) error {
 
 	if name == "*" {
 		c.Indexes = nil
+		c.buildIndexes()
+		e.recordIndexes(db, coll, c.Indexes)
 		return e.save()
 	}
 
 	for i, idx := range c.Indexes {
 		if idx.Name == name {
 			c.Indexes = append(c.Indexes[:i], c.Indexes[i+1:]...)
+			c.buildIndexes()
+			e.recordIndexes(db, coll, c.Indexes)
 			return e.save()
 		}
 	}
 	return nil
 }
 
-// Distinct returns distinct values for a field across documents matching the filter.
-func (e *Engine) Distinct(db, coll, field string, filter bson.D) ([]interface{}, error) {
+// Distinct returns distinct values for a field across documents matching the
+// filter. Under a non-nil collation, strings it considers equal are one
+// value.
+func (e *Engine) Distinct(db, coll, field string, filter bson.D, collation *Collation) ([]interface{}, error) {
+	if err := e.refresh(); err != nil {
+		return nil, err
+	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	return e.distinct(db, coll, field, filter, collation)
+}
 
-	d := e.data.Databases[db]
-	if d == nil {
-		return nil, nil
-	}
-	c := d.Collections[coll]
-	if c == nil {
-		return nil, nil
+func (s *state) distinct(db, coll, field string, filter bson.D, collation *Collation) ([]interface{}, error) {
+	docs, err := s.matching(db, coll, filter, collation)
+	if err != nil {
+		return nil, err
 	}
-
-	docs := FilterDocs(c.Documents, filter)
 	seen := map[string]bool{}
 	var result []interface{}
-	for _, doc := range docs {
-		v, ok := GetField(doc, field)
-		if !ok {
-			continue
-		}
-		key := fmt.Sprintf("%v", v)
+	add := func(v interface{}) {
+		key := fmt.Sprintf("%v", collation.keyValue(v))
 		if !seen[key] {
 			seen[key] = true
 			result = append(result, v)
 		}
 	}
+	for _, doc := range docs {
+		// Arrays contribute their elements, as in MongoDB.
+		for _, v := range lookupValues(doc, field) {
+			if arr, ok := v.(bson.A); ok {
+				for _, elem := range arr {
+					add(elem)
+				}
+				continue
+			}
+			add(v)
+		}
+	}
 	return result, nil
 }
 
+// upsertSeed returns the document an upsert starts from: the fields the
+// filter fixes by equality, including those under $and. The update is then
+// applied to it.
+func upsertSeed(filter bson.D) bson.D {
+	doc := bson.D{}
+	var add func(f bson.D)
+	add = func(f bson.D) {
+		for _, e := range f {
+			if e.Key == "$and" {
+				subs, _ := e.Value.(bson.A)
+				for _, sub := range subs {
+					if d, ok := sub.(bson.D); ok {
+						add(d)
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(e.Key, "$") {
+				continue
+			}
+			val := e.Value
+			if ops, ok := val.(bson.D); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+				if len(ops) != 1 || ops[0].Key != "$eq" {
+					continue
+				}
+				val = ops[0].Value
+			}
+			if _, ok := val.(bson.Regex); ok {
+				continue
+			}
+			doc = SetField(doc, e.Key, val)
+		}
+	}
+	add(filter)
+	return doc
+}
+
 // ensureID adds an _id field if missing.
 func ensureID(doc bson.D) bson.D {
 	for _, e := range doc {
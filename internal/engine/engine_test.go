@@ -4,6 +4,7 @@ import (
 	"errors"
 	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -96,7 +97,7 @@ func TestInsert_Persistence(t *testing.T) {
 	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}})
 
 	eng2 := reloadEng(t, path)
-	docs, err := eng2.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, err := eng2.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if err != nil || len(docs) != 1 {
 		t.Fatalf("expected 1 doc after reload, got %d err=%v", len(docs), err)
 	}
@@ -119,11 +120,43 @@ func TestInsert_UniqueIndexViolation(t *testing.T) {
 	}
 }
 
+func TestInsert_FailedBatchChangesNothing(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.json")
+		eng, err := NewWithOptions(path, Options{Journal: journal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustInsert(t, eng, "db", "col", bson.D{{Key: "_id", Value: int32(1)}})
+
+		_, err = eng.Insert("db", "col", []bson.D{{{Key: "_id", Value: int32(2)}}, {{Key: "_id", Value: int32(1)}}})
+		if err == nil {
+			t.Fatal("expected a duplicate key error")
+		}
+		if n, _ := eng.Count("db", "col", bson.D{}, nil); n != 1 {
+			t.Errorf("journal=%v: expected 1 doc in the same engine, got %d", journal, n)
+		}
+		_, err = eng.Insert("db", "new", []bson.D{{{Key: "_id", Value: int32(1)}}, {{Key: "_id", Value: int32(1)}}})
+		if err == nil {
+			t.Fatal("expected a duplicate key error")
+		}
+		if names := eng.ListCollections("db"); len(names) != 1 {
+			t.Errorf("journal=%v: failed insert left collections %v", journal, names)
+		}
+
+		// A later write must not persist the failed insert's first document.
+		mustInsert(t, eng, "db", "other", bson.D{{Key: "x", Value: int32(1)}})
+		if n, _ := reloadEng(t, path).Count("db", "col", bson.D{}, nil); n != 1 {
+			t.Errorf("journal=%v: expected 1 doc on disk, got %d", journal, n)
+		}
+	}
+}
+
 // ---- Engine.Find ----
 
 func TestFind_NonexistentDB(t *testing.T) {
 	eng, _ := newEng(t)
-	docs, err := eng.Find("nodb", "col", bson.D{}, nil, 0, 0)
+	docs, err := eng.Find("nodb", "col", bson.D{}, nil, 0, 0, nil)
 	if err != nil || docs != nil {
 		t.Fatalf("expected nil, nil; got %v, %v", docs, err)
 	}
@@ -132,7 +165,7 @@ func TestFind_NonexistentDB(t *testing.T) {
 func TestFind_NonexistentCollection(t *testing.T) {
 	eng, _ := newEng(t)
 	mustInsert(t, eng, "db", "other", bson.D{{Key: "x", Value: 1}})
-	docs, err := eng.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, err := eng.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if err != nil || docs != nil {
 		t.Fatalf("expected nil, nil; got %v, %v", docs, err)
 	}
@@ -144,7 +177,7 @@ func TestFind_All(t *testing.T) {
 		bson.D{{Key: "n", Value: int32(1)}},
 		bson.D{{Key: "n", Value: int32(2)}},
 	)
-	docs, err := eng.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, err := eng.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if err != nil || len(docs) != 2 {
 		t.Fatalf("expected 2, got %d, err=%v", len(docs), err)
 	}
@@ -159,7 +192,7 @@ func TestFind_WithFilter(t *testing.T) {
 	)
 	docs, err := eng.Find("db", "col",
 		bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(24)}}}},
-		nil, 0, 0,
+		nil, 0, 0, nil,
 	)
 	if err != nil || len(docs) != 2 {
 		t.Fatalf("expected 2, got %d, err=%v", len(docs), err)
@@ -173,7 +206,7 @@ func TestFind_SortAscending(t *testing.T) {
 		bson.D{{Key: "n", Value: int32(1)}},
 		bson.D{{Key: "n", Value: int32(2)}},
 	)
-	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "n", Value: int32(1)}}, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "n", Value: int32(1)}}, 0, 0, nil)
 	if len(docs) != 3 {
 		t.Fatalf("expected 3 docs")
 	}
@@ -192,7 +225,7 @@ func TestFind_SortDescending(t *testing.T) {
 		bson.D{{Key: "n", Value: int32(3)}},
 		bson.D{{Key: "n", Value: int32(2)}},
 	)
-	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "n", Value: int32(-1)}}, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "n", Value: int32(-1)}}, 0, 0, nil)
 	n0, _ := GetField(docs[0], "n")
 	if n0 != int32(3) {
 		t.Fatalf("expected desc first=3, got %v", n0)
@@ -205,7 +238,7 @@ func TestFind_SkipLimit(t *testing.T) {
 		mustInsert(t, eng, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
 	}
 	// sort asc by i, skip 1, limit 2 → [1,2]
-	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "i", Value: int32(1)}}, 1, 2)
+	docs, _ := eng.Find("db", "col", bson.D{}, bson.D{{Key: "i", Value: int32(1)}}, 1, 2, nil)
 	if len(docs) != 2 {
 		t.Fatalf("expected 2, got %d", len(docs))
 	}
@@ -218,7 +251,7 @@ func TestFind_SkipLimit(t *testing.T) {
 func TestFind_SkipBeyondEnd(t *testing.T) {
 	eng, _ := newEng(t)
 	mustInsert(t, eng, "db", "col", bson.D{{Key: "x", Value: 1}})
-	docs, err := eng.Find("db", "col", bson.D{}, nil, 100, 0)
+	docs, err := eng.Find("db", "col", bson.D{}, nil, 100, 0, nil)
 	if err != nil || docs != nil {
 		t.Fatalf("expected nil, nil; got %v, %v", docs, err)
 	}
@@ -234,7 +267,7 @@ func TestUpdate_SetSingle(t *testing.T) {
 	matched, modified, _, err := eng.Update("db", "col",
 		bson.D{{Key: "name", Value: "Alice"}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(31)}}}},
-		false, false,
+		nil, false, false, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -242,7 +275,7 @@ func TestUpdate_SetSingle(t *testing.T) {
 	if matched != 1 || modified != 1 {
 		t.Fatalf("expected matched=1 modified=1, got %d/%d", matched, modified)
 	}
-	docs, _ := eng.Find("db", "col", bson.D{{Key: "name", Value: "Alice"}}, nil, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{{Key: "name", Value: "Alice"}}, nil, 0, 0, nil)
 	age, _ := GetField(docs[0], "age")
 	if age != int32(31) {
 		t.Fatalf("expected age=31, got %v", age)
@@ -259,7 +292,7 @@ func TestUpdate_Multi(t *testing.T) {
 	matched, modified, _, err := eng.Update("db", "col",
 		bson.D{{Key: "role", Value: "user"}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: "active", Value: true}}}},
-		true, false,
+		nil, true, false, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -278,7 +311,7 @@ func TestUpdate_SingleStopsAtFirst(t *testing.T) {
 	matched, _, _, _ := eng.Update("db", "col",
 		bson.D{{Key: "x", Value: int32(1)}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: "updated", Value: true}}}},
-		false, false,
+		nil, false, false, nil,
 	)
 	if matched != 1 {
 		t.Fatalf("single update should match exactly 1, got %d", matched)
@@ -290,7 +323,7 @@ func TestUpdate_Upsert(t *testing.T) {
 	matched, modified, upsertedID, err := eng.Update("db", "col",
 		bson.D{{Key: "name", Value: "Bob"}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(25)}}}},
-		false, true,
+		nil, false, true, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -298,19 +331,143 @@ func TestUpdate_Upsert(t *testing.T) {
 	if matched != 0 || modified != 0 || upsertedID == nil {
 		t.Fatalf("expected upsert: matched=%d modified=%d upsertedID=%v", matched, modified, upsertedID)
 	}
-	docs, _ := eng.Find("db", "col", bson.D{{Key: "name", Value: "Bob"}}, nil, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{{Key: "name", Value: "Bob"}}, nil, 0, 0, nil)
 	if len(docs) != 1 {
 		t.Fatal("upserted doc not found")
 	}
 }
 
+func TestUpdate_UpsertSetOnInsert(t *testing.T) {
+	eng, _ := newEng(t)
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "seen", Value: int32(1)}}},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "created_at", Value: "t0"}}},
+	}
+	filter := bson.D{{Key: "name", Value: "Bob"}, {Key: "age", Value: bson.D{{Key: "$gt", Value: int32(20)}}}}
+	if _, _, _, err := eng.Update("db", "col", filter, update, nil, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("db", "col", nil, nil, 0, 0, nil)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 doc, got %d", len(docs))
+	}
+	if v, _ := GetField(docs[0], "created_at"); v != "t0" {
+		t.Fatalf("created_at = %v, want t0", v)
+	}
+	if _, ok := GetField(docs[0], "age"); ok {
+		t.Fatal("a range predicate should not seed the upserted document")
+	}
+
+	// A second upsert matches, so $setOnInsert does not apply.
+	update[1].Value = bson.D{{Key: "created_at", Value: "t1"}}
+	if _, _, _, err := eng.Update("db", "col", bson.D{{Key: "name", Value: "Bob"}}, update, nil, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ = eng.Find("db", "col", nil, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "created_at"); v != "t0" {
+		t.Fatalf("created_at = %v, want t0 after a matching upsert", v)
+	}
+}
+
+func TestUpdate_ImmutableID(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "_id", Value: int32(1)}, {Key: "x", Value: int32(1)}})
+	for _, update := range []bson.D{
+		{{Key: "$set", Value: bson.D{{Key: "_id", Value: int32(2)}}}},
+		{{Key: "$unset", Value: bson.D{{Key: "_id", Value: ""}}}},
+		{{Key: "_id", Value: int32(2)}, {Key: "x", Value: int32(2)}},
+	} {
+		_, _, _, err := eng.Update("db", "col", nil, update, nil, false, false, nil)
+		var ue *CommandError
+		if !errors.As(err, &ue) || ue.Code != 66 {
+			t.Errorf("%v: expected ImmutableField, got %v", update, err)
+		}
+	}
+	// Setting _id to its current value is allowed.
+	if _, _, _, err := eng.Update("db", "col", nil, bson.D{{Key: "$set", Value: bson.D{{Key: "_id", Value: int32(1)}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdate_Pipeline(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "a", Value: int32(2)}, {Key: "b", Value: int32(3)}, {Key: "tmp", Value: "x"}},
+	)
+	pipeline := bson.A{
+		bson.D{{Key: "$set", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$a", "$b"}}}}}}},
+		bson.D{{Key: "$unset", Value: "tmp"}},
+	}
+	if _, modified, _, err := eng.Update("db", "col", nil, pipeline, nil, false, false, nil); err != nil || modified != 1 {
+		t.Fatalf("modified=%d err=%v", modified, err)
+	}
+	docs, _ := eng.Find("db", "col", nil, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "total"); toInt64(v) != 5 {
+		t.Fatalf("total = %v, want 5", v)
+	}
+	if _, ok := GetField(docs[0], "tmp"); ok {
+		t.Fatal("tmp should have been unset")
+	}
+
+	// $replaceWith may drop _id, which is kept, but not change it.
+	if _, _, _, err := eng.Update("db", "col", nil, []bson.D{{{Key: "$replaceWith", Value: bson.D{{Key: "only", Value: "$total"}}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ = eng.Find("db", "col", nil, nil, 0, 0, nil)
+	if id, _ := GetField(docs[0], "_id"); id != int32(1) || len(docs[0]) != 2 {
+		t.Fatalf("expected {_id: 1, only: 5}, got %v", docs[0])
+	}
+	_, _, _, err := eng.Update("db", "col", nil, []bson.D{{{Key: "$set", Value: bson.D{{Key: "_id", Value: int32(9)}}}}}, nil, false, false, nil)
+	var ue *CommandError
+	if !errors.As(err, &ue) || ue.Code != 66 {
+		t.Fatalf("expected ImmutableField, got %v", err)
+	}
+}
+
+func TestUpdate_PipelineInvalid(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "a", Value: int32(1)}})
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "b", Value: int32(1)}}}}
+	tests := []struct {
+		name         string
+		update       interface{}
+		arrayFilters []bson.D
+		code         int32
+	}{
+		{"disallowed stage", bson.A{bson.D{{Key: "$match", Value: bson.D{}}}}, nil, 72},
+		{"non-document stage", bson.A{"$set"}, nil, 14},
+		{"arrayFilters", bson.A{set}, []bson.D{{{Key: "x", Value: 1}}}, 9},
+		{"scalar update", int32(1), nil, 14},
+	}
+	for _, tt := range tests {
+		_, _, _, err := eng.Update("db", "col", nil, tt.update, tt.arrayFilters, false, false, nil)
+		var ue *CommandError
+		if !errors.As(err, &ue) || ue.Code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+}
+
+func TestUpdate_PipelineUpsert(t *testing.T) {
+	eng, _ := newEng(t)
+	pipeline := []bson.D{{{Key: "$set", Value: bson.D{{Key: "label", Value: bson.D{{Key: "$concat", Value: bson.A{"user-", "$name"}}}}}}}}
+	_, _, id, err := eng.Update("db", "col", bson.D{{Key: "name", Value: "ann"}}, pipeline, nil, false, true, nil)
+	if err != nil || id == nil {
+		t.Fatalf("upsertedID=%v err=%v", id, err)
+	}
+	docs, _ := eng.Find("db", "col", nil, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "label"); v != "user-ann" {
+		t.Fatalf("label = %v, want user-ann", v)
+	}
+}
+
 func TestUpdate_NoMatch(t *testing.T) {
 	eng, _ := newEng(t)
 	mustInsert(t, eng, "db", "col", bson.D{{Key: "x", Value: int32(1)}})
 	matched, modified, _, _ := eng.Update("db", "col",
 		bson.D{{Key: "x", Value: int32(99)}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: int32(0)}}}},
-		false, false,
+		nil, false, false, nil,
 	)
 	if matched != 0 || modified != 0 {
 		t.Fatalf("expected 0/0, got %d/%d", matched, modified)
@@ -325,11 +482,11 @@ func TestDelete_Single(t *testing.T) {
 		bson.D{{Key: "n", Value: int32(1)}},
 		bson.D{{Key: "n", Value: int32(2)}},
 	)
-	deleted, err := eng.Delete("db", "col", bson.D{{Key: "n", Value: int32(1)}}, false)
+	deleted, err := eng.Delete("db", "col", bson.D{{Key: "n", Value: int32(1)}}, false, nil)
 	if err != nil || deleted != 1 {
 		t.Fatalf("expected 1, nil; got %d, %v", deleted, err)
 	}
-	docs, _ := eng.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if len(docs) != 1 {
 		t.Fatalf("expected 1 remaining, got %d", len(docs))
 	}
@@ -342,11 +499,11 @@ func TestDelete_Multi(t *testing.T) {
 		bson.D{{Key: "tag", Value: "x"}},
 		bson.D{{Key: "tag", Value: "y"}},
 	)
-	deleted, err := eng.Delete("db", "col", bson.D{{Key: "tag", Value: "x"}}, true)
+	deleted, err := eng.Delete("db", "col", bson.D{{Key: "tag", Value: "x"}}, true, nil)
 	if err != nil || deleted != 2 {
 		t.Fatalf("expected 2, nil; got %d, %v", deleted, err)
 	}
-	docs, _ := eng.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, _ := eng.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if len(docs) != 1 {
 		t.Fatalf("expected 1 remaining, got %d", len(docs))
 	}
@@ -355,7 +512,7 @@ func TestDelete_Multi(t *testing.T) {
 func TestDelete_NoMatch(t *testing.T) {
 	eng, _ := newEng(t)
 	mustInsert(t, eng, "db", "col", bson.D{{Key: "x", Value: int32(1)}})
-	deleted, err := eng.Delete("db", "col", bson.D{{Key: "x", Value: int32(99)}}, false)
+	deleted, err := eng.Delete("db", "col", bson.D{{Key: "x", Value: int32(99)}}, false, nil)
 	if err != nil || deleted != 0 {
 		t.Fatalf("expected 0, nil; got %d, %v", deleted, err)
 	}
@@ -363,7 +520,7 @@ func TestDelete_NoMatch(t *testing.T) {
 
 func TestDelete_NonexistentDB(t *testing.T) {
 	eng, _ := newEng(t)
-	deleted, err := eng.Delete("noDB", "col", bson.D{}, false)
+	deleted, err := eng.Delete("noDB", "col", bson.D{}, false, nil)
 	if err != nil || deleted != 0 {
 		t.Fatalf("expected 0, nil; got %d, %v", deleted, err)
 	}
@@ -375,10 +532,10 @@ func TestDelete_Persistence(t *testing.T) {
 		bson.D{{Key: "n", Value: int32(1)}},
 		bson.D{{Key: "n", Value: int32(2)}},
 	)
-	eng.Delete("db", "col", bson.D{{Key: "n", Value: int32(1)}}, false)
+	eng.Delete("db", "col", bson.D{{Key: "n", Value: int32(1)}}, false, nil)
 
 	eng2 := reloadEng(t, path)
-	docs, _ := eng2.Find("db", "col", bson.D{}, nil, 0, 0)
+	docs, _ := eng2.Find("db", "col", bson.D{}, nil, 0, 0, nil)
 	if len(docs) != 1 {
 		t.Fatalf("expected 1 after reload, got %d", len(docs))
 	}
@@ -393,7 +550,7 @@ func TestCount_All(t *testing.T) {
 		bson.D{{Key: "x", Value: 2}},
 		bson.D{{Key: "x", Value: 3}},
 	)
-	n, err := eng.Count("db", "col", bson.D{})
+	n, err := eng.Count("db", "col", bson.D{}, nil)
 	if err != nil || n != 3 {
 		t.Fatalf("expected 3, nil; got %d, %v", n, err)
 	}
@@ -406,7 +563,7 @@ func TestCount_WithFilter(t *testing.T) {
 		bson.D{{Key: "active", Value: false}},
 		bson.D{{Key: "active", Value: true}},
 	)
-	n, _ := eng.Count("db", "col", bson.D{{Key: "active", Value: true}})
+	n, _ := eng.Count("db", "col", bson.D{{Key: "active", Value: true}}, nil)
 	if n != 2 {
 		t.Fatalf("expected 2, got %d", n)
 	}
@@ -414,7 +571,7 @@ func TestCount_WithFilter(t *testing.T) {
 
 func TestCount_NonexistentCollection(t *testing.T) {
 	eng, _ := newEng(t)
-	n, err := eng.Count("db", "col", bson.D{})
+	n, err := eng.Count("db", "col", bson.D{}, nil)
 	if err != nil || n != 0 {
 		t.Fatalf("expected 0, nil; got %d, %v", n, err)
 	}
@@ -428,7 +585,7 @@ func TestFindAndModify_ReturnPre(t *testing.T) {
 	doc, err := eng.FindAndModify("db", "col",
 		bson.D{{Key: "x", Value: int32(1)}}, nil,
 		bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: int32(2)}}}},
-		false, false, false,
+		nil, false, false, false, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -445,7 +602,7 @@ func TestFindAndModify_ReturnPost(t *testing.T) {
 	doc, err := eng.FindAndModify("db", "col",
 		bson.D{{Key: "x", Value: int32(1)}}, nil,
 		bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: int32(2)}}}},
-		false, true, false,
+		nil, false, true, false, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -461,7 +618,7 @@ func TestFindAndModify_Remove(t *testing.T) {
 	mustInsert(t, eng, "db", "col", bson.D{{Key: "x", Value: int32(5)}})
 	doc, err := eng.FindAndModify("db", "col",
 		bson.D{{Key: "x", Value: int32(5)}}, nil,
-		nil, true, false, false,
+		nil, nil, true, false, false, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -470,7 +627,7 @@ func TestFindAndModify_Remove(t *testing.T) {
 	if x != int32(5) {
 		t.Fatalf("expected removed doc x=5, got %v", x)
 	}
-	n, _ := eng.Count("db", "col", bson.D{})
+	n, _ := eng.Count("db", "col", bson.D{}, nil)
 	if n != 0 {
 		t.Fatal("doc not removed")
 	}
@@ -481,7 +638,7 @@ func TestFindAndModify_Upsert(t *testing.T) {
 	doc, err := eng.FindAndModify("db", "col",
 		bson.D{{Key: "name", Value: "Eve"}}, nil,
 		bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(28)}}}},
-		false, true, true,
+		nil, false, true, true, nil,
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -495,11 +652,47 @@ func TestFindAndModify_Upsert(t *testing.T) {
 	}
 }
 
+func TestFindAndModify_UpsertSetOnInsert(t *testing.T) {
+	eng, _ := newEng(t)
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}, {Key: "$setOnInsert", Value: bson.D{{Key: "created", Value: true}}}}
+	doc, err := eng.FindAndModify("db", "col", bson.D{{Key: "_id", Value: "c"}}, nil, update, nil, false, true, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetField(doc, "created"); v != true {
+		t.Fatalf("expected created=true on insert, got %v", doc)
+	}
+	if _, _, _, err := eng.Update("db", "col", nil, bson.D{{Key: "$unset", Value: bson.D{{Key: "created", Value: ""}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = eng.FindAndModify("db", "col", bson.D{{Key: "_id", Value: "c"}}, nil, update, nil, false, true, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := GetField(doc, "created"); ok {
+		t.Fatalf("$setOnInsert applied to an existing document: %v", doc)
+	}
+}
+
+func TestFindAndModify_Pipeline(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "_id", Value: "c"}, {Key: "n", Value: int32(4)}})
+	doc, err := eng.FindAndModify("db", "col", bson.D{{Key: "_id", Value: "c"}}, nil,
+		bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "sq", Value: bson.D{{Key: "$multiply", Value: bson.A{"$n", "$n"}}}}}}}},
+		nil, false, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetField(doc, "sq"); toInt64(v) != 16 {
+		t.Fatalf("sq = %v, want 16", v)
+	}
+}
+
 func TestFindAndModify_NoMatch(t *testing.T) {
 	eng, _ := newEng(t)
 	doc, err := eng.FindAndModify("db", "col",
 		bson.D{{Key: "x", Value: int32(99)}}, nil,
-		nil, false, false, false,
+		nil, nil, false, false, false, nil,
 	)
 	if err != nil || doc != nil {
 		t.Fatalf("expected nil, nil; got %v, %v", doc, err)
@@ -510,7 +703,7 @@ func TestFindAndModify_NoMatch(t *testing.T) {
 
 func TestAggregate_NonexistentCollection(t *testing.T) {
 	eng, _ := newEng(t)
-	docs, err := eng.Aggregate("db", "col", []bson.D{})
+	docs, err := eng.Aggregate("db", "col", []bson.D{}, nil)
 	if err != nil || docs != nil {
 		t.Fatalf("expected nil, nil; got %v, %v", docs, err)
 	}
@@ -526,7 +719,7 @@ func TestAggregate_Match(t *testing.T) {
 	pipeline := []bson.D{
 		{{Key: "$match", Value: bson.D{{Key: "n", Value: bson.D{{Key: "$gte", Value: int32(2)}}}}}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 2 {
 		t.Fatalf("expected 2, got %d, err=%v", len(docs), err)
 	}
@@ -545,7 +738,7 @@ func TestAggregate_Group_Sum(t *testing.T) {
 			{Key: "total", Value: bson.D{{Key: "$sum", Value: "$score"}}},
 		}}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 2 {
 		t.Fatalf("expected 2 groups, got %d, err=%v", len(docs), err)
 	}
@@ -572,7 +765,7 @@ func TestAggregate_Count(t *testing.T) {
 	pipeline := []bson.D{
 		{{Key: "$count", Value: "total"}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 1 {
 		t.Fatalf("expected 1 doc, got %d, err=%v", len(docs), err)
 	}
@@ -592,7 +785,7 @@ func TestAggregate_SortSkipLimit(t *testing.T) {
 		{{Key: "$skip", Value: int64(1)}},
 		{{Key: "$limit", Value: int64(2)}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 2 {
 		t.Fatalf("expected 2, got %d, err=%v", len(docs), err)
 	}
@@ -610,7 +803,7 @@ func TestAggregate_Project(t *testing.T) {
 	pipeline := []bson.D{
 		{{Key: "$project", Value: bson.D{{Key: "name", Value: int32(1)}, {Key: "_id", Value: int32(0)}}}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 1 {
 		t.Fatalf("expected 1, got %d, err=%v", len(docs), err)
 	}
@@ -630,7 +823,7 @@ func TestAggregate_Unwind(t *testing.T) {
 	pipeline := []bson.D{
 		{{Key: "$unwind", Value: "$tags"}},
 	}
-	docs, err := eng.Aggregate("db", "col", pipeline)
+	docs, err := eng.Aggregate("db", "col", pipeline, nil)
 	if err != nil || len(docs) != 3 {
 		t.Fatalf("expected 3, got %d, err=%v", len(docs), err)
 	}
@@ -791,3 +984,81 @@ func TestCreateIndexes_AutoName(t *testing.T) {
 		t.Fatalf("auto-generated name 'email_1' not found in %v", idxs)
 	}
 }
+
+// ---- Cross-process locking ----
+
+func TestLocking_EnginesSeeEachOthersWrites(t *testing.T) {
+	a, path := newEng(t)
+	b := reloadEng(t, path)
+
+	mustInsert(t, a, "db", "col", bson.D{{Key: "from", Value: "a"}})
+	mustInsert(t, b, "db", "col", bson.D{{Key: "from", Value: "b"}})
+
+	// a must pick up b's write instead of serving its stale copy.
+	n, err := a.Count("db", "col", bson.D{}, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("expected a to see 2 docs, got %d err=%v", n, err)
+	}
+	n, err = reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 docs on disk, got %d err=%v", n, err)
+	}
+}
+
+func TestLocking_ConcurrentWritersDoNotLoseUpdates(t *testing.T) {
+	_, path := newEng(t)
+	const writers, perWriter = 4, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Each writer has its own Engine, like separate CLI processes.
+			eng, err := New(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < perWriter; i++ {
+				if _, err := eng.Insert("db", "col", []bson.D{{{Key: "w", Value: int32(w)}, {Key: "i", Value: int32(i)}}}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	n, err := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if err != nil || n != writers*perWriter {
+		t.Fatalf("expected %d docs, got %d err=%v", writers*perWriter, n, err)
+	}
+}
+
+func TestLocking_UpdateAppliesToLatestState(t *testing.T) {
+	a, path := newEng(t)
+	mustInsert(t, a, "db", "col", bson.D{{Key: "_id", Value: "counter"}, {Key: "n", Value: int32(0)}})
+	b := reloadEng(t, path)
+
+	inc := bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}}
+	filter := bson.D{{Key: "_id", Value: "counter"}}
+	for _, eng := range []*Engine{a, b, a, b} {
+		if _, _, _, err := eng.Update("db", "col", filter, inc, nil, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docs, err := reloadEng(t, path).Find("db", "col", filter, nil, 0, 0, nil)
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("find: %v %v", docs, err)
+	}
+	if n, _ := GetField(docs[0], "n"); toInt64(n) != 4 {
+		t.Fatalf("expected n=4, got %v", n)
+	}
+}
@@ -0,0 +1,18 @@
+package engine
+
+import "fmt"
+
+// CommandError is a command MongoDB would refuse, with the error code and
+// code name the server reports for it.
+type CommandError struct {
+	Code int32
+	Name string
+	Msg  string
+}
+
+func (e *CommandError) Error() string { return e.Msg }
+
+// commandErrorf returns a CommandError with a formatted message.
+func commandErrorf(code int32, name, format string, args ...interface{}) error {
+	return &CommandError{Code: code, Name: name, Msg: fmt.Sprintf(format, args...)}
+}
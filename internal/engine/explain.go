@@ -0,0 +1,472 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Explain verbosity modes, as accepted by MongoDB's explain command.
+const (
+	VerbosityQueryPlanner      = "queryPlanner"
+	VerbosityExecutionStats    = "executionStats"
+	VerbosityAllPlansExecution = "allPlansExecution"
+)
+
+// Explain reports how a query was executed. It is produced by the Explain*
+// methods, which run the query without modifying any data.
+type Explain struct {
+	Namespace string
+	Command   string // find, count, aggregate, update or delete
+	Filter    bson.D
+	Sort      bson.D
+	Skip      int64
+	Limit     int64
+
+	Index        *IndexSpec // index scanned; nil for a collection scan
+	MultiKey     bool
+	IndexBounds  []string // leading-field bounds, MongoDB style
+	Exists       bool     // false when the collection does not exist
+	KeysExamined int64
+	DocsExamined int64
+	NReturned    int64 // documents returned (find, count, aggregate)
+	NMatched     int64 // documents that would be modified (update, delete)
+	Duration     time.Duration
+
+	matched int64 // documents returned by the scan stage
+}
+
+// ExplainFind explains Find with the same arguments. On a view it explains
+// the equivalent aggregation, as MongoDB does.
+func (e *Engine) ExplainFind(db, coll string, filter, sort bson.D, skip, limit int64, collation *Collation) (*Explain, error) {
+	if isView, err := e.isView(db, coll); err != nil || isView {
+		if err != nil {
+			return nil, err
+		}
+		var pipeline []bson.D
+		if len(filter) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+		}
+		if len(sort) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sort}})
+		}
+		if skip > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$skip", Value: skip}})
+		}
+		if limit > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+		}
+		return e.ExplainAggregate(db, coll, pipeline, collation)
+	}
+	x := &Explain{Command: "find", Filter: filter, Sort: sort, Skip: skip, Limit: limit}
+	err := e.explain(db, coll, x, func(c *Collection) queryPlan {
+		// Without a sort the scan can stop once skip+limit documents matched.
+		stop := 0
+		if len(sort) == 0 && limit > 0 {
+			stop = int(skip + limit)
+		}
+		docs, plan := c.findPlan(filter, stop, collation)
+		x.matched = int64(len(docs))
+		if len(sort) > 0 {
+			sortDocs(docs, sort, collation)
+		}
+		n := int64(len(docs)) - skip
+		if n < 0 {
+			n = 0
+		}
+		if limit > 0 && n > limit {
+			n = limit
+		}
+		x.NReturned = n
+		return plan
+	})
+	return x, err
+}
+
+// ExplainCount explains Count with the same arguments. On a view it explains
+// the equivalent aggregation, as MongoDB does.
+func (e *Engine) ExplainCount(db, coll string, filter bson.D, collation *Collation) (*Explain, error) {
+	if isView, err := e.isView(db, coll); err != nil || isView {
+		if err != nil {
+			return nil, err
+		}
+		var pipeline []bson.D
+		if len(filter) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+		}
+		return e.ExplainAggregate(db, coll, pipeline, collation)
+	}
+	x := &Explain{Command: "count", Filter: filter}
+	err := e.explain(db, coll, x, func(c *Collection) queryPlan {
+		if len(filter) == 0 {
+			x.NReturned = int64(len(c.Documents))
+			return queryPlan{}
+		}
+		docs, plan := c.findPlan(filter, 0, collation)
+		x.NReturned = int64(len(docs))
+		x.matched = x.NReturned
+		return plan
+	})
+	return x, err
+}
+
+// ExplainAggregate explains Aggregate with the same arguments. Only a
+// leading $match can use an index. A view is explained as its pipeline
+// followed by pipeline on the collection the view reads.
+func (e *Engine) ExplainAggregate(db, coll string, pipeline []bson.D, collation *Collation) (*Explain, error) {
+	x := &Explain{Command: "aggregate"}
+	// Explaining $out or $merge must not write; explain what feeds them.
+	if _, ok := writeStage(pipeline); ok {
+		pipeline = pipeline[:len(pipeline)-1]
+	}
+	source, viewPipeline, err := e.resolveSource(db, coll)
+	if err != nil {
+		return x, err
+	}
+	pipeline = append(viewPipeline, pipeline...)
+	var pipeErr error
+	err = e.explain(db, source, x, func(c *Collection) queryPlan {
+		var docs []bson.D
+		var plan queryPlan
+		if len(pipeline) > 0 && len(pipeline[0]) == 1 && pipeline[0][0].Key == "$match" {
+			x.Filter, _ = pipeline[0][0].Value.(bson.D)
+			docs, plan = c.findPlan(x.Filter, 0, collation)
+		} else {
+			docs = make([]bson.D, len(c.Documents))
+			copy(docs, c.Documents)
+			plan.docsExamined = len(docs)
+		}
+		x.matched = int64(len(docs))
+		results, err := runPipeline(docs, pipeline, e.lookupFunc(db, collation), collation)
+		if err != nil {
+			pipeErr = err
+		}
+		x.NReturned = int64(len(results))
+		return plan
+	})
+	if err == nil {
+		err = pipeErr
+	}
+	return x, err
+}
+
+// ExplainUpdate explains Update with the same filter and multi flag. No
+// documents are modified.
+func (e *Engine) ExplainUpdate(db, coll string, filter bson.D, multi bool, collation *Collation) (*Explain, error) {
+	return e.explainWrite(db, coll, "update", filter, multi, collation)
+}
+
+// ExplainDelete explains Delete with the same filter and multi flag. No
+// documents are removed.
+func (e *Engine) ExplainDelete(db, coll string, filter bson.D, multi bool, collation *Collation) (*Explain, error) {
+	return e.explainWrite(db, coll, "delete", filter, multi, collation)
+}
+
+func (e *Engine) explainWrite(db, coll, command string, filter bson.D, multi bool, collation *Collation) (*Explain, error) {
+	x := &Explain{Command: command, Filter: filter}
+	// Views cannot be written, so neither can writes to them be explained.
+	if isView, err := e.isView(db, coll); err != nil || isView {
+		if err == nil {
+			err = notSupportedOnView(db, coll)
+		}
+		return x, err
+	}
+	err := e.explain(db, coll, x, func(c *Collection) queryPlan {
+		stop := 0
+		if !multi {
+			stop = 1
+		}
+		docs, plan := c.findPlan(filter, stop, collation)
+		x.NMatched = int64(len(docs))
+		x.matched = x.NMatched
+		return plan
+	})
+	return x, err
+}
+
+// resolveSource returns the collection that reads of db.coll run on and, if
+// db.coll is a view, the pipeline to run first.
+func (e *Engine) resolveSource(db, coll string) (string, []bson.D, error) {
+	if err := e.refresh(); err != nil {
+		return "", nil, err
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.resolveView(db, coll)
+}
+
+// isView reports whether db.coll is a view.
+func (e *Engine) isView(db, coll string) (bool, error) {
+	if err := e.refresh(); err != nil {
+		return false, err
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view(db, coll) != nil, nil
+}
+
+// explain runs fn against the collection under the read lock, timing it and
+// copying its plan into x.
+func (e *Engine) explain(db, coll string, x *Explain, fn func(c *Collection) queryPlan) error {
+	x.Namespace = db + "." + coll
+	if err := checkRegexes(x.Filter); err != nil {
+		return err
+	}
+	if err := e.refresh(); err != nil {
+		return err
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	d := e.data.Databases[db]
+	if d == nil || d.Collections[coll] == nil {
+		return nil
+	}
+	c := d.Collections[coll]
+	x.Exists = true
+
+	start := time.Now()
+	plan := fn(c)
+	x.Duration = time.Since(start)
+
+	x.KeysExamined = int64(plan.keysExamined)
+	x.DocsExamined = int64(plan.docsExamined)
+	if plan.index != nil {
+		spec := plan.index.spec
+		x.Index = &spec
+		x.MultiKey = plan.index.multikey
+		x.IndexBounds = plan.bounds.strings()
+	}
+	return nil
+}
+
+// lookupFunc returns the resolver that $lookup and similar stages use to read
+// other collections, in db unless the stage names another database, matching
+// under collation. Callers must hold the engine read lock.
+func (s *state) lookupFunc(db string, collation *Collation) LookupFunc {
+	return func(lookupDB, lookupColl string, filter bson.D) ([]bson.D, error) {
+		if lookupDB == "" {
+			lookupDB = db
+		}
+		return s.matching(lookupDB, lookupColl, filter, collation)
+	}
+}
+
+// Doc renders the explain output in the shape MongoDB uses, so mongosh and
+// Compass can display it. verbosity is one of the Verbosity constants; an
+// empty string means VerbosityAllPlansExecution.
+func (x *Explain) Doc(verbosity string) bson.D {
+	if verbosity == "" {
+		verbosity = VerbosityAllPlansExecution
+	}
+	plan := x.winningPlan(false)
+	out := bson.D{
+		{Key: "explainVersion", Value: "1"},
+		{Key: "queryPlanner", Value: bson.D{
+			{Key: "namespace", Value: x.Namespace},
+			{Key: "indexFilterSet", Value: false},
+			{Key: "parsedQuery", Value: orEmpty(x.Filter)},
+			{Key: "winningPlan", Value: plan},
+			{Key: "rejectedPlans", Value: bson.A{}},
+		}},
+	}
+	if verbosity == VerbosityQueryPlanner {
+		return out
+	}
+	millis := x.Duration.Milliseconds()
+	stats := bson.D{
+		{Key: "executionSuccess", Value: true},
+		{Key: "nReturned", Value: x.NReturned},
+		{Key: "executionTimeMillis", Value: millis},
+		{Key: "totalKeysExamined", Value: x.KeysExamined},
+		{Key: "totalDocsExamined", Value: x.DocsExamined},
+		{Key: "executionStages", Value: x.winningPlan(true)},
+	}
+	if verbosity == VerbosityAllPlansExecution {
+		stats = append(stats, bson.E{Key: "allPlansExecution", Value: bson.A{}})
+	}
+	return append(out, bson.E{Key: "executionStats", Value: stats})
+}
+
+// winningPlan builds the stage tree; withStats adds per-stage counters for
+// executionStats.executionStages.
+func (x *Explain) winningPlan(withStats bool) bson.D {
+	millis := x.Duration.Milliseconds()
+	stage := func(name string, fields bson.D, nReturned int64, input bson.D) bson.D {
+		s := bson.D{{Key: "stage", Value: name}}
+		s = append(s, fields...)
+		if withStats {
+			s = append(s,
+				bson.E{Key: "nReturned", Value: nReturned},
+				bson.E{Key: "executionTimeMillisEstimate", Value: millis})
+		}
+		if input != nil {
+			s = append(s, bson.E{Key: "inputStage", Value: input})
+		}
+		return s
+	}
+
+	matched := x.matched
+
+	var plan bson.D
+	switch {
+	case !x.Exists:
+		plan = stage("EOF", nil, 0, nil)
+	case x.Command == "count" && len(x.Filter) == 0:
+		return stage("RECORD_STORE_FAST_COUNT", nil, 0, nil)
+	case x.Index != nil:
+		ixFields := bson.D{
+			{Key: "keyPattern", Value: x.Index.Keys},
+			{Key: "indexName", Value: x.Index.Name},
+			{Key: "isMultiKey", Value: x.MultiKey},
+			{Key: "isUnique", Value: x.Index.Unique},
+			{Key: "isSparse", Value: x.Index.Sparse},
+			{Key: "isPartial", Value: x.Index.PartialFilterExpression != nil},
+			{Key: "direction", Value: "forward"},
+			{Key: "indexBounds", Value: bson.D{{Key: x.Index.Keys[0].Key, Value: stringsToA(x.IndexBounds)}}},
+		}
+		if withStats {
+			ixFields = append(ixFields, bson.E{Key: "keysExamined", Value: x.KeysExamined})
+		}
+		ixscan := stage("IXSCAN", ixFields, x.DocsExamined, nil)
+		var fetchFields bson.D
+		if len(x.Filter) > 0 {
+			fetchFields = append(fetchFields, bson.E{Key: "filter", Value: x.Filter})
+		}
+		if withStats {
+			fetchFields = append(fetchFields, bson.E{Key: "docsExamined", Value: x.DocsExamined})
+		}
+		plan = stage("FETCH", fetchFields, matched, ixscan)
+	default:
+		var fields bson.D
+		if len(x.Filter) > 0 {
+			fields = append(fields, bson.E{Key: "filter", Value: x.Filter})
+		}
+		fields = append(fields, bson.E{Key: "direction", Value: "forward"})
+		if withStats {
+			fields = append(fields, bson.E{Key: "docsExamined", Value: x.DocsExamined})
+		}
+		plan = stage("COLLSCAN", fields, matched, nil)
+	}
+
+	switch x.Command {
+	case "find":
+		if len(x.Sort) > 0 {
+			plan = stage("SORT", bson.D{{Key: "sortPattern", Value: x.Sort}}, matched, plan)
+		}
+		if x.Skip > 0 {
+			plan = stage("SKIP", bson.D{{Key: "skipAmount", Value: x.Skip}}, x.NReturned, plan)
+		}
+		if x.Limit > 0 {
+			plan = stage("LIMIT", bson.D{{Key: "limitAmount", Value: x.Limit}}, x.NReturned, plan)
+		}
+	case "count":
+		plan = stage("COUNT", nil, 0, plan)
+	case "update":
+		var fields bson.D
+		if withStats {
+			fields = bson.D{{Key: "nMatched", Value: x.NMatched}, {Key: "nWouldModify", Value: x.NMatched}}
+		}
+		plan = stage("UPDATE", fields, 0, plan)
+	case "delete":
+		var fields bson.D
+		if withStats {
+			fields = bson.D{{Key: "nWouldDelete", Value: x.NMatched}}
+		}
+		plan = stage("DELETE", fields, 0, plan)
+	}
+	return plan
+}
+
+// strings renders the bounds in MongoDB's interval notation, e.g.
+// "[25, 25]" or "(30, inf.0]".
+func (b *keyBounds) strings() []string {
+	if !b.isRange {
+		out := make([]string, 0, len(b.points))
+		for _, p := range b.points {
+			v := boundString(p)
+			out = append(out, "["+v+", "+v+"]")
+		}
+		return out
+	}
+	if b.empty {
+		return []string{}
+	}
+	lo, hi := "[", "]"
+	if b.hasLo && !b.loIncl {
+		lo = "("
+	}
+	if b.hasHi && !b.hiIncl {
+		hi = ")"
+	}
+	loVal, hiVal := typeMinMax(b.rank)
+	if b.hasLo {
+		loVal = boundString(b.lo)
+	}
+	if b.hasHi {
+		hiVal = boundString(b.hi)
+	}
+	out := []string{lo + loVal + ", " + hiVal + hi}
+	for _, p := range b.also {
+		v := boundString(p)
+		out = append(out, "["+v+", "+v+"]")
+	}
+	return out
+}
+
+// typeMinMax returns the printed lower and upper limits of a BSON type.
+func typeMinMax(rank int) (string, string) {
+	switch rank {
+	case rankNumber:
+		return "-inf.0", "inf.0"
+	case rankString:
+		return `""`, "{}"
+	case rankObjectID:
+		return "ObjectId('000000000000000000000000')", "ObjectId('ffffffffffffffffffffffff')"
+	case rankBool:
+		return "false", "true"
+	case rankDate:
+		return "new Date(-9223372036854775808)", "new Date(9223372036854775807)"
+	}
+	return "MinKey", "MaxKey"
+}
+
+func boundString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", x)
+	case bson.ObjectID:
+		return "ObjectId('" + x.Hex() + "')"
+	case bson.DateTime:
+		return fmt.Sprintf("new Date(%d)", int64(x))
+	case bson.Regex:
+		return "/" + x.Pattern + "/" + x.Options
+	case float64:
+		if math.IsInf(x, 1) {
+			return "inf.0"
+		}
+		if math.IsInf(x, -1) {
+			return "-inf.0"
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func stringsToA(ss []string) bson.A {
+	a := bson.A{}
+	for _, s := range ss {
+		a = append(a, s)
+	}
+	return a
+}
+
+func orEmpty(d bson.D) bson.D {
+	if d == nil {
+		return bson.D{}
+	}
+	return d
+}
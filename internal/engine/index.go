@@ -1,32 +1,11 @@
 package engine
 
-import "go.mongodb.org/mongo-driver/v2/bson"
+import (
+	"sort"
+	"strings"
 
-// CheckUniqueIndex checks if inserting the given document would violate a unique index.
-func CheckUniqueIndex(docs []bson.D, indexes []IndexSpec, newDoc bson.D) error {
-	for _, idx := range indexes {
-		if !idx.Unique {
-			continue
-		}
-		for _, existing := range docs {
-			if indexKeysMatch(existing, newDoc, idx.Keys) {
-				return &DuplicateKeyError{Index: idx.Name}
-			}
-		}
-	}
-	return nil
-}
-
-func indexKeysMatch(a, b bson.D, keys bson.D) bool {
-	for _, k := range keys {
-		va, _ := GetField(a, k.Key)
-		vb, _ := GetField(b, k.Key)
-		if !valuesEqual(va, vb) {
-			return false
-		}
-	}
-	return true
-}
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
 
 // DefaultIndexName generates an index name from keys.
 func DefaultIndexName(keys bson.D) string {
@@ -46,10 +25,476 @@ func DefaultIndexName(keys bson.D) string {
 	return name
 }
 
+// DuplicateKeyError reports a write or index build that would give two
+// documents the same key in a unique index. Collection, KeyPattern and
+// KeyValue are set when known.
 type DuplicateKeyError struct {
-	Index string
+	Index      string
+	Collection string // "db.coll"
+	KeyPattern bson.D // the index's fields
+	KeyValue   bson.D // the duplicated value of each field
 }
 
 func (e *DuplicateKeyError) Error() string {
-	return "E11000 duplicate key error collection, index: " + e.Index
+	msg := "E11000 duplicate key error collection"
+	if e.Collection != "" {
+		msg += ": " + e.Collection + " index: " + e.Index
+	} else {
+		msg += ", index: " + e.Index
+	}
+	if e.KeyValue != nil {
+		if key, err := bson.MarshalExtJSON(e.KeyValue, false, false); err == nil {
+			msg += " dup key: " + string(key)
+		}
+	}
+	return msg
+}
+
+func cannotCreateIndex(msg string) *CommandError {
+	return &CommandError{Code: 67, Name: "CannotCreateIndex", Msg: msg}
+}
+
+// checkIndexSpec validates the options of a new index specification.
+func checkIndexSpec(spec IndexSpec) error {
+	if len(spec.Keys) == 0 {
+		return cannotCreateIndex("index keys cannot be an empty object")
+	}
+	if spec.Sparse && spec.PartialFilterExpression != nil {
+		return cannotCreateIndex(`cannot mix "partialFilterExpression" and "sparse" options`)
+	}
+	if err := checkRegexes(spec.PartialFilterExpression); err != nil {
+		return cannotCreateIndex(err.Error())
+	}
+	if spec.Collation != nil {
+		if _, err := ParseCollation(spec.Collation); err != nil {
+			return commandErrorf(2, "BadValue", "%v", err)
+		}
+	}
+	if spec.ExpireAfterSeconds != nil {
+		switch {
+		case len(spec.Keys) > 1:
+			return cannotCreateIndex("TTL indexes are single-field indexes, compound indexes do not support TTL")
+		case spec.Keys[0].Key == "_id":
+			return cannotCreateIndex("the field 'expireAfterSeconds' is not valid for an _id index specification")
+		case *spec.ExpireAfterSeconds < 0:
+			return cannotCreateIndex("expireAfterSeconds must be a non-negative number")
+		}
+	}
+	return nil
+}
+
+// sameIndex reports whether two specifications describe the same index.
+func sameIndex(a, b IndexSpec) bool {
+	if a.Name != b.Name || a.Unique != b.Unique || a.Sparse != b.Sparse || len(a.Keys) != len(b.Keys) ||
+		!valuesEqual(a.PartialFilterExpression, b.PartialFilterExpression) || !valuesEqual(a.Collation, b.Collation) {
+		return false
+	}
+	for i := range a.Keys {
+		if a.Keys[i].Key != b.Keys[i].Key || !valuesEqual(a.Keys[i].Value, b.Keys[i].Value) {
+			return false
+		}
+	}
+	if a.ExpireAfterSeconds == nil || b.ExpireAfterSeconds == nil {
+		return a.ExpireAfterSeconds == b.ExpireAfterSeconds
+	}
+	return *a.ExpireAfterSeconds == *b.ExpireAfterSeconds
+}
+
+// covers reports whether doc has entries in an index with this spec. Sparse
+// indexes skip documents missing every indexed field; partial indexes skip
+// documents that do not match the filter expression.
+func (s IndexSpec) covers(doc bson.D) bool {
+	if s.PartialFilterExpression != nil {
+		return MatchDoc(doc, s.PartialFilterExpression)
+	}
+	if s.Sparse {
+		for _, f := range s.Keys {
+			if len(lookupValues(doc, f.Key)) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ---- in-memory indexes ----
+
+// idIndexSpec describes the implicit unique index every collection has on _id.
+var idIndexSpec = IndexSpec{Name: "_id_", Keys: bson.D{{Key: "_id", Value: int32(1)}}, Unique: true}
+
+// collIndexes is the in-memory index state of a collection. It is built from
+// Collection.Documents and Collection.Indexes when the store is loaded or the
+// index list changes, and kept up to date by the Collection mutators below.
+type collIndexes struct {
+	ids     []string       // idKey of each document, parallel to Documents
+	pos     map[string]int // idKey -> position in Documents
+	indexes []*docIndex    // the _id index, then Collection.Indexes in order
+}
+
+// docIndex holds the entries of one index sorted by key. Array values are
+// indexed both whole and per element, and a path through an array of
+// embedded documents indexes each value it reaches, so such an index is
+// multikey.
+type docIndex struct {
+	spec      IndexSpec
+	collation *Collation // strings are indexed by their sort key under it
+	entries   []indexEntry
+	keys      map[string][]indexKey // idKey -> keys the document contributed
+	multikey  bool                  // some document contributed several values
+}
+
+// indexKey is one value per indexed field. Values are normalised by
+// indexValue so entries do not share memory with the documents they index.
+type indexKey []interface{}
+
+type indexEntry struct {
+	key indexKey
+	id  string
+}
+
+// compositeValue stands in for an embedded document, array or other value
+// without a natural order. Composites sort by type, then by a canonical
+// encoding, which is enough for equality lookups.
+type compositeValue struct {
+	rank int
+	repr string
+}
+
+// indexValue normalises v for storage in an index entry.
+func indexValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, bool, bson.ObjectID, bson.DateTime:
+		return v
+	}
+	if isNumeric(v) {
+		return v
+	}
+	return compositeValue{rank: typeRank(v), repr: groupKeyString(v)}
+}
+
+func indexValueRank(v interface{}) int {
+	if c, ok := v.(compositeValue); ok {
+		return c.rank
+	}
+	return typeRank(v)
+}
+
+// compareIndexValues orders normalised index values by BSON type, then by
+// value within the type.
+func compareIndexValues(a, b interface{}) int {
+	ra, rb := indexValueRank(a), indexValueRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	ca, aok := a.(compositeValue)
+	cb, bok := b.(compositeValue)
+	if aok && bok {
+		return strings.Compare(ca.repr, cb.repr)
+	}
+	return compareValues(a, b)
+}
+
+func compareIndexKeys(a, b indexKey) int {
+	for i := range a {
+		if c := compareIndexValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareEntries(a, b indexEntry) int {
+	if c := compareIndexKeys(a.key, b.key); c != 0 {
+		return c
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// docIndexKeys returns the distinct keys doc contributes to an index on the
+// given fields, and whether any field reached more than one value. Paths are
+// resolved as queries resolve them, through arrays of embedded documents. A
+// missing field is indexed as null. Under a collation, strings are indexed
+// by their sort key.
+func docIndexKeys(doc bson.D, fields bson.D, collation *Collation) ([]indexKey, bool) {
+	keys := []indexKey{{}}
+	multikey := false
+	for _, f := range fields {
+		found := lookupValues(doc, f.Key)
+		if len(found) == 0 {
+			found = []interface{}{nil}
+		}
+		if len(found) > 1 {
+			multikey = true
+		}
+		var vals []interface{}
+		for _, v := range found {
+			vals = append(vals, indexValue(collation.keyValue(v)))
+			if arr, ok := v.(bson.A); ok {
+				multikey = true
+				for _, elem := range arr {
+					vals = append(vals, indexValue(collation.keyValue(elem)))
+				}
+			}
+		}
+		var next []indexKey
+		for _, k := range keys {
+			for _, val := range vals {
+				nk := make(indexKey, len(k), len(k)+1)
+				copy(nk, k)
+				next = append(next, append(nk, val))
+			}
+		}
+		keys = next
+	}
+	// Deduplicate so a document appears once per distinct key.
+	sort.Slice(keys, func(i, j int) bool { return compareIndexKeys(keys[i], keys[j]) < 0 })
+	out := keys[:0]
+	for i, k := range keys {
+		if i == 0 || compareIndexKeys(keys[i-1], k) != 0 {
+			out = append(out, k)
+		}
+	}
+	return out, multikey
+}
+
+func newDocIndex(spec IndexSpec, docs []bson.D, ids []string) *docIndex {
+	collation, _ := ParseCollation(spec.Collation)
+	ix := &docIndex{spec: spec, collation: collation, keys: make(map[string][]indexKey, len(docs))}
+	for i, doc := range docs {
+		if !spec.covers(doc) {
+			continue
+		}
+		keys, multikey := docIndexKeys(doc, spec.Keys, collation)
+		ix.multikey = ix.multikey || multikey
+		ix.keys[ids[i]] = keys
+		for _, k := range keys {
+			ix.entries = append(ix.entries, indexEntry{key: k, id: ids[i]})
+		}
+	}
+	sort.Slice(ix.entries, func(i, j int) bool { return compareEntries(ix.entries[i], ix.entries[j]) < 0 })
+	return ix
+}
+
+// search returns the position of the first entry not less than e.
+func (ix *docIndex) search(e indexEntry) int {
+	return sort.Search(len(ix.entries), func(i int) bool { return compareEntries(ix.entries[i], e) >= 0 })
+}
+
+func (ix *docIndex) add(id string, doc bson.D) {
+	if !ix.spec.covers(doc) {
+		return
+	}
+	keys, multikey := docIndexKeys(doc, ix.spec.Keys, ix.collation)
+	ix.multikey = ix.multikey || multikey
+	ix.keys[id] = keys
+	for _, k := range keys {
+		e := indexEntry{key: k, id: id}
+		i := ix.search(e)
+		ix.entries = append(ix.entries, indexEntry{})
+		copy(ix.entries[i+1:], ix.entries[i:])
+		ix.entries[i] = e
+	}
+}
+
+func (ix *docIndex) remove(id string) {
+	for _, k := range ix.keys[id] {
+		e := indexEntry{key: k, id: id}
+		i := ix.search(e)
+		if i < len(ix.entries) && compareEntries(ix.entries[i], e) == 0 {
+			ix.entries = append(ix.entries[:i], ix.entries[i+1:]...)
+		}
+	}
+	delete(ix.keys, id)
+}
+
+// conflict returns the first of keys that a document other than selfID
+// already holds, or nil.
+func (ix *docIndex) conflict(keys []indexKey, selfID string) indexKey {
+	for _, k := range keys {
+		for i := ix.search(indexEntry{key: k}); i < len(ix.entries); i++ {
+			if compareIndexKeys(ix.entries[i].key, k) != 0 {
+				break
+			}
+			if ix.entries[i].id != selfID {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+// duplicate returns the first key two documents share and the id of one of
+// them, or a nil key if every key is held by a single document.
+func (ix *docIndex) duplicate() (indexKey, string) {
+	for i := 1; i < len(ix.entries); i++ {
+		prev, cur := ix.entries[i-1], ix.entries[i]
+		if prev.id != cur.id && compareIndexKeys(prev.key, cur.key) == 0 {
+			return cur.key, cur.id
+		}
+	}
+	return nil, ""
+}
+
+// duplicateKeyError describes key, a key of doc that collides in ix. Index
+// values of documents and arrays, and strings indexed by their collation
+// sort key, are reported as doc's field values.
+func (ix *docIndex) duplicateKeyError(ns string, doc bson.D, key indexKey) *DuplicateKeyError {
+	value := make(bson.D, len(ix.spec.Keys))
+	for i, f := range ix.spec.Keys {
+		v := key[i]
+		if _, composite := v.(compositeValue); composite || ix.collation != nil {
+			v, _ = lookupField(doc, f.Key)
+		}
+		value[i] = bson.E{Key: f.Key, Value: v}
+	}
+	return &DuplicateKeyError{Index: ix.spec.Name, Collection: ns, KeyPattern: ix.spec.Keys, KeyValue: value}
+}
+
+// docIDKey returns the idKey of doc's _id.
+func docIDKey(doc bson.D) string {
+	id, _ := GetField(doc, "_id")
+	return idKey(id)
+}
+
+// buildIndexes rebuilds the collection's in-memory indexes from scratch.
+func (c *Collection) buildIndexes() {
+	ix := &collIndexes{
+		ids: make([]string, len(c.Documents)),
+		pos: make(map[string]int, len(c.Documents)),
+	}
+	for i, doc := range c.Documents {
+		id := docIDKey(doc)
+		ix.ids[i] = id
+		ix.pos[id] = i
+	}
+	specs := append([]IndexSpec{idIndexSpec}, c.Indexes...)
+	for _, spec := range specs {
+		ix.indexes = append(ix.indexes, newDocIndex(spec, c.Documents, ix.ids))
+	}
+	c.ix = ix
+	c.version = nextVersion()
+}
+
+func buildStoreIndexes(s *Store) {
+	for _, db := range s.Databases {
+		for _, c := range db.Collections {
+			c.buildIndexes()
+		}
+	}
+}
+
+// indexState returns the collection's indexes, building them on first use.
+// Callers must hold the engine write lock.
+func (c *Collection) indexState() *collIndexes {
+	if c.ix == nil {
+		c.buildIndexes()
+	}
+	return c.ix
+}
+
+// reposition refreshes the _id positions after Documents has been reordered.
+func (ix *collIndexes) reposition(docs []bson.D) {
+	ix.ids = ix.ids[:0]
+	ix.pos = make(map[string]int, len(docs))
+	for i, doc := range docs {
+		id := docIDKey(doc)
+		ix.ids = append(ix.ids, id)
+		ix.pos[id] = i
+	}
+}
+
+// checkUnique returns a DuplicateKeyError if doc would collide with another
+// document on _id or a unique index. Documents a sparse or partial index
+// leaves out cannot collide in it. selfID is the idKey of the document
+// being replaced, or "" for an insert; ns names the collection in the error.
+func (c *Collection) checkUnique(ns string, doc bson.D, selfID string) error {
+	for _, ix := range c.indexState().indexes {
+		if !ix.spec.Unique || !ix.spec.covers(doc) {
+			continue
+		}
+		keys, _ := docIndexKeys(doc, ix.spec.Keys, ix.collation)
+		if k := ix.conflict(keys, selfID); k != nil {
+			return ix.duplicateKeyError(ns, doc, k)
+		}
+	}
+	return nil
+}
+
+// checkUniqueIndex returns a DuplicateKeyError if idx is unique and two
+// documents share one of its keys.
+func (c *Collection) checkUniqueIndex(ns string, idx *docIndex) error {
+	if !idx.spec.Unique {
+		return nil
+	}
+	if k, id := idx.duplicate(); k != nil {
+		return idx.duplicateKeyError(ns, c.Documents[c.indexState().pos[id]], k)
+	}
+	return nil
+}
+
+// insertDoc appends doc to the collection and its indexes.
+func (c *Collection) insertDoc(doc bson.D) {
+	ix := c.indexState()
+	id := docIDKey(doc)
+	c.version = nextVersion()
+	c.Documents = append(c.Documents, doc)
+	ix.ids = append(ix.ids, id)
+	ix.pos[id] = len(c.Documents) - 1
+	for _, idx := range ix.indexes {
+		idx.add(id, doc)
+	}
+}
+
+// replaceDoc replaces the document at position i and reindexes it.
+func (c *Collection) replaceDoc(i int, doc bson.D) {
+	ix := c.indexState()
+	oldID, newID := ix.ids[i], docIDKey(doc)
+	c.version = nextVersion()
+	c.Documents[i] = doc
+	for _, idx := range ix.indexes {
+		idx.remove(oldID)
+		idx.add(newID, doc)
+	}
+	if oldID != newID {
+		delete(ix.pos, oldID)
+		ix.ids[i] = newID
+		ix.pos[newID] = i
+	}
+}
+
+// removeDocs removes the documents at the given ascending positions.
+func (c *Collection) removeDocs(positions []int) {
+	if len(positions) == 0 {
+		return
+	}
+	ix := c.indexState()
+	c.version = nextVersion()
+	for _, p := range positions {
+		for _, idx := range ix.indexes {
+			idx.remove(ix.ids[p])
+		}
+		delete(ix.pos, ix.ids[p])
+	}
+	kept, keptIDs := c.Documents[:0], ix.ids[:0]
+	next := 0
+	for i, doc := range c.Documents {
+		if next < len(positions) && positions[next] == i {
+			next++
+			continue
+		}
+		kept = append(kept, doc)
+		keptIDs = append(keptIDs, ix.ids[i])
+	}
+	// Clear the tail so removed documents can be collected.
+	for i := len(kept); i < len(c.Documents); i++ {
+		c.Documents[i] = nil
+	}
+	c.Documents, ix.ids = kept, keptIDs
+	for i := positions[0]; i < len(ix.ids); i++ {
+		ix.pos[ix.ids[i]] = i
+	}
 }
@@ -1,66 +1,14 @@
 package engine
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-func TestCheckUniqueIndex_NoViolation(t *testing.T) {
-	existing := []bson.D{
-		{{Key: "email", Value: "a@b.com"}},
-	}
-	indexes := []IndexSpec{
-		{Name: "email_1", Keys: bson.D{{Key: "email", Value: int32(1)}}, Unique: true},
-	}
-	newDoc := bson.D{{Key: "email", Value: "c@d.com"}}
-	if err := CheckUniqueIndex(existing, indexes, newDoc); err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-}
-
-func TestCheckUniqueIndex_Violation(t *testing.T) {
-	existing := []bson.D{
-		{{Key: "email", Value: "a@b.com"}},
-	}
-	indexes := []IndexSpec{
-		{Name: "email_1", Keys: bson.D{{Key: "email", Value: int32(1)}}, Unique: true},
-	}
-	newDoc := bson.D{{Key: "email", Value: "a@b.com"}}
-	err := CheckUniqueIndex(existing, indexes, newDoc)
-	if err == nil {
-		t.Fatal("expected duplicate key error")
-	}
-	dupErr, ok := err.(*DuplicateKeyError)
-	if !ok {
-		t.Fatalf("expected *DuplicateKeyError, got %T: %v", err, err)
-	}
-	if dupErr.Index != "email_1" {
-		t.Fatalf("expected index name email_1, got %s", dupErr.Index)
-	}
-}
-
-func TestCheckUniqueIndex_NonUniqueIgnored(t *testing.T) {
-	existing := []bson.D{
-		{{Key: "tag", Value: "go"}},
-	}
-	indexes := []IndexSpec{
-		{Name: "tag_1", Keys: bson.D{{Key: "tag", Value: int32(1)}}, Unique: false},
-	}
-	newDoc := bson.D{{Key: "tag", Value: "go"}}
-	if err := CheckUniqueIndex(existing, indexes, newDoc); err != nil {
-		t.Fatalf("non-unique index should not raise error: %v", err)
-	}
-}
-
-func TestCheckUniqueIndex_NoIndexes(t *testing.T) {
-	existing := []bson.D{{{Key: "x", Value: 1}}}
-	if err := CheckUniqueIndex(existing, nil, bson.D{{Key: "x", Value: 1}}); err != nil {
-		t.Fatalf("no indexes: unexpected error: %v", err)
-	}
-}
-
 func TestDefaultIndexName_Single(t *testing.T) {
 	got := DefaultIndexName(bson.D{{Key: "email", Value: int32(1)}})
 	if got != "email_1" {
@@ -95,3 +43,538 @@ func TestDuplicateKeyError_Error(t *testing.T) {
 		t.Fatalf("error message should contain index name, got: %s", msg)
 	}
 }
+
+// ---- in-memory indexes ----
+
+// indexedColl returns the collection an engine holds for db.coll.
+func indexedColl(t *testing.T, eng *Engine, db, coll string) *Collection {
+	t.Helper()
+	c := eng.data.Databases[db].Collections[coll]
+	if c == nil || c.ix == nil {
+		t.Fatalf("expected indexed collection %s.%s", db, coll)
+	}
+	return c
+}
+
+func seedPeople(t *testing.T, eng *Engine) {
+	t.Helper()
+	mustInsert(t, eng, "db", "people",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "ann"}, {Key: "age", Value: int32(30)}, {Key: "tags", Value: bson.A{"a", "b"}}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "name", Value: "bob"}, {Key: "age", Value: int32(25)}, {Key: "tags", Value: bson.A{"b"}}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "name", Value: "cid"}, {Key: "age", Value: "unknown"}},
+		bson.D{{Key: "_id", Value: int32(4)}, {Key: "name", Value: "dee"}, {Key: "age", Value: 41.5}},
+		bson.D{{Key: "_id", Value: int32(5)}, {Key: "name", Value: "eve"}},
+	)
+	if err := eng.CreateIndexes("db", "people", []IndexSpec{
+		{Name: "age_1", Keys: bson.D{{Key: "age", Value: int32(1)}}},
+		{Name: "tags_1", Keys: bson.D{{Key: "tags", Value: int32(1)}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanner_ChoosesIndex(t *testing.T) {
+	eng, _ := newEng(t)
+	seedPeople(t, eng)
+	c := indexedColl(t, eng, "db", "people")
+
+	tests := []struct {
+		filter     bson.D
+		index      string
+		candidates int
+	}{
+		{bson.D{{Key: "age", Value: int32(25)}}, "age_1", 1},
+		{bson.D{{Key: "age", Value: bson.D{{Key: "$in", Value: bson.A{int32(25), 41.5}}}}}, "age_1", 2},
+		{bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: int32(30)}}}}, "age_1", 2},
+		{bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(20)}, {Key: "$lt", Value: int32(35)}}}}, "age_1", 2},
+		{bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: "v"}}}}, "age_1", 1},
+		{bson.D{{Key: "_id", Value: int32(3)}, {Key: "age", Value: bson.D{{Key: "$gt", Value: int32(0)}}}}, "_id_", 1},
+		{bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "tags", Value: "b"}}}}}, "tags_1", 2},
+		{bson.D{{Key: "name", Value: "ann"}}, "", 5},
+		{bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "age", Value: int32(25)}}}}}, "", 5},
+	}
+	for _, tt := range tests {
+		positions, plan := c.candidates(tt.filter, nil)
+		if plan.indexName() != tt.index || len(positions) != tt.candidates {
+			t.Errorf("filter %v: got index %q with %d candidates, want %q with %d",
+				tt.filter, plan.indexName(), len(positions), tt.index, tt.candidates)
+		}
+	}
+}
+
+func TestPlanner_SameResultsAsScan(t *testing.T) {
+	eng, _ := newEng(t)
+	seedPeople(t, eng)
+	c := indexedColl(t, eng, "db", "people")
+
+	filters := []bson.D{
+		{{Key: "age", Value: int32(30)}},
+		{{Key: "age", Value: 30.0}},
+		{{Key: "age", Value: nil}},
+		{{Key: "age", Value: bson.D{{Key: "$gte", Value: int32(25)}, {Key: "$lte", Value: int32(41)}}}},
+		{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(100)}}}},
+		{{Key: "age", Value: bson.D{{Key: "$gte", Value: ""}}}},
+		{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(1)}, {Key: "$lt", Value: "z"}}}},
+		{{Key: "age", Value: bson.D{{Key: "$in", Value: bson.A{"unknown", int64(25)}}}}},
+		{{Key: "tags", Value: bson.A{"a", "b"}}},
+		{{Key: "tags", Value: bson.D{{Key: "$eq", Value: "a"}}}},
+		{{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{int64(2), 4.0, int32(9)}}}}},
+		{{Key: "age", Value: bson.Regex{Pattern: "^unk"}}},
+		{{Key: "age", Value: bson.D{{Key: "$regex", Value: "^un"}, {Key: "$options", Value: "i"}}}},
+		{{Key: "tags", Value: bson.D{{Key: "$regex", Value: bson.Regex{Pattern: "^a"}}}}},
+		{{Key: "tags", Value: bson.D{{Key: "$gt", Value: "a"}, {Key: "$lt", Value: "b"}}}},
+		{{Key: "tags", Value: bson.D{{Key: "$ne", Value: "a"}}}},
+	}
+	for _, f := range filters {
+		got := c.find(f, nil)
+		want := FilterDocs(c.Documents, f)
+		if len(got) != len(want) {
+			t.Errorf("filter %v: index returned %d docs, scan %d", f, len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if !valuesEqual(got[i], want[i]) {
+				t.Errorf("filter %v: doc %d differs: %v vs %v", f, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestIndexes_MaintainedAcrossWrites(t *testing.T) {
+	eng, path := newEng(t)
+	seedPeople(t, eng)
+
+	eng.Update("db", "people", bson.D{{Key: "_id", Value: int32(2)}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(26)}}}}, nil, false, false, nil)
+	eng.Delete("db", "people", bson.D{{Key: "age", Value: int32(30)}}, false, nil)
+	eng.FindAndModify("db", "people", bson.D{{Key: "name", Value: "dee"}}, nil,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: int32(42)}}}}, nil, false, true, false, nil)
+	mustInsert(t, eng, "db", "people", bson.D{{Key: "_id", Value: int32(6)}, {Key: "age", Value: int32(25)}})
+
+	for _, e := range []*Engine{eng, reloadEng(t, path)} {
+		c := indexedColl(t, e, "db", "people")
+		for _, f := range []bson.D{
+			{{Key: "age", Value: int32(25)}},
+			{{Key: "age", Value: int32(26)}},
+			{{Key: "age", Value: int32(30)}},
+			{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(40)}}}},
+		} {
+			if got, want := len(c.find(f, nil)), len(FilterDocs(c.Documents, f)); got != want {
+				t.Errorf("filter %v: index returned %d docs, scan %d", f, got, want)
+			}
+		}
+		if n, _ := e.Count("db", "people", bson.D{{Key: "age", Value: int32(25)}}, nil); n != 1 {
+			t.Errorf("expected one doc with age 25, got %d", n)
+		}
+	}
+}
+
+func TestIndexes_DuplicateID(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "_id", Value: int32(1)}})
+
+	_, err := eng.Insert("db", "col", []bson.D{{{Key: "_id", Value: int64(1)}}})
+	dupErr, ok := err.(*DuplicateKeyError)
+	if !ok || dupErr.Index != "_id_" {
+		t.Fatalf("expected duplicate key error on _id_, got %v", err)
+	}
+}
+
+func TestIndexes_UniqueMultikey(t *testing.T) {
+	eng, _ := newEng(t)
+	eng.CreateIndexes("db", "col", []IndexSpec{{Name: "tags_1", Keys: bson.D{{Key: "tags", Value: int32(1)}}, Unique: true}})
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "tags", Value: bson.A{"a", "b"}}})
+
+	if _, err := eng.Insert("db", "col", []bson.D{{{Key: "tags", Value: bson.A{"b", "c"}}}}); err == nil {
+		t.Fatal("expected duplicate key error for shared array element")
+	}
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "tags", Value: bson.A{"c", "c"}}})
+}
+
+// uniqueEmails returns an engine whose db.users has a unique index on email
+// and two users, a@x (_id 1) and b@x (_id 2).
+func uniqueEmails(t *testing.T) *Engine {
+	t.Helper()
+	eng, _ := newEng(t)
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{Name: "email_1", Keys: bson.D{{Key: "email", Value: int32(1)}}, Unique: true}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "users",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "email", Value: "a@x"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "email", Value: "b@x"}},
+	)
+	return eng
+}
+
+func assertDupKey(t *testing.T, err error, index string) *DuplicateKeyError {
+	t.Helper()
+	dupErr, ok := err.(*DuplicateKeyError)
+	if !ok || dupErr.Index != index {
+		t.Fatalf("expected duplicate key error on %s, got %v", index, err)
+	}
+	return dupErr
+}
+
+func TestUniqueIndex_Update(t *testing.T) {
+	eng := uniqueEmails(t)
+	setEmail := bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: "a@x"}}}}
+
+	_, _, _, err := eng.Update("db", "users", bson.D{{Key: "_id", Value: int32(2)}}, setEmail, nil, false, false, nil)
+	dupErr := assertDupKey(t, err, "email_1")
+	if v, _ := GetField(dupErr.KeyValue, "email"); v != "a@x" || dupErr.Collection != "db.users" {
+		t.Fatalf("expected the error to name db.users and a@x, got %+v", dupErr)
+	}
+	if !strings.Contains(err.Error(), `"email":"a@x"`) {
+		t.Fatalf("expected the message to name the key, got %q", err)
+	}
+	if n, _ := eng.Count("db", "users", bson.D{{Key: "email", Value: "a@x"}}, nil); n != 1 {
+		t.Fatalf("the failed update was applied: %d users with a@x", n)
+	}
+
+	// Writing a document's own key back is not a conflict.
+	if _, _, _, err := eng.Update("db", "users", bson.D{{Key: "_id", Value: int32(1)}}, setEmail, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = eng.Update("db", "users", bson.D{{Key: "email", Value: "c@x"}}, setEmail, nil, false, true, nil)
+	assertDupKey(t, err, "email_1")
+}
+
+func TestUniqueIndex_FindAndModify(t *testing.T) {
+	eng := uniqueEmails(t)
+	setEmail := bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: "b@x"}}}}
+	_, err := eng.FindAndModify("db", "users", bson.D{{Key: "_id", Value: int32(1)}}, nil, setEmail, nil, false, true, false, nil)
+	assertDupKey(t, err, "email_1")
+	_, err = eng.FindAndModify("db", "users", bson.D{{Key: "_id", Value: int32(3)}}, nil, setEmail, nil, false, true, true, nil)
+	assertDupKey(t, err, "email_1")
+	if n, _ := eng.Count("db", "users", nil, nil); n != 2 {
+		t.Fatalf("expected 2 users, got %d", n)
+	}
+}
+
+func TestUniqueIndex_TxnUpdate(t *testing.T) {
+	eng := uniqueEmails(t)
+	tx := eng.Begin()
+	_, _, _, err := tx.Update("db", "users", bson.D{{Key: "_id", Value: int32(2)}}, bson.D{{Key: "$set", Value: bson.D{{Key: "email", Value: "a@x"}}}}, nil, false, false, nil)
+	assertDupKey(t, err, "email_1")
+}
+
+func TestCreateIndexes_UniqueOverDuplicates(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "items",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "sku", Value: "A"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "sku", Value: "B"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "sku", Value: "B"}},
+	)
+	err := eng.CreateIndexes("db", "items", []IndexSpec{
+		{Name: "sku_-1", Keys: bson.D{{Key: "sku", Value: int32(-1)}}},
+		{Name: "sku_1", Keys: bson.D{{Key: "sku", Value: int32(1)}}, Unique: true},
+	})
+	dupErr := assertDupKey(t, err, "sku_1")
+	if v, _ := GetField(dupErr.KeyValue, "sku"); v != "B" {
+		t.Fatalf("expected the duplicated key B, got %v", dupErr.KeyValue)
+	}
+	if specs := eng.ListIndexes("db", "items"); len(specs) != 1 {
+		t.Fatalf("a failed createIndexes should add no index, got %v", specs)
+	}
+	reloaded := reloadEng(t, path)
+	if specs := reloaded.ListIndexes("db", "items"); len(specs) != 1 {
+		t.Fatalf("a failed createIndexes should persist no index, got %v", specs)
+	}
+
+	// Documents missing the field share the null key.
+	mustInsert(t, eng, "db", "other", bson.D{{Key: "x", Value: int32(1)}}, bson.D{{Key: "x", Value: int32(2)}})
+	err = eng.CreateIndexes("db", "other", []IndexSpec{{Name: "sku_1", Keys: bson.D{{Key: "sku", Value: int32(1)}}, Unique: true}})
+	assertDupKey(t, err, "sku_1")
+}
+
+func TestRangeOperators_TypeBracketing(t *testing.T) {
+	if MatchDoc(bson.D{{Key: "x", Value: "abc"}}, bson.D{{Key: "x", Value: bson.D{{Key: "$gte", Value: int32(5)}}}}) {
+		t.Fatal("$gte on a number should not match a string")
+	}
+	if !MatchDoc(bson.D{{Key: "x", Value: int64(7)}}, bson.D{{Key: "x", Value: bson.D{{Key: "$gte", Value: 5.5}}}}) {
+		t.Fatal("$gte should compare numbers across numeric types")
+	}
+}
+
+func TestExplain_RangeBounds(t *testing.T) {
+	eng, _ := newEng(t)
+	seedPeople(t, eng)
+
+	x, err := eng.ExplainFind("db", "people", bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int32(26)}}}}, nil, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Index == nil || x.Index.Name != "age_1" {
+		t.Fatalf("expected age_1, got %+v", x.Index)
+	}
+	if len(x.IndexBounds) != 1 || x.IndexBounds[0] != "(26, inf.0]" {
+		t.Fatalf("unexpected bounds %v", x.IndexBounds)
+	}
+	// The scan stops after the first match because there is no sort.
+	if x.NReturned != 1 || x.DocsExamined != 1 || x.KeysExamined != 2 {
+		t.Fatalf("unexpected stats: returned=%d docs=%d keys=%d", x.NReturned, x.DocsExamined, x.KeysExamined)
+	}
+
+	x, _ = eng.ExplainFind("db", "missing", nil, nil, 0, 0, nil)
+	if x.Exists || getStage(x.Doc(VerbosityQueryPlanner)) != "EOF" {
+		t.Fatalf("expected EOF plan for a missing collection, got %v", x.Doc(VerbosityQueryPlanner))
+	}
+}
+
+func getStage(doc bson.D) interface{} {
+	qp, _ := GetField(doc, "queryPlanner.winningPlan.stage")
+	return qp
+}
+
+func TestPlanner_RegexPrefix(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "tests",
+		bson.D{{Key: "name", Value: "TestFind"}},
+		bson.D{{Key: "name", Value: "TestInsert"}},
+		bson.D{{Key: "name", Value: "BenchmarkFind"}},
+		bson.D{{Key: "name", Value: bson.Regex{Pattern: "^Test"}}},
+	)
+	if err := eng.CreateIndexes("db", "tests", []IndexSpec{{Name: "name_1", Keys: bson.D{{Key: "name", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := bson.D{{Key: "name", Value: bson.Regex{Pattern: "^Test"}}}
+	x, err := eng.ExplainFind("db", "tests", filter, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Index == nil || x.Index.Name != "name_1" {
+		t.Fatalf("expected name_1 index, got %+v", x.Index)
+	}
+	want := []string{`["Test", "Tesu")`, `[/^Test/, /^Test/]`}
+	if len(x.IndexBounds) != 2 || x.IndexBounds[0] != want[0] || x.IndexBounds[1] != want[1] {
+		t.Errorf("bounds = %v, want %v", x.IndexBounds, want)
+	}
+	if x.NReturned != 3 || x.KeysExamined != 3 {
+		t.Errorf("expected 3 returned and 3 keys examined, got %d and %d", x.NReturned, x.KeysExamined)
+	}
+
+	// Case-insensitive and unanchored patterns scan the collection.
+	for _, re := range []bson.Regex{{Pattern: "^test", Options: "i"}, {Pattern: "Find"}, {Pattern: "^Test|^Bench"}} {
+		x, _ := eng.ExplainFind("db", "tests", bson.D{{Key: "name", Value: re}}, nil, 0, 0, nil)
+		if x.Index != nil {
+			t.Errorf("%v: expected a collection scan, got %s", re, x.Index.Name)
+		}
+	}
+}
+
+func TestPlanner_RegexPrefixNonASCII(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "words",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "name", Value: "é…"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "name", Value: "é…"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "name", Value: "éa"}},
+		bson.D{{Key: "_id", Value: int32(4)}, {Key: "name", Value: "ÿ"}},
+		bson.D{{Key: "_id", Value: int32(5)}, {Key: "name", Value: "日本"}},
+		bson.D{{Key: "_id", Value: int32(6)}, {Key: "name", Value: "e"}},
+	)
+	patterns := []string{"^é*", "^é?", "^é{1}", "^é…", "^é", "^ÿ", "^日*", "^日本?", "^e"}
+	scanned := make(map[string][]int32)
+	for _, p := range patterns {
+		docs, err := eng.Find("db", "words", bson.D{{Key: "name", Value: bson.Regex{Pattern: p}}}, nil, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned[p] = sortedIDs(docs)
+	}
+	if err := eng.CreateIndexes("db", "words", []IndexSpec{{Name: "name_1", Keys: bson.D{{Key: "name", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range patterns {
+		docs, _ := eng.Find("db", "words", bson.D{{Key: "name", Value: bson.Regex{Pattern: p}}}, nil, 0, 0, nil)
+		if got := sortedIDs(docs); fmt.Sprint(got) != fmt.Sprint(scanned[p]) {
+			t.Errorf("%s: index scan = %v, collection scan = %v", p, got, scanned[p])
+		}
+	}
+}
+
+// sortedIDs returns the int32 _ids of docs in ascending order, so results of
+// an index scan compare equal to those of a collection scan.
+func sortedIDs(docs []bson.D) []int32 {
+	var ids []int32
+	for _, id := range docIDs(docs) {
+		ids = append(ids, id.(int32))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestPlanner_DottedArrayPath(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "orders",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}, bson.D{{Key: "sku", Value: "B2"}}}}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "B2"}}}}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "items", Value: bson.D{{Key: "sku", Value: "C3"}}}},
+	)
+	if err := eng.CreateIndexes("db", "orders", []IndexSpec{{Name: "items.sku_1", Keys: bson.D{{Key: "items.sku", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	c := indexedColl(t, eng, "db", "orders")
+	for _, tt := range []struct {
+		sku  string
+		want int
+	}{{"A1", 1}, {"B2", 2}, {"C3", 1}, {"D4", 0}} {
+		f := bson.D{{Key: "items.sku", Value: tt.sku}}
+		positions, plan := c.candidates(f, nil)
+		if plan.indexName() != "items.sku_1" || len(positions) != tt.want {
+			t.Errorf("%s: got index %q with %d candidates, want items.sku_1 with %d", tt.sku, plan.indexName(), len(positions), tt.want)
+		}
+		if got := len(c.find(f, nil)); got != tt.want {
+			t.Errorf("%s: found %d docs, want %d", tt.sku, got, tt.want)
+		}
+	}
+	if !c.ix.indexes[1].multikey {
+		t.Error("expected items.sku_1 to be multikey")
+	}
+}
+
+// ---- sparse and partial indexes ----
+
+func TestUniqueIndex_Sparse(t *testing.T) {
+	eng, _ := newEng(t)
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{Keys: bson.D{{Key: "email", Value: int32(1)}}, Unique: true, Sparse: true}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "users",
+		bson.D{{Key: "_id", Value: int32(1)}},
+		bson.D{{Key: "_id", Value: int32(2)}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "email", Value: "a@x"}},
+	)
+	_, err := eng.Insert("db", "users", []bson.D{{{Key: "_id", Value: int32(4)}, {Key: "email", Value: "a@x"}}})
+	assertDupKey(t, err, "email_1")
+	// A null value is present, so it is indexed.
+	mustInsert(t, eng, "db", "users", bson.D{{Key: "_id", Value: int32(5)}, {Key: "email", Value: nil}})
+	_, err = eng.Insert("db", "users", []bson.D{{{Key: "_id", Value: int32(6)}, {Key: "email", Value: nil}}})
+	assertDupKey(t, err, "email_1")
+
+	c := indexedColl(t, eng, "db", "users")
+	if got := len(c.ix.indexes[1].entries); got != 2 {
+		t.Errorf("sparse index has %d entries, want 2", got)
+	}
+	// Missing fields match null, which the sparse index cannot answer.
+	nullFilter := bson.D{{Key: "email", Value: nil}}
+	if _, plan := c.candidates(nullFilter, nil); plan.indexName() != "" {
+		t.Errorf("null query used %q, want a collection scan", plan.indexName())
+	}
+	if got := len(c.find(nullFilter, nil)); got != 3 {
+		t.Errorf("null query found %d docs, want 3", got)
+	}
+	if _, plan := c.candidates(bson.D{{Key: "email", Value: "a@x"}}, nil); plan.indexName() != "email_1" {
+		t.Errorf("equality query used %q, want email_1", plan.indexName())
+	}
+}
+
+func TestUniqueIndex_Partial(t *testing.T) {
+	eng, _ := newEng(t)
+	active := bson.D{{Key: "active", Value: true}}
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{Keys: bson.D{{Key: "email", Value: int32(1)}}, Unique: true, PartialFilterExpression: active}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "users",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "email", Value: "a@x"}, {Key: "active", Value: true}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "email", Value: "a@x"}, {Key: "active", Value: false}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "email", Value: "a@x"}},
+	)
+	_, err := eng.Insert("db", "users", []bson.D{{{Key: "_id", Value: int32(4)}, {Key: "email", Value: "a@x"}, {Key: "active", Value: true}}})
+	assertDupKey(t, err, "email_1")
+
+	// Updating a document into the filter expression checks it too.
+	_, _, _, err = eng.Update("db", "users", bson.D{{Key: "_id", Value: int32(2)}}, bson.D{{Key: "$set", Value: active}}, nil, false, false, nil)
+	assertDupKey(t, err, "email_1")
+
+	c := indexedColl(t, eng, "db", "users")
+	tests := []struct {
+		filter bson.D
+		index  string
+		found  int
+	}{
+		{bson.D{{Key: "email", Value: "a@x"}}, "", 3},
+		{bson.D{{Key: "email", Value: "a@x"}, {Key: "active", Value: true}}, "email_1", 1},
+		{bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "active", Value: true}}, bson.D{{Key: "email", Value: "a@x"}}}}}, "email_1", 1},
+		{bson.D{{Key: "email", Value: "a@x"}, {Key: "active", Value: false}}, "", 1},
+	}
+	for _, tt := range tests {
+		_, plan := c.candidates(tt.filter, nil)
+		if plan.indexName() != tt.index {
+			t.Errorf("filter %v: used %q, want %q", tt.filter, plan.indexName(), tt.index)
+		}
+		if got := len(c.find(tt.filter, nil)); got != tt.found {
+			t.Errorf("filter %v: found %d docs, want %d", tt.filter, got, tt.found)
+		}
+	}
+}
+
+func TestFilterImplies(t *testing.T) {
+	expr := bson.D{{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(5)}}}}
+	tests := []struct {
+		filter bson.D
+		want   bool
+	}{
+		{bson.D{{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(5)}}}}, true},
+		{bson.D{{Key: "qty", Value: int32(10)}}, true},
+		{bson.D{{Key: "qty", Value: bson.D{{Key: "$eq", Value: int32(10)}}}}, true},
+		{bson.D{{Key: "qty", Value: int32(3)}}, false},
+		{bson.D{{Key: "qty", Value: bson.D{{Key: "$gt", Value: int32(10)}}}}, false},
+		{bson.D{{Key: "name", Value: "x"}}, false},
+	}
+	for _, tt := range tests {
+		if got := filterImplies(tt.filter, expr); got != tt.want {
+			t.Errorf("filterImplies(%v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestCreateIndexes_Options(t *testing.T) {
+	ttl := func(n int64) *int64 { return &n }
+	email := bson.D{{Key: "email", Value: int32(1)}}
+	tests := []struct {
+		name string
+		spec IndexSpec
+		code int32
+	}{
+		{"no keys", IndexSpec{Name: "x"}, 67},
+		{"sparse and partial", IndexSpec{Keys: email, Sparse: true, PartialFilterExpression: bson.D{{Key: "a", Value: int32(1)}}}, 67},
+		{"compound TTL", IndexSpec{Keys: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}}, ExpireAfterSeconds: ttl(60)}, 67},
+		{"_id TTL", IndexSpec{Keys: bson.D{{Key: "_id", Value: int32(1)}}, ExpireAfterSeconds: ttl(60)}, 67},
+		{"negative TTL", IndexSpec{Keys: email, ExpireAfterSeconds: ttl(-1)}, 67},
+		{"same name, other options", IndexSpec{Name: "email_1", Keys: email, Unique: true}, 85},
+	}
+	eng, path := newEng(t)
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{Name: "email_1", Keys: email}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		err := eng.CreateIndexes("db", "users", []IndexSpec{tt.spec})
+		ie, ok := err.(*CommandError)
+		if !ok || ie.Code != tt.code {
+			t.Errorf("%s: got %v, want code %d", tt.name, err, tt.code)
+		}
+	}
+	// Creating the same index again is a no-op.
+	if err := eng.CreateIndexes("db", "users", []IndexSpec{{Name: "email_1", Keys: bson.D{{Key: "email", Value: 1.0}}}}); err != nil {
+		t.Errorf("recreate: %v", err)
+	}
+
+	specs := []IndexSpec{
+		{Name: "nick_1", Keys: bson.D{{Key: "nick", Value: int32(1)}}, Unique: true, Sparse: true},
+		{Name: "seen_1", Keys: bson.D{{Key: "seen", Value: int32(1)}}, ExpireAfterSeconds: ttl(0)},
+		{Name: "code_1", Keys: bson.D{{Key: "code", Value: int32(1)}}, PartialFilterExpression: bson.D{{Key: "code", Value: bson.D{{Key: "$exists", Value: true}}}}},
+	}
+	if err := eng.CreateIndexes("db", "users", specs); err != nil {
+		t.Fatal(err)
+	}
+	got := reloadEng(t, path).ListIndexes("db", "users")
+	if len(got) != 5 {
+		t.Fatalf("got %d indexes after reload, want 5", len(got))
+	}
+	for i, want := range specs {
+		if !sameIndex(got[2+i], want) {
+			t.Errorf("reloaded %+v, want %+v", got[2+i], want)
+		}
+	}
+}
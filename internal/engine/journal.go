@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// DefaultCompactThreshold is the number of journal records after which a
+// journaling engine folds the journal back into the data file.
+const DefaultCompactThreshold = 1000
+
+// Journal operations. Records describe the resulting state of a document,
+// collection or index list rather than the command that produced it, so
+// replaying a journal over the data file generation it was written against
+// is deterministic and idempotent.
+const (
+	journalPut          = "put"          // insert or replace the document with Doc's _id
+	journalDelete       = "delete"       // remove the document whose _id is ID
+	journalCreateColl   = "create"       // ensure the collection exists, capped if Capped is set
+	journalDropColl     = "drop"         // remove the collection
+	journalDropDatabase = "dropDatabase" // remove the database
+	journalIndexes      = "indexes"      // replace the collection's index list
+	journalCreateView   = "createView"   // define the view named Coll as View
+	journalDropView     = "dropView"     // remove the view named Coll
+)
+
+// journalEntry is one ndjson record of the write-ahead journal.
+type journalEntry struct {
+	Op      string         `bson:"op"`
+	DB      string         `bson:"db"`
+	Coll    string         `bson:"coll,omitempty"`
+	Doc     bson.D         `bson:"doc"`
+	ID      interface{}    `bson:"id"`
+	Indexes []IndexSpec    `bson:"indexes,omitempty"`
+	Capped  *CappedOptions `bson:"capped,omitempty"`
+	View    *View          `bson:"view,omitempty"`
+
+	// Generation is the data file generation the record was appended to. A
+	// crash between rewriting the data file and removing the journal leaves
+	// records of an older generation behind; replay skips them.
+	Generation int64 `bson:"generation,omitempty"`
+
+	// For change events, not journaled: the document a put replaced (nil
+	// for an insert) and whether it was replaced whole rather than updated.
+	prev    bson.D
+	replace bool
+}
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// appendJournal appends entries, written against data file generation
+// generation, to the journal file in a single write. A torn record left at
+// the end by an interrupted write is cut off first, otherwise it would end up
+// in the middle of the file where replay rejects it.
+func appendJournal(path string, generation int64, entries []journalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		entry.Generation = generation
+		line, err := bson.MarshalExtJSON(entry, false, false)
+		if err != nil {
+			return fmt.Errorf("marshal journal entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	end, err := journalEnd(f)
+	if err == nil {
+		_, err = f.WriteAt(buf.Bytes(), end)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("append journal: %w", err)
+	}
+	return f.Close()
+}
+
+// journalEnd returns the offset just past the last complete record in the
+// journal, truncating anything after it. Every record ends with a newline, so
+// a file that does not is torn.
+func journalEnd(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return 0, err
+	}
+	end := int64(bytes.LastIndexByte(data, '\n') + 1)
+	return end, f.Truncate(end)
+}
+
+// removeJournal deletes the journal file once its records have been folded
+// into the data file.
+func removeJournal(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove journal: %w", err)
+	}
+	return nil
+}
+
+// replayJournal applies the records in the journal file to s and returns the
+// number of records applied. A final line without its newline is torn (a
+// write interrupted by a crash) and ignored; a malformed line anywhere else
+// is an error. Records of another data file generation than s's are already
+// part of the data file and skipped.
+func replayJournal(path string, s *Store) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read journal: %w", err)
+	}
+
+	r := newJournalReplayer(s)
+	n := 0
+	lines := bytes.Split(data, []byte("\n"))
+	// The element after the last newline is empty unless the final record is
+	// torn; either way it is not replayed.
+	lines = lines[:len(lines)-1]
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := bson.UnmarshalExtJSON(line, false, &entry); err != nil {
+			return n, fmt.Errorf("journal line %d: %w", i+1, err)
+		}
+		if entry.Generation != s.Generation {
+			continue
+		}
+		r.apply(entry)
+		n++
+	}
+	r.finish()
+	return n, nil
+}
+
+// journalReplayer applies journal records to a store. It keeps an _id
+// position map per collection so replaying N records stays linear.
+type journalReplayer struct {
+	store     *Store
+	positions map[*Collection]map[string]int
+}
+
+func newJournalReplayer(s *Store) *journalReplayer {
+	return &journalReplayer{store: s, positions: make(map[*Collection]map[string]int)}
+}
+
+func (r *journalReplayer) collPositions(c *Collection) map[string]int {
+	pos, ok := r.positions[c]
+	if !ok {
+		pos = make(map[string]int, len(c.Documents))
+		for i, doc := range c.Documents {
+			if doc == nil {
+				continue
+			}
+			id, _ := GetField(doc, "_id")
+			pos[idKey(id)] = i
+		}
+		r.positions[c] = pos
+	}
+	return pos
+}
+
+func (r *journalReplayer) apply(entry journalEntry) {
+	switch entry.Op {
+	case journalPut:
+		c := r.store.GetOrCreateDB(entry.DB).GetOrCreateColl(entry.Coll)
+		pos := r.collPositions(c)
+		id, _ := GetField(entry.Doc, "_id")
+		key := idKey(id)
+		if i, ok := pos[key]; ok {
+			c.Documents[i] = entry.Doc
+			return
+		}
+		pos[key] = len(c.Documents)
+		c.Documents = append(c.Documents, entry.Doc)
+	case journalDelete:
+		d := r.store.Databases[entry.DB]
+		if d == nil || d.Collections[entry.Coll] == nil {
+			return
+		}
+		c := d.Collections[entry.Coll]
+		pos := r.collPositions(c)
+		key := idKey(entry.ID)
+		if i, ok := pos[key]; ok {
+			// Leave a hole and compact once in finish, so deletes stay O(1).
+			c.Documents[i] = nil
+			delete(pos, key)
+		}
+	case journalCreateColl:
+		c := r.store.GetOrCreateDB(entry.DB).GetOrCreateColl(entry.Coll)
+		if entry.Capped != nil {
+			c.Capped = entry.Capped
+		}
+	case journalDropColl:
+		if d := r.store.Databases[entry.DB]; d != nil {
+			if c := d.Collections[entry.Coll]; c != nil {
+				delete(r.positions, c)
+				delete(d.Collections, entry.Coll)
+			}
+		}
+	case journalDropDatabase:
+		if d := r.store.Databases[entry.DB]; d != nil {
+			for _, c := range d.Collections {
+				delete(r.positions, c)
+			}
+			delete(r.store.Databases, entry.DB)
+		}
+	case journalIndexes:
+		c := r.store.GetOrCreateDB(entry.DB).GetOrCreateColl(entry.Coll)
+		c.Indexes = entry.Indexes
+	case journalCreateView:
+		d := r.store.GetOrCreateDB(entry.DB)
+		if d.Views == nil {
+			d.Views = make(map[string]*View)
+		}
+		d.Views[entry.Coll] = entry.View
+	case journalDropView:
+		if d := r.store.Databases[entry.DB]; d != nil {
+			delete(d.Views, entry.Coll)
+		}
+	}
+}
+
+// finish removes the holes left by deletes and restores the on-disk order.
+func (r *journalReplayer) finish() {
+	for c := range r.positions {
+		kept := c.Documents[:0]
+		for _, doc := range c.Documents {
+			if doc != nil {
+				kept = append(kept, doc)
+			}
+		}
+		c.Documents = kept
+	}
+	sortStore(r.store)
+}
+
+// idKey returns a canonical string for an _id value. Numeric ids compare by
+// value, so int32(1), int64(1) and 1.0 share a key, as they do in MongoDB.
+func idKey(id interface{}) string {
+	if isNumeric(id) {
+		return "number:" + strconv.FormatFloat(toFloat64(id), 'g', -1, 64)
+	}
+	return groupKeyString(id)
+}
+
+// ---- recording ----
+
+// record queues an entry for the next save, which appends it to the journal
+// when the engine is journaling and publishes it as a change event.
+func (s *state) record(entry journalEntry) {
+	s.pending = append(s.pending, entry)
+}
+
+// recordPut records an inserted document.
+func (s *state) recordPut(db, coll string, doc bson.D) {
+	s.record(journalEntry{Op: journalPut, DB: db, Coll: coll, Doc: doc})
+}
+
+// recordUpdate records that doc replaced prev, either whole (a replacement
+// document) or through update operators.
+func (s *state) recordUpdate(db, coll string, prev, doc bson.D, replace bool) {
+	s.record(journalEntry{Op: journalPut, DB: db, Coll: coll, Doc: doc, prev: prev, replace: replace})
+}
+
+func (s *state) recordDelete(db, coll string, doc bson.D) {
+	id, _ := GetField(doc, "_id")
+	s.record(journalEntry{Op: journalDelete, DB: db, Coll: coll, ID: id})
+}
+
+func (s *state) recordIndexes(db, coll string, indexes []IndexSpec) {
+	s.record(journalEntry{Op: journalIndexes, DB: db, Coll: coll, Indexes: indexes})
+}
+
+// Compact folds the journal into the data file and removes it. It is a no-op
+// for the data file's contents, and safe to call whether or not the engine is
+// journaling.
+func (e *Engine) Compact() error {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return e.writeStore()
+}
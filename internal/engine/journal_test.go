@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func newJournalEng(t *testing.T, threshold int) (*Engine, string) {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "test.json")
+	eng, err := NewWithOptions(f, Options{Journal: true, CompactThreshold: threshold})
+	if err != nil {
+		t.Fatalf("NewWithOptions: %v", err)
+	}
+	return eng, f
+}
+
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(journalPath(path))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestJournal_AppendsInsteadOfRewriting(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	for i := 0; i < 5; i++ {
+		mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(i)}})
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected data file not to be written yet, stat err=%v", err)
+	}
+	if n := journalLines(t, path); n != 5 {
+		t.Fatalf("expected 5 journal records, got %d", n)
+	}
+
+	// A non-journaling reader replays the journal on load.
+	n, err := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 docs after replay, got %d err=%v", n, err)
+	}
+}
+
+func TestJournal_ReplaysUpdatesAndDeletes(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "status", Value: "pending"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "status", Value: "pending"}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "status", Value: "pending"}},
+	)
+	eng.Update("db", "col", bson.D{{Key: "_id", Value: int32(1)}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "done"}}}}, nil, false, false, nil)
+	eng.Delete("db", "col", bson.D{{Key: "_id", Value: int32(2)}}, false, nil)
+	eng.FindAndModify("db", "col", bson.D{{Key: "_id", Value: int32(3)}}, nil,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "claimed"}}}}, nil, false, true, false, nil)
+	eng.CreateIndexes("db", "col", []IndexSpec{{Name: "status_1", Keys: bson.D{{Key: "status", Value: int32(1)}}}})
+
+	got := reloadEng(t, path)
+	docs, err := got.Find("db", "col", bson.D{}, bson.D{{Key: "_id", Value: int32(1)}}, 0, 0, nil)
+	if err != nil || len(docs) != 2 {
+		t.Fatalf("expected 2 docs, got %v err=%v", docs, err)
+	}
+	if s, _ := GetField(docs[0], "status"); s != "done" {
+		t.Fatalf("expected _id 1 done, got %v", s)
+	}
+	if s, _ := GetField(docs[1], "status"); s != "claimed" {
+		t.Fatalf("expected _id 3 claimed, got %v", s)
+	}
+	if idxs := got.ListIndexes("db", "col"); len(idxs) != 2 {
+		t.Fatalf("expected _id_ + status_1, got %v", idxs)
+	}
+}
+
+func TestJournal_ReplaysDrops(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "keep", bson.D{{Key: "x", Value: int32(1)}})
+	mustInsert(t, eng, "db", "gone", bson.D{{Key: "x", Value: int32(1)}})
+	mustInsert(t, eng, "other", "col", bson.D{{Key: "x", Value: int32(1)}})
+	eng.DropCollection("db", "gone")
+	eng.DropDatabase("other")
+	eng.CreateCollection("db", "empty")
+
+	got := reloadEng(t, path)
+	colls := got.ListCollections("db")
+	if len(colls) != 2 {
+		t.Fatalf("expected keep + empty, got %v", colls)
+	}
+	if dbs := got.ListDatabases(); len(dbs) != 1 || dbs[0] != "db" {
+		t.Fatalf("expected only db, got %v", dbs)
+	}
+}
+
+func TestJournal_CompactsAtThreshold(t *testing.T) {
+	eng, path := newJournalEng(t, 3)
+	for i := 0; i < 4; i++ {
+		mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(i)}})
+	}
+	// Records 1-2 were journaled, the third write hit the threshold and
+	// rewrote the data file, the fourth started a new journal.
+	if n := journalLines(t, path); n != 1 {
+		t.Fatalf("expected 1 journal record after compaction, got %d", n)
+	}
+	base, err := readStoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(base.Databases["db"].Collections["col"].Documents); n != 3 {
+		t.Fatalf("expected 3 docs folded into the data file, got %d", n)
+	}
+	n, _ := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if n != 4 {
+		t.Fatalf("expected 4 docs, got %d", n)
+	}
+}
+
+func TestJournal_Compact(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}}, bson.D{{Key: "n", Value: int32(2)}})
+
+	if err := eng.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected journal removed, stat err=%v", err)
+	}
+	n, _ := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if n != 2 {
+		t.Fatalf("expected 2 docs, got %d", n)
+	}
+}
+
+func TestJournal_NonJournalingWriterFoldsJournal(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}})
+
+	plain := reloadEng(t, path)
+	mustInsert(t, plain, "db", "col", bson.D{{Key: "n", Value: int32(2)}})
+	if _, err := os.Stat(journalPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected journal folded, stat err=%v", err)
+	}
+
+	// The journaling engine notices the rewrite and keeps appending on top.
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(3)}})
+	n, _ := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if n != 3 {
+		t.Fatalf("expected 3 docs, got %d", n)
+	}
+}
+
+func TestJournal_IgnoresTornFinalLine(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}})
+
+	f, err := os.OpenFile(journalPath(path), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","db":"db","coll":"col","doc":{"_id":`)
+	f.Close()
+
+	n, err := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 doc, got %d err=%v", n, err)
+	}
+}
+
+func TestJournal_AppendsAfterTornFinalLine(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}})
+
+	f, err := os.OpenFile(journalPath(path), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","db":"db","coll":"col","doc":{"_id":`)
+	f.Close()
+
+	// The next write cuts off the torn record instead of burying it.
+	eng, err = NewWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(2)}})
+	if n := journalLines(t, path); n != 2 {
+		t.Fatalf("expected 2 journal records, got %d", n)
+	}
+	n, err := reloadEng(t, path).Count("db", "col", bson.D{}, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 docs, got %d err=%v", n, err)
+	}
+}
+
+func TestJournal_SkipsJournalLeftBehindByCompaction(t *testing.T) {
+	eng, path := newJournalEng(t, 3)
+	mustInsert(t, eng, "db", "col",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "status", Value: "old"}},
+	)
+	mustInsert(t, eng, "db", "col",
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "status", Value: "old"}},
+	)
+	stale, err := os.ReadFile(journalPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The third record compacts the journal into the data file.
+	if _, _, _, err := eng.Update("db", "col", bson.D{{Key: "_id", Value: int32(1)}}, bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "new"}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journalPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected the journal to be compacted, stat err=%v", err)
+	}
+
+	// Simulate a crash after the data file was renamed into place but
+	// before the old journal was removed.
+	if err := os.WriteFile(journalPath(path), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	eng, err = NewWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Delete("db", "col", bson.D{{Key: "_id", Value: int32(2)}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := reloadEng(t, path).Find("db", "col", bson.D{}, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 doc, got %v", docs)
+	}
+	if status, _ := GetField(docs[0], "status"); status != "new" {
+		t.Fatalf("expected the update to survive, got status %v", status)
+	}
+}
+
+func TestJournal_RejectsCorruptRecord(t *testing.T) {
+	eng, path := newJournalEng(t, 0)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "n", Value: int32(1)}})
+
+	data, _ := os.ReadFile(journalPath(path))
+	os.WriteFile(journalPath(path), append([]byte("not json\n"), data...), 0644)
+
+	if _, err := New(path); err == nil {
+		t.Fatal("expected error for corrupt journal record")
+	}
+}
@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockFile opens the sidecar lock file at path and takes an advisory lock on
+// it, blocking until the lock is available. Exclusive locks are taken around
+// load-modify-save cycles; shared locks are taken while reading the data file.
+//
+// If a shared lock cannot be taken because the lock file cannot be created
+// (for example on a read-only directory), lockFile returns a nil file and no
+// error: saves are atomic renames, so an unlocked reader still sees a
+// consistent file.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		if !exclusive {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// unlockFile releases a lock taken with lockFile. A nil file is a no-op.
+func unlockFile(f *os.File) {
+	if f == nil {
+		return
+	}
+	funlock(f)
+	f.Close()
+}
+
+// fileStamp identifies one version of a file on disk. Every save replaces
+// the data file through a rename and every journal write grows the journal,
+// so a changed stamp means another process (or another Engine) has written.
+type fileStamp struct {
+	info    os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+// statFile returns the stamp of the file at path. A missing file yields the
+// zero stamp.
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fileStamp{}, nil
+		}
+		return fileStamp{}, fmt.Errorf("stat store file: %w", err)
+	}
+	return fileStamp{info: info, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (s fileStamp) equal(o fileStamp) bool {
+	if s.info == nil || o.info == nil {
+		return s.info == nil && o.info == nil
+	}
+	return os.SameFile(s.info, o.info) && s.size == o.size && s.modTime.Equal(o.modTime)
+}
+
+// storeStamp identifies the on-disk state of a data file and its journal.
+type storeStamp struct {
+	data    fileStamp
+	journal fileStamp
+}
+
+func statStore(path string) (storeStamp, error) {
+	data, err := statFile(path)
+	if err != nil {
+		return storeStamp{}, err
+	}
+	journal, err := statFile(journalPath(path))
+	if err != nil {
+		return storeStamp{}, err
+	}
+	return storeStamp{data: data, journal: journal}, nil
+}
+
+func (s storeStamp) equal(o storeStamp) bool {
+	return s.data.equal(o.data) && s.journal.equal(o.journal)
+}
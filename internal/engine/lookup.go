@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// lookupSpec is a parsed $lookup stage. The equality form sets localField
+// and foreignField, the correlated form sets pipeline and optionally let;
+// both may be combined.
+type lookupSpec struct {
+	db, from                 string // db is empty for the pipeline's database
+	localField, foreignField string
+	let                      bson.D
+	pipeline                 []bson.D
+	as                       string
+}
+
+func parseLookup(spec bson.D) (*lookupSpec, error) {
+	l := &lookupSpec{}
+	hasFrom, hasLocal, hasForeign, hasPipeline := false, false, false, false
+	var err error
+	for _, f := range spec {
+		switch f.Key {
+		case "from":
+			if l.db, l.from, err = stageNamespace("$lookup", f.Value, ""); err != nil {
+				return nil, err
+			}
+			hasFrom = true
+		case "localField":
+			l.localField, hasLocal = f.Value.(string)
+			if !hasLocal {
+				return nil, fmt.Errorf("$lookup 'localField' must be a string")
+			}
+		case "foreignField":
+			l.foreignField, hasForeign = f.Value.(string)
+			if !hasForeign {
+				return nil, fmt.Errorf("$lookup 'foreignField' must be a string")
+			}
+		case "let":
+			let, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$lookup 'let' must be a document")
+			}
+			if err := checkVarNames(let); err != nil {
+				return nil, err
+			}
+			l.let = let
+		case "pipeline":
+			if l.pipeline, err = subPipeline("$lookup", f.Value); err != nil {
+				return nil, err
+			}
+			hasPipeline = true
+		case "as":
+			as, ok := f.Value.(string)
+			if !ok || as == "" {
+				return nil, fmt.Errorf("$lookup 'as' must be a non-empty string")
+			}
+			l.as = as
+		default:
+			return nil, fmt.Errorf("$lookup: unknown argument %q", f.Key)
+		}
+	}
+	switch {
+	case !hasFrom:
+		return nil, fmt.Errorf("$lookup requires a 'from' field")
+	case l.as == "":
+		return nil, fmt.Errorf("$lookup requires an 'as' field")
+	case hasLocal != hasForeign:
+		return nil, fmt.Errorf("$lookup requires both or neither of 'localField' and 'foreignField'")
+	case !hasLocal && !hasPipeline:
+		return nil, fmt.Errorf("$lookup requires either 'pipeline' or both 'localField' and 'foreignField'")
+	case l.let != nil && !hasPipeline:
+		return nil, fmt.Errorf("$lookup 'let' requires a 'pipeline'")
+	}
+	return l, nil
+}
+
+// lookupDocs adds to each document the array of documents from another
+// collection that match it: by equality of localField and foreignField, by
+// the sub-pipeline run with the document's let variables, or both.
+func lookupDocs(docs []bson.D, spec bson.D, lookupFn LookupFunc, collation *Collation) ([]bson.D, error) {
+	if lookupFn == nil {
+		return nil, fmt.Errorf("$lookup not supported without lookup function")
+	}
+	l, err := parseLookup(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []bson.D
+	for _, doc := range docs {
+		var filter bson.D
+		if l.localField != "" {
+			localVal, _ := GetField(doc, l.localField)
+			// An array local value matches each of its elements.
+			if arr, ok := localVal.(bson.A); ok {
+				filter = bson.D{{Key: l.foreignField, Value: bson.D{{Key: "$in", Value: arr}}}}
+			} else {
+				filter = bson.D{{Key: l.foreignField, Value: localVal}}
+			}
+		}
+		matched, err := lookupFn(l.db, l.from, filter)
+		if err != nil {
+			return nil, err
+		}
+		if l.pipeline != nil {
+			vars := bson.D{}
+			for _, v := range l.let {
+				vars = append(vars, bson.E{Key: v.Key, Value: evalExpr(doc, v.Value)})
+			}
+			if matched, err = runSubPipeline(matched, bindVars(l.pipeline, vars), lookupFn, collation); err != nil {
+				return nil, err
+			}
+		}
+		// Convert to bson.A
+		matchedArr := bson.A{}
+		for _, m := range matched {
+			matchedArr = append(matchedArr, m)
+		}
+		newDoc, err := CopyDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		newDoc = SetField(newDoc, l.as, matchedArr)
+		result = append(result, newDoc)
+	}
+	return result, nil
+}
+
+// graphLookupDocs adds to each document the documents reachable from it by
+// recursively matching connectFromField values against connectToField,
+// starting from the startWith expression.
+func graphLookupDocs(docs []bson.D, spec bson.D, lookupFn LookupFunc) ([]bson.D, error) {
+	if lookupFn == nil {
+		return nil, fmt.Errorf("$graphLookup not supported without lookup function")
+	}
+	var db, from, connectFrom, connectTo, as, depthField string
+	var startWith interface{}
+	var restrict bson.D
+	maxDepth := int64(-1)
+	hasFrom, hasStart := false, false
+	var err error
+	for _, f := range spec {
+		switch f.Key {
+		case "from":
+			if db, from, err = stageNamespace("$graphLookup", f.Value, ""); err != nil {
+				return nil, err
+			}
+			hasFrom = true
+		case "startWith":
+			startWith, hasStart = f.Value, true
+		case "connectFromField", "connectToField", "as", "depthField":
+			s, ok := f.Value.(string)
+			if !ok || s == "" || strings.HasPrefix(s, "$") {
+				return nil, fmt.Errorf("$graphLookup '%s' must be a field name", f.Key)
+			}
+			switch f.Key {
+			case "connectFromField":
+				connectFrom = s
+			case "connectToField":
+				connectTo = s
+			case "as":
+				as = s
+			default:
+				depthField = s
+			}
+		case "maxDepth":
+			if !isNumeric(f.Value) || toFloat64(f.Value) < 0 || toFloat64(f.Value) != float64(toInt64(f.Value)) {
+				return nil, fmt.Errorf("$graphLookup 'maxDepth' must be a non-negative integer")
+			}
+			maxDepth = toInt64(f.Value)
+		case "restrictSearchWithMatch":
+			m, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$graphLookup 'restrictSearchWithMatch' must be a document")
+			}
+			restrict = m
+		default:
+			return nil, fmt.Errorf("$graphLookup: unknown argument %q", f.Key)
+		}
+	}
+	if !hasFrom || !hasStart || connectFrom == "" || connectTo == "" || as == "" {
+		return nil, fmt.Errorf("$graphLookup requires 'from', 'startWith', 'connectFromField', 'connectToField' and 'as'")
+	}
+
+	var result []bson.D
+	for _, doc := range docs {
+		found := bson.A{}
+		seen := make(map[string]bool)
+		values := graphValues(nil, evalExpr(doc, startWith))
+		for depth := int64(0); len(values) > 0 && (maxDepth < 0 || depth <= maxDepth); depth++ {
+			filter := bson.D{{Key: connectTo, Value: bson.D{{Key: "$in", Value: values}}}}
+			if restrict != nil {
+				filter = bson.D{{Key: "$and", Value: bson.A{filter, restrict}}}
+			}
+			matched, err := lookupFn(db, from, filter)
+			if err != nil {
+				return nil, err
+			}
+			values = nil
+			for _, m := range matched {
+				key := docIDKey(m)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				v, _ := GetField(m, connectFrom)
+				values = graphValues(values, v)
+				if depthField != "" {
+					if m, err = CopyDoc(m); err != nil {
+						return nil, err
+					}
+					m = SetField(m, depthField, depth)
+				}
+				found = append(found, m)
+			}
+		}
+		newDoc, err := CopyDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, SetField(newDoc, as, found))
+	}
+	return result, nil
+}
+
+// graphValues appends the values $graphLookup searches for next: v itself,
+// or each element of an array. Nulls lead nowhere and are dropped.
+func graphValues(values bson.A, v interface{}) bson.A {
+	if arr, ok := v.(bson.A); ok {
+		for _, elem := range arr {
+			values = graphValues(values, elem)
+		}
+		return values
+	}
+	if v == nil {
+		return values
+	}
+	return append(values, v)
+}
+
+// unionWithDocs appends to docs the documents of another collection, after
+// the optional pipeline has run on them.
+func unionWithDocs(docs []bson.D, spec interface{}, lookupFn LookupFunc, collation *Collation) ([]bson.D, error) {
+	if lookupFn == nil {
+		return nil, fmt.Errorf("$unionWith not supported without lookup function")
+	}
+	var db, coll string
+	var pipeline []bson.D
+	var err error
+	switch v := spec.(type) {
+	case string:
+		if db, coll, err = stageNamespace("$unionWith", v, ""); err != nil {
+			return nil, err
+		}
+	case bson.D:
+		for _, f := range v {
+			switch f.Key {
+			case "coll":
+				if db, coll, err = stageNamespace("$unionWith", f.Value, ""); err != nil {
+					return nil, err
+				}
+			case "pipeline":
+				if pipeline, err = subPipeline("$unionWith", f.Value); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("$unionWith: unknown argument %q", f.Key)
+			}
+		}
+		if coll == "" {
+			return nil, fmt.Errorf("$unionWith requires a 'coll' field")
+		}
+	default:
+		return nil, fmt.Errorf("$unionWith requires a collection name or a document")
+	}
+
+	other, err := lookupFn(db, coll, nil)
+	if err != nil {
+		return nil, err
+	}
+	other, err = runSubPipeline(other, pipeline, lookupFn, collation)
+	if err != nil {
+		return nil, err
+	}
+	return append(docs, other...), nil
+}
+
+// subPipeline parses the pipeline argument of stage, which may not write
+// to a collection.
+func subPipeline(stage string, v interface{}) ([]bson.D, error) {
+	stages, ok := v.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("%s 'pipeline' must be an array of stages", stage)
+	}
+	pipeline := make([]bson.D, 0, len(stages))
+	for _, st := range stages {
+		d, ok := st.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s 'pipeline' must be an array of stages", stage)
+		}
+		if len(d) == 1 && (d[0].Key == "$out" || d[0].Key == "$merge") {
+			return nil, fmt.Errorf("%s is not allowed within a %s pipeline", d[0].Key, stage)
+		}
+		pipeline = append(pipeline, d)
+	}
+	return pipeline, nil
+}
+
+// runSubPipeline runs pipeline on copies of docs, which may be shared with
+// the collection they were read from.
+func runSubPipeline(docs []bson.D, pipeline []bson.D, lookupFn LookupFunc, collation *Collation) ([]bson.D, error) {
+	if len(pipeline) == 0 {
+		return docs, nil
+	}
+	input := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		d, err := CopyDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		input[i] = d
+	}
+	return runPipeline(input, pipeline, lookupFn, collation)
+}
+
+// checkVarNames rejects let variable names MongoDB would not accept: user
+// variables start with a lowercase letter and contain only letters, digits
+// and underscores.
+func checkVarNames(let bson.D) error {
+	for _, v := range let {
+		valid := v.Key != "" && v.Key[0] >= 'a' && v.Key[0] <= 'z'
+		for _, r := range v.Key {
+			valid = valid && (r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}
+		if !valid {
+			return fmt.Errorf("'%s' is not a valid user variable name", v.Key)
+		}
+	}
+	return nil
+}
+
+// bindVars returns a copy of pipeline in which each reference to one of vars
+// ($$name or $$name.path) is replaced by its value as a $literal, so the
+// variables are visible to every stage, including nested sub-pipelines.
+func bindVars(pipeline []bson.D, vars bson.D) []bson.D {
+	if len(vars) == 0 {
+		return pipeline
+	}
+	out := make([]bson.D, len(pipeline))
+	for i, stage := range pipeline {
+		out[i] = bindValue(stage, vars).(bson.D)
+	}
+	return out
+}
+
+// usesVar reports whether v refers to the variable $$name outside a
+// $literal.
+func usesVar(v interface{}, name string) bool {
+	switch x := v.(type) {
+	case string:
+		return x == "$$"+name || strings.HasPrefix(x, "$$"+name+".")
+	case bson.D:
+		for _, f := range x {
+			if f.Key != "$literal" && usesVar(f.Value, name) {
+				return true
+			}
+		}
+	case bson.A:
+		for _, elem := range x {
+			if usesVar(elem, name) {
+				return true
+			}
+		}
+	case []bson.D:
+		for _, stage := range x {
+			if usesVar(stage, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bindValue(v interface{}, vars bson.D) interface{} {
+	switch x := v.(type) {
+	case string:
+		if !strings.HasPrefix(x, "$$") {
+			return x
+		}
+		name, path, hasPath := strings.Cut(x[2:], ".")
+		for _, bound := range vars {
+			if bound.Key != name {
+				continue
+			}
+			val := bound.Value
+			if hasPath {
+				sub, _ := val.(bson.D)
+				val, _ = GetField(sub, path)
+			}
+			return bson.D{{Key: "$literal", Value: val}}
+		}
+		return x
+	case bson.D:
+		out := make(bson.D, len(x))
+		for i, f := range x {
+			if f.Key == "$literal" {
+				out[i] = f
+				continue
+			}
+			out[i] = bson.E{Key: f.Key, Value: bindValue(f.Value, vars)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, elem := range x {
+			out[i] = bindValue(elem, vars)
+		}
+		return out
+	default:
+		return v
+	}
+}
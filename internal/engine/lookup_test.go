@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// seedTasks creates db.tasks, where each task lists the tasks it depends
+// on, and the assignees of some of them in team.people.
+func seedTasks(t *testing.T, eng *Engine) {
+	t.Helper()
+	mustInsert(t, eng, "db", "tasks",
+		bson.D{{Key: "_id", Value: "deploy"}, {Key: "after", Value: bson.A{"test", "build"}}, {Key: "est", Value: int32(1)}},
+		bson.D{{Key: "_id", Value: "test"}, {Key: "after", Value: bson.A{"build"}}, {Key: "est", Value: int32(3)}},
+		bson.D{{Key: "_id", Value: "build"}, {Key: "after", Value: bson.A{"fetch"}}, {Key: "est", Value: int32(2)}},
+		bson.D{{Key: "_id", Value: "fetch"}, {Key: "after", Value: bson.A{}}, {Key: "est", Value: int32(5)}},
+	)
+	mustInsert(t, eng, "team", "people",
+		bson.D{{Key: "_id", Value: "ana"}, {Key: "owns", Value: bson.A{"deploy", "build"}}},
+		bson.D{{Key: "_id", Value: "bo"}, {Key: "owns", Value: bson.A{"test"}}},
+	)
+}
+
+// byID returns the document with the given _id from an array of documents.
+func byID(arr interface{}, id interface{}) bson.D {
+	for _, v := range arr.(bson.A) {
+		d := v.(bson.D)
+		if got, _ := GetField(d, "_id"); valuesEqual(got, id) {
+			return d
+		}
+	}
+	return nil
+}
+
+// ---- $lookup ----
+
+func TestLookup_PipelineWithLet(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTasks(t, eng)
+
+	// Each task with the dependencies that take longer than the task itself;
+	// $$est is used in $match and again in a later stage.
+	res, err := eng.Aggregate("db", "tasks", []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: bson.A{"deploy", "test"}}}}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "tasks"},
+			{Key: "let", Value: bson.D{{Key: "deps", Value: "$after"}, {Key: "est", Value: "$est"}}},
+			{Key: "pipeline", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{
+					bson.D{{Key: "$in", Value: bson.A{"$_id", "$$deps"}}},
+					bson.D{{Key: "$gt", Value: bson.A{"$est", "$$est"}}},
+				}}}}}}},
+				bson.D{{Key: "$project", Value: bson.D{{Key: "extra", Value: bson.D{{Key: "$subtract", Value: bson.A{"$est", "$$est"}}}}}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+			}},
+			{Key: "as", Value: "slower"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.D{
+		{{Key: "_id", Value: "build"}, {Key: "extra", Value: int64(1)}},
+		{{Key: "_id", Value: "test"}, {Key: "extra", Value: int64(2)}},
+	}
+	if len(res) != 2 {
+		t.Fatalf("got %d documents, want 2", len(res))
+	}
+	if got, _ := GetField(res[0], "slower"); !reflect.DeepEqual(got, bson.A{want[0], want[1]}) {
+		t.Errorf("deploy slower = %v, want %v", got, want)
+	}
+	if got, _ := GetField(res[1], "slower"); !reflect.DeepEqual(got, bson.A{}) {
+		t.Errorf("test slower = %v, want []", got)
+	}
+}
+
+func TestLookup_PipelineWithEquality(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTasks(t, eng)
+
+	// localField/foreignField and a pipeline combine; an array local value
+	// matches any of its elements.
+	res, err := eng.Aggregate("db", "tasks", []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: "deploy"}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "tasks"},
+			{Key: "localField", Value: "after"},
+			{Key: "foreignField", Value: "_id"},
+			{Key: "pipeline", Value: bson.A{bson.D{{Key: "$sort", Value: bson.D{{Key: "est", Value: int32(-1)}}}}}},
+			{Key: "as", Value: "deps"},
+		}}},
+	}, nil)
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Aggregate = %v, %v", res, err)
+	}
+	deps, _ := GetField(res[0], "deps")
+	var got bson.A
+	for _, d := range deps.(bson.A) {
+		id, _ := GetField(d.(bson.D), "_id")
+		got = append(got, id)
+	}
+	if !reflect.DeepEqual(got, bson.A{"test", "build"}) {
+		t.Errorf("deps = %v, want [test build]", got)
+	}
+}
+
+func TestLookup_NestedAndCrossDatabase(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTasks(t, eng)
+
+	// team.people looked up from db.tasks, and each person's other tasks
+	// from db.tasks through a nested $lookup that sees the outer $$task.
+	res, err := eng.Aggregate("db", "tasks", []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: "deploy"}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: bson.D{{Key: "db", Value: "team"}, {Key: "coll", Value: "people"}}},
+			{Key: "localField", Value: "_id"},
+			{Key: "foreignField", Value: "owns"},
+			{Key: "let", Value: bson.D{{Key: "task", Value: "$_id"}}},
+			{Key: "pipeline", Value: bson.A{
+				bson.D{{Key: "$lookup", Value: bson.D{
+					{Key: "from", Value: bson.D{{Key: "db", Value: "db"}, {Key: "coll", Value: "tasks"}}},
+					{Key: "let", Value: bson.D{{Key: "owns", Value: "$owns"}}},
+					{Key: "pipeline", Value: bson.A{
+						bson.D{{Key: "$match", Value: bson.D{{Key: "$expr", Value: bson.D{{Key: "$and", Value: bson.A{
+							bson.D{{Key: "$in", Value: bson.A{"$_id", "$$owns"}}},
+							bson.D{{Key: "$ne", Value: bson.A{"$_id", "$$task"}}},
+						}}}}}}},
+					}},
+					{Key: "as", Value: "others"},
+				}}},
+			}},
+			{Key: "as", Value: "owner"},
+		}}},
+	}, nil)
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Aggregate = %v, %v", res, err)
+	}
+	owner, _ := GetField(res[0], "owner")
+	ana := byID(owner, "ana")
+	if len(owner.(bson.A)) != 1 || ana == nil {
+		t.Fatalf("owner = %v, want [ana]", owner)
+	}
+	if others, _ := GetField(ana, "others"); len(others.(bson.A)) != 1 || byID(others, "build") == nil {
+		t.Errorf("others = %v, want [build]", others)
+	}
+}
+
+func TestLookup_Errors(t *testing.T) {
+	docs := []bson.D{{{Key: "_id", Value: int32(1)}}}
+	none := func(string, string, bson.D) ([]bson.D, error) { return nil, nil }
+	for name, spec := range map[string]bson.D{
+		"no from":          {{Key: "pipeline", Value: bson.A{}}, {Key: "as", Value: "x"}},
+		"no as":            {{Key: "from", Value: "c"}, {Key: "pipeline", Value: bson.A{}}},
+		"localField only":  {{Key: "from", Value: "c"}, {Key: "localField", Value: "a"}, {Key: "as", Value: "x"}},
+		"let without pipe": {{Key: "from", Value: "c"}, {Key: "localField", Value: "a"}, {Key: "foreignField", Value: "b"}, {Key: "let", Value: bson.D{}}, {Key: "as", Value: "x"}},
+		"bad var name":     {{Key: "from", Value: "c"}, {Key: "let", Value: bson.D{{Key: "Bad", Value: int32(1)}}}, {Key: "pipeline", Value: bson.A{}}, {Key: "as", Value: "x"}},
+		"$out in pipeline": {{Key: "from", Value: "c"}, {Key: "pipeline", Value: bson.A{bson.D{{Key: "$out", Value: "o"}}}}, {Key: "as", Value: "x"}},
+		"unknown argument": {{Key: "from", Value: "c"}, {Key: "pipeline", Value: bson.A{}}, {Key: "as", Value: "x"}, {Key: "bogus", Value: int32(1)}},
+	} {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$lookup", Value: spec}}}, none); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// ---- $graphLookup ----
+
+func TestGraphLookup(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTasks(t, eng)
+
+	depths := func(t *testing.T, spec bson.D) map[interface{}]interface{} {
+		t.Helper()
+		res, err := eng.Aggregate("db", "tasks", []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "_id", Value: "deploy"}}}},
+			{{Key: "$graphLookup", Value: spec}},
+		}, nil)
+		if err != nil || len(res) != 1 {
+			t.Fatalf("Aggregate = %v, %v", res, err)
+		}
+		got := make(map[interface{}]interface{})
+		all, _ := GetField(res[0], "all")
+		for _, v := range all.(bson.A) {
+			id, _ := GetField(v.(bson.D), "_id")
+			got[id], _ = GetField(v.(bson.D), "depth")
+		}
+		return got
+	}
+	spec := bson.D{
+		{Key: "from", Value: "tasks"},
+		{Key: "startWith", Value: "$after"},
+		{Key: "connectFromField", Value: "after"},
+		{Key: "connectToField", Value: "_id"},
+		{Key: "as", Value: "all"},
+		{Key: "depthField", Value: "depth"},
+	}
+
+	// build is reachable at depth 0 and 1 and is reported once, at 0.
+	want := map[interface{}]interface{}{"test": int64(0), "build": int64(0), "fetch": int64(1)}
+	if got := depths(t, spec); !reflect.DeepEqual(got, want) {
+		t.Errorf("all = %v, want %v", got, want)
+	}
+	limited := append(append(bson.D{}, spec...), bson.E{Key: "maxDepth", Value: int32(0)})
+	want = map[interface{}]interface{}{"test": int64(0), "build": int64(0)}
+	if got := depths(t, limited); !reflect.DeepEqual(got, want) {
+		t.Errorf("maxDepth 0 = %v, want %v", got, want)
+	}
+	restricted := append(append(bson.D{}, spec...), bson.E{Key: "restrictSearchWithMatch", Value: bson.D{{Key: "est", Value: bson.D{{Key: "$gt", Value: int32(2)}}}}})
+	want = map[interface{}]interface{}{"test": int64(0)}
+	if got := depths(t, restricted); !reflect.DeepEqual(got, want) {
+		t.Errorf("restrictSearchWithMatch = %v, want %v", got, want)
+	}
+}
+
+func TestGraphLookup_Cycle(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "other", "links",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "next", Value: int32(2)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "next", Value: int32(1)}},
+	)
+	mustInsert(t, eng, "db", "starts", bson.D{{Key: "_id", Value: "s"}, {Key: "first", Value: int32(1)}})
+
+	res, err := eng.Aggregate("db", "starts", []bson.D{{{Key: "$graphLookup", Value: bson.D{
+		{Key: "from", Value: bson.D{{Key: "db", Value: "other"}, {Key: "coll", Value: "links"}}},
+		{Key: "startWith", Value: "$first"},
+		{Key: "connectFromField", Value: "next"},
+		{Key: "connectToField", Value: "_id"},
+		{Key: "as", Value: "chain"},
+	}}}}, nil)
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Aggregate = %v, %v", res, err)
+	}
+	if chain, _ := GetField(res[0], "chain"); len(chain.(bson.A)) != 2 {
+		t.Errorf("chain = %v, want both documents once", chain)
+	}
+}
+
+func TestGraphLookup_Errors(t *testing.T) {
+	docs := []bson.D{{{Key: "_id", Value: int32(1)}}}
+	none := func(string, string, bson.D) ([]bson.D, error) { return nil, nil }
+	base := bson.D{
+		{Key: "from", Value: "c"},
+		{Key: "startWith", Value: "$_id"},
+		{Key: "connectFromField", Value: "a"},
+		{Key: "connectToField", Value: "b"},
+		{Key: "as", Value: "x"},
+	}
+	for name, spec := range map[string]bson.D{
+		"missing as":        base[:4],
+		"negative maxDepth": append(append(bson.D{}, base...), bson.E{Key: "maxDepth", Value: int32(-1)}),
+		"fractional depth":  append(append(bson.D{}, base...), bson.E{Key: "maxDepth", Value: 1.5}),
+		"bad depthField":    append(append(bson.D{}, base...), bson.E{Key: "depthField", Value: "$d"}),
+		"bad restrict":      append(append(bson.D{}, base...), bson.E{Key: "restrictSearchWithMatch", Value: "x"}),
+	} {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$graphLookup", Value: spec}}}, none); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := RunPipeline(docs, []bson.D{{{Key: "$graphLookup", Value: base}}}, nil); err == nil {
+		t.Error("expected an error without a lookup function")
+	}
+}
+
+// ---- $unionWith ----
+
+func TestUnionWith(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTasks(t, eng)
+
+	res, err := eng.Aggregate("db", "tasks", []bson.D{
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+		{{Key: "$unionWith", Value: bson.D{
+			{Key: "coll", Value: bson.D{{Key: "db", Value: "team"}, {Key: "coll", Value: "people"}}},
+			{Key: "pipeline", Value: bson.A{bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: int32(1)}}}}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"ana", "bo", "build", "deploy", "fetch", "test"}
+	if got := docIDs(res); !reflect.DeepEqual(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+
+	res, err = eng.Aggregate("team", "people", []bson.D{{{Key: "$unionWith", Value: "people"}}}, nil)
+	if err != nil || len(res) != 4 {
+		t.Errorf("$unionWith with itself = %d documents, %v; want 4", len(res), err)
+	}
+
+	// The pipeline runs on copies; the collection is unchanged.
+	if _, err := eng.Aggregate("team", "people", []bson.D{{{Key: "$unionWith", Value: bson.D{
+		{Key: "coll", Value: "people"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "owns", Value: "x"}}}}}},
+	}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("team", "people", bson.D{{Key: "owns", Value: "x"}}, nil, 0, 0, nil)
+	if len(docs) != 0 {
+		t.Errorf("$unionWith pipeline modified the collection: %v", docs)
+	}
+}
+
+func TestUnionWith_Errors(t *testing.T) {
+	docs := []bson.D{{{Key: "_id", Value: int32(1)}}}
+	none := func(string, string, bson.D) ([]bson.D, error) { return nil, nil }
+	for name, spec := range map[string]interface{}{
+		"number":           int32(1),
+		"no coll":          bson.D{{Key: "pipeline", Value: bson.A{}}},
+		"bad pipeline":     bson.D{{Key: "coll", Value: "c"}, {Key: "pipeline", Value: "x"}},
+		"$merge in pipe":   bson.D{{Key: "coll", Value: "c"}, {Key: "pipeline", Value: bson.A{bson.D{{Key: "$merge", Value: "o"}}}}},
+		"unknown argument": bson.D{{Key: "coll", Value: "c"}, {Key: "bogus", Value: int32(1)}},
+	} {
+		if _, err := RunPipeline(docs, []bson.D{{{Key: "$unionWith", Value: spec}}}, none); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
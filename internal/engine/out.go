@@ -0,0 +1,360 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// writeStage returns the final stage of pipeline if it is $out or $merge,
+// which write the pipeline's results to a collection instead of returning
+// them.
+func writeStage(pipeline []bson.D) (bson.E, bool) {
+	if len(pipeline) == 0 || len(pipeline[len(pipeline)-1]) != 1 {
+		return bson.E{}, false
+	}
+	last := pipeline[len(pipeline)-1][0]
+	return last, last.Key == "$out" || last.Key == "$merge"
+}
+
+// aggregateInto runs a pipeline that ends in $out or $merge under the write
+// lock and writes its results to the target collection.
+func (e *Engine) aggregateInto(db, coll string, pipeline []bson.D, collation *Collation) error {
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	last, _ := writeStage(pipeline)
+	docs, err := e.aggregate(db, coll, pipeline[:len(pipeline)-1], collation)
+	if err != nil {
+		return err
+	}
+	if last.Key == "$out" {
+		if err := e.out(db, last.Value, docs); err != nil {
+			return err
+		}
+		return e.save()
+	}
+	// Like MongoDB, $merge keeps the documents it wrote before a failure.
+	mergeErr := e.merge(db, last.Value, docs)
+	if len(e.pending) > 0 {
+		if err := e.save(); err != nil {
+			return err
+		}
+	}
+	return mergeErr
+}
+
+// stageNamespace parses the collection argument of stage, such as $out's
+// target or $lookup's from: a collection name in db, or {db, coll}.
+func stageNamespace(stage string, v interface{}, db string) (string, string, error) {
+	switch x := v.(type) {
+	case string:
+		if x != "" {
+			return db, x, nil
+		}
+	case bson.D:
+		targetDB, targetColl := db, ""
+		for _, f := range x {
+			s, ok := f.Value.(string)
+			switch {
+			case f.Key == "db" && ok && s != "":
+				targetDB = s
+			case f.Key == "coll" && ok:
+				targetColl = s
+			default:
+				return "", "", fmt.Errorf("%s: unknown or invalid field %q in the target namespace", stage, f.Key)
+			}
+		}
+		if targetColl != "" {
+			return targetDB, targetColl, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s requires a collection name or a {db, coll} document", stage)
+}
+
+// out replaces the collection named by spec with docs. The new contents are
+// built in a fresh collection with the target's indexes and installed only
+// if every document passes the target's schema and unique indexes, so a
+// failure leaves the target as it was.
+func (s *state) out(db string, spec interface{}, docs []bson.D) error {
+	targetDB, target, err := stageNamespace("$out", spec, db)
+	if err != nil {
+		return err
+	}
+	if err := s.writable(targetDB, target); err != nil {
+		return err
+	}
+	// Results may share values with the source collection.
+	copies := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		if copies[i], err = CopyDoc(doc); err != nil {
+			return err
+		}
+	}
+	d, hadDB := s.data.Databases[targetDB]
+	if !hadDB {
+		d = s.data.GetOrCreateDB(targetDB)
+	}
+	old := d.Collections[target]
+	if old != nil && old.Capped != nil {
+		return commandErrorf(17152, "Location17152", "namespace '%s.%s' is capped so it can't be used for $out", targetDB, target)
+	}
+
+	c := &Collection{}
+	if old != nil {
+		c.Indexes = old.Indexes
+	}
+	d.Collections[target] = c
+	mark := len(s.pending)
+	if old != nil {
+		s.record(journalEntry{Op: journalDropColl, DB: targetDB, Coll: target})
+	}
+	s.record(journalEntry{Op: journalCreateColl, DB: targetDB, Coll: target})
+	if len(c.Indexes) > 0 {
+		s.recordIndexes(targetDB, target, c.Indexes)
+	}
+	if _, err := s.insert(targetDB, target, copies); err != nil {
+		s.pending = s.pending[:mark]
+		switch {
+		case old != nil:
+			d.Collections[target] = old
+		case hadDB:
+			delete(d.Collections, target)
+		default:
+			delete(s.data.Databases, targetDB)
+		}
+		return err
+	}
+	return nil
+}
+
+// mergeSpec is a parsed $merge stage.
+type mergeSpec struct {
+	db, coll       string
+	on             []string
+	let            bson.D // nil for the default {new: "$$ROOT"}
+	whenMatched    string // "replace", "keepExisting", "merge", "fail" or "pipeline"
+	pipeline       []bson.D
+	whenNotMatched string // "insert", "discard" or "fail"
+	index          string // the unique index on the on fields
+}
+
+func parseMerge(db string, spec interface{}) (*mergeSpec, error) {
+	m := &mergeSpec{on: []string{"_id"}, whenMatched: "merge", whenNotMatched: "insert"}
+	var err error
+	d, ok := spec.(bson.D)
+	if !ok {
+		m.db, m.coll, err = stageNamespace("$merge", spec, db)
+		return m, err
+	}
+	hasInto, hasLet := false, false
+	for _, f := range d {
+		switch f.Key {
+		case "into":
+			if m.db, m.coll, err = stageNamespace("$merge", f.Value, db); err != nil {
+				return nil, err
+			}
+			hasInto = true
+		case "on":
+			m.on = nil
+			switch v := f.Value.(type) {
+			case string:
+				m.on = []string{v}
+			case bson.A:
+				for _, item := range v {
+					s, ok := item.(string)
+					if !ok {
+						return nil, fmt.Errorf("$merge 'on' array elements must be field names")
+					}
+					m.on = append(m.on, s)
+				}
+			}
+			if len(m.on) == 0 {
+				return nil, fmt.Errorf("$merge 'on' must be a field name or a non-empty array of field names")
+			}
+		case "let":
+			let, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$merge 'let' must be a document")
+			}
+			m.let, hasLet = let, true
+		case "whenMatched":
+			switch v := f.Value.(type) {
+			case string:
+				switch v {
+				case "replace", "keepExisting", "merge", "fail":
+					m.whenMatched = v
+				default:
+					return nil, fmt.Errorf("$merge: unknown whenMatched mode %q", v)
+				}
+			case bson.A:
+				if _, _, err := newUpdateContext(nil, v, nil, nil); err != nil {
+					return nil, err
+				}
+				for _, st := range v {
+					m.pipeline = append(m.pipeline, st.(bson.D))
+				}
+				m.whenMatched = "pipeline"
+			default:
+				return nil, fmt.Errorf("$merge 'whenMatched' must be a string or a pipeline")
+			}
+		case "whenNotMatched":
+			v, _ := f.Value.(string)
+			switch v {
+			case "insert", "discard", "fail":
+				m.whenNotMatched = v
+			default:
+				return nil, fmt.Errorf("$merge: unknown whenNotMatched mode %v", f.Value)
+			}
+		default:
+			return nil, fmt.Errorf("$merge: unknown field %q", f.Key)
+		}
+	}
+	if !hasInto {
+		return nil, fmt.Errorf("$merge requires an 'into' field")
+	}
+	if hasLet && m.whenMatched != "pipeline" {
+		return nil, commandErrorf(51199, "Location51199", "Cannot use 'let' variables with 'whenMatched: %s' mode", m.whenMatched)
+	}
+	return m, nil
+}
+
+// merge writes docs into the collection named by spec: each document is
+// matched to a target document by the on fields, then inserted, merged into
+// or used to replace it, as the stage's whenMatched and whenNotMatched modes
+// say. Writes go through insert and update, so the target's schema and
+// unique indexes are enforced.
+func (s *state) merge(db string, spec interface{}, docs []bson.D) error {
+	m, err := parseMerge(db, spec)
+	if err != nil {
+		return err
+	}
+	if err := s.writable(m.db, m.coll); err != nil {
+		return err
+	}
+	if err := m.checkIndex(s.collection(m.db, m.coll)); err != nil {
+		return err
+	}
+	ns := m.db + "." + m.coll
+	for _, doc := range docs {
+		// Results may share values with the source collection.
+		doc, err := CopyDoc(doc)
+		if err != nil {
+			return err
+		}
+		filter := bson.D{}
+		for _, f := range m.on {
+			v, ok := GetField(doc, f)
+			if !ok && f == "_id" {
+				doc = ensureID(doc)
+				v, ok = GetField(doc, f)
+			}
+			if _, isArray := v.(bson.A); !ok || v == nil || isArray {
+				return commandErrorf(51132, "Location51132", "$merge write error: 'on' field '%s' cannot be missing, null, undefined or an array", f)
+			}
+			filter = append(filter, bson.E{Key: f, Value: v})
+		}
+
+		var target bson.D
+		if c := s.collection(m.db, m.coll); c != nil {
+			if found := c.find(filter, nil); len(found) > 0 {
+				target = found[0]
+			}
+		}
+		if target == nil {
+			switch m.whenNotMatched {
+			case "insert":
+				if _, err := s.insert(m.db, m.coll, []bson.D{doc}); err != nil {
+					return err
+				}
+			case "fail":
+				return commandErrorf(13113, "MergeStageNoMatchingDocument", "$merge could not find a matching document in the target collection for at least one document in the source collection")
+			}
+			continue
+		}
+
+		id, _ := GetField(target, "_id")
+		byID := bson.D{{Key: "_id", Value: id}}
+		var update bson.D
+		switch m.whenMatched {
+		case "keepExisting":
+			continue
+		case "fail":
+			keys := bson.D{}
+			for _, f := range m.on {
+				keys = append(keys, bson.E{Key: f, Value: int32(1)})
+			}
+			return &DuplicateKeyError{Index: m.index, Collection: ns, KeyPattern: keys, KeyValue: filter}
+		case "merge":
+			update = bson.D{{Key: "$set", Value: doc}}
+		case "replace":
+			update = doc
+		case "pipeline":
+			if update, err = m.apply(target, doc); err != nil {
+				return err
+			}
+		}
+		if _, _, _, err := s.update(m.db, m.coll, byID, update, nil, false, false, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIndex returns an error unless the on fields are _id or the fields of
+// a unique index of c, which guarantees that a result matches at most one
+// target document. It records the index's name for duplicate key errors.
+func (m *mergeSpec) checkIndex(c *Collection) error {
+	if len(m.on) == 1 && m.on[0] == "_id" {
+		m.index = "_id_"
+		return nil
+	}
+	if c != nil {
+		for _, ix := range c.Indexes {
+			if !ix.Unique || ix.PartialFilterExpression != nil || len(ix.Keys) != len(m.on) {
+				continue
+			}
+			covered := true
+			for _, f := range m.on {
+				found := false
+				for _, k := range ix.Keys {
+					found = found || k.Key == f
+				}
+				covered = covered && found
+			}
+			if covered {
+				m.index = ix.Name
+				return nil
+			}
+		}
+	}
+	return commandErrorf(51183, "Location51183", "Cannot find index to verify that join fields will be unique: %s", strings.Join(m.on, ", "))
+}
+
+// apply runs the whenMatched pipeline on target with the stage's variables,
+// $$new by default, bound from the result document doc, and returns the
+// replacement for target.
+func (m *mergeSpec) apply(target, doc bson.D) (bson.D, error) {
+	vars := bson.D{{Key: "$$new", Value: doc}}
+	if m.let != nil {
+		vars = bson.D{}
+		for _, v := range m.let {
+			vars = append(vars, bson.E{Key: "$$" + v.Key, Value: evalExpr(doc, v.Value)})
+		}
+	}
+	updated, err := applyPipelineUpdate(append(vars, target...), m.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	out := bson.D{}
+	for _, f := range updated {
+		if !strings.HasPrefix(f.Key, "$$") {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
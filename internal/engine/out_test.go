@@ -0,0 +1,289 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// seedRuns creates db.runs with the durations of test runs per category.
+func seedRuns(t *testing.T, eng *Engine) {
+	t.Helper()
+	mustInsert(t, eng, "db", "runs",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "cat", Value: "unit"}, {Key: "ms", Value: int32(10)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "cat", Value: "unit"}, {Key: "ms", Value: int32(30)}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "cat", Value: "e2e"}, {Key: "ms", Value: int32(500)}},
+	)
+}
+
+// rollup groups db.runs by category into the total of their durations.
+var rollup = bson.D{{Key: "$group", Value: bson.D{
+	{Key: "_id", Value: "$cat"},
+	{Key: "total", Value: bson.D{{Key: "$sum", Value: "$ms"}}},
+}}}
+
+// totals returns the total field of each document of db.coll by _id. The
+// data file keeps small int64 values as int32, so compare with valuesEqual.
+func totals(t *testing.T, eng *Engine, coll string) map[interface{}]interface{} {
+	t.Helper()
+	docs, err := eng.Find("db", coll, nil, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[interface{}]interface{})
+	for _, d := range docs {
+		id, _ := GetField(d, "_id")
+		m[id], _ = GetField(d, "total")
+	}
+	return m
+}
+
+// ---- $out ----
+
+func TestOut(t *testing.T) {
+	eng, path := newEng(t)
+	seedRuns(t, eng)
+	mustInsert(t, eng, "db", "rollup", bson.D{{Key: "_id", Value: "stale"}})
+	if err := eng.CreateIndexes("db", "rollup", []IndexSpec{{Name: "total_1", Keys: bson.D{{Key: "total", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$out", Value: "rollup"}}}, nil)
+	if err != nil || len(res) != 0 {
+		t.Fatalf("Aggregate = %v, %v; want no documents", res, err)
+	}
+	for _, e := range []*Engine{eng, reloadEng(t, path)} {
+		got := totals(t, e, "rollup")
+		if len(got) != 2 || !valuesEqual(got["unit"], int64(40)) || !valuesEqual(got["e2e"], int64(500)) {
+			t.Errorf("rollup = %v, want the stale document replaced by the totals", got)
+		}
+		if ix := e.ListIndexes("db", "rollup"); len(ix) != 2 {
+			t.Errorf("indexes = %v, want the target's indexes kept", ix)
+		}
+	}
+
+	// {db, coll} writes to another database.
+	if _, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$out", Value: bson.D{{Key: "db", Value: "reports"}, {Key: "coll", Value: "totals"}}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := eng.Count("reports", "totals", nil, nil); n != 2 {
+		t.Errorf("reports.totals has %d documents, want 2", n)
+	}
+}
+
+func TestOut_Journal(t *testing.T) {
+	eng, path := newEng(t)
+	jeng, err := NewWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedRuns(t, jeng)
+	mustInsert(t, jeng, "db", "rollup", bson.D{{Key: "_id", Value: "stale"}})
+	if _, err := jeng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$out", Value: "rollup"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := totals(t, eng, "rollup"); len(got) != 2 || !valuesEqual(got["unit"], int64(40)) {
+		t.Errorf("rollup replayed from the journal = %v", got)
+	}
+}
+
+func TestOut_FailureKeepsTarget(t *testing.T) {
+	eng, path := newEng(t)
+	seedRuns(t, eng)
+	mustInsert(t, eng, "db", "rollup", bson.D{{Key: "_id", Value: "old"}, {Key: "total", Value: int32(1)}})
+	if err := eng.CreateIndexes("db", "rollup", []IndexSpec{{Name: "n_1", Keys: bson.D{{Key: "n", Value: int32(1)}}, Unique: true}}); err != nil {
+		t.Fatal(err)
+	}
+	// Every result has n: 1, so the second one violates the unique index.
+	_, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$set", Value: bson.D{{Key: "n", Value: int32(1)}}}}, {{Key: "$out", Value: "rollup"}}}, nil)
+	var dup *DuplicateKeyError
+	if !errors.As(err, &dup) {
+		t.Fatalf("got %v, want a duplicate key error", err)
+	}
+	for _, e := range []*Engine{eng, reloadEng(t, path)} {
+		if got := totals(t, e, "rollup"); len(got) != 1 || !valuesEqual(got["old"], int32(1)) {
+			t.Errorf("rollup = %v, want it unchanged", got)
+		}
+	}
+
+	// Nor is a new collection left behind.
+	_, err = eng.Aggregate("db", "runs", []bson.D{{{Key: "$set", Value: bson.D{{Key: "_id", Value: int32(1)}}}}, {{Key: "$out", Value: "fresh"}}}, nil)
+	if !errors.As(err, &dup) {
+		t.Fatalf("got %v, want a duplicate key error", err)
+	}
+	for _, name := range eng.ListCollections("db") {
+		if name == "fresh" {
+			t.Error("failed $out created its target")
+		}
+	}
+}
+
+func TestOut_Errors(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTests(t, eng)
+	if err := eng.CreateCappedCollection("db", "log", CappedOptions{Size: 4096}); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CommandError
+	if _, err := eng.Aggregate("db", "tests", []bson.D{{{Key: "$out", Value: "log"}}}, nil); !errors.As(err, &ce) || ce.Code != 17152 {
+		t.Errorf("capped target: got %v, want 17152", err)
+	}
+	if _, err := eng.Aggregate("db", "tests", []bson.D{{{Key: "$out", Value: "failing"}}}, nil); !errors.As(err, &ce) || ce.Code != 166 {
+		t.Errorf("view target: got %v, want CommandNotSupportedOnView", err)
+	}
+	if _, err := eng.Aggregate("db", "tests", []bson.D{{{Key: "$out", Value: "x"}}, {{Key: "$limit", Value: 1}}}, nil); err == nil {
+		t.Error("$out before another stage: expected an error")
+	}
+	if _, err := eng.Begin().Aggregate("db", "tests", []bson.D{{{Key: "$out", Value: "x"}}}, nil); !errors.As(err, &ce) || ce.Code != 263 {
+		t.Errorf("in a transaction: got %v, want OperationNotSupportedInTransaction", err)
+	}
+	if err := eng.CreateView("db", "v", "tests", []bson.D{{{Key: "$out", Value: "x"}}}); !errors.As(err, &ce) || ce.Code != 167 {
+		t.Errorf("in a view: got %v, want OptionNotSupportedOnView", err)
+	}
+	if x, err := eng.ExplainAggregate("db", "tests", []bson.D{{{Key: "$out", Value: "x"}}}, nil); err != nil || x.NReturned != 3 {
+		t.Errorf("explain = %+v, %v", x, err)
+	}
+	if n, _ := eng.Count("db", "x", nil, nil); n != 0 {
+		t.Errorf("explain wrote %d documents", n)
+	}
+}
+
+// ---- $merge ----
+
+func TestMerge(t *testing.T) {
+	eng, path := newEng(t)
+	seedRuns(t, eng)
+	mustInsert(t, eng, "db", "rollup",
+		bson.D{{Key: "_id", Value: "unit"}, {Key: "total", Value: int32(1)}, {Key: "owner", Value: "ana"}},
+		bson.D{{Key: "_id", Value: "lint"}, {Key: "total", Value: int32(7)}},
+	)
+	// The default mode merges into matching documents and inserts the rest.
+	if _, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$merge", Value: "rollup"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	re := reloadEng(t, path)
+	if got := totals(t, re, "rollup"); len(got) != 3 || !valuesEqual(got["unit"], int64(40)) || !valuesEqual(got["e2e"], int64(500)) || !valuesEqual(got["lint"], int32(7)) {
+		t.Errorf("rollup = %v", got)
+	}
+	docs, _ := re.Find("db", "rollup", bson.D{{Key: "_id", Value: "unit"}}, nil, 0, 0, nil)
+	if owner, _ := GetField(docs[0], "owner"); owner != "ana" {
+		t.Errorf("merge dropped a field of the target: %v", docs[0])
+	}
+}
+
+func TestMerge_Modes(t *testing.T) {
+	tests := []struct {
+		name  string
+		merge bson.D
+		unit  interface{} // total of unit afterwards
+		e2e   bool        // whether e2e was inserted
+		owner bool        // whether unit kept its owner field
+	}{
+		{"replace", bson.D{{Key: "whenMatched", Value: "replace"}}, int64(40), true, false},
+		{"keepExisting", bson.D{{Key: "whenMatched", Value: "keepExisting"}}, int32(1), true, true},
+		{"discard", bson.D{{Key: "whenNotMatched", Value: "discard"}}, int64(40), false, true},
+		{"pipeline", bson.D{{Key: "whenMatched", Value: bson.A{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$total", "$$new.total"}}}}}}},
+		}}}, int64(41), true, true},
+		{"pipeline with let", bson.D{
+			{Key: "let", Value: bson.D{{Key: "t", Value: "$total"}}},
+			{Key: "whenMatched", Value: bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "total", Value: "$$t"}}}}}},
+		}, int64(40), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng, _ := newEng(t)
+			seedRuns(t, eng)
+			mustInsert(t, eng, "db", "rollup", bson.D{{Key: "_id", Value: "unit"}, {Key: "total", Value: int32(1)}, {Key: "owner", Value: "ana"}})
+			spec := append(bson.D{{Key: "into", Value: "rollup"}}, tt.merge...)
+			if _, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$merge", Value: spec}}}, nil); err != nil {
+				t.Fatal(err)
+			}
+			got := totals(t, eng, "rollup")
+			if !valuesEqual(got["unit"], tt.unit) {
+				t.Errorf("unit total = %v (%T), want %v", got["unit"], got["unit"], tt.unit)
+			}
+			if _, ok := got["e2e"]; ok != tt.e2e {
+				t.Errorf("e2e inserted = %v, want %v", ok, tt.e2e)
+			}
+			docs, _ := eng.Find("db", "rollup", bson.D{{Key: "_id", Value: "unit"}}, nil, 0, 0, nil)
+			if _, ok := GetField(docs[0], "owner"); ok != tt.owner {
+				t.Errorf("owner kept = %v, want %v", ok, tt.owner)
+			}
+		})
+	}
+}
+
+func TestMerge_On(t *testing.T) {
+	eng, _ := newEng(t)
+	seedRuns(t, eng)
+	mustInsert(t, eng, "db", "rollup", bson.D{{Key: "cat", Value: "unit"}, {Key: "total", Value: int32(1)}})
+	pipeline := []bson.D{
+		rollup,
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: int32(0)}, {Key: "cat", Value: "$_id"}, {Key: "total", Value: int32(1)}}}},
+		{{Key: "$merge", Value: bson.D{{Key: "into", Value: "rollup"}, {Key: "on", Value: "cat"}}}},
+	}
+	var ce *CommandError
+	if _, err := eng.Aggregate("db", "runs", pipeline, nil); !errors.As(err, &ce) || ce.Code != 51183 {
+		t.Fatalf("without a unique index on cat: got %v, want 51183", err)
+	}
+	if err := eng.CreateIndexes("db", "rollup", []IndexSpec{{Name: "cat_1", Keys: bson.D{{Key: "cat", Value: int32(1)}}, Unique: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Aggregate("db", "runs", pipeline, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("db", "rollup", nil, bson.D{{Key: "cat", Value: int32(1)}}, 0, 0, nil)
+	if len(docs) != 2 {
+		t.Fatalf("rollup = %v", docs)
+	}
+	if total, _ := GetField(docs[1], "total"); !valuesEqual(total, 40) {
+		t.Errorf("unit total = %v, want 40", total)
+	}
+}
+
+func TestMerge_Errors(t *testing.T) {
+	eng, path := newEng(t)
+	seedRuns(t, eng)
+	mustInsert(t, eng, "db", "rollup", bson.D{{Key: "_id", Value: "unit"}, {Key: "total", Value: int32(1)}})
+	merge := func(spec bson.D) error {
+		_, err := eng.Aggregate("db", "runs", []bson.D{rollup, {{Key: "$merge", Value: append(bson.D{{Key: "into", Value: "rollup"}}, spec...)}}}, nil)
+		return err
+	}
+
+	var dup *DuplicateKeyError
+	if err := merge(bson.D{{Key: "whenMatched", Value: "fail"}}); !errors.As(err, &dup) {
+		t.Errorf("whenMatched fail: got %v, want a duplicate key error", err)
+	}
+	var ce *CommandError
+	if err := merge(bson.D{{Key: "whenNotMatched", Value: "fail"}}); !errors.As(err, &ce) || ce.Code != 13113 {
+		t.Errorf("whenNotMatched fail: got %v, want 13113", err)
+	}
+	if err := merge(bson.D{{Key: "let", Value: bson.D{}}, {Key: "whenMatched", Value: "merge"}}); !errors.As(err, &ce) || ce.Code != 51199 {
+		t.Errorf("let without a pipeline: got %v, want 51199", err)
+	}
+	for name, spec := range map[string]bson.D{
+		"bad whenMatched":    {{Key: "whenMatched", Value: "overwrite"}},
+		"bad whenNotMatched": {{Key: "whenNotMatched", Value: "skip"}},
+		"bad pipeline":       {{Key: "whenMatched", Value: bson.A{bson.D{{Key: "$group", Value: bson.D{}}}}}},
+		"unknown field":      {{Key: "mode", Value: 1}},
+	} {
+		if err := merge(spec); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// The target's schema is enforced. Documents written before the
+	// failure are kept, as in MongoDB.
+	if err := eng.SetSchema("db", "rollup", json.RawMessage(`{"type":"object","properties":{"total":{"type":"integer","maximum":100}}}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge(nil); err == nil {
+		t.Error("schema violation: expected an error")
+	}
+	if got := totals(t, reloadEng(t, path), "rollup"); !valuesEqual(got["unit"], int64(40)) {
+		t.Errorf("rollup = %v, want the write before the failure kept", got)
+	}
+}
@@ -0,0 +1,443 @@
+package engine
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// queryPlan describes how documents for a filter were found.
+type queryPlan struct {
+	index        *docIndex  // index scanned; nil for a collection scan
+	bounds       *keyBounds // leading-field bounds of the index scan
+	keysExamined int        // index entries visited
+	docsExamined int        // documents MatchDoc was applied to
+}
+
+func (p queryPlan) indexName() string {
+	if p.index == nil {
+		return ""
+	}
+	return p.index.spec.Name
+}
+
+// keyBounds is the set of leading-field values an index scan visits: either
+// a list of points or a single range within one BSON type.
+type keyBounds struct {
+	points   []interface{}
+	isRange  bool
+	rank     int // type of the range
+	lo, hi   interface{}
+	loIncl   bool
+	hiIncl   bool
+	hasLo    bool
+	hasHi    bool
+	empty    bool          // contradictory range bounds; nothing can match
+	also     []interface{} // points scanned in addition to the range
+	priority int           // 3 equality, 2 $in, 1 range
+}
+
+// fieldPredicates collects the indexable predicates of a filter by field
+// path. Fields under $and are included; $or, $nor and $expr are left to
+// MatchDoc. Range bounds on strings are ordered under collation.
+func fieldPredicates(filter bson.D, out map[string]*keyBounds, collation *Collation) {
+	for _, fe := range filter {
+		switch fe.Key {
+		case "$and":
+			arr, _ := fe.Value.(bson.A)
+			for _, sub := range arr {
+				if subDoc, ok := sub.(bson.D); ok {
+					fieldPredicates(subDoc, out, collation)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(fe.Key, "$") {
+			continue
+		}
+		b := predicateBounds(fe.Value, collation)
+		if b == nil {
+			continue
+		}
+		if cur := out[fe.Key]; cur == nil || b.priority > cur.priority {
+			out[fe.Key] = b
+		}
+	}
+}
+
+// predicateBounds returns the index bounds for a single field's filter value,
+// or nil when the predicate cannot use an index.
+func predicateBounds(val interface{}, collation *Collation) *keyBounds {
+	if re, ok := val.(bson.Regex); ok {
+		return regexBounds(re.Pattern, re.Options)
+	}
+	ops, isOps := val.(bson.D)
+	if !isOps || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		if !pointIndexable(val) {
+			return nil
+		}
+		return &keyBounds{points: []interface{}{val}, priority: 3}
+	}
+
+	var best, regex *keyBounds
+	rng := &keyBounds{isRange: true, priority: 1}
+	for _, op := range ops {
+		switch op.Key {
+		case "$regex":
+			pattern, options := "", ""
+			switch r := op.Value.(type) {
+			case string:
+				pattern = r
+			case bson.Regex:
+				pattern, options = r.Pattern, r.Options
+			}
+			for _, o := range ops {
+				if o.Key == "$options" {
+					options, _ = o.Value.(string)
+				}
+			}
+			regex = regexBounds(pattern, options)
+		case "$eq":
+			if pointIndexable(op.Value) {
+				return &keyBounds{points: []interface{}{op.Value}, priority: 3}
+			}
+		case "$in":
+			arr, ok := op.Value.(bson.A)
+			if !ok {
+				continue
+			}
+			points := make([]interface{}, 0, len(arr))
+			for _, v := range arr {
+				if !pointIndexable(v) {
+					points = nil
+					break
+				}
+				points = append(points, v)
+			}
+			if points != nil || len(arr) == 0 {
+				best = &keyBounds{points: points, priority: 2}
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !rangeIndexable(op.Value) {
+				continue
+			}
+			rank := typeRank(op.Value)
+			if (rng.hasLo || rng.hasHi) && rng.rank != rank {
+				// Range operators only match values of their own type.
+				rng.empty = true
+			}
+			rng.rank = rank
+			incl := op.Key == "$gte" || op.Key == "$lte"
+			if op.Key == "$gt" || op.Key == "$gte" {
+				if c := compareCollated(op.Value, rng.lo, collation); !rng.hasLo || c > 0 || (c == 0 && !incl) {
+					rng.lo, rng.loIncl, rng.hasLo = op.Value, incl, true
+				}
+			} else {
+				if c := compareCollated(op.Value, rng.hi, collation); !rng.hasHi || c < 0 || (c == 0 && !incl) {
+					rng.hi, rng.hiIncl, rng.hasHi = op.Value, incl, true
+				}
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if rng.hasLo || rng.hasHi {
+		return rng
+	}
+	return regex
+}
+
+// regexBounds returns the bounds of an anchored, case-sensitive regular
+// expression: the strings starting with its literal prefix, plus the regex
+// itself, which matches documents storing the same regular expression. It
+// returns nil when the pattern has no usable prefix.
+func regexBounds(pattern, options string) *keyBounds {
+	prefix := regexPrefix(pattern, options)
+	if prefix == "" {
+		return nil
+	}
+	b := &keyBounds{
+		isRange: true, rank: rankString,
+		lo: prefix, loIncl: true, hasLo: true,
+		also:     []interface{}{bson.Regex{Pattern: pattern, Options: options}},
+		priority: 1,
+	}
+	// The first string after every string with the prefix: increment the
+	// last byte that is not 0xff and drop the rest.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			b.hi, b.hasHi = string(append([]byte(prefix[:i]), prefix[i]+1)), true
+			break
+		}
+	}
+	return b
+}
+
+// pointIndexable reports whether equality on v can be answered by an index
+// lookup.
+func pointIndexable(v interface{}) bool {
+	switch x := v.(type) {
+	case bson.Regex:
+		return false
+	case bson.D:
+		return len(x) == 0 || !strings.HasPrefix(x[0].Key, "$")
+	}
+	return true
+}
+
+// rangeIndexable reports whether range bounds on v can be answered by an
+// index scan: compareValues must order values of v's type.
+func rangeIndexable(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, bson.ObjectID, bson.DateTime:
+		return true
+	}
+	return isNumeric(v)
+}
+
+// plan picks the index to answer filter with, or nil for a collection scan.
+// Equality beats $in beats a range; ties go to unique indexes, then to the
+// first index defined. Only indexes with the query's collation can answer
+// bounds on strings.
+func (ix *collIndexes) plan(filter bson.D, collation *Collation) (*docIndex, *keyBounds) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	preds := make(map[string]*keyBounds)
+	fieldPredicates(filter, preds, collation)
+	if len(preds) == 0 {
+		return nil, nil
+	}
+	var bestIdx *docIndex
+	var bestBounds *keyBounds
+	for _, idx := range ix.indexes {
+		b := preds[idx.spec.Keys[0].Key]
+		if b == nil || !idx.usableFor(filter, b, collation) {
+			continue
+		}
+		if bestBounds == nil || b.priority > bestBounds.priority ||
+			(b.priority == bestBounds.priority && idx.spec.Unique && !bestIdx.spec.Unique) {
+			bestIdx, bestBounds = idx, b
+		}
+	}
+	// On a multikey index each range operator may be satisfied by a different
+	// array element, so the bounds of two operators cannot be intersected.
+	// Scan from the lower bound only and let MatchDoc apply the rest.
+	if bestBounds != nil && bestIdx.multikey && bestBounds.isRange && bestBounds.also == nil &&
+		bestBounds.hasLo && bestBounds.hasHi {
+		b := *bestBounds
+		b.hi, b.hasHi, b.empty, b.rank = nil, false, false, typeRank(b.lo)
+		bestBounds = &b
+	}
+	return bestIdx, bestBounds
+}
+
+// usableFor reports whether the index can answer filter under collation.
+// An index with another collation orders strings differently, so it can only
+// answer bounds without strings, and a collated index cannot answer the
+// byte prefix of a regular expression. An index that leaves documents out
+// can answer filter only if no matching document is left out: a sparse
+// index only when the bounds exclude null, which matches missing fields,
+// and a partial index only when every matching document satisfies its
+// filter expression, which is checked without collation.
+func (idx *docIndex) usableFor(filter bson.D, b *keyBounds, collation *Collation) bool {
+	if !sameCollation(idx.collation, collation) && b.hasStrings() {
+		return false
+	}
+	if idx.collation != nil && b.also != nil {
+		return false
+	}
+	if idx.spec.Sparse {
+		for _, p := range b.points {
+			if p == nil {
+				return false
+			}
+		}
+	}
+	if idx.spec.PartialFilterExpression != nil {
+		return collation == nil && filterImplies(filter, idx.spec.PartialFilterExpression)
+	}
+	return true
+}
+
+// hasStrings reports whether the bounds hold a value whose order depends on
+// the collation: a string, or a document or array that may contain one.
+func (b *keyBounds) hasStrings() bool {
+	if b.isRange && b.rank == rankString {
+		return true
+	}
+	for _, p := range append(b.points, b.also...) {
+		switch typeRank(p) {
+		case rankString, rankObject, rankArray, rankRegex:
+			return true
+		}
+	}
+	return false
+}
+
+// filterImplies reports whether every document matching filter also matches
+// expr. It is conservative: each condition of expr, including those under
+// $and, must appear verbatim in filter or be satisfied by an equality
+// predicate in it.
+func filterImplies(filter, expr bson.D) bool {
+	conds := flattenAnd(filter, nil)
+	for _, e := range flattenAnd(expr, nil) {
+		implied := false
+		for _, c := range conds {
+			if c.Key != e.Key {
+				continue
+			}
+			if reflect.DeepEqual(c.Value, e.Value) {
+				implied = true
+				break
+			}
+			if strings.ContainsAny(c.Key, "$.") {
+				continue
+			}
+			// A scalar equality pins the field: test the value itself.
+			v := c.Value
+			if d, ok := v.(bson.D); ok && len(d) == 1 && d[0].Key == "$eq" {
+				v = d[0].Value
+			}
+			switch v.(type) {
+			case bson.D, bson.A, bson.Regex:
+				continue
+			}
+			if MatchDoc(bson.D{{Key: e.Key, Value: v}}, bson.D{e}) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			return false
+		}
+	}
+	return true
+}
+
+// flattenAnd appends the conditions of filter to out, expanding $and.
+func flattenAnd(filter bson.D, out bson.D) bson.D {
+	for _, fe := range filter {
+		if fe.Key == "$and" {
+			arr, _ := fe.Value.(bson.A)
+			for _, sub := range arr {
+				if subDoc, ok := sub.(bson.D); ok {
+					out = flattenAnd(subDoc, out)
+				}
+			}
+			continue
+		}
+		out = append(out, fe)
+	}
+	return out
+}
+
+// scan returns the ids of the entries whose leading key falls within b.
+func (idx *docIndex) scan(b *keyBounds, plan *queryPlan) map[string]bool {
+	ids := make(map[string]bool)
+	leading := func(i int) interface{} { return idx.entries[i].key[0] }
+
+	scanPoints := func(points []interface{}) {
+		for _, p := range points {
+			v := indexValue(idx.collation.keyValue(p))
+			i := sort.Search(len(idx.entries), func(i int) bool { return compareIndexValues(leading(i), v) >= 0 })
+			for ; i < len(idx.entries) && compareIndexValues(leading(i), v) == 0; i++ {
+				plan.keysExamined++
+				ids[idx.entries[i].id] = true
+			}
+		}
+	}
+	if !b.isRange {
+		scanPoints(b.points)
+		return ids
+	}
+	scanPoints(b.also)
+	if b.empty {
+		return ids
+	}
+	lo, hi := idx.collation.keyValue(b.lo), idx.collation.keyValue(b.hi)
+
+	start := sort.Search(len(idx.entries), func(i int) bool {
+		k := leading(i)
+		if r := indexValueRank(k); r != b.rank {
+			return r > b.rank
+		}
+		if !b.hasLo {
+			return true
+		}
+		c := compareValues(k, lo)
+		return c > 0 || (c == 0 && b.loIncl)
+	})
+	for i := start; i < len(idx.entries); i++ {
+		k := leading(i)
+		if indexValueRank(k) != b.rank {
+			break
+		}
+		if b.hasHi {
+			c := compareValues(k, hi)
+			if c > 0 || (c == 0 && !b.hiIncl) {
+				break
+			}
+		}
+		plan.keysExamined++
+		ids[idx.entries[i].id] = true
+	}
+	return ids
+}
+
+// candidates returns the positions, in natural order, of the documents that
+// may match filter under collation, and the plan used to find them. Callers
+// must still apply MatchDoc to each candidate.
+func (c *Collection) candidates(filter bson.D, collation *Collation) ([]int, queryPlan) {
+	var plan queryPlan
+	var idx *docIndex
+	var bounds *keyBounds
+	if c.ix != nil {
+		idx, bounds = c.ix.plan(filter, collation)
+	}
+	if idx == nil {
+		positions := make([]int, len(c.Documents))
+		for i := range positions {
+			positions[i] = i
+		}
+		return positions, plan
+	}
+
+	plan.index, plan.bounds = idx, bounds
+	ids := idx.scan(bounds, &plan)
+	positions := make([]int, 0, len(ids))
+	for id := range ids {
+		if p, ok := c.ix.pos[id]; ok {
+			positions = append(positions, p)
+		}
+	}
+	sort.Ints(positions)
+	return positions, plan
+}
+
+// find returns the documents matching filter under collation in natural
+// order.
+func (c *Collection) find(filter bson.D, collation *Collation) []bson.D {
+	docs, _ := c.findPlan(filter, 0, collation)
+	return docs
+}
+
+// findPlan is find that stops after limit matches (0 means no limit) and
+// reports the plan used.
+func (c *Collection) findPlan(filter bson.D, limit int, collation *Collation) ([]bson.D, queryPlan) {
+	positions, plan := c.candidates(filter, collation)
+	var result []bson.D
+	for _, p := range positions {
+		plan.docsExamined++
+		if matchDoc(c.Documents[p], filter, collation) {
+			result = append(result, c.Documents[p])
+			if limit > 0 && len(result) == limit {
+				break
+			}
+		}
+	}
+	return result, plan
+}
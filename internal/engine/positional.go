@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// updateContext is what an update needs beyond the document itself: the
+// query, whose first matched array element $ refers to, the arrayFilters
+// that $[<identifier>] refers to, and whether the update is building the
+// document an upsert inserts, which is when $setOnInsert applies. For a
+// pipeline-style update it also holds the stages. The zero value resolves
+// no positional segments and updates an existing document.
+type updateContext struct {
+	filter       bson.D
+	collation    *Collation
+	arrayFilters map[string]bson.D
+	insert       bool
+	pipeline     []bson.D
+}
+
+// parseArrayFilters checks the arrayFilters of an update and returns them by
+// identifier. Every filter must name a single identifier used by a
+// $[<identifier>] segment of update, and every such segment must have a
+// filter.
+func parseArrayFilters(filters []bson.D, update bson.D) (map[string]bson.D, error) {
+	byID := make(map[string]bson.D, len(filters))
+	for _, f := range filters {
+		id, err := arrayFilterIdentifier(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRegexes(f); err != nil {
+			return nil, err
+		}
+		if _, dup := byID[id]; dup {
+			return nil, commandErrorf(9, "FailedToParse",
+				"Found multiple array filters with the same top-level field name %s", id)
+		}
+		byID[id] = f
+	}
+
+	used := make(map[string]bool)
+	for _, op := range update {
+		fields, _ := op.Value.(bson.D)
+		for _, f := range fields {
+			for _, part := range strings.Split(f.Key, ".") {
+				if !strings.HasPrefix(part, "$[") || part == "$[]" {
+					continue
+				}
+				id := strings.TrimSuffix(part[2:], "]")
+				if byID[id] == nil {
+					return nil, commandErrorf(2, "BadValue",
+						"No array filter found for identifier '%s' in path '%s'", id, f.Key)
+				}
+				used[id] = true
+			}
+		}
+	}
+	for id := range byID {
+		if !used[id] {
+			return nil, commandErrorf(9, "FailedToParse",
+				"The array filter for identifier '%s' was not used in the update", id)
+		}
+	}
+	return byID, nil
+}
+
+// arrayFilterIdentifier returns the identifier an array filter applies to:
+// the first segment of its field names, which must all agree.
+func arrayFilterIdentifier(filter bson.D) (string, error) {
+	var id string
+	var walk func(f bson.D) error
+	walk = func(f bson.D) error {
+		for _, e := range f {
+			if e.Key == "$and" || e.Key == "$or" || e.Key == "$nor" {
+				arr, _ := e.Value.(bson.A)
+				for _, sub := range arr {
+					if d, ok := sub.(bson.D); ok {
+						if err := walk(d); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			name, _, _ := strings.Cut(e.Key, ".")
+			if id != "" && name != id {
+				return commandErrorf(9, "FailedToParse",
+					"Error parsing array filter :: caused by :: Expected a single top-level field name, found '%s' and '%s'", id, name)
+			}
+			id = name
+		}
+		return nil
+	}
+	if err := walk(filter); err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", commandErrorf(9, "FailedToParse",
+			"Cannot use an expression without a top-level field name in arrayFilters")
+	}
+	if !validIdentifier(id) {
+		return "", commandErrorf(2, "BadValue",
+			"Error parsing array filter :: caused by :: The top-level field name must be an alphanumeric string beginning with a lowercase letter, found '%s'", id)
+	}
+	return id, nil
+}
+
+func validIdentifier(id string) bool {
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case i > 0 && (c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'):
+		default:
+			return false
+		}
+	}
+	return id != ""
+}
+
+// expandPath resolves the positional segments of an update path against doc
+// and returns the concrete paths to update: $ becomes the position the query
+// matched, $[] every element, and $[id] every element its array filter
+// matches. Paths without positional segments are returned as is.
+func (u *updateContext) expandPath(doc bson.D, path string) ([]string, error) {
+	if !strings.Contains(path, "$") {
+		return []string{path}, nil
+	}
+	var out []string
+	err := u.expand(doc, true, strings.Split(path, "."), nil, path, &out)
+	return out, err
+}
+
+// expand resolves parts within v, found reporting whether v exists, and
+// appends the concrete paths, prefixed by done, to out.
+func (u *updateContext) expand(v interface{}, found bool, parts, done []string, path string, out *[]string) error {
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "$") {
+			v, found = pathChild(v, part)
+			continue
+		}
+		prefix := append(append([]string(nil), done...), parts[:i]...)
+		if part == "$" {
+			n := u.position(strings.Join(prefix, "."), v)
+			if n < 0 {
+				return commandErrorf(2, "BadValue",
+					"The positional operator did not find the match needed from the query.")
+			}
+			idx := strconv.Itoa(n)
+			child, ok := pathChild(v, idx)
+			return u.expand(child, ok, parts[i+1:], append(prefix, idx), path, out)
+		}
+
+		arr, ok := v.(bson.A)
+		if !found {
+			return commandErrorf(2, "BadValue",
+				"The path '%s' must exist in the document in order to apply array updates.", strings.Join(prefix, "."))
+		}
+		if !ok {
+			return commandErrorf(2, "BadValue",
+				"Cannot apply array updates to non-array element %s: %v", strings.Join(prefix, "."), v)
+		}
+		var filter bson.D
+		id := strings.TrimSuffix(strings.TrimPrefix(part, "$["), "]")
+		if part != "$[]" {
+			filter = u.arrayFilters[id]
+			if filter == nil {
+				return commandErrorf(2, "BadValue",
+					"No array filter found for identifier '%s' in path '%s'", id, path)
+			}
+		}
+		for j, elem := range arr {
+			if filter != nil && !matchDoc(bson.D{{Key: id, Value: elem}}, filter, u.collation) {
+				continue
+			}
+			idx := strconv.Itoa(j)
+			if err := u.expand(elem, true, parts[i+1:], append(append([]string(nil), prefix...), idx), path, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	*out = append(*out, strings.Join(append(append([]string(nil), done...), parts...), "."))
+	return nil
+}
+
+// pathChild returns the value of one path segment within v.
+func pathChild(v interface{}, part string) (interface{}, bool) {
+	switch x := v.(type) {
+	case bson.D:
+		for _, e := range x {
+			if e.Key == part {
+				return e.Value, true
+			}
+		}
+	case bson.A:
+		if i, ok := arrayIndex(part); ok && i < len(x) {
+			return x[i], true
+		}
+	}
+	return nil, false
+}
+
+// position returns the position of the first element of the array at
+// arrPath that satisfies a query predicate on that array, or -1. A
+// predicate on the array itself, such as {tags: "a"} or an $elemMatch, is
+// applied to each element's value; a predicate on a field below it, such as
+// {"steps.name": "build"}, to each element's fields.
+func (u *updateContext) position(arrPath string, v interface{}) int {
+	arr, ok := v.(bson.A)
+	if !ok {
+		return -1
+	}
+	var preds []bson.E
+	var collect func(f bson.D)
+	collect = func(f bson.D) {
+		for _, e := range f {
+			switch {
+			case e.Key == "$and":
+				subs, _ := e.Value.(bson.A)
+				for _, sub := range subs {
+					if d, ok := sub.(bson.D); ok {
+						collect(d)
+					}
+				}
+			case e.Key == arrPath || strings.HasPrefix(e.Key, arrPath+"."):
+				preds = append(preds, e)
+			}
+		}
+	}
+	collect(u.filter)
+
+	for i, elem := range arr {
+		for _, p := range preds {
+			if p.Key == arrPath {
+				// Wrapping the element keeps array operators like
+				// $elemMatch meaningful.
+				if matchValues([]interface{}{bson.A{elem}}, p.Value, u.collation) {
+					return i
+				}
+				continue
+			}
+			rest := strings.TrimPrefix(p.Key, arrPath+".")
+			if d, ok := elem.(bson.D); ok && matchDoc(d, bson.D{{Key: rest, Value: p.Value}}, u.collation) {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ---- positional updates ----
+
+func stepsDoc() bson.D {
+	return bson.D{
+		{Key: "_id", Value: "r1"},
+		{Key: "tags", Value: bson.A{"a", "b", "c"}},
+		{Key: "steps", Value: bson.A{
+			bson.D{{Key: "name", Value: "build"}, {Key: "status", Value: "fail"}, {Key: "tries", Value: int32(1)}},
+			bson.D{{Key: "name", Value: "test"}, {Key: "status", Value: "fail"}, {Key: "tries", Value: int32(2)}},
+			bson.D{{Key: "name", Value: "lint"}, {Key: "status", Value: "pass"}, {Key: "tries", Value: int32(1)}},
+		}},
+	}
+}
+
+func stepStatuses(t *testing.T, doc bson.D) []interface{} {
+	t.Helper()
+	var out []interface{}
+	for i := 0; i < 3; i++ {
+		v, _ := GetField(doc, "steps."+string(rune('0'+i))+".status")
+		out = append(out, v)
+	}
+	return out
+}
+
+func TestUpdate_PositionalOperator(t *testing.T) {
+	tests := []struct {
+		filter bson.D
+		path   string
+		want   []interface{}
+	}{
+		{bson.D{{Key: "steps.name", Value: "test"}}, "steps.$.status", []interface{}{"fail", "done", "pass"}},
+		{bson.D{{Key: "_id", Value: "r1"}, {Key: "steps.status", Value: "pass"}}, "steps.$.status", []interface{}{"fail", "fail", "done"}},
+		{bson.D{{Key: "steps", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "status", Value: "fail"}, {Key: "tries", Value: int32(2)}}}}}}, "steps.$.status", []interface{}{"fail", "done", "pass"}},
+		{bson.D{{Key: "steps.tries", Value: bson.D{{Key: "$gt", Value: int32(1)}}}}, "steps.$.status", []interface{}{"fail", "done", "pass"}},
+	}
+	for _, tt := range tests {
+		eng, _ := newEng(t)
+		mustInsert(t, eng, "db", "runs", stepsDoc())
+		_, modified, _, err := eng.Update("db", "runs", tt.filter, bson.D{{Key: "$set", Value: bson.D{{Key: tt.path, Value: "done"}}}}, nil, false, false, nil)
+		if err != nil || modified != 1 {
+			t.Fatalf("filter %v: modified=%d err=%v", tt.filter, modified, err)
+		}
+		docs, _ := eng.Find("db", "runs", nil, nil, 0, 0, nil)
+		if got := stepStatuses(t, docs[0]); !valuesEqual(bson.A(got), bson.A(tt.want)) {
+			t.Errorf("filter %v: statuses = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestUpdate_PositionalScalarArray(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "runs", stepsDoc())
+	if _, _, _, err := eng.Update("db", "runs", bson.D{{Key: "tags", Value: "b"}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "tags.$", Value: "B"}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("db", "runs", nil, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "tags"); !valuesEqual(v, bson.A{"a", "B", "c"}) {
+		t.Errorf("tags = %v, want [a B c]", v)
+	}
+}
+
+func TestUpdate_PositionalNoMatch(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "runs", stepsDoc())
+	_, _, _, err := eng.Update("db", "runs", bson.D{{Key: "_id", Value: "r1"}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "steps.$.status", Value: "x"}}}}, nil, false, false, nil)
+	var ue *CommandError
+	if !errors.As(err, &ue) || ue.Code != 2 {
+		t.Fatalf("expected BadValue for $ without an array match, got %v", err)
+	}
+}
+
+func TestUpdate_AllPositional(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "runs", stepsDoc())
+	if _, _, _, err := eng.Update("db", "runs", nil,
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "steps.$[].tries", Value: int32(10)}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("db", "runs", nil, nil, 0, 0, nil)
+	for i, want := range []int64{11, 12, 11} {
+		if v, _ := GetField(docs[0], "steps."+string(rune('0'+i))+".tries"); v != want {
+			t.Errorf("steps.%d.tries = %v, want %d", i, v, want)
+		}
+	}
+}
+
+func TestUpdate_ArrayFilters(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "runs", stepsDoc())
+	arrayFilters := []bson.D{{{Key: "s.status", Value: "fail"}, {Key: "s.tries", Value: bson.D{{Key: "$lt", Value: int32(2)}}}}}
+	if _, _, _, err := eng.Update("db", "runs", nil,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "steps.$[s].status", Value: "retry"}}}}, arrayFilters, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := eng.Find("db", "runs", nil, nil, 0, 0, nil)
+	if got, want := stepStatuses(t, docs[0]), []interface{}{"retry", "fail", "pass"}; !valuesEqual(bson.A(got), bson.A(want)) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+
+	// Scalar elements are matched by the bare identifier.
+	if _, _, _, err := eng.Update("db", "runs", nil,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "tags.$[t]", Value: "z"}}}},
+		[]bson.D{{{Key: "t", Value: bson.D{{Key: "$in", Value: bson.A{"a", "c"}}}}}}, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ = eng.Find("db", "runs", nil, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "tags"); !valuesEqual(v, bson.A{"z", "b", "z"}) {
+		t.Errorf("tags = %v, want [z b z]", v)
+	}
+}
+
+func TestUpdate_ArrayFiltersFindAndModify(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "runs", stepsDoc())
+	doc, err := eng.FindAndModify("db", "runs", bson.D{{Key: "_id", Value: "r1"}}, nil,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "steps.$[s].status", Value: "skipped"}}}},
+		[]bson.D{{{Key: "s.name", Value: "lint"}}}, false, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepStatuses(t, doc), []interface{}{"fail", "fail", "skipped"}; !valuesEqual(bson.A(got), bson.A(want)) {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+}
+
+func TestUpdate_ArrayFiltersInvalid(t *testing.T) {
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "steps.$[s].status", Value: "x"}}}}
+	tests := []struct {
+		name    string
+		update  bson.D
+		filters []bson.D
+		code    int32
+	}{
+		{"missing filter", set, nil, 2},
+		{"unused filter", set, []bson.D{{{Key: "s.a", Value: 1}}, {{Key: "u.a", Value: 1}}}, 9},
+		{"duplicate identifier", set, []bson.D{{{Key: "s.a", Value: 1}}, {{Key: "s.b", Value: 1}}}, 9},
+		{"two identifiers", set, []bson.D{{{Key: "s.a", Value: 1}, {Key: "u.a", Value: 1}}}, 9},
+		{"bad identifier", bson.D{{Key: "$set", Value: bson.D{{Key: "steps.$[S].status", Value: "x"}}}}, []bson.D{{{Key: "S.a", Value: 1}}}, 2},
+	}
+	for _, tt := range tests {
+		eng, _ := newEng(t)
+		mustInsert(t, eng, "db", "runs", stepsDoc())
+		_, _, _, err := eng.Update("db", "runs", nil, tt.update, tt.filters, false, false, nil)
+		var ue *CommandError
+		if !errors.As(err, &ue) || ue.Code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+}
+
+func TestUpdate_AllPositionalNonArray(t *testing.T) {
+	for _, path := range []string{"_id.$[].x", "missing.$[].x"} {
+		_, err := applyUpdate(stepsDoc(), bson.D{{Key: "$set", Value: bson.D{{Key: path, Value: 1}}}}, &updateContext{})
+		var ue *CommandError
+		if !errors.As(err, &ue) {
+			t.Errorf("%s: expected CommandError, got %v", path, err)
+		}
+	}
+}
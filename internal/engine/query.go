@@ -1,8 +1,13 @@
 package engine
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -10,6 +15,13 @@ import (
 
 // MatchDoc checks if a document matches the given filter.
 func MatchDoc(doc bson.D, filter bson.D) bool {
+	return matchDoc(doc, filter, nil)
+}
+
+// matchDoc checks if a document matches the filter, comparing strings under
+// collation. $expr and regular expressions ignore the collation, as in
+// MongoDB.
+func matchDoc(doc bson.D, filter bson.D, collation *Collation) bool {
 	if len(filter) == 0 {
 		return true
 	}
@@ -33,7 +45,7 @@ func MatchDoc(doc bson.D, filter bson.D) bool {
 				if !ok {
 					return false
 				}
-				if !MatchDoc(doc, subDoc) {
+				if !matchDoc(doc, subDoc, collation) {
 					return false
 				}
 			}
@@ -48,7 +60,7 @@ func MatchDoc(doc bson.D, filter bson.D) bool {
 				if !ok {
 					continue
 				}
-				if MatchDoc(doc, subDoc) {
+				if matchDoc(doc, subDoc, collation) {
 					matched = true
 					break
 				}
@@ -66,7 +78,7 @@ func MatchDoc(doc bson.D, filter bson.D) bool {
 				if !ok {
 					continue
 				}
-				if MatchDoc(doc, subDoc) {
+				if matchDoc(doc, subDoc, collation) {
 					return false
 				}
 			}
@@ -75,12 +87,11 @@ func MatchDoc(doc bson.D, filter bson.D) bool {
 			if !ok {
 				return false
 			}
-			if MatchDoc(doc, subDoc) {
+			if matchDoc(doc, subDoc, collation) {
 				return false
 			}
 		default:
-			docVal, exists := lookupField(doc, key)
-			if !matchFieldValue(docVal, exists, val) {
+			if !matchValues(lookupValues(doc, key), val, collation) {
 				return false
 			}
 		}
@@ -88,7 +99,8 @@ func MatchDoc(doc bson.D, filter bson.D) bool {
 	return true
 }
 
-// lookupField resolves a dotted field path in a document.
+// lookupField resolves a dotted field path to a single value. Numeric
+// segments index into arrays, so "items.0.sku" reads the first item's sku.
 func lookupField(doc bson.D, path string) (interface{}, bool) {
 	parts := strings.Split(path, ".")
 	var current interface{} = doc
@@ -107,6 +119,12 @@ func lookupField(doc bson.D, path string) (interface{}, bool) {
 			if !found {
 				return nil, false
 			}
+		case bson.A:
+			i, ok := arrayIndex(part)
+			if !ok || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
 		default:
 			return nil, false
 		}
@@ -114,72 +132,195 @@ func lookupField(doc bson.D, path string) (interface{}, bool) {
 	return current, true
 }
 
-// matchFieldValue matches a document field value against a filter value.
-// If the filter value is a bson.D with operator keys ($gt, $eq, etc.), apply operators.
-// Otherwise, do equality comparison.
-func matchFieldValue(docVal interface{}, exists bool, filterVal interface{}) bool {
+// lookupValues resolves a dotted field path the way query predicates do.
+// A segment that meets an array is applied to each embedded document in it,
+// and a numeric segment also selects the element at that position, so a path
+// can reach several values. It returns nil if the path reaches nothing.
+func lookupValues(doc bson.D, path string) []interface{} {
+	var out []interface{}
+	collectPath(doc, strings.Split(path, "."), &out)
+	return out
+}
+
+func collectPath(v interface{}, parts []string, out *[]interface{}) {
+	if len(parts) == 0 {
+		*out = append(*out, v)
+		return
+	}
+	switch x := v.(type) {
+	case bson.D:
+		for _, elem := range x {
+			if elem.Key == parts[0] {
+				collectPath(elem.Value, parts[1:], out)
+				return
+			}
+		}
+	case bson.A:
+		if i, ok := arrayIndex(parts[0]); ok && i < len(x) {
+			collectPath(x[i], parts[1:], out)
+		}
+		for _, elem := range x {
+			if d, ok := elem.(bson.D); ok {
+				collectPath(d, parts, out)
+			}
+		}
+	}
+}
+
+// arrayIndex parses a path segment as an array position.
+func arrayIndex(part string) (int, bool) {
+	if part == "" || len(part) > 9 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range part {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// anyValue reports whether pred holds for one of vals or, for arrays, one
+// of their elements. This is MongoDB's "any element matches" rule.
+func anyValue(vals []interface{}, pred func(interface{}) bool) bool {
+	for _, v := range vals {
+		if pred(v) {
+			return true
+		}
+		if arr, ok := v.(bson.A); ok {
+			for _, elem := range arr {
+				if pred(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchValues matches the values a field path reached against a filter
+// value. If the filter value is a bson.D with operator keys ($gt, $eq, etc.),
+// apply operators. Otherwise, do equality comparison.
+func matchValues(vals []interface{}, filterVal interface{}, collation *Collation) bool {
 	// Check if filterVal is an operator document
 	if opDoc, ok := filterVal.(bson.D); ok && len(opDoc) > 0 && strings.HasPrefix(opDoc[0].Key, "$") {
-		return matchOperators(docVal, exists, opDoc)
+		return matchOperators(vals, opDoc, collation)
 	}
-	// Direct equality
-	if !exists {
-		return filterVal == nil
+	// A regular expression value matches strings it finds, as in MongoDB.
+	if re, ok := filterVal.(bson.Regex); ok {
+		return anyValue(vals, func(v interface{}) bool { return matchRegex(v, re.Pattern, re.Options) })
+	}
+	return equalsAny(vals, filterVal, collation)
+}
+
+// equalsAny reports whether one of vals, or one of their elements, equals
+// want. A missing field equals null.
+func equalsAny(vals []interface{}, want interface{}, collation *Collation) bool {
+	if len(vals) == 0 {
+		return want == nil
 	}
-	return valuesEqual(docVal, filterVal)
+	return anyValue(vals, func(v interface{}) bool { return equalCollated(v, want, collation) })
 }
 
-func matchOperators(docVal interface{}, exists bool, ops bson.D) bool {
+func matchOperators(vals []interface{}, ops bson.D, collation *Collation) bool {
 	for _, op := range ops {
-		if !applyOperator(docVal, exists, op.Key, op.Value) {
+		switch op.Key {
+		case "$options":
+			// Read by $regex.
+			continue
+		case "$regex":
+			options, hasOptions := "", false
+			for _, o := range ops {
+				if o.Key == "$options" {
+					options, _ = o.Value.(string)
+					hasOptions = true
+				}
+			}
+			if !anyValue(vals, func(v interface{}) bool { return regexOperator(v, op.Value, options, hasOptions) }) {
+				return false
+			}
+			continue
+		}
+		if !applyOperator(vals, op.Key, op.Value, collation) {
 			return false
 		}
 	}
 	return true
 }
 
-func applyOperator(docVal interface{}, exists bool, op string, opVal interface{}) bool {
+// inMatches reports whether docVal equals one of the $in/$nin values, or
+// matches one of its regular expressions.
+func inMatches(docVal interface{}, arr bson.A, collation *Collation) bool {
+	for _, v := range arr {
+		if re, ok := v.(bson.Regex); ok {
+			if matchRegex(docVal, re.Pattern, re.Options) {
+				return true
+			}
+			continue
+		}
+		if equalCollated(docVal, v, collation) {
+			return true
+		}
+	}
+	return false
+}
+
+// inValues reports whether the values a field path reached satisfy $in.
+func inValues(vals []interface{}, arr bson.A, collation *Collation) bool {
+	if len(vals) == 0 {
+		for _, v := range arr {
+			if v == nil {
+				return true
+			}
+		}
+		return false
+	}
+	return anyValue(vals, func(v interface{}) bool { return inMatches(v, arr, collation) })
+}
+
+// applyOperator evaluates one query operator against the values a field path
+// reached. Negated operators ($ne, $nin, $not) match only when no value
+// matches the positive form.
+func applyOperator(vals []interface{}, op string, opVal interface{}, collation *Collation) bool {
+	exists := len(vals) > 0
+	compare := func(pred func(int) bool) bool {
+		// A missing field compares as null, so {$gte: null} and
+		// {$lte: null} match it as {$eq: null} does.
+		vals := vals
+		if !exists {
+			vals = []interface{}{nil}
+		}
+		return anyValue(vals, func(v interface{}) bool {
+			return sameType(v, opVal) && pred(compareCollated(v, opVal, collation))
+		})
+	}
 	switch op {
 	case "$eq":
-		return exists && valuesEqual(docVal, opVal)
+		return equalsAny(vals, opVal, collation)
 	case "$ne":
-		return !exists || !valuesEqual(docVal, opVal)
+		return !equalsAny(vals, opVal, collation)
 	case "$gt":
-		return exists && compareValues(docVal, opVal) > 0
+		return compare(func(c int) bool { return c > 0 })
 	case "$gte":
-		return exists && compareValues(docVal, opVal) >= 0
+		return compare(func(c int) bool { return c >= 0 })
 	case "$lt":
-		return exists && compareValues(docVal, opVal) < 0
+		return compare(func(c int) bool { return c < 0 })
 	case "$lte":
-		return exists && compareValues(docVal, opVal) <= 0
+		return compare(func(c int) bool { return c <= 0 })
 	case "$in":
 		arr, ok := opVal.(bson.A)
 		if !ok {
 			return false
 		}
-		if !exists {
-			return false
-		}
-		for _, v := range arr {
-			if valuesEqual(docVal, v) {
-				return true
-			}
-		}
-		return false
+		return inValues(vals, arr, collation)
 	case "$nin":
 		arr, ok := opVal.(bson.A)
 		if !ok {
 			return true
 		}
-		if !exists {
-			return true
-		}
-		for _, v := range arr {
-			if valuesEqual(docVal, v) {
-				return false
-			}
-		}
-		return true
+		return !inValues(vals, arr, collation)
 	case "$exists":
 		want, ok := opVal.(bool)
 		if !ok {
@@ -187,64 +328,61 @@ func applyOperator(docVal interface{}, exists bool, op string, opVal interface{}
 		}
 		return exists == want
 	case "$type":
-		if !exists {
-			return false
-		}
-		return matchType(docVal, opVal)
+		return anyValue(vals, func(v interface{}) bool { return matchType(v, opVal) })
 	case "$all":
 		arr, ok := opVal.(bson.A)
-		if !ok {
-			return false
-		}
-		docArr, ok := docVal.(bson.A)
-		if !ok {
+		if !ok || len(arr) == 0 || !exists {
 			return false
 		}
 		for _, needed := range arr {
-			found := false
-			for _, have := range docArr {
-				if valuesEqual(have, needed) {
-					found = true
-					break
-				}
-			}
-			if !found {
+			if !equalsAny(vals, needed, collation) {
 				return false
 			}
 		}
 		return true
 	case "$size":
-		docArr, ok := docVal.(bson.A)
-		if !ok {
-			return false
-		}
 		size := toInt64(opVal)
-		return int64(len(docArr)) == size
+		for _, v := range vals {
+			if docArr, ok := v.(bson.A); ok && int64(len(docArr)) == size {
+				return true
+			}
+		}
+		return false
 	case "$elemMatch":
 		subFilter, ok := opVal.(bson.D)
 		if !ok {
 			return false
 		}
-		docArr, ok := docVal.(bson.A)
-		if !ok {
-			return false
-		}
-		for _, elem := range docArr {
-			elemDoc, ok := elem.(bson.D)
+		// {$elemMatch: {$gt: 1}} applies operators to scalar elements;
+		// {$elemMatch: {field: ...}} applies a filter to embedded documents.
+		isOps := len(subFilter) > 0 && strings.HasPrefix(subFilter[0].Key, "$")
+		for _, v := range vals {
+			docArr, ok := v.(bson.A)
 			if !ok {
 				continue
 			}
-			if MatchDoc(elemDoc, subFilter) {
-				return true
+			for _, elem := range docArr {
+				if isOps {
+					if matchOperators([]interface{}{elem}, subFilter, collation) {
+						return true
+					}
+					continue
+				}
+				if elemDoc, ok := elem.(bson.D); ok && matchDoc(elemDoc, subFilter, collation) {
+					return true
+				}
 			}
 		}
 		return false
 	case "$not":
+		if re, ok := opVal.(bson.Regex); ok {
+			return !anyValue(vals, func(v interface{}) bool { return matchRegex(v, re.Pattern, re.Options) })
+		}
 		subOps, ok := opVal.(bson.D)
 		if !ok {
 			return false
 		}
-		return !matchOperators(docVal, exists, subOps)
+		return !matchOperators(vals, subOps, collation)
 	default:
 		return false
 	}
@@ -275,12 +413,27 @@ func matchType(val interface{}, typeVal interface{}) bool {
 		return ok
 	case "null":
 		return val == nil
+	case "date":
+		_, ok := val.(bson.DateTime)
+		return ok
 	default:
 		return false
 	}
 }
 
 func valuesEqual(a, b interface{}) bool {
+	return equalCollated(a, b, nil)
+}
+
+// equalCollated reports whether a and b are equal, comparing strings, and
+// strings within documents and arrays, under collation.
+func equalCollated(a, b interface{}, collation *Collation) bool {
+	if collation != nil {
+		switch typeRank(a) {
+		case rankString, rankObject, rankArray:
+			return sameType(a, b) && compareCollated(a, b, collation) == 0
+		}
+	}
 	if a == nil && b == nil {
 		return true
 	}
@@ -294,61 +447,211 @@ func valuesEqual(a, b interface{}) bool {
 	return reflect.DeepEqual(a, b)
 }
 
-// compareValues returns -1, 0, or 1. For non-comparable types, returns 0.
+// BSON type ranks, in MongoDB's cross-type comparison order.
+const (
+	rankMinKey = iota
+	rankNull
+	rankNumber
+	rankString
+	rankObject
+	rankArray
+	rankBinary
+	rankObjectID
+	rankBool
+	rankDate
+	rankTimestamp
+	rankRegex
+	rankMaxKey
+)
+
+// typeRank returns the rank of v's BSON type. Values of different ranks
+// never compare equal, and range operators only match values of the same
+// rank as their operand.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case bson.MinKey:
+		return rankMinKey
+	case nil, bson.Null, bson.Undefined:
+		return rankNull
+	case string, bson.Symbol:
+		return rankString
+	case bson.D, bson.M:
+		return rankObject
+	case bson.A:
+		return rankArray
+	case bson.Binary:
+		return rankBinary
+	case bson.ObjectID:
+		return rankObjectID
+	case bool:
+		return rankBool
+	case bson.DateTime:
+		return rankDate
+	case bson.Timestamp:
+		return rankTimestamp
+	case bson.Regex:
+		return rankRegex
+	case bson.MaxKey:
+		return rankMaxKey
+	}
+	if isNumeric(v) {
+		return rankNumber
+	}
+	if _, ok := v.(bson.Decimal128); ok {
+		return rankNumber
+	}
+	return rankObject
+}
+
+// sameType reports whether a and b have the same BSON type rank.
+func sameType(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b)
+}
+
+// compareValues returns -1, 0, or 1, ordering values as MongoDB does: first
+// by BSON type, MinKey < null < numbers < string < object < array < binData
+// < ObjectId < bool < date < timestamp < regex < MaxKey, then by value
+// within the type. Documents and arrays compare element by element.
 func compareValues(a, b interface{}) int {
-	// Handle numeric types
-	if isNumeric(a) && isNumeric(b) {
-		af := toFloat64(a)
-		bf := toFloat64(b)
-		if af < bf {
-			return -1
-		}
-		if af > bf {
-			return 1
-		}
-		return 0
+	return compareCollated(a, b, nil)
+}
+
+// compareCollated is compareValues with strings, including those within
+// documents and arrays, compared under collation.
+func compareCollated(a, b interface{}, collation *Collation) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return cmp.Compare(ra, rb)
 	}
-	// String comparison
-	if as, ok := a.(string); ok {
-		if bs, ok := b.(string); ok {
-			if as < bs {
-				return -1
-			}
-			if as > bs {
-				return 1
-			}
+	switch ra {
+	case rankNumber:
+		return compareNumbers(a, b)
+	case rankString:
+		return collation.compareStrings(stringValue(a), stringValue(b))
+	case rankObject:
+		ad, aok := documentValue(a)
+		bd, bok := documentValue(b)
+		if !aok || !bok {
 			return 0
 		}
-	}
-	// Bool comparison
-	if ab, ok := a.(bool); ok {
-		if bb, ok := b.(bool); ok {
-			if ab == bb {
-				return 0
+		return compareDocuments(ad, bd, collation)
+	case rankArray:
+		aa, ba := a.(bson.A), b.(bson.A)
+		for i := 0; i < len(aa) && i < len(ba); i++ {
+			if c := compareCollated(aa[i], ba[i], collation); c != 0 {
+				return c
 			}
-			if !ab {
-				return -1
-			}
-			return 1
 		}
-	}
-	// ObjectID comparison
-	if ao, ok := a.(bson.ObjectID); ok {
-		if bo, ok := b.(bson.ObjectID); ok {
-			for i := 0; i < 12; i++ {
-				if ao[i] < bo[i] {
-					return -1
-				}
-				if ao[i] > bo[i] {
-					return 1
-				}
-			}
+		return cmp.Compare(len(aa), len(ba))
+	case rankBinary:
+		// By length, then subtype, then bytes.
+		ab, bb := a.(bson.Binary), b.(bson.Binary)
+		if c := cmp.Compare(len(ab.Data), len(bb.Data)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(ab.Subtype, bb.Subtype); c != 0 {
+			return c
+		}
+		return bytes.Compare(ab.Data, bb.Data)
+	case rankObjectID:
+		ao, bo := a.(bson.ObjectID), b.(bson.ObjectID)
+		return bytes.Compare(ao[:], bo[:])
+	case rankBool:
+		ab, bb := a.(bool), b.(bool)
+		if ab == bb {
 			return 0
 		}
+		if !ab {
+			return -1
+		}
+		return 1
+	case rankDate:
+		return cmp.Compare(a.(bson.DateTime), b.(bson.DateTime))
+	case rankTimestamp:
+		at, bt := a.(bson.Timestamp), b.(bson.Timestamp)
+		if c := cmp.Compare(at.T, bt.T); c != 0 {
+			return c
+		}
+		return cmp.Compare(at.I, bt.I)
+	case rankRegex:
+		ar, br := a.(bson.Regex), b.(bson.Regex)
+		if c := strings.Compare(ar.Pattern, br.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(ar.Options, br.Options)
 	}
+	// MinKey, null and MaxKey have a single value.
 	return 0
 }
 
+// compareNumbers compares two numbers of any numeric type. Integers compare
+// exactly; NaN sorts before every other number.
+func compareNumbers(a, b interface{}) int {
+	if isInt(a) && isInt(b) {
+		return cmp.Compare(toInt64(a), toInt64(b))
+	}
+	return cmp.Compare(numberFloat(a), numberFloat(b))
+}
+
+// numberFloat converts a number, including a Decimal128, to a float64.
+func numberFloat(v interface{}) float64 {
+	if d, ok := v.(bson.Decimal128); ok {
+		f, err := strconv.ParseFloat(d.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return toFloat64(v)
+}
+
+// stringValue returns the text of a string or symbol.
+func stringValue(v interface{}) string {
+	if s, ok := v.(bson.Symbol); ok {
+		return string(s)
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// documentValue returns v as a bson.D; a bson.M is ordered by key.
+func documentValue(v interface{}) (bson.D, bool) {
+	switch d := v.(type) {
+	case bson.D:
+		return d, true
+	case bson.M:
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make(bson.D, len(keys))
+		for i, k := range keys {
+			out[i] = bson.E{Key: k, Value: d[k]}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// compareDocuments compares documents field by field: by the type of the
+// values, then the field names, then the values. A document that is a
+// prefix of the other is smaller.
+func compareDocuments(a, b bson.D, collation *Collation) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := cmp.Compare(typeRank(a[i].Value), typeRank(b[i].Value)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Key, b[i].Key); c != 0 {
+			return c
+		}
+		if c := compareCollated(a[i].Value, b[i].Value, collation); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
 func isNumeric(v interface{}) bool {
 	switch v.(type) {
 	case int, int32, int64, float32, float64:
@@ -389,6 +692,12 @@ func toInt64(v interface{}) int64 {
 
 // SortDocs sorts documents by the given sort specification.
 func SortDocs(docs []bson.D, sortSpec bson.D) {
+	sortDocs(docs, sortSpec, nil)
+}
+
+// sortDocs sorts documents by the sort specification, comparing strings
+// under collation.
+func sortDocs(docs []bson.D, sortSpec bson.D, collation *Collation) {
 	if len(sortSpec) == 0 {
 		return
 	}
@@ -396,7 +705,7 @@ func SortDocs(docs []bson.D, sortSpec bson.D) {
 	n := len(docs)
 	for i := 1; i < n; i++ {
 		for j := i; j > 0; j-- {
-			if compareDocs(docs[j-1], docs[j], sortSpec) > 0 {
+			if compareDocs(docs[j-1], docs[j], sortSpec, collation) > 0 {
 				docs[j-1], docs[j] = docs[j], docs[j-1]
 			} else {
 				break
@@ -405,16 +714,24 @@ func SortDocs(docs []bson.D, sortSpec bson.D) {
 	}
 }
 
-func compareDocs(a, b bson.D, sortSpec bson.D) int {
+func compareDocs(a, b bson.D, sortSpec bson.D, collation *Collation) int {
 	for _, s := range sortSpec {
-		aVal, _ := lookupField(a, s.Key)
-		bVal, _ := lookupField(b, s.Key)
-		cmp := compareValues(aVal, bVal)
+		desc := toInt64(s.Value) < 0
+		av, aEmpty := sortValue(a, s.Key, desc, collation)
+		bv, bEmpty := sortValue(b, s.Key, desc, collation)
+		var cmp int
+		switch {
+		case aEmpty && !bEmpty:
+			cmp = -1
+		case bEmpty && !aEmpty:
+			cmp = 1
+		default:
+			cmp = compareCollated(av, bv, collation)
+		}
 		if cmp == 0 {
 			continue
 		}
-		dir := toInt64(s.Value)
-		if dir < 0 {
+		if desc {
 			return -cmp
 		}
 		return cmp
@@ -422,8 +739,44 @@ func compareDocs(a, b bson.D, sortSpec bson.D) int {
 	return 0
 }
 
+// sortValue returns the value doc sorts by on path. As in MongoDB, a path
+// that reaches an array sorts by its smallest element ascending and its
+// largest element descending. If the path reaches only empty arrays, empty
+// is true: an empty array sorts before null and missing fields.
+func sortValue(doc bson.D, path string, desc bool, collation *Collation) (best interface{}, empty bool) {
+	found, sawEmpty := false, false
+	consider := func(v interface{}) {
+		if !found {
+			best, found = v, true
+			return
+		}
+		c := compareCollated(v, best, collation)
+		if (desc && c > 0) || (!desc && c < 0) {
+			best = v
+		}
+	}
+	for _, v := range lookupValues(doc, path) {
+		if arr, ok := v.(bson.A); ok {
+			if len(arr) == 0 {
+				sawEmpty = true
+			}
+			for _, elem := range arr {
+				consider(elem)
+			}
+			continue
+		}
+		consider(v)
+	}
+	return best, sawEmpty && !found
+}
+
 // FilterDocs returns documents matching the filter.
 func FilterDocs(docs []bson.D, filter bson.D) []bson.D {
+	return filterDocs(docs, filter, nil)
+}
+
+// filterDocs returns documents matching the filter under collation.
+func filterDocs(docs []bson.D, filter bson.D, collation *Collation) []bson.D {
 	if len(filter) == 0 {
 		result := make([]bson.D, len(docs))
 		copy(result, docs)
@@ -431,66 +784,132 @@ func FilterDocs(docs []bson.D, filter bson.D) []bson.D {
 	}
 	var result []bson.D
 	for _, doc := range docs {
-		if MatchDoc(doc, filter) {
+		if matchDoc(doc, filter, collation) {
 			result = append(result, doc)
 		}
 	}
 	return result
 }
 
-// SetField sets a field in a document, creating intermediate docs for dotted paths.
+// SetField sets a field in a document, creating intermediate docs for dotted
+// paths. Numeric segments address array elements, padding the array with
+// nulls if needed; any other value in the way is replaced by a document.
 func SetField(doc bson.D, path string, val interface{}) bson.D {
-	parts := strings.Split(path, ".")
-	if len(parts) == 1 {
-		for i, e := range doc {
-			if e.Key == path {
-				doc[i].Value = val
-				return doc
+	out, _ := setPath(doc, strings.Split(path, "."), val, false)
+	return out.(bson.D)
+}
+
+// setField is SetField for update operators: instead of replacing a value
+// that is in the way, such as a string where "a.b" needs a document or an
+// array under a non-numeric segment, it returns a PathError.
+func setField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	out, err := setPath(doc, strings.Split(path, "."), val, true)
+	if err != nil {
+		return nil, &PathError{Path: path, Err: err}
+	}
+	return out.(bson.D), nil
+}
+
+// PathError is returned by update operators when a dotted path cannot be
+// created in a document.
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("cannot set %q: %v", e.Path, e.Err)
+}
+
+func (e *PathError) Unwrap() error { return e.Err }
+
+// setPath sets parts within v, which must be a document or array, and
+// returns the updated value.
+func setPath(v interface{}, parts []string, val interface{}, strict bool) (interface{}, error) {
+	if len(parts) == 0 {
+		return val, nil
+	}
+	switch x := v.(type) {
+	case bson.D:
+		for i, e := range x {
+			if e.Key == parts[0] {
+				nv, err := setPath(e.Value, parts[1:], val, strict)
+				if err != nil {
+					return nil, err
+				}
+				x[i].Value = nv
+				return x, nil
 			}
 		}
-		return append(doc, bson.E{Key: path, Value: val})
-	}
-	// Nested path: find or create the intermediate document
-	first := parts[0]
-	rest := strings.Join(parts[1:], ".")
-	for i, e := range doc {
-		if e.Key == first {
-			sub, ok := e.Value.(bson.D)
-			if !ok {
-				sub = bson.D{}
+		return append(x, bson.E{Key: parts[0], Value: newPath(parts[1:], val)}), nil
+	case bson.A:
+		i, ok := arrayIndex(parts[0])
+		if !ok {
+			if strict {
+				return nil, fmt.Errorf("cannot create field %q in an array", parts[0])
+			}
+			return setPath(bson.D{}, parts, val, strict)
+		}
+		if i >= len(x) {
+			for len(x) <= i {
+				x = append(x, nil)
 			}
-			doc[i].Value = SetField(sub, rest, val)
-			return doc
+			x[i] = newPath(parts[1:], val)
+			return x, nil
+		}
+		nv, err := setPath(x[i], parts[1:], val, strict)
+		if err != nil {
+			return nil, err
 		}
+		x[i] = nv
+		return x, nil
+	}
+	if strict {
+		return nil, fmt.Errorf("cannot create field %q in a value of type %s", parts[0], bsonTypeName(v))
 	}
-	sub := SetField(bson.D{}, rest, val)
-	return append(doc, bson.E{Key: first, Value: sub})
+	return setPath(bson.D{}, parts, val, strict)
 }
 
-// UnsetField removes a field from a document.
+// newPath returns val nested in documents along parts.
+func newPath(parts []string, val interface{}) interface{} {
+	for i := len(parts) - 1; i >= 0; i-- {
+		val = bson.D{{Key: parts[i], Value: val}}
+	}
+	return val
+}
+
+// UnsetField removes a field from a document. A numeric segment that ends
+// the path sets that array element to null, as MongoDB does, so the
+// positions of later elements are kept.
 func UnsetField(doc bson.D, path string) bson.D {
-	parts := strings.Split(path, ".")
-	if len(parts) == 1 {
-		for i, e := range doc {
-			if e.Key == path {
-				return append(doc[:i], doc[i+1:]...)
+	return unsetPath(doc, strings.Split(path, ".")).(bson.D)
+}
+
+func unsetPath(v interface{}, parts []string) interface{} {
+	switch x := v.(type) {
+	case bson.D:
+		for i, e := range x {
+			if e.Key != parts[0] {
+				continue
 			}
-		}
-		return doc
-	}
-	first := parts[0]
-	rest := strings.Join(parts[1:], ".")
-	for i, e := range doc {
-		if e.Key == first {
-			sub, ok := e.Value.(bson.D)
-			if !ok {
-				return doc
+			if len(parts) == 1 {
+				return append(x[:i], x[i+1:]...)
 			}
-			doc[i].Value = UnsetField(sub, rest)
-			return doc
+			x[i].Value = unsetPath(e.Value, parts[1:])
+			return x
+		}
+	case bson.A:
+		i, ok := arrayIndex(parts[0])
+		if !ok || i >= len(x) {
+			return x
+		}
+		if len(parts) == 1 {
+			x[i] = nil
+			return x
 		}
+		x[i] = unsetPath(x[i], parts[1:])
 	}
-	return doc
+	return v
 }
 
 // GetField retrieves a field value from a bson.D, same as lookupField but exported.
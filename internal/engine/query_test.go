@@ -1,6 +1,9 @@
 package engine
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -153,6 +156,39 @@ func TestMatchDoc_GtLtGteLte(t *testing.T) {
 	}
 }
 
+func TestMatchDoc_CompareNullMatchesMissing(t *testing.T) {
+	missing := bson.D{{Key: "a", Value: 1}}
+	for _, tt := range []struct {
+		op   string
+		want bool
+	}{{"$gte", true}, {"$lte", true}, {"$gt", false}, {"$lt", false}} {
+		if got := MatchDoc(missing, bson.D{{Key: "f", Value: bson.D{{Key: tt.op, Value: nil}}}}); got != tt.want {
+			t.Errorf("{f: {%s: null}} on a missing field = %v, want %v", tt.op, got, tt.want)
+		}
+	}
+	if MatchDoc(missing, bson.D{{Key: "f", Value: bson.D{{Key: "$gte", Value: int32(0)}}}}) {
+		t.Error("{f: {$gte: 0}} should not match a missing field")
+	}
+
+	// An index scan agrees with the collection scan.
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "c",
+		bson.D{{Key: "_id", Value: int32(1)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "f", Value: nil}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "f", Value: int32(1)}},
+	)
+	if err := eng.CreateIndexes("db", "c", []IndexSpec{{Name: "f_1", Keys: bson.D{{Key: "f", Value: int32(1)}}}}); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := eng.Find("db", "c", bson.D{{Key: "f", Value: bson.D{{Key: "$gte", Value: nil}}}}, bson.D{{Key: "_id", Value: int32(1)}}, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := docIDs(docs), []interface{}{int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("indexed {f: {$gte: null}} = %v, want %v", got, want)
+	}
+}
+
 func TestMatchDoc_In(t *testing.T) {
 	doc := bson.D{{Key: "status", Value: "active"}}
 	if !MatchDoc(doc, bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: bson.A{"active", "pending"}}}}}) {
@@ -279,6 +315,199 @@ func TestMatchDoc_FieldNot(t *testing.T) {
 	}
 }
 
+func TestMatchDoc_Regex(t *testing.T) {
+	doc := bson.D{{Key: "name", Value: "TestFindAll"}, {Key: "n", Value: int32(1)}}
+	cases := []struct {
+		filter bson.D
+		want   bool
+	}{
+		{bson.D{{Key: "name", Value: bson.Regex{Pattern: "^Test.*"}}}, true},
+		{bson.D{{Key: "name", Value: bson.Regex{Pattern: "^test"}}}, false},
+		{bson.D{{Key: "name", Value: bson.Regex{Pattern: "^test", Options: "i"}}}, true},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "find"}}}}, false},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "find"}, {Key: "$options", Value: "i"}}}}, true},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$options", Value: "i"}, {Key: "$regex", Value: "FIND"}}}}, true},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: bson.Regex{Pattern: "all$", Options: "i"}}}}}, true},
+		// $options replaces the options of a regex value.
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: bson.Regex{Pattern: "all$", Options: "i"}}, {Key: "$options", Value: ""}}}}, false},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$not", Value: bson.Regex{Pattern: "^Test"}}}}}, false},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$regex", Value: "^Bench"}}}}}}, true},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: bson.A{"x", bson.Regex{Pattern: "All$"}}}}}}, true},
+		{bson.D{{Key: "name", Value: bson.D{{Key: "$nin", Value: bson.A{bson.Regex{Pattern: "All$"}}}}}}, false},
+		// Only strings (and identical stored regexes) match.
+		{bson.D{{Key: "n", Value: bson.Regex{Pattern: "1"}}}, false},
+		{bson.D{{Key: "missing", Value: bson.Regex{Pattern: ".*"}}}, false},
+		// Patterns RE2 cannot compile match nothing.
+		{bson.D{{Key: "name", Value: bson.Regex{Pattern: "^Test(?=Find)"}}}, false},
+	}
+	for _, c := range cases {
+		if got := MatchDoc(doc, c.filter); got != c.want {
+			t.Errorf("MatchDoc(%v) = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestMatchDoc_RegexOptions(t *testing.T) {
+	doc := bson.D{{Key: "text", Value: "first line\nsecond line"}}
+	cases := []struct {
+		re   bson.Regex
+		want bool
+	}{
+		{bson.Regex{Pattern: "^second"}, false},
+		{bson.Regex{Pattern: "^second", Options: "m"}, true},
+		{bson.Regex{Pattern: "line.second"}, false},
+		{bson.Regex{Pattern: "line.second", Options: "s"}, true},
+		{bson.Regex{Pattern: "first line", Options: "x"}, false},
+		{bson.Regex{Pattern: "first \\s line # a comment\n", Options: "x"}, true},
+		{bson.Regex{Pattern: "first\\ line # a comment\n \\n second", Options: "x"}, true},
+		{bson.Regex{Pattern: "[ ]line", Options: "x"}, true},
+		{bson.Regex{Pattern: "FIRST \\s LINE", Options: "ix"}, true},
+	}
+	for _, c := range cases {
+		if got := MatchDoc(doc, bson.D{{Key: "text", Value: c.re}}); got != c.want {
+			t.Errorf("/%s/%s: got %v, want %v", c.re.Pattern, c.re.Options, got, c.want)
+		}
+	}
+}
+
+func TestMatchDoc_StoredRegex(t *testing.T) {
+	doc := bson.D{{Key: "re", Value: bson.Regex{Pattern: "^a", Options: "i"}}}
+	if !MatchDoc(doc, bson.D{{Key: "re", Value: bson.Regex{Pattern: "^a", Options: "i"}}}) {
+		t.Error("identical regex should match a stored regex")
+	}
+	if !MatchDoc(doc, bson.D{{Key: "re", Value: bson.D{{Key: "$eq", Value: bson.Regex{Pattern: "^a", Options: "i"}}}}}) {
+		t.Error("$eq should compare regexes literally")
+	}
+	if MatchDoc(doc, bson.D{{Key: "re", Value: bson.Regex{Pattern: "^a"}}}) {
+		t.Error("regex with different options should not match")
+	}
+}
+
+func TestInvalidRegexIsAnError(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "col", bson.D{{Key: "name", Value: "a"}, {Key: "tags", Value: bson.A{"x"}}})
+	bad := bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "("}}}}
+	badOptions := bson.D{{Key: "name", Value: bson.Regex{Pattern: "a", Options: "z"}}}
+
+	if _, err := eng.Find("db", "col", bad, nil, 0, 0, nil); err == nil || !strings.Contains(err.Error(), "regular expression is invalid") {
+		t.Errorf("find: got %v, want an invalid regular expression error", err)
+	}
+	if _, err := eng.Find("db", "col", badOptions, nil, 0, 0, nil); err == nil || !strings.Contains(err.Error(), "invalid flag in regex options: z") {
+		t.Errorf("find with options z: got %v, want an invalid flag error", err)
+	}
+	if _, err := eng.Count("db", "col", bad, nil); err == nil {
+		t.Error("count: expected an error")
+	}
+	if _, err := eng.Delete("db", "col", bad, true, nil); err == nil {
+		t.Error("delete: expected an error")
+	}
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: int32(1)}}}}
+	if _, _, _, err := eng.Update("db", "col", bad, set, nil, true, false, nil); err == nil {
+		t.Error("update: expected an error")
+	}
+	pull := bson.D{{Key: "$pull", Value: bson.D{{Key: "tags", Value: bson.Regex{Pattern: "["}}}}}
+	if _, _, _, err := eng.Update("db", "col", bson.D{}, pull, nil, true, false, nil); err == nil {
+		t.Error("$pull: expected an error")
+	}
+	if _, err := eng.Aggregate("db", "col", []bson.D{{{Key: "$match", Value: bad}}}, nil); err == nil {
+		t.Error("aggregate: expected an error")
+	}
+	if _, err := eng.ExplainFind("db", "col", bad, nil, 0, 0, nil); err == nil {
+		t.Error("explain: expected an error")
+	}
+	// $eq compares a regular expression as a value.
+	literal := bson.D{{Key: "name", Value: bson.D{{Key: "$eq", Value: bson.Regex{Pattern: "("}}}}}
+	if _, err := eng.Find("db", "col", literal, nil, 0, 0, nil); err != nil {
+		t.Errorf("$eq regex: unexpected error %v", err)
+	}
+	if n, _ := eng.Count("db", "col", bson.D{}, nil); n != 1 {
+		t.Errorf("expected the document to be untouched, count %d", n)
+	}
+}
+
+func TestRegexCacheIsBounded(t *testing.T) {
+	for i := 0; i < 2*regexCacheSize; i++ {
+		if _, err := compileRegex(fmt.Sprintf("^p%d$", i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	regexCache.mu.Lock()
+	n := regexCache.order.Len()
+	regexCache.mu.Unlock()
+	if n > regexCacheSize {
+		t.Errorf("cache holds %d patterns, want at most %d", n, regexCacheSize)
+	}
+	re, err := compileRegex("^p0$", "")
+	if err != nil || !re.MatchString("p0") {
+		t.Errorf("recompiling an evicted pattern: %v", err)
+	}
+}
+
+func TestMatchDoc_ArrayTraversal(t *testing.T) {
+	doc := bson.D{
+		{Key: "tags", Value: bson.A{"checkout", "payments"}},
+		{Key: "items", Value: bson.A{
+			bson.D{{Key: "sku", Value: "A1"}, {Key: "qty", Value: int32(2)}},
+			bson.D{{Key: "sku", Value: "B2"}, {Key: "qty", Value: int32(7)}, {Key: "opts", Value: bson.A{"gift"}}},
+		}},
+		{Key: "scores", Value: bson.A{int32(3), int32(9)}},
+	}
+	tests := []struct {
+		filter bson.D
+		want   bool
+	}{
+		{bson.D{{Key: "tags", Value: "checkout"}}, true},
+		{bson.D{{Key: "tags", Value: "auth"}}, false},
+		{bson.D{{Key: "tags", Value: bson.A{"checkout", "payments"}}}, true},
+		{bson.D{{Key: "items.sku", Value: "B2"}}, true},
+		{bson.D{{Key: "items.sku", Value: "C3"}}, false},
+		{bson.D{{Key: "items.0.sku", Value: "A1"}}, true},
+		{bson.D{{Key: "items.0.sku", Value: "B2"}}, false},
+		{bson.D{{Key: "items.1", Value: bson.D{{Key: "$exists", Value: true}}}}, true},
+		{bson.D{{Key: "items.2", Value: bson.D{{Key: "$exists", Value: true}}}}, false},
+		{bson.D{{Key: "items.opts", Value: "gift"}}, true},
+		{bson.D{{Key: "items.qty", Value: bson.D{{Key: "$gt", Value: int32(5)}}}}, true},
+		{bson.D{{Key: "items.qty", Value: bson.D{{Key: "$gt", Value: int32(10)}}}}, false},
+		{bson.D{{Key: "scores", Value: bson.D{{Key: "$gt", Value: int32(4)}, {Key: "$lt", Value: int32(5)}}}}, true},
+		{bson.D{{Key: "scores", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: int32(4)}, {Key: "$lt", Value: int32(5)}}}}}}, false},
+		{bson.D{{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "sku", Value: "B2"}, {Key: "qty", Value: int32(7)}}}}}}, true},
+		{bson.D{{Key: "items", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "sku", Value: "A1"}, {Key: "qty", Value: int32(7)}}}}}}, false},
+		{bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{"auth", "payments"}}}}}, true},
+		{bson.D{{Key: "items.opts", Value: bson.D{{Key: "$size", Value: int32(1)}}}}, true},
+		{bson.D{{Key: "items.sku", Value: bson.D{{Key: "$all", Value: bson.A{"A1", "B2"}}}}}, true},
+		{bson.D{{Key: "items.sku", Value: bson.Regex{Pattern: "^B"}}}, true},
+	}
+	for _, tt := range tests {
+		if got := MatchDoc(doc, tt.filter); got != tt.want {
+			t.Errorf("MatchDoc(%v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDoc_NegationOverArrays(t *testing.T) {
+	doc := bson.D{
+		{Key: "tags", Value: bson.A{"checkout", "payments"}},
+		{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}, bson.D{{Key: "sku", Value: "B2"}}}},
+	}
+	tests := []struct {
+		filter bson.D
+		want   bool
+	}{
+		// A negation holds only if no element matches the positive form.
+		{bson.D{{Key: "tags", Value: bson.D{{Key: "$ne", Value: "checkout"}}}}, false},
+		{bson.D{{Key: "tags", Value: bson.D{{Key: "$ne", Value: "auth"}}}}, true},
+		{bson.D{{Key: "items.sku", Value: bson.D{{Key: "$nin", Value: bson.A{"B2"}}}}}, false},
+		{bson.D{{Key: "items.sku", Value: bson.D{{Key: "$not", Value: bson.Regex{Pattern: "^C"}}}}}, true},
+		{bson.D{{Key: "missing", Value: bson.D{{Key: "$ne", Value: nil}}}}, false},
+		{bson.D{{Key: "missing", Value: bson.D{{Key: "$in", Value: bson.A{nil}}}}}, true},
+	}
+	for _, tt := range tests {
+		if got := MatchDoc(doc, tt.filter); got != tt.want {
+			t.Errorf("MatchDoc(%v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
 // ---- SetField / UnsetField / GetField ----
 
 func TestSetField_ExistingKey(t *testing.T) {
@@ -352,6 +581,32 @@ func TestUnsetField_Missing(t *testing.T) {
 	}
 }
 
+func TestSetField_ArrayIndex(t *testing.T) {
+	doc := bson.D{{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}, "x"}}}
+	doc = SetField(doc, "items.0.qty", int32(3))
+	doc = SetField(doc, "items.3", "y")
+	if v, _ := GetField(doc, "items.0.qty"); v != int32(3) {
+		t.Errorf("items.0.qty = %v, want 3", v)
+	}
+	arr, _ := GetField(doc, "items")
+	if a := arr.(bson.A); len(a) != 4 || a[2] != nil || a[3] != "y" {
+		t.Errorf("expected items padded with null to length 4, got %v", a)
+	}
+}
+
+func TestUnsetField_ArrayIndex(t *testing.T) {
+	doc := bson.D{{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}, {Key: "qty", Value: 1}}, "x", "y"}}}
+	doc = UnsetField(doc, "items.0.qty")
+	doc = UnsetField(doc, "items.1")
+	if _, ok := GetField(doc, "items.0.qty"); ok {
+		t.Error("items.0.qty should be removed")
+	}
+	arr, _ := GetField(doc, "items")
+	if a := arr.(bson.A); len(a) != 3 || a[1] != nil || a[2] != "y" {
+		t.Errorf("expected items.1 to become null, got %v", a)
+	}
+}
+
 func TestGetField_Exists(t *testing.T) {
 	doc := bson.D{{Key: "k", Value: "v"}}
 	val, ok := GetField(doc, "k")
@@ -368,6 +623,16 @@ func TestGetField_Missing(t *testing.T) {
 	}
 }
 
+func TestGetField_ArrayIndex(t *testing.T) {
+	doc := bson.D{{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}}}}
+	if v, ok := GetField(doc, "items.0.sku"); !ok || v != "A1" {
+		t.Errorf("items.0.sku = %v (ok=%v), want A1", v, ok)
+	}
+	if _, ok := GetField(doc, "items.1.sku"); ok {
+		t.Error("items.1.sku should not exist")
+	}
+}
+
 // ---- FilterDocs ----
 
 func TestFilterDocs_EmptyFilter(t *testing.T) {
@@ -435,6 +700,73 @@ func TestSortDocs_StringField(t *testing.T) {
 	}
 }
 
+func TestSortDocs_ArrayField(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "n", Value: "a"}, {Key: "scores", Value: bson.A{int32(5), int32(1)}}},
+		{{Key: "n", Value: "b"}, {Key: "scores", Value: bson.A{int32(3)}}},
+		{{Key: "n", Value: "c"}, {Key: "scores", Value: bson.A{int32(2), int32(9)}}},
+	}
+	order := func() string {
+		var s string
+		for _, d := range docs {
+			v, _ := GetField(d, "n")
+			s += v.(string)
+		}
+		return s
+	}
+	// Ascending sorts by each array's smallest element, descending by its largest.
+	SortDocs(docs, bson.D{{Key: "scores", Value: int32(1)}})
+	if got := order(); got != "acb" {
+		t.Errorf("ascending order = %s, want acb", got)
+	}
+	SortDocs(docs, bson.D{{Key: "scores", Value: int32(-1)}})
+	if got := order(); got != "cab" {
+		t.Errorf("descending order = %s, want cab", got)
+	}
+
+	items := []bson.D{
+		{{Key: "n", Value: "x"}, {Key: "items", Value: bson.A{bson.D{{Key: "p", Value: int32(4)}}}}},
+		{{Key: "n", Value: "y"}, {Key: "items", Value: bson.A{bson.D{{Key: "p", Value: int32(2)}}}}},
+	}
+	SortDocs(items, bson.D{{Key: "items.p", Value: int32(1)}})
+	if v, _ := GetField(items[0], "n"); v != "y" {
+		t.Errorf("expected y first when sorting by items.p, got %v", v)
+	}
+}
+
+func TestSortDocs_MixedTypes(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "n", Value: "bool"}, {Key: "v", Value: true}},
+		{{Key: "n", Value: "date"}, {Key: "v", Value: bson.DateTime(0)}},
+		{{Key: "n", Value: "str"}, {Key: "v", Value: "x"}},
+		{{Key: "n", Value: "missing"}},
+		{{Key: "n", Value: "doc"}, {Key: "v", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+		{{Key: "n", Value: "num"}, {Key: "v", Value: int64(7)}},
+		{{Key: "n", Value: "empty"}, {Key: "v", Value: bson.A{}}},
+		{{Key: "n", Value: "null"}, {Key: "v", Value: nil}},
+		{{Key: "n", Value: "arr"}, {Key: "v", Value: bson.A{"y", int32(1)}}},
+		{{Key: "n", Value: "oid"}, {Key: "v", Value: bson.ObjectID{1}}},
+	}
+	order := func() []string {
+		var names []string
+		for _, d := range docs {
+			v, _ := GetField(d, "n")
+			names = append(names, v.(string))
+		}
+		return names
+	}
+	// An empty array sorts before null and missing, which are equal and keep
+	// their order. [y, 1] sorts by 1 ascending and by "y" descending.
+	SortDocs(docs, bson.D{{Key: "v", Value: int32(1)}})
+	if got, want := order(), []string{"empty", "missing", "null", "arr", "num", "str", "doc", "oid", "bool", "date"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ascending order = %v, want %v", got, want)
+	}
+	SortDocs(docs, bson.D{{Key: "v", Value: int32(-1)}})
+	if got, want := order(), []string{"date", "bool", "oid", "doc", "arr", "str", "num", "missing", "null", "empty"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("descending order = %v, want %v", got, want)
+	}
+}
+
 func TestSortDocs_Empty(t *testing.T) {
 	var docs []bson.D
 	SortDocs(docs, bson.D{{Key: "x", Value: int32(1)}}) // should not panic
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// regexCacheSize is the number of compiled patterns kept by regexCache.
+const regexCacheSize = 256
+
+// regexCache holds the most recently used compiled patterns keyed by options
+// and pattern, so a filter applied to every document of a collection
+// compiles once without a long-running server keeping every pattern it has
+// seen.
+var regexCache = regexLRU{entries: make(map[string]*list.Element), order: list.New()}
+
+type regexLRU struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *regexEntry, most recently used first
+}
+
+type regexEntry struct {
+	key string
+	re  *regexp.Regexp
+	err error
+}
+
+func (c *regexLRU) get(key string) (*regexEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*regexEntry), true
+}
+
+func (c *regexLRU) put(entry *regexEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[entry.key]; ok {
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > regexCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexEntry).key)
+	}
+}
+
+// compileRegex compiles a MongoDB regular expression. The i, m and s options
+// map to Go's flags; x strips unescaped whitespace and # comments from the
+// pattern, and u is accepted as Go patterns are always Unicode. It returns an
+// error for other options and for patterns Go's RE2 syntax cannot compile,
+// such as those using lookaround or backreferences.
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	key := options + "/" + pattern
+	if entry, ok := regexCache.get(key); ok {
+		return entry.re, entry.err
+	}
+
+	entry := &regexEntry{key: key}
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, o) {
+				flags += string(o)
+			}
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u':
+		default:
+			entry.err = fmt.Errorf("invalid flag in regex options: %c", o)
+		}
+	}
+	if entry.err == nil {
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if se, ok := err.(*syntax.Error); ok {
+			err = fmt.Errorf("regular expression is invalid: %s: %s", se.Code, se.Expr)
+		}
+		entry.re, entry.err = re, err
+	}
+	regexCache.put(entry)
+	return entry.re, entry.err
+}
+
+// checkRegexes compiles the regular expressions of a filter, given with
+// $regex or as BSON regular expression values at any depth, and returns the
+// first error. Matching treats a pattern that does not compile as matching
+// nothing, so filters are checked before they are applied. $eq and $expr
+// compare regular expressions as values and are not checked.
+func checkRegexes(filter interface{}) error {
+	switch f := filter.(type) {
+	case bson.D:
+		options, hasOptions := "", false
+		for _, e := range f {
+			if e.Key == "$options" {
+				options, _ = e.Value.(string)
+				hasOptions = true
+			}
+		}
+		for _, e := range f {
+			if e.Key == "$eq" || e.Key == "$expr" {
+				continue
+			}
+			if e.Key != "$regex" {
+				if err := checkRegexes(e.Value); err != nil {
+					return err
+				}
+				continue
+			}
+			switch r := e.Value.(type) {
+			case string:
+				if _, err := compileRegex(r, options); err != nil {
+					return err
+				}
+			case bson.Regex:
+				if !hasOptions {
+					options = r.Options
+				}
+				if _, err := compileRegex(r.Pattern, options); err != nil {
+					return err
+				}
+			}
+		}
+	case bson.A:
+		for _, v := range f {
+			if err := checkRegexes(v); err != nil {
+				return err
+			}
+		}
+	case bson.Regex:
+		if _, err := compileRegex(f.Pattern, f.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripExtended removes the whitespace and #-comments that the x option
+// ignores. Escaped characters and character classes are kept as written.
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	inClass, inComment := false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+			}
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			b.WriteByte(pattern[i+1])
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		case c == '#':
+			inComment = true
+		case c == ' ', c == '\t', c == '\n', c == '\r', c == '\f', c == '\v':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// matchRegex reports whether a document value matches the regular expression
+// pattern/options. Strings match when the pattern finds them; stored regular
+// expressions match when they are identical.
+func matchRegex(docVal interface{}, pattern, options string) bool {
+	switch v := docVal.(type) {
+	case string:
+		re, err := compileRegex(pattern, options)
+		return err == nil && re.MatchString(v)
+	case bson.Regex:
+		return v.Pattern == pattern && v.Options == options
+	}
+	return false
+}
+
+// regexOperator evaluates {$regex: opVal, $options: options}. opVal may be a
+// string or a bson.Regex; $options, when present, replaces the regex's own
+// options.
+func regexOperator(docVal interface{}, opVal interface{}, options string, hasOptions bool) bool {
+	switch r := opVal.(type) {
+	case string:
+		return matchRegex(docVal, r, options)
+	case bson.Regex:
+		if !hasOptions {
+			options = r.Options
+		}
+		return matchRegex(docVal, r.Pattern, options)
+	}
+	return false
+}
+
+// regexPrefix returns the literal prefix every match of an anchored,
+// case-sensitive pattern starts with, or "" if there is none. Index scans
+// use it to bound a regex predicate to a string range.
+func regexPrefix(pattern, options string) string {
+	if strings.ContainsAny(options, "imx") || strings.Contains(pattern, "|") {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(pattern, "^"):
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, `\A`):
+		pattern = pattern[2:]
+	default:
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if strings.IndexByte(`.^$*+?()[]{}|\`, c) >= 0 {
+			// A quantifier makes the preceding character optional.
+			if strings.IndexByte("*?{", c) >= 0 && b.Len() > 0 {
+				s := b.String()
+				_, size := utf8.DecodeLastRuneInString(s)
+				return s[:len(s)-size]
+			}
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
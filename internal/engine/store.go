@@ -6,27 +6,115 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"sync/atomic"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Store struct {
 	Databases map[string]*Database `bson:"databases" json:"databases"`
+	// Generation counts the rewrites of the data file. Journal records
+	// carry the generation they extend, so records already folded into a
+	// newer data file are not replayed over it.
+	Generation int64 `bson:"generation,omitempty" json:"generation,omitempty"`
 }
 
 type Database struct {
 	Collections map[string]*Collection `bson:"collections" json:"collections"`
+	Views       map[string]*View       `bson:"views,omitempty" json:"views,omitempty"`
+}
+
+// View is a read-only collection whose documents are the result of an
+// aggregation pipeline on another collection or view of the same database.
+type View struct {
+	ViewOn   string   `bson:"viewOn" json:"viewOn"`
+	Pipeline []bson.D `bson:"pipeline" json:"pipeline"`
 }
 
 type Collection struct {
 	Documents []bson.D    `bson:"documents" json:"documents"`
 	Indexes   []IndexSpec `bson:"indexes" json:"indexes"`
+	// Capped, when set, makes this a capped collection: documents stay in
+	// insertion order and the oldest are removed once it outgrows the limits.
+	Capped *CappedOptions `bson:"capped,omitempty" json:"capped,omitempty"`
+
+	ix      *collIndexes // in-memory indexes; nil until built
+	version uint64       // changed on every change, for transaction conflict checks
+}
+
+// versionClock hands out collection versions. Versions are unique across
+// collections, so a dropped and recreated collection never repeats one.
+var versionClock atomic.Uint64
+
+func nextVersion() uint64 {
+	return versionClock.Add(1)
+}
+
+// carryVersions gives each collection of cur that holds the same contents as
+// in prev the version it had there, so reloading the store after another
+// process wrote to it does not look like a change to the collections it
+// left alone.
+func carryVersions(prev, cur *Store) {
+	for name, d := range cur.Databases {
+		pd := prev.Databases[name]
+		if pd == nil {
+			continue
+		}
+		for cn, c := range d.Collections {
+			if pc := pd.Collections[cn]; pc != nil && sameContents(pc, c) {
+				c.version = pc.version
+			}
+		}
+	}
+}
+
+// sameContents reports whether two collections hold the same documents,
+// matched by _id, and the same indexes and capped options.
+func sameContents(a, b *Collection) bool {
+	if len(a.Documents) != len(b.Documents) || len(a.Indexes) != len(b.Indexes) {
+		return false
+	}
+	if (a.Capped == nil) != (b.Capped == nil) || (a.Capped != nil && *a.Capped != *b.Capped) {
+		return false
+	}
+	for i := range a.Indexes {
+		if !sameIndex(a.Indexes[i], b.Indexes[i]) {
+			return false
+		}
+	}
+	docs := make(map[string]bson.D, len(a.Documents))
+	for _, doc := range a.Documents {
+		docs[docIDKey(doc)] = doc
+	}
+	for _, doc := range b.Documents {
+		if prev, ok := docs[docIDKey(doc)]; !ok || !valuesEqual(prev, doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// CappedOptions are the limits of a capped collection.
+type CappedOptions struct {
+	Size int64 `bson:"size" json:"size"`                   // maximum total BSON size of the documents in bytes
+	Max  int64 `bson:"max,omitempty" json:"max,omitempty"` // maximum number of documents; 0 for no limit
 }
 
 type IndexSpec struct {
 	Name   string `bson:"name" json:"name"`
 	Keys   bson.D `bson:"key" json:"key"`
 	Unique bool   `bson:"unique" json:"unique"`
+	// Sparse indexes only documents that have at least one of the fields.
+	Sparse bool `bson:"sparse,omitempty" json:"sparse,omitempty"`
+	// PartialFilterExpression, when set, indexes only matching documents.
+	PartialFilterExpression bson.D `bson:"partialFilterExpression,omitempty" json:"partialFilterExpression,omitempty"`
+	// ExpireAfterSeconds makes a TTL index: documents whose indexed date is
+	// older than this many seconds are removed. Nil for other indexes.
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds,omitempty" json:"expireAfterSeconds,omitempty"`
+	// Collation, when set, orders and compares the index's strings under
+	// that collation. CreateIndexes stores it with every option spelled
+	// out.
+	Collation bson.D `bson:"collation,omitempty" json:"collation,omitempty"`
 }
 
 func NewStore() *Store {
@@ -51,7 +139,27 @@ func (db *Database) GetOrCreateColl(name string) *Collection {
 	return coll
 }
 
+// LoadStore reads the data file at path and replays its journal, if any.
 func LoadStore(path string) (*Store, error) {
+	s, _, err := loadStore(path)
+	return s, err
+}
+
+// loadStore is LoadStore that also reports how many journal records were
+// replayed on top of the data file.
+func loadStore(path string) (*Store, int, error) {
+	s, err := readStoreFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := replayJournal(journalPath(path), s)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s, n, nil
+}
+
+func readStoreFile(path string) (*Store, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -77,34 +185,47 @@ func LoadStore(path string) (*Store, error) {
 	return &s, nil
 }
 
+// SaveStore writes s to the data file at path as its next generation, which
+// retires any journal written against the previous one.
 func SaveStore(path string, s *Store) error {
 	// Sort documents by _id within each collection before saving,
 	// and sort map keys (databases, collections) for deterministic output.
 	sortStore(s)
 
+	s.Generation++
 	data, err := marshalStoreJSON(s)
 	if err != nil {
+		s.Generation--
 		return fmt.Errorf("marshal store: %w", err)
 	}
 	tmp := path + ".tmp"
 	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		s.Generation--
 		return fmt.Errorf("write tmp file: %w", err)
 	}
 	if err := os.Rename(tmp, path); err != nil {
+		s.Generation--
 		return fmt.Errorf("rename tmp to store: %w", err)
 	}
 	return nil
 }
 
-// sortStore sorts documents by _id in each collection (in-place).
+// sortStore sorts documents by _id in each collection (in-place). Capped
+// collections keep their insertion order.
 func sortStore(s *Store) {
 	for _, db := range s.Databases {
 		for _, coll := range db.Collections {
+			if coll.Capped != nil {
+				continue
+			}
 			sort.SliceStable(coll.Documents, func(i, j int) bool {
 				idI := docIDSortKey(coll.Documents[i])
 				idJ := docIDSortKey(coll.Documents[j])
 				return idI < idJ
 			})
+			if coll.ix != nil {
+				coll.ix.reposition(coll.Documents)
+			}
 		}
 	}
 }
@@ -167,16 +288,39 @@ func marshalStoreJSON(s *Store) ([]byte, error) {
 				return nil, fmt.Errorf("marshal indexes array: %w", err)
 			}
 			indexes := json.RawMessage(idxJSON)
-			colls[collName] = map[string]interface{}{
+			collJSON := map[string]interface{}{
 				"documents": docs,
 				"indexes":   indexes,
 			}
+			if coll.Capped != nil {
+				raw, err := bson.MarshalExtJSON(coll.Capped, false, false)
+				if err != nil {
+					return nil, fmt.Errorf("marshal capped options: %w", err)
+				}
+				collJSON["capped"] = json.RawMessage(raw)
+			}
+			colls[collName] = collJSON
 		}
-		dbs[dbName] = map[string]interface{}{
+		dbJSON := map[string]interface{}{
 			"collections": colls,
 		}
+		if len(db.Views) > 0 {
+			views := make(map[string]json.RawMessage, len(db.Views))
+			for name, v := range db.Views {
+				raw, err := bson.MarshalExtJSON(v, false, false)
+				if err != nil {
+					return nil, fmt.Errorf("marshal view: %w", err)
+				}
+				views[name] = raw
+			}
+			dbJSON["views"] = views
+		}
+		dbs[dbName] = dbJSON
 	}
 	ordered["databases"] = dbs
+	if s.Generation > 0 {
+		ordered["generation"] = s.Generation
+	}
 
 	data, err := json.MarshalIndent(ordered, "", "  ")
 	if err != nil {
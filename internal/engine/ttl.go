@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TTLMonitorInterval is how often a server removes expired documents, the
+// same period MongoDB's TTL monitor uses.
+const TTLMonitorInterval = 60 * time.Second
+
+// ExpireTTL removes the documents that TTL indexes have expired as of now and
+// returns how many it removed. A document expires expireAfterSeconds after
+// the date in its indexed field, or after the earliest date when the field
+// is an array. Documents without a date in the field never expire.
+func (e *Engine) ExpireTTL(now time.Time) (int64, error) {
+	if err := e.refresh(); err != nil {
+		return 0, err
+	}
+	e.mu.RLock()
+	hasTTL := e.data.hasTTLIndexes()
+	e.mu.RUnlock()
+	if !hasTTL {
+		return 0, nil
+	}
+
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var n int64
+	for dbName, d := range e.data.Databases {
+		for collName, c := range d.Collections {
+			var expired []int
+			for i, doc := range c.Documents {
+				if c.expired(doc, now) {
+					expired = append(expired, i)
+					e.recordDelete(dbName, collName, doc)
+				}
+			}
+			c.removeDocs(expired)
+			n += int64(len(expired))
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, e.save()
+}
+
+func (s *Store) hasTTLIndexes() bool {
+	for _, d := range s.Databases {
+		for _, c := range d.Collections {
+			for _, idx := range c.Indexes {
+				if idx.ExpireAfterSeconds != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expired reports whether a TTL index of the collection has expired doc.
+func (c *Collection) expired(doc bson.D, now time.Time) bool {
+	for _, idx := range c.Indexes {
+		if idx.ExpireAfterSeconds == nil || !idx.covers(doc) {
+			continue
+		}
+		date, ok := earliestDate(lookupValues(doc, idx.Keys[0].Key))
+		if !ok {
+			continue
+		}
+		expiry := date.Time().Add(time.Duration(*idx.ExpireAfterSeconds) * time.Second)
+		if !expiry.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// earliestDate returns the earliest date among vals and the elements of
+// arrays in vals.
+func earliestDate(vals []interface{}) (bson.DateTime, bool) {
+	var min bson.DateTime
+	found := false
+	consider := func(v interface{}) {
+		if d, ok := v.(bson.DateTime); ok && (!found || d < min) {
+			min, found = d, true
+		}
+	}
+	for _, v := range vals {
+		if arr, ok := v.(bson.A); ok {
+			for _, elem := range arr {
+				consider(elem)
+			}
+			continue
+		}
+		consider(v)
+	}
+	return min, found
+}
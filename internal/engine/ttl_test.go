@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestExpireTTL(t *testing.T) {
+	eng, path := newEng(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) bson.DateTime { return bson.NewDateTimeFromTime(now.Add(d)) }
+	ttl := int64(3600)
+	if err := eng.CreateIndexes("db", "sessions", []IndexSpec{{Keys: bson.D{{Key: "seen", Value: int32(1)}}, ExpireAfterSeconds: &ttl}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "sessions",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "seen", Value: at(-2 * time.Hour)}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "seen", Value: at(-30 * time.Minute)}},
+		bson.D{{Key: "_id", Value: int32(3)}, {Key: "seen", Value: bson.A{at(0), at(-time.Hour)}}},
+		bson.D{{Key: "_id", Value: int32(4)}, {Key: "seen", Value: "yesterday"}},
+		bson.D{{Key: "_id", Value: int32(5)}},
+	)
+
+	n, err := eng.ExpireTTL(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expired %d docs, want 2", n)
+	}
+	docs, err := reloadEng(t, path).Find("db", "sessions", nil, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for _, d := range docs {
+		id, _ := GetField(d, "_id")
+		ids = append(ids, id)
+	}
+	if len(ids) != 3 || ids[0] != int32(2) || ids[1] != int32(4) || ids[2] != int32(5) {
+		t.Errorf("remaining ids %v, want [2 4 5]", ids)
+	}
+
+	if n, err := eng.ExpireTTL(now.Add(30 * time.Minute)); err != nil || n != 1 {
+		t.Errorf("second pass expired %d docs (%v), want 1", n, err)
+	}
+}
+
+func TestExpireTTL_NoTTLIndexes(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "at", Value: bson.DateTime(0)}})
+	if n, err := eng.ExpireTTL(time.Now()); err != nil || n != 0 {
+		t.Errorf("ExpireTTL = %d, %v; want 0, nil", n, err)
+	}
+}
@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var (
+	// ErrWriteConflict is returned when a collection the transaction read or
+	// wrote was changed by another writer after the transaction first read
+	// or wrote it. The transaction is aborted and may be retried.
+	ErrWriteConflict = errors.New("write conflict: a collection used by this transaction was modified concurrently")
+	// ErrTxnDone is returned when a transaction is used after it has been
+	// committed or aborted.
+	ErrTxnDone = errors.New("transaction has been committed or aborted")
+)
+
+// Txn is a multi-document transaction. The first write to a collection
+// copies it; later reads and writes in the transaction see that copy, while
+// collections the transaction has not written are read from the committed
+// store. Nothing is visible to other readers until Commit installs the
+// copies and saves the store once.
+//
+// Reads are snapshot-isolated: the transaction records the version of each
+// collection when it first reads or writes it, and reading, writing or
+// committing after another writer changed one of those collections fails
+// with ErrWriteConflict.
+//
+// A write that fails aborts the transaction, as in MongoDB. A Txn is safe
+// for concurrent use, but operations on it are serialized.
+type Txn struct {
+	e       *Engine
+	mu      sync.Mutex
+	colls   map[string]map[string]*txnColl
+	pending []journalEntry
+	done    bool
+}
+
+// txnColl is a collection the transaction has read or written: whether the
+// committed collection existed when the transaction first used it and its
+// version at the time, plus the transaction's own copy once it writes.
+type txnColl struct {
+	coll    *Collection // nil until the transaction writes to the collection
+	exists  bool
+	version uint64
+}
+
+// changed reports whether c, the committed collection now, differs from the
+// one the transaction first used.
+func (tc *txnColl) changed(c *Collection) bool {
+	if c == nil {
+		return tc.exists
+	}
+	return !tc.exists || c.version != tc.version
+}
+
+// Begin starts a transaction.
+func (e *Engine) Begin() *Txn {
+	return &Txn{e: e, colls: make(map[string]map[string]*txnColl)}
+}
+
+// Insert adds documents to a collection within the transaction.
+func (t *Txn) Insert(db, coll string, docs []bson.D) ([]interface{}, error) {
+	var ids []interface{}
+	err := t.write(db, coll, func(s *state) (err error) {
+		ids, err = s.insert(db, coll, docs)
+		return err
+	})
+	return ids, err
+}
+
+// Find queries documents within the transaction.
+func (t *Txn) Find(db, coll string, filter bson.D, sort bson.D, skip, limit int64, collation *Collation) ([]bson.D, error) {
+	var docs []bson.D
+	err := t.read(func(s *state) (err error) {
+		docs, err = s.find(db, coll, filter, sort, skip, limit, collation)
+		return err
+	})
+	return docs, err
+}
+
+// Update modifies documents within the transaction.
+func (t *Txn) Update(db, coll string, filter bson.D, update interface{}, arrayFilters []bson.D, multi, upsert bool, collation *Collation) (matched, modified int64, upsertedID interface{}, err error) {
+	err = t.write(db, coll, func(s *state) (err error) {
+		matched, modified, upsertedID, err = s.update(db, coll, filter, update, arrayFilters, multi, upsert, collation)
+		return err
+	})
+	return matched, modified, upsertedID, err
+}
+
+// Delete removes documents within the transaction.
+func (t *Txn) Delete(db, coll string, filter bson.D, multi bool, collation *Collation) (int64, error) {
+	var n int64
+	err := t.write(db, coll, func(s *state) (err error) {
+		n, err = s.remove(db, coll, filter, multi, collation)
+		return err
+	})
+	return n, err
+}
+
+// Count returns the number of matching documents within the transaction.
+func (t *Txn) Count(db, coll string, filter bson.D, collation *Collation) (int64, error) {
+	var n int64
+	err := t.read(func(s *state) (err error) {
+		n, err = s.count(db, coll, filter, collation)
+		return err
+	})
+	return n, err
+}
+
+// FindAndModify finds a single document and modifies or removes it within
+// the transaction.
+func (t *Txn) FindAndModify(db, coll string, filter bson.D, sort bson.D, update interface{}, arrayFilters []bson.D, remove bool, returnNew bool, upsert bool, collation *Collation) (bson.D, error) {
+	var doc bson.D
+	err := t.write(db, coll, func(s *state) (err error) {
+		doc, err = s.findAndModify(db, coll, filter, sort, update, arrayFilters, remove, returnNew, upsert, collation)
+		return err
+	})
+	return doc, err
+}
+
+// Aggregate runs an aggregation pipeline within the transaction.
+func (t *Txn) Aggregate(db, coll string, pipeline []bson.D, collation *Collation) ([]bson.D, error) {
+	if last, ok := writeStage(pipeline); ok {
+		return nil, commandErrorf(263, "OperationNotSupportedInTransaction", "%s cannot be used in a transaction", last.Key)
+	}
+	var docs []bson.D
+	err := t.read(func(s *state) (err error) {
+		docs, err = s.aggregate(db, coll, pipeline, collation)
+		return err
+	})
+	return docs, err
+}
+
+// Distinct returns distinct values for a field within the transaction.
+func (t *Txn) Distinct(db, coll, field string, filter bson.D, collation *Collation) ([]interface{}, error) {
+	var values []interface{}
+	err := t.read(func(s *state) (err error) {
+		values, err = s.distinct(db, coll, field, filter, collation)
+		return err
+	})
+	return values, err
+}
+
+// Commit installs the transaction's writes and saves the store once. It
+// returns ErrWriteConflict, and discards the writes, if another writer
+// changed a collection the transaction read or wrote.
+func (t *Txn) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	if !t.wrote() {
+		return nil
+	}
+
+	e := t.e
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for db, colls := range t.colls {
+		for name, tc := range colls {
+			if tc.changed(e.collection(db, name)) {
+				return ErrWriteConflict
+			}
+		}
+	}
+	for db, colls := range t.colls {
+		for name, tc := range colls {
+			if tc.coll != nil {
+				e.data.GetOrCreateDB(db).Collections[name] = tc.coll
+			}
+		}
+	}
+	e.pending = append(e.pending, t.pending...)
+	return e.save()
+}
+
+// Abort discards the transaction's writes. Aborting a finished transaction
+// returns ErrTxnDone.
+func (t *Txn) Abort() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	t.abort()
+	return nil
+}
+
+// wrote reports whether the transaction has written to any collection.
+func (t *Txn) wrote() bool {
+	for _, colls := range t.colls {
+		for _, tc := range colls {
+			if tc.coll != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// read runs fn against the transaction's view of the store. If fn read a
+// collection that changed since the transaction first used it, the result
+// is not from the transaction's snapshot: the transaction is aborted with
+// ErrWriteConflict.
+func (t *Txn) read(fn func(s *state) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.e.refresh(); err != nil {
+		return err
+	}
+	t.e.mu.RLock()
+	defer t.e.mu.RUnlock()
+
+	err := t.run(t.view(), fn)
+	if err == ErrWriteConflict {
+		t.abort()
+	}
+	return err
+}
+
+// run runs fn against s, recording the version of each committed collection
+// fn reads for the first time. It returns ErrWriteConflict if fn read a
+// collection that changed since the transaction first used it. Callers must
+// hold the engine read lock.
+func (t *Txn) run(s *state, fn func(s *state) error) error {
+	conflict := false
+	s.onRead = func(db, coll string) {
+		if !t.use(db, coll) {
+			conflict = true
+		}
+	}
+	err := fn(s)
+	if err == nil && conflict {
+		err = ErrWriteConflict
+	}
+	return err
+}
+
+// use records the committed version of db.coll the first time the
+// transaction reads or writes it. It reports false if the collection has
+// changed since. Callers must hold the engine read lock.
+func (t *Txn) use(db, coll string) bool {
+	cur := t.e.collection(db, coll)
+	if tc := t.colls[db][coll]; tc != nil {
+		return tc.coll != nil || !tc.changed(cur)
+	}
+	tc := &txnColl{}
+	if cur != nil {
+		tc.exists, tc.version = true, cur.version
+	}
+	if t.colls[db] == nil {
+		t.colls[db] = make(map[string]*txnColl)
+	}
+	t.colls[db][coll] = tc
+	return true
+}
+
+// abort drops the transaction's writes and ends it.
+func (t *Txn) abort() {
+	t.done = true
+	t.colls, t.pending = nil, nil
+}
+
+// write copies db.coll into the transaction if needed and runs fn against the
+// transaction's view of the store. An error aborts the transaction.
+func (t *Txn) write(db, coll string, fn func(s *state) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.e.refresh(); err != nil {
+		return err
+	}
+	t.e.mu.RLock()
+	defer t.e.mu.RUnlock()
+
+	err := t.e.writable(db, coll)
+	if err == nil {
+		err = t.own(db, coll)
+	}
+	if err == nil {
+		s := t.view()
+		err = t.run(s, fn)
+		t.pending = s.pending
+	}
+	if err != nil {
+		t.abort()
+	}
+	return err
+}
+
+// own gives the transaction its own copy of db.coll, returning
+// ErrWriteConflict if the transaction read the collection before another
+// writer changed it. Callers must hold the engine read lock.
+func (t *Txn) own(db, coll string) error {
+	if !t.use(db, coll) {
+		return ErrWriteConflict
+	}
+	tc := t.colls[db][coll]
+	if tc.coll != nil {
+		return nil
+	}
+	c := &Collection{}
+	if base := t.e.collection(db, coll); base != nil {
+		var err error
+		if c, err = base.clone(); err != nil {
+			return err
+		}
+	}
+	c.buildIndexes()
+	tc.coll = c
+	return nil
+}
+
+// view returns the state the transaction's operations run against: the
+// committed store with the transaction's copies in place of the collections
+// it has written. Callers must hold the engine read lock.
+func (t *Txn) view() *state {
+	v := NewStore()
+	for name, d := range t.e.data.Databases {
+		vd := v.GetOrCreateDB(name)
+		for cn, c := range d.Collections {
+			vd.Collections[cn] = c
+		}
+		vd.Views = d.Views
+	}
+	for name, colls := range t.colls {
+		for cn, tc := range colls {
+			if tc.coll != nil {
+				v.GetOrCreateDB(name).Collections[cn] = tc.coll
+			}
+		}
+	}
+	return &state{data: v, pending: t.pending}
+}
+
+// clone returns a deep copy of the collection, without its in-memory indexes.
+func (c *Collection) clone() (*Collection, error) {
+	docs := make([]bson.D, len(c.Documents))
+	for i, doc := range c.Documents {
+		cp, err := CopyDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = cp
+	}
+	return &Collection{Documents: docs, Indexes: append([]IndexSpec(nil), c.Indexes...), Capped: c.Capped}, nil
+}
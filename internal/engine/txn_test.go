@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ---- Txn ----
+
+func TestTxn_WritesVisibleOnlyInside(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "a"}, {Key: "n", Value: int32(1)}})
+
+	tx := eng.Begin()
+	if _, err := tx.Insert("db", "c", []bson.D{{{Key: "_id", Value: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := tx.Update("db", "c", bson.D{{Key: "_id", Value: "a"}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := tx.Count("db", "c", nil, nil); n != 2 {
+		t.Errorf("inside txn: expected 2 docs, got %d", n)
+	}
+	if n, _ := eng.Count("db", "c", nil, nil); n != 1 {
+		t.Errorf("outside txn: expected 1 doc, got %d", n)
+	}
+	docs, _ := eng.Find("db", "c", bson.D{{Key: "_id", Value: "a"}}, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "n"); v != int32(1) {
+		t.Errorf("outside txn: n = %v, want 1", v)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	eng2 := reloadEng(t, path)
+	if n, _ := eng2.Count("db", "c", nil, nil); n != 2 {
+		t.Errorf("after commit: expected 2 docs, got %d", n)
+	}
+	docs, _ = eng2.Find("db", "c", bson.D{{Key: "_id", Value: "a"}}, nil, 0, 0, nil)
+	if v, _ := GetField(docs[0], "n"); v != int32(2) {
+		t.Errorf("after commit: n = %v, want 2", v)
+	}
+}
+
+func TestTxn_Abort(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "a"}})
+
+	tx := eng.Begin()
+	if _, err := tx.Delete("db", "c", nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Insert("db", "other", []bson.D{{{Key: "x", Value: int32(1)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Count("db", "c", nil, nil); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("expected ErrTxnDone after abort, got %v", err)
+	}
+
+	eng2 := reloadEng(t, path)
+	if n, _ := eng2.Count("db", "c", nil, nil); n != 1 {
+		t.Errorf("expected 1 doc after abort, got %d", n)
+	}
+	if names := eng2.ListCollections("db"); len(names) != 1 {
+		t.Errorf("expected only c after abort, got %v", names)
+	}
+}
+
+func TestTxn_WriteConflict(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "a"}})
+
+	tx := eng.Begin()
+	if _, err := tx.Insert("db", "c", []bson.D{{{Key: "_id", Value: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "c"}})
+
+	if err := tx.Commit(); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("expected ErrWriteConflict, got %v", err)
+	}
+	docs, _ := eng.Find("db", "c", nil, nil, 0, 0, nil)
+	if len(docs) != 2 {
+		t.Errorf("expected the conflicting txn to be discarded, got %d docs", len(docs))
+	}
+}
+
+func TestTxn_FailedWriteAborts(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "a"}})
+
+	tx := eng.Begin()
+	if _, err := tx.Insert("db", "c", []bson.D{{{Key: "_id", Value: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var dke *DuplicateKeyError
+	if _, err := tx.Insert("db", "c", []bson.D{{{Key: "_id", Value: "a"}}}); !errors.As(err, &dke) {
+		t.Fatalf("expected duplicate key error, got %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("expected ErrTxnDone, got %v", err)
+	}
+	if n, _ := eng.Count("db", "c", nil, nil); n != 1 {
+		t.Errorf("expected 1 doc, got %d", n)
+	}
+}
+
+func TestTxn_OtherCollectionsDoNotConflict(t *testing.T) {
+	eng, _ := newEng(t)
+	tx := eng.Begin()
+	if _, err := tx.Insert("db", "mine", []bson.D{{{Key: "x", Value: int32(1)}}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "theirs", bson.D{{Key: "y", Value: int32(1)}})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n, _ := eng.Count("db", "mine", nil, nil); n != 1 {
+		t.Errorf("expected committed doc, got %d", n)
+	}
+	if n, _ := eng.Count("db", "theirs", nil, nil); n != 1 {
+		t.Errorf("expected concurrent doc, got %d", n)
+	}
+}
+
+func TestTxn_ReloadMidTransaction(t *testing.T) {
+	eng, path := newEng(t)
+	mustInsert(t, eng, "db", "mine", bson.D{{Key: "_id", Value: "a"}})
+	mustInsert(t, eng, "db", "theirs", bson.D{{Key: "_id", Value: "a"}})
+
+	tx := eng.Begin()
+	if _, err := tx.Insert("db", "mine", []bson.D{{{Key: "_id", Value: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Another process writes a collection the transaction has not used;
+	// this engine reloads the whole store before the next operation.
+	mustInsert(t, reloadEng(t, path), "db", "theirs", bson.D{{Key: "_id", Value: "b"}})
+	if n, err := tx.Count("db", "mine", nil, nil); err != nil || n != 2 {
+		t.Fatalf("Count after reload = %d, %v; want 2", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit after an unrelated reload: %v", err)
+	}
+	for coll, want := range map[string]int64{"mine": 2, "theirs": 2} {
+		if n, _ := reloadEng(t, path).Count("db", coll, nil, nil); n != want {
+			t.Errorf("%s: expected %d docs, got %d", coll, want, n)
+		}
+	}
+
+	// A reload that changed a collection the transaction wrote conflicts.
+	tx = eng.Begin()
+	if _, err := tx.Insert("db", "mine", []bson.D{{{Key: "_id", Value: "c"}}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, reloadEng(t, path), "db", "mine", bson.D{{Key: "_id", Value: "d"}})
+	if err := tx.Commit(); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("expected ErrWriteConflict, got %v", err)
+	}
+}
+
+func TestTxn_ReadsAreSnapshotIsolated(t *testing.T) {
+	eng, _ := newEng(t)
+	mustInsert(t, eng, "db", "src", bson.D{{Key: "_id", Value: "a"}})
+
+	// A read of a collection changed since the transaction first read it
+	// fails rather than mixing two versions of the data.
+	tx := eng.Begin()
+	if n, err := tx.Count("db", "src", nil, nil); err != nil || n != 1 {
+		t.Fatalf("Count = %d, %v; want 1", n, err)
+	}
+	mustInsert(t, eng, "db", "src", bson.D{{Key: "_id", Value: "b"}})
+	if _, err := tx.Find("db", "src", nil, nil, 0, 0, nil); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("expected ErrWriteConflict, got %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("expected the conflict to abort the transaction, got %v", err)
+	}
+
+	// A transaction that wrote based on what it read does not commit once
+	// what it read has changed.
+	tx = eng.Begin()
+	docs, err := tx.Find("db", "src", nil, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Insert("db", "dst", []bson.D{{{Key: "n", Value: int32(len(docs))}}}); err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, eng, "db", "src", bson.D{{Key: "_id", Value: "c"}})
+	if err := tx.Commit(); !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("expected ErrWriteConflict, got %v", err)
+	}
+	if n, _ := eng.Count("db", "dst", nil, nil); n != 0 {
+		t.Errorf("expected the conflicting txn to be discarded, got %d docs", n)
+	}
+}
+
+func TestTxn_JournalCommit(t *testing.T) {
+	eng, path := newEng(t)
+	eng.journal = true
+	mustInsert(t, eng, "db", "c", bson.D{{Key: "_id", Value: "a"}})
+
+	tx := eng.Begin()
+	if _, err := tx.FindAndModify("db", "c", bson.D{{Key: "_id", Value: "a"}}, nil, nil, nil, true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Insert("db", "c", []bson.D{{{Key: "_id", Value: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ := reloadEng(t, path).Find("db", "c", nil, nil, 0, 0, nil)
+	if len(docs) != 1 || docIDKey(docs[0]) != idKey("b") {
+		t.Errorf("expected only b after journal replay, got %v", docs)
+	}
+}
@@ -2,6 +2,8 @@ package engine
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -9,10 +11,82 @@ import (
 
 // ApplyUpdate applies update operators to a document.
 func ApplyUpdate(doc bson.D, update bson.D) (bson.D, error) {
-	// Check if this is a replacement document (no $ operators)
-	if len(update) > 0 && update[0].Key != "" && update[0].Key[0] != '$' {
+	return applyUpdate(doc, update, &updateContext{})
+}
+
+// newUpdateContext checks an update and its arrayFilters and returns the
+// context to apply it to the documents filter matches, together with the
+// update document. The update is either an update document (bson.D) or a
+// pipeline-style update: a list of stages given as []bson.D or bson.A.
+func newUpdateContext(filter bson.D, update interface{}, arrayFilters []bson.D, collation *Collation) (*updateContext, bson.D, error) {
+	u := &updateContext{filter: filter, collation: collation}
+	switch x := update.(type) {
+	case nil:
+		return u, nil, nil
+	case bson.D:
+		filters, err := parseArrayFilters(arrayFilters, x)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.arrayFilters = filters
+		return u, x, nil
+	case []bson.D:
+		u.pipeline = x
+	case bson.A:
+		u.pipeline = make([]bson.D, 0, len(x))
+		for _, st := range x {
+			stage, ok := st.(bson.D)
+			if !ok {
+				return nil, nil, commandErrorf(14, "TypeMismatch", "Each element of the 'pipeline' array must be an object")
+			}
+			u.pipeline = append(u.pipeline, stage)
+		}
+	default:
+		return nil, nil, commandErrorf(14, "TypeMismatch", "Update argument must be either an object or an array, not %s", bsonTypeName(update))
+	}
+	if len(arrayFilters) > 0 {
+		return nil, nil, commandErrorf(9, "FailedToParse", "arrayFilters may not be specified for pipeline-style updates")
+	}
+	for _, stage := range u.pipeline {
+		if len(stage) != 1 {
+			return nil, nil, commandErrorf(9, "FailedToParse", "A pipeline stage specification object must contain exactly one field.")
+		}
+		switch stage[0].Key {
+		case "$addFields", "$set", "$project", "$unset", "$replaceRoot", "$replaceWith":
+		default:
+			return nil, nil, commandErrorf(72, "InvalidOptions", "%s is not allowed to be used within an update", stage[0].Key)
+		}
+	}
+	return u, nil, nil
+}
+
+// isReplacement reports whether update is a replacement document rather than
+// a document of update operators.
+func isReplacement(update bson.D) bool {
+	return len(update) > 0 && update[0].Key != "" && update[0].Key[0] != '$'
+}
+
+// applyUpdate is ApplyUpdate with the context positional paths are resolved
+// in. The update fails if it would change or remove the document's _id.
+// Operators are applied to a copy, so doc is unchanged when one fails.
+func applyUpdate(doc bson.D, update bson.D, u *updateContext) (bson.D, error) {
+	if u.pipeline != nil {
+		return applyPipelineUpdate(doc, u.pipeline)
+	}
+	id, hasID := GetField(doc, "_id")
+
+	if isReplacement(update) {
+		for _, f := range update {
+			if strings.HasPrefix(f.Key, "$") {
+				return nil, commandErrorf(52, "DollarPrefixedFieldName",
+					"The dollar ($) prefixed field '%s' in '%s' is not allowed in the context of an update's replacement document", f.Key, f.Key)
+			}
+		}
+		if newID, ok := GetField(update, "_id"); ok && hasID && !valuesEqual(newID, id) {
+			return nil, commandErrorf(66, "ImmutableField",
+				"After applying the update, the (immutable) field '_id' was found to have been altered to _id: %v", newID)
+		}
 		// Replacement: keep _id from original, replace everything else
-		id, hasID := GetField(doc, "_id")
 		result := make(bson.D, len(update))
 		copy(result, update)
 		if hasID {
@@ -22,182 +96,548 @@ func ApplyUpdate(doc bson.D, update bson.D) (bson.D, error) {
 		return result, nil
 	}
 
+	if err := checkUpdateOperators(update); err != nil {
+		return nil, err
+	}
+	doc = cloneValue(doc).(bson.D)
 	var err error
 	for _, op := range update {
-		fields, ok := op.Value.(bson.D)
-		if !ok {
-			return nil, fmt.Errorf("update operator %s requires a document", op.Key)
-		}
+		fields := op.Value.(bson.D)
 		switch op.Key {
-		case "$set":
-			for _, f := range fields {
-				doc = SetField(doc, f.Key, f.Value)
-			}
-		case "$unset":
-			for _, f := range fields {
-				doc = UnsetField(doc, f.Key)
-				_ = f.Value // value is ignored for $unset
-			}
-		case "$inc":
-			for _, f := range fields {
-				doc, err = incField(doc, f.Key, f.Value)
-				if err != nil {
-					return nil, err
-				}
-			}
-		case "$mul":
-			for _, f := range fields {
-				doc, err = mulField(doc, f.Key, f.Value)
-				if err != nil {
-					return nil, err
-				}
-			}
-		case "$min":
-			for _, f := range fields {
-				current, exists := GetField(doc, f.Key)
-				if !exists || compareValues(f.Value, current) < 0 {
-					doc = SetField(doc, f.Key, f.Value)
-				}
-			}
-		case "$max":
-			for _, f := range fields {
-				current, exists := GetField(doc, f.Key)
-				if !exists || compareValues(f.Value, current) > 0 {
-					doc = SetField(doc, f.Key, f.Value)
-				}
-			}
 		case "$rename":
 			for _, f := range fields {
-				newName, ok := f.Value.(string)
-				if !ok {
-					return nil, fmt.Errorf("$rename target must be a string")
-				}
 				val, exists := GetField(doc, f.Key)
 				if exists {
 					doc = UnsetField(doc, f.Key)
-					doc = SetField(doc, newName, val)
+					if doc, err = setField(doc, f.Value.(string), val); err != nil {
+						return nil, err
+					}
 				}
 			}
-		case "$push":
-			for _, f := range fields {
-				doc, err = pushField(doc, f.Key, f.Value)
-				if err != nil {
-					return nil, err
-				}
+			continue
+		case "$setOnInsert":
+			if !u.insert {
+				continue
 			}
-		case "$pull":
-			for _, f := range fields {
-				doc, err = pullField(doc, f.Key, f.Value)
-				if err != nil {
-					return nil, err
-				}
+		}
+		for _, f := range fields {
+			// Positional segments ($, $[], $[id]) expand to one path per
+			// array element they select.
+			paths, err := u.expandPath(doc, f.Key)
+			if err != nil {
+				return nil, err
 			}
-		case "$addToSet":
-			for _, f := range fields {
-				doc, err = addToSetField(doc, f.Key, f.Value)
-				if err != nil {
+			for _, path := range paths {
+				if doc, err = applyFieldOp(doc, op.Key, path, f.Value); err != nil {
 					return nil, err
 				}
 			}
-		case "$currentDate":
-			for _, f := range fields {
-				doc = SetField(doc, f.Key, bson.DateTime(time.Now().UnixMilli()))
-			}
+		}
+	}
+
+	if newID, ok := GetField(doc, "_id"); hasID && (!ok || !valuesEqual(newID, id)) {
+		return nil, commandErrorf(66, "ImmutableField",
+			"Performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+	return doc, nil
+}
+
+// applyPipelineUpdate runs the stages of a pipeline-style update on doc.
+// The result keeps doc's _id, which the pipeline may drop but not change.
+func applyPipelineUpdate(doc bson.D, stages []bson.D) (bson.D, error) {
+	id, hasID := GetField(doc, "_id")
+	out, err := RunPipeline([]bson.D{cloneValue(doc).(bson.D)}, stages, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != 1 {
+		return nil, fmt.Errorf("pipeline-style update must produce exactly one document")
+	}
+	result := out[0]
+	newID, ok := GetField(result, "_id")
+	switch {
+	case !hasID:
+	case !ok:
+		result = append(bson.D{{Key: "_id", Value: id}}, result...)
+	case !valuesEqual(newID, id):
+		return nil, commandErrorf(66, "ImmutableField",
+			"After applying the update, the (immutable) field '_id' was found to have been altered to _id: %v", newID)
+	}
+	return result, nil
+}
+
+// cloneValue copies the documents and arrays within v, so v can be updated
+// in place without changing the original. Other values are shared.
+func cloneValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(x))
+		for i, e := range x {
+			out[i] = bson.E{Key: e.Key, Value: cloneValue(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(x))
+		for i, e := range x {
+			out[i] = cloneValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// checkUpdateOperators validates an update document before any of it is
+// applied: every operator must be known and take a document of fields, and
+// no two fields may name the same path or one inside the other.
+func checkUpdateOperators(update bson.D) error {
+	var paths []string
+	for _, op := range update {
+		switch op.Key {
+		case "$set", "$setOnInsert", "$unset", "$inc", "$mul", "$min", "$max", "$rename", "$bit",
+			"$push", "$pop", "$pull", "$pullAll", "$addToSet", "$currentDate":
 		default:
-			return nil, fmt.Errorf("unsupported update operator: %s", op.Key)
+			return commandErrorf(9, "FailedToParse",
+				"Unknown modifier: %s. Expected a valid update modifier or pipeline-style update specified as an array", op.Key)
+		}
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return commandErrorf(9, "FailedToParse",
+				"Modifiers operate on fields but we found type %s instead. For example: {$mod: {<field>: ...}} not {%s: %v}",
+				bsonTypeName(op.Value), op.Key, op.Value)
+		}
+		if op.Key == "$pull" {
+			if err := checkRegexes(fields); err != nil {
+				return err
+			}
+		}
+		for _, f := range fields {
+			if f.Key == "" || strings.HasPrefix(f.Key, ".") || strings.HasSuffix(f.Key, ".") || strings.Contains(f.Key, "..") {
+				return commandErrorf(56, "EmptyFieldName", "An empty update path is not valid.")
+			}
+			paths = append(paths, f.Key)
+			if op.Key != "$rename" {
+				continue
+			}
+			to, ok := f.Value.(string)
+			switch {
+			case !ok:
+				return commandErrorf(2, "BadValue", "The 'to' field for $rename must be a string: %s: %v", f.Key, f.Value)
+			case to == f.Key:
+				return commandErrorf(2, "BadValue", "The source and target field for $rename must differ: %s: %q", f.Key, to)
+			case strings.Contains(f.Key, "$") || strings.Contains(to, "$"):
+				return commandErrorf(2, "BadValue", "The source and target field for $rename may not be dynamic: %s: %q", f.Key, to)
+			}
+			paths = append(paths, to)
+		}
+	}
+	for i, a := range paths {
+		for _, b := range paths[:i] {
+			if a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".") {
+				at := a
+				if len(b) < len(a) {
+					at = b
+				}
+				return commandErrorf(40, "ConflictingUpdateOperators",
+					"Updating the path '%s' would create a conflict at '%s'", a, at)
+			}
+		}
+	}
+	return nil
+}
+
+// applyFieldOp applies one field of an update operator to doc.
+func applyFieldOp(doc bson.D, op, path string, val interface{}) (bson.D, error) {
+	switch op {
+	case "$set", "$setOnInsert":
+		return setField(doc, path, val)
+	case "$unset":
+		return UnsetField(doc, path), nil
+	case "$inc":
+		return incField(doc, path, val)
+	case "$mul":
+		return mulField(doc, path, val)
+	case "$bit":
+		return bitField(doc, path, val)
+	case "$min":
+		current, exists := GetField(doc, path)
+		if !exists || compareValues(val, current) < 0 {
+			return setField(doc, path, val)
+		}
+	case "$max":
+		current, exists := GetField(doc, path)
+		if !exists || compareValues(val, current) > 0 {
+			return setField(doc, path, val)
 		}
+	case "$push":
+		return pushField(doc, path, val)
+	case "$pop":
+		return popField(doc, path, val)
+	case "$pull":
+		return pullField(doc, path, val)
+	case "$pullAll":
+		return pullAllField(doc, path, val)
+	case "$addToSet":
+		return addToSetField(doc, path, val)
+	case "$currentDate":
+		return currentDateField(doc, path, val)
 	}
 	return doc, nil
 }
 
 func incField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	if !isNumeric(val) {
+		return nil, commandErrorf(14, "TypeMismatch", "Cannot increment with non-numeric argument: {%s: %v}", path, val)
+	}
 	incVal := toFloat64(val)
 	current, exists := GetField(doc, path)
 	if !exists {
-		return SetField(doc, path, val), nil
+		return setField(doc, path, val)
 	}
 	if !isNumeric(current) {
-		return nil, fmt.Errorf("$inc: field %q is not numeric", path)
+		return nil, commandErrorf(14, "TypeMismatch",
+			"Cannot apply $inc to a value of non-numeric type. The field '%s' has non-numeric type %s", path, bsonTypeName(current))
 	}
 	// Preserve int type if both are int
 	if isInt(current) && isInt(val) {
-		return SetField(doc, path, toInt64(current)+toInt64(val)), nil
+		return setField(doc, path, toInt64(current)+toInt64(val))
 	}
-	return SetField(doc, path, toFloat64(current)+incVal), nil
+	return setField(doc, path, toFloat64(current)+incVal)
 }
 
 func mulField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	if !isNumeric(val) {
+		return nil, commandErrorf(14, "TypeMismatch", "Cannot multiply with non-numeric argument: {%s: %v}", path, val)
+	}
 	mulVal := toFloat64(val)
 	current, exists := GetField(doc, path)
 	if !exists {
 		// $mul on nonexistent field sets it to 0
-		return SetField(doc, path, int64(0)), nil
+		return setField(doc, path, int64(0))
 	}
 	if !isNumeric(current) {
-		return nil, fmt.Errorf("$mul: field %q is not numeric", path)
+		return nil, commandErrorf(14, "TypeMismatch",
+			"Cannot apply $mul to a value of non-numeric type. The field '%s' has non-numeric type %s", path, bsonTypeName(current))
 	}
 	if isInt(current) && isInt(val) {
-		return SetField(doc, path, toInt64(current)*toInt64(val)), nil
+		return setField(doc, path, toInt64(current)*toInt64(val))
 	}
-	return SetField(doc, path, toFloat64(current)*mulVal), nil
+	return setField(doc, path, toFloat64(current)*mulVal)
 }
 
-func pushField(doc bson.D, path string, val interface{}) (bson.D, error) {
+// bitField implements $bit: {path: {and|or|xor: n}} applies the bitwise
+// operations in order to an integer field, a missing field counting as 0.
+// The result is an int32 only if the field and every operand are.
+func bitField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	ops, ok := val.(bson.D)
+	if !ok || len(ops) == 0 {
+		return nil, commandErrorf(9, "FailedToParse",
+			"The $bit modifier is not compatible with a %s. You must pass in an embedded document: {$bit: {field: {and/or/xor: #}}", bsonTypeName(val))
+	}
 	current, exists := GetField(doc, path)
 	if !exists {
-		return SetField(doc, path, bson.A{val}), nil
+		current = int32(0)
 	}
-	arr, ok := current.(bson.A)
-	if !ok {
-		return nil, fmt.Errorf("$push: field %q is not an array", path)
+	if !isInt(current) {
+		return nil, commandErrorf(2, "BadValue",
+			"Cannot apply $bit to a value of non-integral type. The field '%s' has non-integral type %s", path, bsonTypeName(current))
+	}
+	_, wide := current.(int64)
+	n := toInt64(current)
+	for _, op := range ops {
+		if !isInt(op.Value) {
+			return nil, commandErrorf(9, "FailedToParse",
+				"The $bit modifier field must be an Integer(32/64 bit); a '%s' is not supported here: {%s: %v}", bsonTypeName(op.Value), op.Key, op.Value)
+		}
+		if _, ok := op.Value.(int32); !ok {
+			wide = true
+		}
+		operand := toInt64(op.Value)
+		switch op.Key {
+		case "and":
+			n &= operand
+		case "or":
+			n |= operand
+		case "xor":
+			n ^= operand
+		default:
+			return nil, commandErrorf(9, "FailedToParse",
+				"The $bit modifier only supports 'and', 'or', and 'xor', not '%s' which is an unknown operator: {%s: %v}", op.Key, op.Key, op.Value)
+		}
 	}
-	return SetField(doc, path, append(arr, val)), nil
+	if wide {
+		return setField(doc, path, n)
+	}
+	return setField(doc, path, int32(n))
 }
 
-func pullField(doc bson.D, path string, val interface{}) (bson.D, error) {
+// currentDateField implements $currentDate: true or {$type: "date"} sets a
+// date, {$type: "timestamp"} a timestamp.
+func currentDateField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	now := time.Now()
+	switch v := val.(type) {
+	case bool:
+		return setField(doc, path, bson.DateTime(now.UnixMilli()))
+	case bson.D:
+		if len(v) == 1 && v[0].Key == "$type" {
+			switch v[0].Value {
+			case "date":
+				return setField(doc, path, bson.DateTime(now.UnixMilli()))
+			case "timestamp":
+				return setField(doc, path, bson.Timestamp{T: uint32(now.Unix()), I: 1})
+			}
+			return nil, commandErrorf(2, "BadValue",
+				"The '$type' string field is required to be 'date' or 'timestamp': {$currentDate: {field : {$type: 'date'}}}")
+		}
+	}
+	return nil, commandErrorf(2, "BadValue", "%s is not valid type for $currentDate. Please use a boolean ('true') or a $type expression ({$type: 'timestamp/date'}).", bsonTypeName(val))
+}
+
+// arrayField returns the array at path for an array update operator. A
+// missing field yields a nil array and exists false.
+func arrayField(doc bson.D, op, path string) (arr bson.A, exists bool, err error) {
 	current, exists := GetField(doc, path)
 	if !exists {
-		return doc, nil
+		return nil, false, nil
 	}
 	arr, ok := current.(bson.A)
 	if !ok {
-		return nil, fmt.Errorf("$pull: field %q is not an array", path)
-	}
-	var newArr bson.A
-	// If val is a document, it's a condition
-	if cond, ok := val.(bson.D); ok {
-		for _, elem := range arr {
-			elemDoc, ok := elem.(bson.D)
-			if ok && MatchDoc(elemDoc, cond) {
-				continue
+		return nil, true, commandErrorf(14, "TypeMismatch", "Cannot apply %s to a non-array field. Field named '%s' has a non-array type %s", op, path, bsonTypeName(current))
+	}
+	return arr, true, nil
+}
+
+// eachValues returns the elements of an {$each: [...]} argument and the
+// modifiers beside it, or the value itself when it is not one.
+func eachValues(op string, val interface{}) (bson.A, bson.D, error) {
+	d, ok := val.(bson.D)
+	if !ok {
+		return bson.A{val}, nil, nil
+	}
+	var each bson.A
+	var mods bson.D
+	hasEach := false
+	for _, e := range d {
+		if e.Key == "$each" {
+			arr, ok := e.Value.(bson.A)
+			if !ok {
+				return nil, nil, commandErrorf(14, "TypeMismatch", "The argument to $each in %s must be an array but it was of type: %s", op, bsonTypeName(e.Value))
 			}
-			newArr = append(newArr, elem)
+			each, hasEach = arr, true
+			continue
 		}
-	} else {
-		for _, elem := range arr {
-			if !valuesEqual(elem, val) {
-				newArr = append(newArr, elem)
+		mods = append(mods, e)
+	}
+	if !hasEach {
+		return bson.A{val}, nil, nil
+	}
+	return each, mods, nil
+}
+
+// pushField implements $push: {path: value} appends value, and
+// {path: {$each: [...], $position: n, $sort: spec, $slice: n}} inserts the
+// values at $position (from the end when negative), then sorts the whole
+// array and keeps the first $slice elements (the last when negative).
+func pushField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	arr, _, err := arrayField(doc, "$push", path)
+	if err != nil {
+		return nil, err
+	}
+	each, mods, err := eachValues("$push", val)
+	if err != nil {
+		return nil, err
+	}
+
+	position, hasSlice, slice := len(arr), false, 0
+	var sortSpec interface{}
+	for _, m := range mods {
+		switch m.Key {
+		case "$position":
+			if !isInt(m.Value) {
+				return nil, commandErrorf(14, "TypeMismatch", "The value for $position must be an integer value, not of type: %s", bsonTypeName(m.Value))
 			}
+			position = int(toInt64(m.Value))
+			if position < 0 {
+				position += len(arr)
+			}
+			position = max(0, min(position, len(arr)))
+		case "$slice":
+			if !isNumeric(m.Value) {
+				return nil, commandErrorf(14, "TypeMismatch", "The value for $slice must be an integer value but was given type: %s", bsonTypeName(m.Value))
+			}
+			hasSlice, slice = true, int(toInt64(m.Value))
+		case "$sort":
+			if err := checkPushSort(m.Value); err != nil {
+				return nil, err
+			}
+			sortSpec = m.Value
+		default:
+			return nil, commandErrorf(2, "BadValue", "Unrecognized clause in $push: %s", m.Key)
 		}
 	}
-	return SetField(doc, path, newArr), nil
+
+	out := make(bson.A, 0, len(arr)+len(each))
+	out = append(out, arr[:position]...)
+	out = append(out, each...)
+	out = append(out, arr[position:]...)
+	if sortSpec != nil {
+		sortArray(out, sortSpec)
+	}
+	if hasSlice {
+		switch {
+		case slice >= 0 && slice < len(out):
+			out = out[:slice]
+		case slice < 0 && -slice < len(out):
+			out = out[len(out)+slice:]
+		}
+	}
+	return setField(doc, path, out)
 }
 
-func addToSetField(doc bson.D, path string, val interface{}) (bson.D, error) {
-	current, exists := GetField(doc, path)
-	if !exists {
-		return SetField(doc, path, bson.A{val}), nil
+// checkPushSort validates a $push $sort: 1 or -1 to sort whole elements, or
+// a document of field directions to sort embedded documents.
+func checkPushSort(spec interface{}) error {
+	if d, ok := spec.(bson.D); ok {
+		if len(d) == 0 {
+			return commandErrorf(2, "BadValue", "The $sort pattern is empty when it should be a set of fields.")
+		}
+		for _, e := range d {
+			if dir := toInt64(e.Value); !isNumeric(e.Value) || (dir != 1 && dir != -1) {
+				return commandErrorf(2, "BadValue", "The $sort element value must be either 1 or -1")
+			}
+		}
+		return nil
 	}
-	arr, ok := current.(bson.A)
+	if dir := toInt64(spec); !isNumeric(spec) || (dir != 1 && dir != -1) {
+		return commandErrorf(2, "BadValue", "The $sort is invalid: use 1/-1 to sort the whole element, or {field:1/-1} to sort embedded fields")
+	}
+	return nil
+}
+
+// sortArray sorts arr in place by a validated $push $sort spec. With a
+// field spec, elements that are not documents sort as empty documents.
+func sortArray(arr bson.A, spec interface{}) {
+	fields, byField := spec.(bson.D)
+	desc := !byField && toInt64(spec) < 0
+	sort.SliceStable(arr, func(i, j int) bool {
+		if !byField {
+			c := compareValues(arr[i], arr[j])
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		a, _ := arr[i].(bson.D)
+		b, _ := arr[j].(bson.D)
+		return compareDocs(a, b, fields, nil) < 0
+	})
+}
+
+// popField implements $pop: 1 removes the last element, -1 the first.
+func popField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	dir := toInt64(val)
+	if !isNumeric(val) || (dir != 1 && dir != -1) {
+		return nil, commandErrorf(9, "FailedToParse", "$pop expects 1 or -1, found: %v", val)
+	}
+	arr, exists, err := arrayField(doc, "$pop", path)
+	if err != nil || !exists {
+		return doc, err
+	}
+	if len(arr) == 0 {
+		return doc, nil
+	}
+	if dir == 1 {
+		return setField(doc, path, append(bson.A{}, arr[:len(arr)-1]...))
+	}
+	return setField(doc, path, append(bson.A{}, arr[1:]...))
+}
+
+// pullField implements $pull. A condition made of query operators, such as
+// {$gte: 6}, is applied to each element; any other document is a query on
+// the fields of embedded document elements; anything else removes equal
+// elements.
+func pullField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	arr, exists, err := arrayField(doc, "$pull", path)
+	if err != nil || !exists {
+		return doc, err
+	}
+	var match func(elem interface{}) bool
+	switch cond := val.(type) {
+	case bson.D:
+		if len(cond) > 0 && strings.HasPrefix(cond[0].Key, "$") &&
+			cond[0].Key != "$and" && cond[0].Key != "$or" && cond[0].Key != "$nor" {
+			match = func(elem interface{}) bool { return matchOperators([]interface{}{elem}, cond, nil) }
+		} else {
+			match = func(elem interface{}) bool {
+				elemDoc, ok := elem.(bson.D)
+				return ok && MatchDoc(elemDoc, cond)
+			}
+		}
+	case bson.Regex:
+		match = func(elem interface{}) bool {
+			return matchValues([]interface{}{elem}, cond, nil)
+		}
+	default:
+		match = func(elem interface{}) bool { return valuesEqual(elem, val) }
+	}
+	newArr := bson.A{}
+	for _, elem := range arr {
+		if !match(elem) {
+			newArr = append(newArr, elem)
+		}
+	}
+	return setField(doc, path, newArr)
+}
+
+// pullAllField implements $pullAll: it removes every element equal to one of
+// the listed values.
+func pullAllField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	values, ok := val.(bson.A)
 	if !ok {
-		return nil, fmt.Errorf("$addToSet: field %q is not an array", path)
+		return nil, commandErrorf(14, "TypeMismatch", "$pullAll requires an array argument but was given a %s", bsonTypeName(val))
+	}
+	arr, exists, err := arrayField(doc, "$pullAll", path)
+	if err != nil || !exists {
+		return doc, err
 	}
+	newArr := bson.A{}
 	for _, elem := range arr {
-		if valuesEqual(elem, val) {
-			return doc, nil // already exists
+		if !containsValue(values, elem) {
+			newArr = append(newArr, elem)
 		}
 	}
-	return SetField(doc, path, append(arr, val)), nil
+	return setField(doc, path, newArr)
+}
+
+// addToSetField implements $addToSet: it appends each value, or each value
+// of {$each: [...]}, that the array does not already hold.
+func addToSetField(doc bson.D, path string, val interface{}) (bson.D, error) {
+	arr, _, err := arrayField(doc, "$addToSet", path)
+	if err != nil {
+		return nil, err
+	}
+	each, mods, err := eachValues("$addToSet", val)
+	if err != nil {
+		return nil, err
+	}
+	if len(mods) > 0 {
+		return nil, commandErrorf(2, "BadValue", "Found unexpected fields after $each in $addToSet: %s", mods[0].Key)
+	}
+	out := append(bson.A{}, arr...)
+	for _, v := range each {
+		if !containsValue(out, v) {
+			out = append(out, v)
+		}
+	}
+	return setField(doc, path, out)
+}
+
+func containsValue(arr bson.A, v interface{}) bool {
+	for _, elem := range arr {
+		if valuesEqual(elem, v) {
+			return true
+		}
+	}
+	return false
 }
 
 func isInt(v interface{}) bool {
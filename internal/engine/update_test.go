@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"errors"
 	"testing"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -36,6 +37,37 @@ func TestApplyUpdate_Set_Nested(t *testing.T) {
 	}
 }
 
+func TestApplyUpdate_Set_ArrayIndex(t *testing.T) {
+	doc := bson.D{{Key: "items", Value: bson.A{
+		bson.D{{Key: "sku", Value: "A1"}, {Key: "qty", Value: int32(1)}},
+		bson.D{{Key: "sku", Value: "B2"}, {Key: "qty", Value: int32(2)}},
+	}}}
+	out, err := ApplyUpdate(doc, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "items.1.sku", Value: "C3"}}},
+		{Key: "$inc", Value: bson.D{{Key: "items.0.qty", Value: int32(5)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetField(out, "items.1.sku"); v != "C3" {
+		t.Errorf("items.1.sku = %v, want C3", v)
+	}
+	if v, _ := GetField(out, "items.0.qty"); v != int64(6) {
+		t.Errorf("items.0.qty = %v, want 6", v)
+	}
+}
+
+func TestApplyUpdate_Set_PathBlocked(t *testing.T) {
+	for _, path := range []string{"items.sku", "name.first"} {
+		doc := bson.D{{Key: "name", Value: "ann"}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}}}}
+		_, err := ApplyUpdate(doc, bson.D{{Key: "$set", Value: bson.D{{Key: path, Value: "x"}}}})
+		var pe *PathError
+		if !errors.As(err, &pe) || pe.Path != path {
+			t.Errorf("$set %s: expected PathError, got %v", path, err)
+		}
+	}
+}
+
 func TestApplyUpdate_Unset(t *testing.T) {
 	doc := bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 2}}
 	out, err := ApplyUpdate(doc, bson.D{{Key: "$unset", Value: bson.D{{Key: "a", Value: ""}}}})
@@ -204,8 +236,9 @@ func TestApplyUpdate_Push_New(t *testing.T) {
 func TestApplyUpdate_Push_NonArray(t *testing.T) {
 	doc := bson.D{{Key: "x", Value: "not_array"}}
 	_, err := ApplyUpdate(doc, bson.D{{Key: "$push", Value: bson.D{{Key: "x", Value: "v"}}}})
-	if err == nil {
-		t.Fatal("expected error for $push on non-array")
+	var ce *CommandError
+	if !errors.As(err, &ce) || ce.Code != 14 {
+		t.Fatalf("expected TypeMismatch for $push on non-array, got %v", err)
 	}
 }
 
@@ -293,6 +326,265 @@ func TestApplyUpdate_AddToSet_New(t *testing.T) {
 	}
 }
 
+func TestApplyUpdate_Push_Each(t *testing.T) {
+	ev := func(ts int32) bson.D { return bson.D{{Key: "ts", Value: ts}} }
+	tests := []struct {
+		name string
+		arg  bson.D
+		want bson.A
+	}{
+		{"each", bson.D{{Key: "$each", Value: bson.A{ev(9), ev(1)}}}, bson.A{ev(5), ev(3), ev(9), ev(1)}},
+		{"position", bson.D{{Key: "$each", Value: bson.A{ev(9)}}, {Key: "$position", Value: int32(1)}}, bson.A{ev(5), ev(9), ev(3)}},
+		{"negative position", bson.D{{Key: "$each", Value: bson.A{ev(9)}}, {Key: "$position", Value: int32(-1)}}, bson.A{ev(5), ev(9), ev(3)}},
+		{"sort by field", bson.D{{Key: "$each", Value: bson.A{ev(4)}}, {Key: "$sort", Value: bson.D{{Key: "ts", Value: int32(1)}}}}, bson.A{ev(3), ev(4), ev(5)}},
+		{"sort and keep last", bson.D{
+			{Key: "$each", Value: bson.A{ev(9), ev(1)}},
+			{Key: "$sort", Value: bson.D{{Key: "ts", Value: int32(1)}}},
+			{Key: "$slice", Value: int32(-2)},
+		}, bson.A{ev(5), ev(9)}},
+		{"keep first", bson.D{{Key: "$each", Value: bson.A{ev(9)}}, {Key: "$slice", Value: int32(1)}}, bson.A{ev(5)}},
+		{"slice zero", bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$slice", Value: int32(0)}}, bson.A{}},
+	}
+	for _, tt := range tests {
+		doc := bson.D{{Key: "events", Value: bson.A{ev(5), ev(3)}}}
+		out, err := ApplyUpdate(doc, bson.D{{Key: "$push", Value: bson.D{{Key: "events", Value: tt.arg}}}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, _ := GetField(out, "events"); !valuesEqual(got, tt.want) {
+			t.Errorf("%s: events = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyUpdate_Push_SortWholeElements(t *testing.T) {
+	doc := bson.D{{Key: "nums", Value: bson.A{int32(3), int32(1)}}}
+	out, err := ApplyUpdate(doc, bson.D{{Key: "$push", Value: bson.D{{Key: "nums", Value: bson.D{
+		{Key: "$each", Value: bson.A{int32(2)}}, {Key: "$sort", Value: int32(-1)},
+	}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetField(out, "nums"); !valuesEqual(got, bson.A{int32(3), int32(2), int32(1)}) {
+		t.Fatalf("nums = %v, want [3 2 1]", got)
+	}
+}
+
+func TestApplyUpdate_Push_InvalidModifiers(t *testing.T) {
+	for _, tt := range []struct {
+		arg  bson.D
+		code int32
+	}{
+		{bson.D{{Key: "$each", Value: "x"}}, 14},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$slice", Value: "1"}}, 14},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$position", Value: 1.5}}, 14},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$sort", Value: int32(2)}}, 2},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$sort", Value: bson.D{}}}, 2},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$sort", Value: bson.D{{Key: "x", Value: int32(0)}}}}, 2},
+		{bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$bogus", Value: int32(1)}}, 2},
+	} {
+		doc := bson.D{{Key: "a", Value: bson.A{}}}
+		_, err := ApplyUpdate(doc, bson.D{{Key: "$push", Value: bson.D{{Key: "a", Value: tt.arg}}}})
+		var ce *CommandError
+		if !errors.As(err, &ce) || ce.Code != tt.code {
+			t.Errorf("$push %v: expected code %d, got %v", tt.arg, tt.code, err)
+		}
+	}
+}
+
+func TestApplyUpdate_Pop(t *testing.T) {
+	doc := bson.D{{Key: "a", Value: bson.A{int32(1), int32(2), int32(3)}}}
+	out, err := ApplyUpdate(doc, bson.D{{Key: "$pop", Value: bson.D{{Key: "a", Value: int32(1)}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ApplyUpdate(out, bson.D{{Key: "$pop", Value: bson.D{{Key: "a", Value: int32(-1)}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetField(out, "a"); !valuesEqual(got, bson.A{int32(2)}) {
+		t.Fatalf("a = %v, want [2]", got)
+	}
+	if _, err := ApplyUpdate(out, bson.D{{Key: "$pop", Value: bson.D{{Key: "a", Value: int32(2)}}}}); err == nil {
+		t.Fatal("expected error for $pop 2")
+	}
+	if _, err := ApplyUpdate(out, bson.D{{Key: "$pop", Value: bson.D{{Key: "missing", Value: int32(1)}}}}); err != nil {
+		t.Fatalf("$pop on a missing field should be a no-op: %v", err)
+	}
+}
+
+func TestApplyUpdate_PullAll(t *testing.T) {
+	doc := bson.D{{Key: "a", Value: bson.A{int32(1), int32(2), int32(3), int32(2), "x"}}}
+	out, err := ApplyUpdate(doc, bson.D{{Key: "$pullAll", Value: bson.D{{Key: "a", Value: bson.A{int32(2), "x"}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetField(out, "a"); !valuesEqual(got, bson.A{int32(1), int32(3)}) {
+		t.Fatalf("a = %v, want [1 3]", got)
+	}
+	_, err = ApplyUpdate(doc, bson.D{{Key: "$pullAll", Value: bson.D{{Key: "a", Value: int32(2)}}}})
+	var ce *CommandError
+	if !errors.As(err, &ce) || ce.Code != 14 {
+		t.Fatalf("expected TypeMismatch for a non-array $pullAll argument, got %v", err)
+	}
+}
+
+func TestApplyUpdate_Pull_Conditions(t *testing.T) {
+	tests := []struct {
+		name string
+		arr  bson.A
+		cond interface{}
+		want bson.A
+	}{
+		{"operators on scalars", bson.A{int32(3), int32(6), int32(9)}, bson.D{{Key: "$gte", Value: int32(6)}}, bson.A{int32(3)}},
+		{"$in", bson.A{"a", "b", "c"}, bson.D{{Key: "$in", Value: bson.A{"a", "c"}}}, bson.A{"b"}},
+		{"regex", bson.A{"apple", "banana", "avocado"}, bson.Regex{Pattern: "^a"}, bson.A{"banana"}},
+		{"embedded field query", bson.A{
+			bson.D{{Key: "sku", Value: "A"}, {Key: "qty", Value: int32(0)}},
+			bson.D{{Key: "sku", Value: "B"}, {Key: "qty", Value: int32(4)}},
+		}, bson.D{{Key: "qty", Value: bson.D{{Key: "$lt", Value: int32(1)}}}}, bson.A{
+			bson.D{{Key: "sku", Value: "B"}, {Key: "qty", Value: int32(4)}},
+		}},
+		{"embedded $or", bson.A{
+			bson.D{{Key: "sku", Value: "A"}},
+			bson.D{{Key: "sku", Value: "B"}},
+			bson.D{{Key: "sku", Value: "C"}},
+		}, bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "sku", Value: "A"}}, bson.D{{Key: "sku", Value: "C"}}}}}, bson.A{
+			bson.D{{Key: "sku", Value: "B"}},
+		}},
+		{"pull everything", bson.A{int32(1)}, int32(1), bson.A{}},
+	}
+	for _, tt := range tests {
+		doc := bson.D{{Key: "a", Value: tt.arr}}
+		out, err := ApplyUpdate(doc, bson.D{{Key: "$pull", Value: bson.D{{Key: "a", Value: tt.cond}}}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, _ := GetField(out, "a"); !valuesEqual(got, tt.want) {
+			t.Errorf("%s: a = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyUpdate_AddToSet_Each(t *testing.T) {
+	doc := bson.D{{Key: "tags", Value: bson.A{"a", "b"}}}
+	out, err := ApplyUpdate(doc, bson.D{{Key: "$addToSet", Value: bson.D{{Key: "tags", Value: bson.D{
+		{Key: "$each", Value: bson.A{"b", "c", "c", "d"}},
+	}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetField(out, "tags"); !valuesEqual(got, bson.A{"a", "b", "c", "d"}) {
+		t.Fatalf("tags = %v, want [a b c d]", got)
+	}
+	// A document without $each is added as a value.
+	out, err = ApplyUpdate(out, bson.D{{Key: "$addToSet", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "k", Value: "v"}}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetField(out, "tags"); len(got.(bson.A)) != 5 {
+		t.Fatalf("tags = %v, want the document appended", got)
+	}
+}
+
+func TestApplyUpdate_SetOnInsertIgnoredOnUpdate(t *testing.T) {
+	doc := bson.D{{Key: "a", Value: int32(1)}}
+	out, err := ApplyUpdate(doc, bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "b", Value: int32(2)}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := GetField(out, "b"); ok {
+		t.Fatal("$setOnInsert should not apply to an existing document")
+	}
+	out, err = applyUpdate(doc, bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "b", Value: int32(2)}}}}, &updateContext{insert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetField(out, "b"); v != int32(2) {
+		t.Fatalf("b = %v, want 2 on insert", v)
+	}
+}
+
+func TestApplyUpdate_Bit(t *testing.T) {
+	tests := []struct {
+		doc  bson.D
+		ops  bson.D
+		want interface{}
+	}{
+		{bson.D{{Key: "a", Value: int32(13)}}, bson.D{{Key: "and", Value: int32(10)}}, int32(8)},
+		{bson.D{{Key: "a", Value: int32(13)}}, bson.D{{Key: "or", Value: int32(2)}}, int32(15)},
+		{bson.D{{Key: "a", Value: int32(13)}}, bson.D{{Key: "xor", Value: int32(5)}}, int32(8)},
+		{bson.D{{Key: "a", Value: int32(13)}}, bson.D{{Key: "and", Value: int64(12)}, {Key: "or", Value: int32(1)}}, int64(13)},
+		{bson.D{}, bson.D{{Key: "or", Value: int32(4)}}, int32(4)},
+	}
+	for _, tt := range tests {
+		out, err := ApplyUpdate(tt.doc, bson.D{{Key: "$bit", Value: bson.D{{Key: "a", Value: tt.ops}}}})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.ops, err)
+		}
+		if v, _ := GetField(out, "a"); v != tt.want {
+			t.Errorf("%v on %v: a = %v (%T), want %v (%T)", tt.ops, tt.doc, v, v, tt.want, tt.want)
+		}
+	}
+	for _, bad := range []struct {
+		doc bson.D
+		arg interface{}
+	}{
+		{bson.D{{Key: "a", Value: 1.5}}, bson.D{{Key: "and", Value: int32(1)}}},
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "nand", Value: int32(1)}}},
+		{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "and", Value: 1.0}}},
+		{bson.D{{Key: "a", Value: int32(1)}}, int32(1)},
+	} {
+		if _, err := ApplyUpdate(bad.doc, bson.D{{Key: "$bit", Value: bson.D{{Key: "a", Value: bad.arg}}}}); err == nil {
+			t.Errorf("expected error for $bit %v on %v", bad.arg, bad.doc)
+		}
+	}
+}
+
+func TestApplyUpdate_Validation(t *testing.T) {
+	tests := []struct {
+		name   string
+		update bson.D
+		code   int32
+	}{
+		{"unknown operator", bson.D{{Key: "$foo", Value: bson.D{{Key: "a", Value: 1}}}}, 9},
+		{"operator not a document", bson.D{{Key: "$set", Value: int32(1)}}, 9},
+		{"field after operator", bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}, {Key: "b", Value: 1}}, 9},
+		{"same path", bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}, {Key: "$inc", Value: bson.D{{Key: "a", Value: 1}}}}, 40},
+		{"nested path", bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}, {Key: "a.b", Value: 1}}}}, 40},
+		{"rename target", bson.D{{Key: "$rename", Value: bson.D{{Key: "a", Value: "b"}}}, {Key: "$set", Value: bson.D{{Key: "b", Value: 1}}}}, 40},
+		{"rename to non-string", bson.D{{Key: "$rename", Value: bson.D{{Key: "a", Value: 1}}}}, 2},
+		{"empty path", bson.D{{Key: "$set", Value: bson.D{{Key: "a..b", Value: 1}}}}, 56},
+		{"inc non-numeric", bson.D{{Key: "$inc", Value: bson.D{{Key: "a", Value: "x"}}}}, 14},
+		{"inc non-numeric field", bson.D{{Key: "$inc", Value: bson.D{{Key: "s", Value: int32(1)}}}}, 14},
+		{"currentDate type", bson.D{{Key: "$currentDate", Value: bson.D{{Key: "d", Value: bson.D{{Key: "$type", Value: "string"}}}}}}, 2},
+		{"addToSet non-array field", bson.D{{Key: "$addToSet", Value: bson.D{{Key: "s", Value: "x"}}}}, 14},
+		{"addToSet extra modifier", bson.D{{Key: "$addToSet", Value: bson.D{{Key: "t", Value: bson.D{{Key: "$each", Value: bson.A{}}, {Key: "$slice", Value: int32(1)}}}}}}, 2},
+		{"pull non-array field", bson.D{{Key: "$pull", Value: bson.D{{Key: "s", Value: "x"}}}}, 14},
+		{"replacement with operator", bson.D{{Key: "a", Value: 1}, {Key: "$set", Value: bson.D{}}}, 52},
+	}
+	for _, tt := range tests {
+		doc := bson.D{{Key: "a", Value: int32(1)}, {Key: "s", Value: "str"}}
+		_, err := ApplyUpdate(doc, tt.update)
+		var ue *CommandError
+		if !errors.As(err, &ue) || ue.Code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+}
+
+func TestApplyUpdate_CurrentDateTimestamp(t *testing.T) {
+	out, err := ApplyUpdate(bson.D{}, bson.D{{Key: "$currentDate", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$type", Value: "timestamp"}}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetField(out, "ts"); v == nil {
+		t.Fatal("ts should be set")
+	} else if _, ok := v.(bson.Timestamp); !ok {
+		t.Fatalf("expected bson.Timestamp, got %T", v)
+	}
+}
+
 func TestApplyUpdate_CurrentDate(t *testing.T) {
 	doc := bson.D{}
 	out, err := ApplyUpdate(doc, bson.D{{Key: "$currentDate", Value: bson.D{{Key: "updatedAt", Value: true}}}})
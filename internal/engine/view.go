@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// maxViewDepth is how many views a view may be defined on in a chain, as in
+// MongoDB.
+const maxViewDepth = 20
+
+func namespaceExists(db, name string) error {
+	return commandErrorf(48, "NamespaceExists", "Collection %s.%s already exists.", db, name)
+}
+
+func notSupportedOnView(db, name string) error {
+	return commandErrorf(166, "CommandNotSupportedOnView", "Namespace %s.%s is a view, not a collection", db, name)
+}
+
+// CreateView defines a read-only view named name on the collection or view
+// viewOn of the same database. Reading the view runs pipeline on viewOn's
+// documents; writing to it fails with CommandNotSupportedOnView.
+func (e *Engine) CreateView(db, name, viewOn string, pipeline []bson.D) error {
+	if viewOn == "" {
+		return commandErrorf(2, "BadValue", "'viewOn' must be a non-empty collection name")
+	}
+	for _, stage := range pipeline {
+		if len(stage) != 1 || !strings.HasPrefix(stage[0].Key, "$") {
+			return commandErrorf(40323, "Location40323", "A pipeline stage specification object must contain exactly one field.")
+		}
+		if stage[0].Key == "$out" || stage[0].Key == "$merge" {
+			return commandErrorf(167, "OptionNotSupportedOnView", "%s cannot be used in a view definition", stage[0].Key)
+		}
+	}
+	unlock, err := e.lockWrite()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if e.collection(db, name) != nil || e.view(db, name) != nil {
+		return namespaceExists(db, name)
+	}
+	v := &View{ViewOn: viewOn, Pipeline: pipeline}
+	if v.Pipeline == nil {
+		v.Pipeline = []bson.D{}
+	}
+	d := e.data.GetOrCreateDB(db)
+	if d.Views == nil {
+		d.Views = make(map[string]*View)
+	}
+	d.Views[name] = v
+	e.record(journalEntry{Op: journalCreateView, DB: db, Coll: name, View: v})
+	return e.save()
+}
+
+// Views returns the definitions of the views of db by name.
+func (e *Engine) Views(db string) map[string]View {
+	_ = e.refresh() // on error keep serving the last loaded state
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	d := e.data.Databases[db]
+	if d == nil || len(d.Views) == 0 {
+		return nil
+	}
+	views := make(map[string]View, len(d.Views))
+	for name, v := range d.Views {
+		views[name] = *v
+	}
+	return views
+}
+
+// view returns the named view, or nil if there is no such view.
+func (s *state) view(db, name string) *View {
+	d := s.data.Databases[db]
+	if d == nil {
+		return nil
+	}
+	return d.Views[name]
+}
+
+// writable returns CommandNotSupportedOnView if db.coll is a view.
+func (s *state) writable(db, coll string) error {
+	if s.view(db, coll) != nil {
+		return notSupportedOnView(db, coll)
+	}
+	return nil
+}
+
+// resolveView returns the collection that reads of db.name run on and the
+// pipeline to run first: for a view, the pipelines of the view and of the
+// views it is defined on, innermost first. For a collection the pipeline is
+// nil.
+func (s *state) resolveView(db, name string) (string, []bson.D, error) {
+	var pipeline []bson.D
+	for depth := 0; ; depth++ {
+		v := s.view(db, name)
+		if v == nil {
+			return name, pipeline, nil
+		}
+		if depth == maxViewDepth {
+			return "", nil, commandErrorf(165, "ViewDepthLimitExceeded", "View depth too deep or view cycle detected; maximum depth is %d", maxViewDepth)
+		}
+		pipeline = append(append([]bson.D(nil), v.Pipeline...), pipeline...)
+		name = v.ViewOn
+	}
+}
+
+// matching returns the documents of the collection or view db.coll that
+// match filter under collation.
+func (s *state) matching(db, coll string, filter bson.D, collation *Collation) ([]bson.D, error) {
+	if err := checkRegexes(filter); err != nil {
+		return nil, err
+	}
+	if s.view(db, coll) == nil {
+		c := s.collection(db, coll)
+		if c == nil {
+			return nil, nil
+		}
+		return c.find(filter, collation), nil
+	}
+	var pipeline []bson.D
+	if len(filter) > 0 {
+		pipeline = []bson.D{{{Key: "$match", Value: filter}}}
+	}
+	return s.aggregate(db, coll, pipeline, collation)
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// seedTests creates db.tests, db.owners and the view db.failing of failing
+// tests with their owner.
+func seedTests(t *testing.T, eng *Engine) {
+	t.Helper()
+	mustInsert(t, eng, "db", "tests",
+		bson.D{{Key: "_id", Value: "TestA"}, {Key: "status", Value: "fail"}, {Key: "pkg", Value: "api"}},
+		bson.D{{Key: "_id", Value: "TestB"}, {Key: "status", Value: "pass"}, {Key: "pkg", Value: "api"}},
+		bson.D{{Key: "_id", Value: "TestC"}, {Key: "status", Value: "fail"}, {Key: "pkg", Value: "db"}},
+	)
+	mustInsert(t, eng, "db", "owners",
+		bson.D{{Key: "_id", Value: "api"}, {Key: "owner", Value: "ana"}},
+		bson.D{{Key: "_id", Value: "db"}, {Key: "owner", Value: "bo"}},
+	)
+	err := eng.CreateView("db", "failing", "tests", []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "status", Value: "fail"}}}},
+		{{Key: "$lookup", Value: bson.D{{Key: "from", Value: "owners"}, {Key: "localField", Value: "pkg"}, {Key: "foreignField", Value: "_id"}, {Key: "as", Value: "owner"}}}},
+		{{Key: "$set", Value: bson.D{{Key: "owner", Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$owner", 0}}}}}}},
+		{{Key: "$set", Value: bson.D{{Key: "owner", Value: "$owner.owner"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestView_Reads(t *testing.T) {
+	eng, path := newEng(t)
+	seedTests(t, eng)
+
+	for _, e := range []*Engine{eng, reloadEng(t, path)} {
+		docs, err := e.Find("db", "failing", bson.D{{Key: "owner", Value: "bo"}}, nil, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := docIDs(docs); len(got) != 1 || got[0] != "TestC" {
+			t.Errorf("Find = %v, want [TestC]", got)
+		}
+		docs, _ = e.Find("db", "failing", nil, bson.D{{Key: "_id", Value: -1}}, 0, 1, nil)
+		if got := docIDs(docs); len(got) != 1 || got[0] != "TestC" {
+			t.Errorf("Find sorted and limited = %v, want [TestC]", got)
+		}
+		if n, err := e.Count("db", "failing", nil, nil); err != nil || n != 2 {
+			t.Errorf("Count = %d, %v; want 2", n, err)
+		}
+		owners, err := e.Distinct("db", "failing", "owner", nil, nil)
+		if err != nil || len(owners) != 2 {
+			t.Errorf("Distinct = %v, %v", owners, err)
+		}
+		res, err := e.Aggregate("db", "failing", []bson.D{{{Key: "$count", Value: "n"}}}, nil)
+		if err != nil || len(res) != 1 {
+			t.Fatalf("Aggregate = %v, %v", res, err)
+		}
+		if n, _ := GetField(res[0], "n"); n != int64(2) {
+			t.Errorf("Aggregate $count = %v", n)
+		}
+	}
+}
+
+func TestView_OnView(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTests(t, eng)
+	if err := eng.CreateView("db", "failingAPI", "failing", []bson.D{{{Key: "$match", Value: bson.D{{Key: "pkg", Value: "api"}}}}}); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := eng.Find("db", "failingAPI", nil, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("Find = %v", docs)
+	}
+	if owner, _ := GetField(docs[0], "owner"); owner != "ana" {
+		t.Errorf("owner = %v, want the outer view's stages to run after the inner view's", owner)
+	}
+
+	// $lookup reads views too.
+	res, err := eng.Aggregate("db", "owners", []bson.D{
+		{{Key: "$lookup", Value: bson.D{{Key: "from", Value: "failing"}, {Key: "localField", Value: "_id"}, {Key: "foreignField", Value: "pkg"}, {Key: "as", Value: "failing"}}}},
+		{{Key: "$match", Value: bson.D{{Key: "_id", Value: "api"}}}},
+	}, nil)
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Aggregate = %v, %v", res, err)
+	}
+	if failing, _ := GetField(res[0], "failing"); len(failing.(bson.A)) != 1 {
+		t.Errorf("$lookup from view = %v", failing)
+	}
+}
+
+func TestView_Explain(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTests(t, eng)
+	explains := map[string]func() (*Explain, error){
+		"find": func() (*Explain, error) {
+			return eng.ExplainFind("db", "failing", bson.D{{Key: "owner", Value: "bo"}}, nil, 0, 0, nil)
+		},
+		"count": func() (*Explain, error) {
+			return eng.ExplainCount("db", "failing", bson.D{{Key: "owner", Value: "bo"}}, nil)
+		},
+		"aggregate": func() (*Explain, error) {
+			return eng.ExplainAggregate("db", "failing", []bson.D{{{Key: "$match", Value: bson.D{{Key: "owner", Value: "bo"}}}}}, nil)
+		},
+	}
+	for name, explain := range explains {
+		x, err := explain()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !x.Exists || x.Namespace != "db.tests" || x.Command != "aggregate" {
+			t.Errorf("%s: explained %s %q (exists %v), want an aggregate on db.tests", name, x.Command, x.Namespace, x.Exists)
+		}
+		if x.DocsExamined != 3 || x.NReturned != 1 {
+			t.Errorf("%s: examined %d, returned %d; want 3 and 1", name, x.DocsExamined, x.NReturned)
+		}
+	}
+
+	var ce *CommandError
+	if _, err := eng.ExplainUpdate("db", "failing", nil, false, nil); !errors.As(err, &ce) || ce.Code != 166 {
+		t.Errorf("explain update: got %v, want CommandNotSupportedOnView", err)
+	}
+}
+
+func TestView_WritesRejected(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTests(t, eng)
+	filter := bson.D{{Key: "_id", Value: "TestA"}}
+	set := bson.D{{Key: "$set", Value: bson.D{{Key: "x", Value: 1}}}}
+	writes := map[string]func() error{
+		"insert": func() error { _, err := eng.Insert("db", "failing", []bson.D{{{Key: "x", Value: 1}}}); return err },
+		"update": func() error {
+			_, _, _, err := eng.Update("db", "failing", filter, set, nil, false, true, nil)
+			return err
+		},
+		"delete": func() error { _, err := eng.Delete("db", "failing", filter, false, nil); return err },
+		"findAndModify": func() error {
+			_, err := eng.FindAndModify("db", "failing", filter, nil, set, nil, false, false, false, nil)
+			return err
+		},
+		"createIndexes": func() error {
+			return eng.CreateIndexes("db", "failing", []IndexSpec{{Name: "x_1", Keys: bson.D{{Key: "x", Value: int32(1)}}}})
+		},
+		"txn insert": func() error {
+			_, err := eng.Begin().Insert("db", "failing", []bson.D{{{Key: "x", Value: 1}}})
+			return err
+		},
+	}
+	for name, write := range writes {
+		var ce *CommandError
+		if err := write(); !errors.As(err, &ce) || ce.Code != 166 {
+			t.Errorf("%s: got %v, want CommandNotSupportedOnView", name, err)
+		}
+	}
+	if n, _ := eng.Count("db", "tests", nil, nil); n != 3 {
+		t.Errorf("source changed: %d docs", n)
+	}
+}
+
+func TestCreateView_Errors(t *testing.T) {
+	eng, _ := newEng(t)
+	seedTests(t, eng)
+	var ce *CommandError
+	for _, name := range []string{"tests", "failing"} {
+		if err := eng.CreateView("db", name, "owners", nil); !errors.As(err, &ce) || ce.Code != 48 {
+			t.Errorf("view %s: got %v, want NamespaceExists", name, err)
+		}
+	}
+	if err := eng.CreateCollection("db", "failing"); !errors.As(err, &ce) || ce.Code != 48 {
+		t.Errorf("collection over view: got %v, want NamespaceExists", err)
+	}
+	if err := eng.CreateView("db", "v", "", nil); err == nil {
+		t.Error("expected an error for an empty viewOn")
+	}
+	if err := eng.CreateView("db", "v", "tests", []bson.D{{{Key: "$match", Value: bson.D{}}, {Key: "$limit", Value: 1}}}); err == nil {
+		t.Error("expected an error for a stage with two fields")
+	}
+}
+
+func TestDropCollection_View(t *testing.T) {
+	eng, path := newEng(t)
+	jeng, err := NewWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedTests(t, jeng)
+	if eng.Views("db")["failing"].ViewOn != "tests" {
+		t.Fatalf("view not replayed from the journal: %v", eng.Views("db"))
+	}
+	if err := jeng.DropCollection("db", "failing"); err != nil {
+		t.Fatal(err)
+	}
+	if views := eng.Views("db"); len(views) != 0 {
+		t.Errorf("views after drop = %v", views)
+	}
+	if n, _ := eng.Count("db", "tests", nil, nil); n != 3 {
+		t.Errorf("dropping the view changed its source: %d docs", n)
+	}
+}
@@ -0,0 +1,590 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// windowAccumulators are the $group accumulators $setWindowFields can run
+// over a window.
+var windowAccumulators = map[string]bool{
+	"$sum": true, "$avg": true, "$min": true, "$max": true, "$first": true, "$last": true,
+	"$push": true, "$addToSet": true, "$count": true, "$stdDevPop": true, "$stdDevSamp": true,
+}
+
+// unitMillis is the length in milliseconds of each fixed time unit.
+var unitMillis = map[string]float64{
+	"week":        7 * 24 * 60 * 60 * 1000,
+	"day":         24 * 60 * 60 * 1000,
+	"hour":        60 * 60 * 1000,
+	"minute":      60 * 1000,
+	"second":      1000,
+	"millisecond": 1,
+}
+
+// calendarMonths is the length in months of each calendar time unit, whose
+// length in milliseconds varies.
+var calendarMonths = map[string]int{"year": 12, "quarter": 3, "month": 1}
+
+func checkUnit(stage, unit string) error {
+	if _, ok := unitMillis[unit]; ok {
+		return nil
+	}
+	if _, ok := calendarMonths[unit]; ok {
+		return nil
+	}
+	return fmt.Errorf("%s: unknown time unit %q", stage, unit)
+}
+
+// addUnits adds n units to a date given in milliseconds since the epoch.
+func addUnits(ms float64, n int64, unit string) float64 {
+	if months, ok := calendarMonths[unit]; ok {
+		t := addMonths(time.UnixMilli(int64(ms)).UTC(), int(n)*months)
+		return float64(t.UnixMilli())
+	}
+	return ms + float64(n)*unitMillis[unit]
+}
+
+// addMonths adds n months to t, clamping the day to the end of the resulting
+// month, so one month after January 31st is February 28th rather than the
+// March 3rd that time.AddDate returns.
+func addMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// windowKey returns the number that range windows, $derivative, $integral,
+// $densify and linear $fill measure distances with: a number itself, or a
+// date in milliseconds since the epoch.
+func windowKey(v interface{}) (key float64, isDate, ok bool) {
+	if d, ok := v.(bson.DateTime); ok {
+		return float64(d), true, true
+	}
+	if isNumeric(v) {
+		return toFloat64(v), false, true
+	}
+	return 0, false, false
+}
+
+// partition is the documents of one partition of $setWindowFields, $densify
+// or $fill.
+type partition struct {
+	key  interface{}
+	docs []bson.D
+}
+
+// partitionDocs splits docs by key, in ascending key order, and sorts each
+// partition by sortBy.
+func partitionDocs(docs []bson.D, key func(bson.D) interface{}, sortBy bson.D) []*partition {
+	var parts []*partition
+	index := make(map[string]*partition)
+	for _, doc := range docs {
+		k := key(doc)
+		ks := groupKeyString(k)
+		p := index[ks]
+		if p == nil {
+			p = &partition{key: k}
+			index[ks] = p
+			parts = append(parts, p)
+		}
+		p.docs = append(p.docs, doc)
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		return compareValues(parts[i].key, parts[j].key) < 0
+	})
+	for _, p := range parts {
+		SortDocs(p.docs, sortBy)
+	}
+	return parts
+}
+
+// windowBounds is the window of a $setWindowFields output: document offsets
+// from the current document, or a range of sortBy values around the current
+// document's. Unbounded ends are infinite.
+type windowBounds struct {
+	byRange bool
+	lo, hi  float64
+	unit    string
+}
+
+func parseWindow(spec interface{}) (*windowBounds, error) {
+	d, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$setWindowFields 'window' must be a document")
+	}
+	w := &windowBounds{}
+	var bounds interface{}
+	for _, f := range d {
+		switch f.Key {
+		case "documents", "range":
+			if bounds != nil {
+				return nil, fmt.Errorf("$setWindowFields window may have 'documents' or 'range', not both")
+			}
+			bounds, w.byRange = f.Value, f.Key == "range"
+		case "unit":
+			unit, ok := f.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("$setWindowFields window 'unit' must be a string")
+			}
+			if err := checkUnit("$setWindowFields", unit); err != nil {
+				return nil, err
+			}
+			w.unit = unit
+		default:
+			return nil, fmt.Errorf("$setWindowFields: unknown window field %q", f.Key)
+		}
+	}
+	arr, ok := bounds.(bson.A)
+	if !ok || len(arr) != 2 {
+		return nil, fmt.Errorf("$setWindowFields window requires 'documents' or 'range' as a [lower, upper] array")
+	}
+	if w.unit != "" && !w.byRange {
+		return nil, fmt.Errorf("$setWindowFields window 'unit' requires a 'range' window")
+	}
+	var err error
+	if w.lo, err = w.bound(arr[0], math.Inf(-1)); err != nil {
+		return nil, err
+	}
+	if w.hi, err = w.bound(arr[1], math.Inf(1)); err != nil {
+		return nil, err
+	}
+	if w.lo > w.hi {
+		return nil, fmt.Errorf("$setWindowFields window lower bound must not be greater than the upper bound")
+	}
+	return w, nil
+}
+
+// bound parses one end of a window: "unbounded", "current" or an offset,
+// which must be whole for document windows and windows with a unit.
+func (w *windowBounds) bound(v interface{}, unbounded float64) (float64, error) {
+	switch v {
+	case "unbounded":
+		return unbounded, nil
+	case "current":
+		return 0, nil
+	}
+	if !isNumeric(v) {
+		return 0, fmt.Errorf("$setWindowFields window bounds must be 'unbounded', 'current' or a number")
+	}
+	n := toFloat64(v)
+	if (!w.byRange || w.unit != "") && n != math.Trunc(n) {
+		return 0, fmt.Errorf("$setWindowFields window bounds must be integers for document windows and windows with a unit")
+	}
+	return n, nil
+}
+
+// windowOutput is one output field of $setWindowFields.
+type windowOutput struct {
+	field  string
+	op     string
+	arg    interface{}
+	window *windowBounds // nil for the whole partition
+}
+
+func parseWindowOutput(field string, spec interface{}, sortBy bson.D) (*windowOutput, error) {
+	d, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("$setWindowFields output field %q must be a document", field)
+	}
+	o := &windowOutput{field: field}
+	for _, f := range d {
+		if f.Key == "window" {
+			w, err := parseWindow(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			o.window = w
+			continue
+		}
+		if o.op != "" {
+			return nil, fmt.Errorf("$setWindowFields output field %q must have exactly one window function", field)
+		}
+		o.op, o.arg = f.Key, f.Value
+	}
+
+	switch o.op {
+	case "$rank", "$denseRank", "$documentNumber", "$shift", "$expMovingAvg":
+		if len(sortBy) == 0 {
+			return nil, fmt.Errorf("%s requires a sortBy", o.op)
+		}
+		if o.window != nil {
+			return nil, fmt.Errorf("%s does not accept a window", o.op)
+		}
+		if (o.op == "$rank" || o.op == "$denseRank") && len(sortBy) != 1 {
+			return nil, fmt.Errorf("%s requires a sortBy with exactly one field", o.op)
+		}
+	case "$derivative", "$integral":
+		if len(sortBy) != 1 {
+			return nil, fmt.Errorf("%s requires a sortBy with exactly one field", o.op)
+		}
+		if o.op == "$derivative" && o.window == nil {
+			return nil, fmt.Errorf("$derivative requires a window")
+		}
+	case "":
+		return nil, fmt.Errorf("$setWindowFields output field %q requires a window function", field)
+	default:
+		if !windowAccumulators[o.op] {
+			return nil, fmt.Errorf("$setWindowFields: unsupported window function %s", o.op)
+		}
+	}
+	if o.window != nil && o.window.byRange && len(sortBy) != 1 {
+		return nil, fmt.Errorf("range-based windows require a sortBy with exactly one field")
+	}
+	if err := o.checkArgs(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// checkArgs validates the arguments of the operators that take a document.
+func (o *windowOutput) checkArgs() error {
+	switch o.op {
+	case "$shift":
+		d, _ := o.arg.(bson.D)
+		var hasOutput, hasBy bool
+		for _, f := range d {
+			switch f.Key {
+			case "output":
+				hasOutput = true
+			case "by":
+				hasBy = isNumeric(f.Value) && toFloat64(f.Value) == math.Trunc(toFloat64(f.Value))
+			case "default":
+			default:
+				return fmt.Errorf("$shift: unknown argument %q", f.Key)
+			}
+		}
+		if !hasOutput || !hasBy {
+			return fmt.Errorf("$shift requires 'output' and an integer 'by'")
+		}
+	case "$expMovingAvg":
+		d, _ := o.arg.(bson.D)
+		var hasInput, hasN, hasAlpha bool
+		for _, f := range d {
+			switch f.Key {
+			case "input":
+				hasInput = true
+			case "N":
+				hasN = isInt(f.Value) && toInt64(f.Value) > 0
+			case "alpha":
+				a := toFloat64(f.Value)
+				hasAlpha = isNumeric(f.Value) && a > 0 && a < 1
+			default:
+				return fmt.Errorf("$expMovingAvg: unknown argument %q", f.Key)
+			}
+		}
+		if !hasInput || hasN == hasAlpha {
+			return fmt.Errorf("$expMovingAvg requires 'input' and either a positive integer 'N' or an 'alpha' between 0 and 1")
+		}
+	case "$derivative", "$integral":
+		d, _ := o.arg.(bson.D)
+		hasInput := false
+		for _, f := range d {
+			switch f.Key {
+			case "input":
+				hasInput = true
+			case "unit":
+				unit, _ := f.Value.(string)
+				if _, ok := unitMillis[unit]; !ok {
+					return fmt.Errorf("%s 'unit' must be one of week, day, hour, minute, second or millisecond", o.op)
+				}
+			default:
+				return fmt.Errorf("%s: unknown argument %q", o.op, f.Key)
+			}
+		}
+		if !hasInput {
+			return fmt.Errorf("%s requires an 'input'", o.op)
+		}
+	}
+	return nil
+}
+
+// setWindowFieldsDocs adds to each document the output fields of spec, each
+// computed over a window of the documents in the same partition in sortBy
+// order. The documents come out grouped by partition and sorted.
+func setWindowFieldsDocs(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var partitionBy interface{}
+	var sortBy, outputSpec bson.D
+	for _, f := range spec {
+		switch f.Key {
+		case "partitionBy":
+			partitionBy = f.Value
+		case "sortBy":
+			s, ok := f.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$setWindowFields 'sortBy' must be a document")
+			}
+			sortBy = s
+		case "output":
+			o, ok := f.Value.(bson.D)
+			if !ok || len(o) == 0 {
+				return nil, fmt.Errorf("$setWindowFields 'output' must be a non-empty document")
+			}
+			outputSpec = o
+		default:
+			return nil, fmt.Errorf("$setWindowFields: unknown argument %q", f.Key)
+		}
+	}
+	if outputSpec == nil {
+		return nil, fmt.Errorf("$setWindowFields requires an 'output' field")
+	}
+	outputs := make([]*windowOutput, 0, len(outputSpec))
+	for _, f := range outputSpec {
+		o, err := parseWindowOutput(f.Key, f.Value, sortBy)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+
+	parts := partitionDocs(docs, func(doc bson.D) interface{} { return evalExpr(doc, partitionBy) }, sortBy)
+	var result []bson.D
+	for _, p := range parts {
+		// Every output is computed from the input documents before any
+		// field is set.
+		values := make([][]interface{}, len(outputs))
+		for i, o := range outputs {
+			vals, err := o.compute(p.docs, sortBy)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = vals
+		}
+		for i, doc := range p.docs {
+			newDoc, err := CopyDoc(doc)
+			if err != nil {
+				return nil, err
+			}
+			for j, o := range outputs {
+				newDoc = SetField(newDoc, o.field, values[j][i])
+			}
+			result = append(result, newDoc)
+		}
+	}
+	return result, nil
+}
+
+// compute returns the output's value for each document of a sorted
+// partition.
+func (o *windowOutput) compute(docs []bson.D, sortBy bson.D) ([]interface{}, error) {
+	vals := make([]interface{}, len(docs))
+	arg, _ := o.arg.(bson.D)
+	switch o.op {
+	case "$documentNumber":
+		for i := range docs {
+			vals[i] = int32(i + 1)
+		}
+		return vals, nil
+
+	case "$rank", "$denseRank":
+		rank := int32(0)
+		for i := range docs {
+			switch {
+			case i > 0 && compareDocs(docs[i-1], docs[i], sortBy, nil) == 0:
+			case o.op == "$rank":
+				rank = int32(i + 1)
+			default:
+				rank++
+			}
+			vals[i] = rank
+		}
+		return vals, nil
+
+	case "$shift":
+		var output, def interface{}
+		var by int
+		for _, f := range arg {
+			switch f.Key {
+			case "output":
+				output = f.Value
+			case "by":
+				by = int(toInt64(f.Value))
+			case "default":
+				def = f.Value
+			}
+		}
+		for i, doc := range docs {
+			if j := i + by; j >= 0 && j < len(docs) {
+				vals[i] = evalExpr(docs[j], output)
+			} else {
+				vals[i] = evalExpr(doc, def)
+			}
+		}
+		return vals, nil
+
+	case "$expMovingAvg":
+		var input interface{}
+		var alpha float64
+		for _, f := range arg {
+			switch f.Key {
+			case "input":
+				input = f.Value
+			case "N":
+				alpha = 2 / (toFloat64(f.Value) + 1)
+			case "alpha":
+				alpha = toFloat64(f.Value)
+			}
+		}
+		// Non-numeric inputs are skipped and leave the average as it was.
+		var avg interface{}
+		for i, doc := range docs {
+			if v := evalExpr(doc, input); isNumeric(v) {
+				if avg == nil {
+					avg = toFloat64(v)
+				} else {
+					avg = alpha*toFloat64(v) + (1-alpha)*avg.(float64)
+				}
+			}
+			vals[i] = avg
+		}
+		return vals, nil
+	}
+
+	keys, err := o.sortKeys(docs, sortBy)
+	if err != nil {
+		return nil, err
+	}
+	for i := range docs {
+		from, to, err := o.windowRange(docs, keys, i)
+		if err != nil {
+			return nil, err
+		}
+		win := docs[from:to]
+		switch o.op {
+		case "$derivative", "$integral":
+			vals[i], err = o.calculus(win, keys[from:to])
+			if err != nil {
+				return nil, err
+			}
+		default:
+			v := computeAccumulator(win, o.op, o.arg)
+			if arr, ok := v.(bson.A); ok && arr == nil {
+				v = bson.A{}
+			}
+			vals[i] = v
+		}
+	}
+	return vals, nil
+}
+
+// sortKeys returns each document's sortBy value as a number, for range
+// windows, $derivative and $integral, which measure distances along it.
+// Other operators need no keys and get nil.
+func (o *windowOutput) sortKeys(docs []bson.D, sortBy bson.D) ([]float64, error) {
+	byRange := o.window != nil && o.window.byRange
+	if !byRange && o.op != "$derivative" && o.op != "$integral" {
+		return nil, nil
+	}
+	// $derivative and $integral take their unit from their arguments.
+	unit := ""
+	if byRange {
+		unit = o.window.unit
+	}
+	if arg, ok := o.arg.(bson.D); ok && !byRange {
+		for _, f := range arg {
+			if f.Key == "unit" {
+				unit, _ = f.Value.(string)
+			}
+		}
+	}
+	keys := make([]float64, len(docs))
+	for i, doc := range docs {
+		v, _ := GetField(doc, sortBy[0].Key)
+		key, isDate, ok := windowKey(v)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s: the sortBy field must be a number or a date, got %v", o.op, v)
+		case isDate && unit == "":
+			return nil, fmt.Errorf("%s: a date sortBy field requires a unit", o.op)
+		case !isDate && unit != "":
+			return nil, fmt.Errorf("%s: a unit requires a date sortBy field", o.op)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// windowRange returns the bounds [from, to) of document i's window in docs.
+func (o *windowOutput) windowRange(docs []bson.D, keys []float64, i int) (int, int, error) {
+	w := o.window
+	if w == nil {
+		return 0, len(docs), nil
+	}
+	if !w.byRange {
+		from := math.Max(0, float64(i)+w.lo)
+		to := math.Min(float64(len(docs)), float64(i)+w.hi+1)
+		if from >= to {
+			return 0, 0, nil
+		}
+		return int(from), int(to), nil
+	}
+	lo, hi := keys[i]+w.lo, keys[i]+w.hi
+	if w.unit != "" {
+		if !math.IsInf(w.lo, 0) {
+			lo = addUnits(keys[i], int64(w.lo), w.unit)
+		}
+		if !math.IsInf(w.hi, 0) {
+			hi = addUnits(keys[i], int64(w.hi), w.unit)
+		}
+	}
+	// The window is the run of documents whose keys are in [lo, hi], in
+	// either sort direction.
+	from, to := -1, 0
+	for j, k := range keys {
+		if k >= lo && k <= hi {
+			if from < 0 {
+				from = j
+			}
+			to = j + 1
+		}
+	}
+	if from < 0 {
+		return 0, 0, nil
+	}
+	return from, to, nil
+}
+
+// calculus computes $derivative or $integral of the input over a window
+// whose sortBy values are keys, per unit of the sortBy field.
+func (o *windowOutput) calculus(win []bson.D, keys []float64) (interface{}, error) {
+	var input interface{}
+	scale := 1.0
+	for _, f := range o.arg.(bson.D) {
+		switch f.Key {
+		case "input":
+			input = f.Value
+		case "unit":
+			scale = unitMillis[f.Value.(string)]
+		}
+	}
+	ys := make([]float64, len(win))
+	for i, doc := range win {
+		v := evalExpr(doc, input)
+		if !isNumeric(v) {
+			return nil, fmt.Errorf("%s: input must be numeric, got %v", o.op, v)
+		}
+		ys[i] = toFloat64(v)
+	}
+	if o.op == "$derivative" {
+		n := len(win)
+		if n < 2 || keys[n-1] == keys[0] {
+			return nil, nil
+		}
+		return (ys[n-1] - ys[0]) / ((keys[n-1] - keys[0]) / scale), nil
+	}
+	if len(win) == 0 {
+		return nil, nil
+	}
+	area := 0.0
+	for i := 1; i < len(win); i++ {
+		area += (ys[i] + ys[i-1]) / 2 * (keys[i] - keys[i-1]) / scale
+	}
+	return area, nil
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// testRuns returns runs of two tests: run number, duration and status.
+func testRuns() []bson.D {
+	run := func(test string, n, ms int32, status string) bson.D {
+		return bson.D{{Key: "test", Value: test}, {Key: "run", Value: n}, {Key: "ms", Value: ms}, {Key: "status", Value: status}}
+	}
+	return []bson.D{
+		run("login", 3, 30, "pass"),
+		run("search", 1, 200, "pass"),
+		run("login", 1, 10, "pass"),
+		run("login", 2, 20, "fail"),
+		run("search", 2, 100, "fail"),
+		run("login", 4, 20, "pass"),
+	}
+}
+
+// fieldValues returns the value of field in each document.
+func fieldValues(docs []bson.D, field string) []interface{} {
+	vals := make([]interface{}, len(docs))
+	for i, d := range docs {
+		vals[i], _ = GetField(d, field)
+	}
+	return vals
+}
+
+func setWindowFields(t *testing.T, docs []bson.D, spec bson.D) []bson.D {
+	t.Helper()
+	out, err := RunPipeline(docs, []bson.D{{{Key: "$setWindowFields", Value: spec}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// ---- $setWindowFields ----
+
+func TestSetWindowFields_PartitionsAndRanks(t *testing.T) {
+	out := setWindowFields(t, testRuns(), bson.D{
+		{Key: "partitionBy", Value: "$test"},
+		{Key: "sortBy", Value: bson.D{{Key: "ms", Value: int32(1)}}},
+		{Key: "output", Value: bson.D{
+			{Key: "rank", Value: bson.D{{Key: "$rank", Value: bson.D{}}}},
+			{Key: "dense", Value: bson.D{{Key: "$denseRank", Value: bson.D{}}}},
+			{Key: "n", Value: bson.D{{Key: "$documentNumber", Value: bson.D{}}}},
+			{Key: "fastest", Value: bson.D{{Key: "$min", Value: "$ms"}}},
+		}},
+	})
+	// Partitions come out in partitionBy order, each sorted by sortBy.
+	if got, want := fieldValues(out, "test"), []interface{}{"login", "login", "login", "login", "search", "search"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("test = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "ms"), []interface{}{int32(10), int32(20), int32(20), int32(30), int32(100), int32(200)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ms = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "rank"), []interface{}{int32(1), int32(2), int32(2), int32(4), int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rank = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "dense"), []interface{}{int32(1), int32(2), int32(2), int32(3), int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("denseRank = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "n"), []interface{}{int32(1), int32(2), int32(3), int32(4), int32(1), int32(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("documentNumber = %v, want %v", got, want)
+	}
+	// Without a window an accumulator covers the whole partition.
+	if got, want := fieldValues(out, "fastest"), []interface{}{int32(10), int32(10), int32(10), int32(10), int32(100), int32(100)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fastest = %v, want %v", got, want)
+	}
+}
+
+func TestSetWindowFields_DocumentWindows(t *testing.T) {
+	out := setWindowFields(t, testRuns(), bson.D{
+		{Key: "partitionBy", Value: "$test"},
+		{Key: "sortBy", Value: bson.D{{Key: "run", Value: int32(1)}}},
+		{Key: "output", Value: bson.D{
+			{Key: "total", Value: bson.D{
+				{Key: "$sum", Value: "$ms"},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "current"}}}},
+			}},
+			{Key: "avg2", Value: bson.D{
+				{Key: "$avg", Value: "$ms"},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{int32(-1), int32(0)}}}},
+			}},
+			{Key: "next", Value: bson.D{
+				{Key: "$push", Value: "$status"},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{int32(1), int32(1)}}}},
+			}},
+			{Key: "prevStatus", Value: bson.D{{Key: "$shift", Value: bson.D{
+				{Key: "output", Value: "$status"},
+				{Key: "by", Value: int32(-1)},
+				{Key: "default", Value: "none"},
+			}}}},
+		}},
+	})
+	if got, want := fieldValues(out, "total"), []interface{}{int64(10), int64(30), int64(60), int64(80), int64(200), int64(300)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("running total = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "avg2"), []interface{}{10.0, 15.0, 25.0, 25.0, 200.0, 150.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("moving average = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "next")[3], (bson.A{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("$push over an empty window = %#v, want []", got)
+	}
+	if got, want := fieldValues(out, "prevStatus"), []interface{}{"none", "pass", "fail", "pass", "none", "pass"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("previous status = %v, want %v", got, want)
+	}
+}
+
+func TestSetWindowFields_RangeWindows(t *testing.T) {
+	out := setWindowFields(t, testRuns(), bson.D{
+		{Key: "partitionBy", Value: "$test"},
+		{Key: "sortBy", Value: bson.D{{Key: "ms", Value: int32(1)}}},
+		{Key: "output", Value: bson.D{
+			// Runs within 10ms of this one, ties included.
+			{Key: "near", Value: bson.D{
+				{Key: "$count", Value: bson.D{}},
+				{Key: "window", Value: bson.D{{Key: "range", Value: bson.A{int32(-10), int32(10)}}}},
+			}},
+			{Key: "upTo", Value: bson.D{
+				{Key: "$count", Value: bson.D{}},
+				{Key: "window", Value: bson.D{{Key: "range", Value: bson.A{"unbounded", "current"}}}},
+			}},
+		}},
+	})
+	if got, want := fieldValues(out, "near"), []interface{}{int64(3), int64(4), int64(4), int64(3), int64(1), int64(1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("near = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "upTo"), []interface{}{int64(1), int64(3), int64(3), int64(4), int64(1), int64(2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upTo = %v, want %v", got, want)
+	}
+}
+
+func TestSetWindowFields_DateRangeAndCalculus(t *testing.T) {
+	day := func(d int) bson.DateTime {
+		return bson.NewDateTimeFromTime(time.Date(2025, 3, d, 0, 0, 0, 0, time.UTC))
+	}
+	// Cumulative test counts, one sample a day with a gap on the 3rd.
+	var docs []bson.D
+	for _, s := range []struct {
+		day, total int
+	}{{1, 100}, {2, 110}, {4, 150}, {5, 150}} {
+		docs = append(docs, bson.D{{Key: "at", Value: day(s.day)}, {Key: "total", Value: int32(s.total)}})
+	}
+	out := setWindowFields(t, docs, bson.D{
+		{Key: "sortBy", Value: bson.D{{Key: "at", Value: int32(1)}}},
+		{Key: "output", Value: bson.D{
+			{Key: "perDay", Value: bson.D{
+				{Key: "$derivative", Value: bson.D{{Key: "input", Value: "$total"}, {Key: "unit", Value: "day"}}},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{int32(-1), "current"}}}},
+			}},
+			{Key: "area", Value: bson.D{
+				{Key: "$integral", Value: bson.D{{Key: "input", Value: "$total"}, {Key: "unit", Value: "day"}}},
+				{Key: "window", Value: bson.D{{Key: "range", Value: bson.A{int32(-2), int32(0)}}, {Key: "unit", Value: "day"}}},
+			}},
+			{Key: "ema", Value: bson.D{{Key: "$expMovingAvg", Value: bson.D{{Key: "input", Value: "$total"}, {Key: "alpha", Value: 0.5}}}}},
+		}},
+	})
+	if got, want := fieldValues(out, "perDay"), []interface{}{nil, 10.0, 20.0, 0.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("$derivative = %v, want %v", got, want)
+	}
+	// The window of the 4th covers the 2nd and the 4th: (110+150)/2*2 days.
+	if got, want := fieldValues(out, "area"), []interface{}{0.0, 105.0, 260.0, 150.0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("$integral = %v, want %v", got, want)
+	}
+	if got, want := fieldValues(out, "ema"), []interface{}{100.0, 105.0, 127.5, 138.75}; !reflect.DeepEqual(got, want) {
+		t.Errorf("$expMovingAvg = %v, want %v", got, want)
+	}
+}
+
+func TestSetWindowFields_Errors(t *testing.T) {
+	sortByMS := bson.E{Key: "sortBy", Value: bson.D{{Key: "ms", Value: int32(1)}}}
+	output := func(spec bson.D) bson.E {
+		return bson.E{Key: "output", Value: bson.D{{Key: "x", Value: spec}}}
+	}
+	sumOver := func(window bson.D) bson.D {
+		return bson.D{{Key: "$sum", Value: "$ms"}, {Key: "window", Value: window}}
+	}
+	for name, spec := range map[string]bson.D{
+		"no output":           {sortByMS},
+		"unknown function":    {output(bson.D{{Key: "$median", Value: "$ms"}})},
+		"two functions":       {output(bson.D{{Key: "$sum", Value: "$ms"}, {Key: "$avg", Value: "$ms"}})},
+		"rank without sort":   {output(bson.D{{Key: "$rank", Value: bson.D{}}})},
+		"rank with window":    {sortByMS, output(bson.D{{Key: "$rank", Value: bson.D{}}, {Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{int32(0), int32(0)}}}}})},
+		"rank on two fields":  {{Key: "sortBy", Value: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}}}, output(bson.D{{Key: "$rank", Value: bson.D{}}})},
+		"shift without by":    {sortByMS, output(bson.D{{Key: "$shift", Value: bson.D{{Key: "output", Value: "$ms"}}}})},
+		"ema with N and a":    {sortByMS, output(bson.D{{Key: "$expMovingAvg", Value: bson.D{{Key: "input", Value: "$ms"}, {Key: "N", Value: int32(2)}, {Key: "alpha", Value: 0.5}}}})},
+		"derivative windowed": {sortByMS, output(bson.D{{Key: "$derivative", Value: bson.D{{Key: "input", Value: "$ms"}}}})},
+		"inverted bounds":     {sortByMS, output(sumOver(bson.D{{Key: "documents", Value: bson.A{int32(1), int32(-1)}}}))},
+		"fractional docs":     {sortByMS, output(sumOver(bson.D{{Key: "documents", Value: bson.A{-1.5, int32(0)}}}))},
+		"unit on documents":   {sortByMS, output(sumOver(bson.D{{Key: "documents", Value: bson.A{int32(-1), int32(0)}}, {Key: "unit", Value: "day"}}))},
+		"range without sort":  {output(sumOver(bson.D{{Key: "range", Value: bson.A{int32(-1), int32(0)}}}))},
+		"range on a string":   {{Key: "sortBy", Value: bson.D{{Key: "status", Value: int32(1)}}}, output(sumOver(bson.D{{Key: "range", Value: bson.A{int32(-1), int32(0)}}}))},
+		"unit on numbers":     {sortByMS, output(sumOver(bson.D{{Key: "range", Value: bson.A{int32(-1), int32(0)}}, {Key: "unit", Value: "day"}}))},
+	} {
+		if _, err := RunPipeline(testRuns(), []bson.D{{{Key: "$setWindowFields", Value: spec}}}, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
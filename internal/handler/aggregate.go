@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"github.com/wricardo/mongolite/internal/engine"
 	"github.com/wricardo/mongolite/internal/proto"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -10,11 +11,6 @@ func init() {
 }
 
 func cmdAggregate(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
-	collName, _ := cmd[0].Value.(string)
-	if collName == "" {
-		return errorResp(2, "BadValue", "aggregate requires a collection name"), nil
-	}
-
 	pipelineArr := getArrayField(cmd, "pipeline")
 	if pipelineArr == nil {
 		return errorResp(2, "BadValue", "aggregate requires pipeline array"), nil
@@ -26,24 +22,34 @@ func cmdAggregate(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D,
 			pipeline = append(pipeline, d)
 		}
 	}
+	if len(pipeline) > 0 && len(pipeline[0]) == 1 && pipeline[0][0].Key == "$changeStream" {
+		return aggregateChangeStream(h, db, cmd, pipeline)
+	}
+
+	collName, _ := cmd[0].Value.(string)
+	if collName == "" {
+		return errorResp(2, "BadValue", "aggregate requires a collection name"), nil
+	}
 
-	results, err := h.Engine.Aggregate(db, collName, pipeline)
+	collation, err := getCollationField(cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	batch := bson.A{}
-	for _, doc := range results {
-		batch = append(batch, doc)
+	// Drivers send aggregate explains as {aggregate: ..., explain: true}.
+	if getBoolField(cmd, "explain", false) {
+		x, err := h.Engine.ExplainAggregate(db, collName, pipeline, collation)
+		if err != nil {
+			return nil, err
+		}
+		return explainResp(x, engine.VerbosityQueryPlanner, cmd), nil
+	}
+
+	results, err := h.store().Aggregate(db, collName, pipeline, collation)
+	if err != nil {
+		return nil, err
 	}
 
 	ns := db + "." + collName
-	return bson.D{
-		{Key: "cursor", Value: bson.D{
-			{Key: "firstBatch", Value: batch},
-			{Key: "id", Value: int64(0)},
-			{Key: "ns", Value: ns},
-		}},
-		{Key: "ok", Value: float64(1)},
-	}, nil
+	return h.cursorResp(ns, results, cursorBatchSize(getDocField(cmd, "cursor")), false), nil
 }
@@ -33,12 +33,16 @@ func cmdBulkWrite(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D,
 		if !ok {
 			continue
 		}
+		collation, err := getCollationField(opVal)
+		if err != nil {
+			return nil, err
+		}
 
 		switch opName {
 		case "insertOne":
 			doc := getDocField(opVal, "document")
 			if doc != nil {
-				_, err := h.Engine.Insert(db, collName, []bson.D{doc})
+				_, err := h.store().Insert(db, collName, []bson.D{doc})
 				if err != nil {
 					return nil, err
 				}
@@ -46,32 +50,34 @@ func cmdBulkWrite(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D,
 			}
 		case "updateOne":
 			filter := getDocField(opVal, "filter")
-			update := getDocField(opVal, "update")
+			update := getUpdateField(opVal, "update")
 			upsert := getBoolField(opVal, "upsert", false)
-			_, modified, _, err := h.Engine.Update(db, collName, filter, update, false, upsert)
+			arrayFilters := getDocArrayField(opVal, "arrayFilters")
+			_, modified, _, err := h.store().Update(db, collName, filter, update, arrayFilters, false, upsert, collation)
 			if err != nil {
 				return nil, err
 			}
 			nModified += int32(modified)
 		case "updateMany":
 			filter := getDocField(opVal, "filter")
-			update := getDocField(opVal, "update")
+			update := getUpdateField(opVal, "update")
 			upsert := getBoolField(opVal, "upsert", false)
-			_, modified, _, err := h.Engine.Update(db, collName, filter, update, true, upsert)
+			arrayFilters := getDocArrayField(opVal, "arrayFilters")
+			_, modified, _, err := h.store().Update(db, collName, filter, update, arrayFilters, true, upsert, collation)
 			if err != nil {
 				return nil, err
 			}
 			nModified += int32(modified)
 		case "deleteOne":
 			filter := getDocField(opVal, "filter")
-			n, err := h.Engine.Delete(db, collName, filter, false)
+			n, err := h.store().Delete(db, collName, filter, false, collation)
 			if err != nil {
 				return nil, err
 			}
 			nRemoved += int32(n)
 		case "deleteMany":
 			filter := getDocField(opVal, "filter")
-			n, err := h.Engine.Delete(db, collName, filter, true)
+			n, err := h.store().Delete(db, collName, filter, true, collation)
 			if err != nil {
 				return nil, err
 			}
@@ -80,7 +86,7 @@ func cmdBulkWrite(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D,
 			filter := getDocField(opVal, "filter")
 			replacement := getDocField(opVal, "replacement")
 			upsert := getBoolField(opVal, "upsert", false)
-			_, modified, _, err := h.Engine.Update(db, collName, filter, replacement, false, upsert)
+			_, modified, _, err := h.store().Update(db, collName, filter, replacement, nil, false, upsert, collation)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wricardo/mongolite/internal/engine"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// defaultAwaitTime is how long a getMore on a change stream waits for events
+// when the client sends no maxTimeMS, as in MongoDB.
+const defaultAwaitTime = time.Second
+
+// changeStreamStages are the stages allowed after $changeStream.
+var changeStreamStages = map[string]bool{
+	"$match": true, "$project": true, "$addFields": true, "$set": true,
+	"$unset": true, "$replaceRoot": true, "$replaceWith": true,
+}
+
+// changeStream is the state of an open $changeStream cursor. getMore holds
+// mu while it waits for events.
+type changeStream struct {
+	mu           sync.Mutex
+	stream       *engine.ChangeStream
+	pipeline     []bson.D // stages after $changeStream, run on each event
+	updateLookup bool
+	pending      []bson.D // events not yet returned
+	tokens       []string // resume token of each pending event
+}
+
+// aggregateChangeStream opens a change stream for an aggregate command whose
+// pipeline starts with $changeStream. The stream covers the collection
+// named by the command, or with {aggregate: 1} the database, or with
+// allChangesForCluster on admin every database.
+func aggregateChangeStream(h *Handler, db string, cmd bson.D, pipeline []bson.D) (bson.D, error) {
+	if h.txn != nil {
+		return errorResp(263, "OperationNotSupportedInTransaction",
+			"$changeStream is not allowed within a multi-document transaction"), nil
+	}
+	opts, ok := pipeline[0][0].Value.(bson.D)
+	if !ok {
+		return errorResp(2, "BadValue", "the $changeStream stage specification must be an object"), nil
+	}
+
+	coll, _ := cmd[0].Value.(string)
+	ns := db + "." + coll
+	watchDB := db
+	if coll == "" {
+		if getInt64Field(cmd, cmd[0].Key) != 1 {
+			return errorResp(2, "BadValue", "aggregate requires a collection name or 1"), nil
+		}
+		ns = db + ".$cmd.aggregate"
+		if getBoolField(opts, "allChangesForCluster", false) {
+			if db != "admin" {
+				return errorResp(2, "BadValue", "$changeStream may only be opened on all databases from the admin database"), nil
+			}
+			watchDB = ""
+		}
+	}
+
+	updateLookup := false
+	switch getStringField(opts, "fullDocument") {
+	case "", "default":
+	case "updateLookup", "whenAvailable", "required":
+		updateLookup = true
+	default:
+		return errorResp(2, "BadValue", "unsupported fullDocument option: "+getStringField(opts, "fullDocument")), nil
+	}
+	token := getStringField(getDocField(opts, "resumeAfter"), "_data")
+	if t := getStringField(getDocField(opts, "startAfter"), "_data"); t != "" {
+		token = t
+	}
+	for _, stage := range pipeline[1:] {
+		if len(stage) != 1 || !changeStreamStages[stage[0].Key] {
+			return errorResp(2, "BadValue", fmt.Sprintf("%s is not permitted in a $changeStream pipeline", stage[0].Key)), nil
+		}
+	}
+
+	stream, err := h.Engine.Watch(watchDB, coll, token)
+	if errors.Is(err, engine.ErrChangeHistoryLost) {
+		return errorResp(286, "ChangeStreamHistoryLost", err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cs := &changeStream{stream: stream, pipeline: pipeline[1:], updateLookup: updateLookup}
+	id := h.cursors.openLive(ns, cs)
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: bson.A{}},
+			{Key: "postBatchResumeToken", Value: resumeTokenDoc(stream.ResumeToken())},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
+
+func resumeTokenDoc(token string) bson.D {
+	return bson.D{{Key: "_data", Value: token}}
+}
+
+// next returns up to batchSize events (0 means no limit), waiting up to wait
+// for one, along with the token to resume after them and whether the
+// stream has ended.
+func (cs *changeStream) next(wait time.Duration, batchSize int) (bson.A, string, bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.pending) == 0 {
+		events, err := cs.stream.Next(wait)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, ev := range events {
+			docs, err := engine.RunPipeline([]bson.D{ev.Doc(cs.updateLookup)}, cs.pipeline, nil)
+			if err != nil {
+				return nil, "", false, err
+			}
+			for _, doc := range docs {
+				cs.pending = append(cs.pending, doc)
+				cs.tokens = append(cs.tokens, ev.Token)
+			}
+		}
+	}
+	batch, rest := takeBatch(cs.pending, batchSize)
+	token := cs.stream.ResumeToken()
+	if len(rest) > 0 {
+		token = cs.tokens[len(batch)-1]
+	}
+	cs.pending, cs.tokens = rest, cs.tokens[len(batch):]
+	return batch, token, len(rest) == 0 && cs.stream.Invalidated(), nil
+}
+
+func (cs *changeStream) close() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.stream.Close()
+}
+
+// getMore answers a getMore on a change stream cursor.
+func (cs *changeStream) getMore(h *Handler, id int64, ns string, cmd bson.D) (bson.D, error) {
+	wait := defaultAwaitTime
+	if ms := getInt64Field(cmd, "maxTimeMS"); ms > 0 {
+		wait = time.Duration(ms) * time.Millisecond
+	}
+	batch, token, ended, err := cs.next(wait, int(getInt64Field(cmd, "batchSize")))
+	if errors.Is(err, engine.ErrChangeHistoryLost) {
+		h.cursors.kill(id)
+		return errorResp(286, "ChangeStreamHistoryLost", err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ended {
+		h.cursors.kill(id)
+		id = 0
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: batch},
+			{Key: "postBatchResumeToken", Value: resumeTokenDoc(token)},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
@@ -1,6 +1,9 @@
 package handler
 
 import (
+	"sort"
+
+	"github.com/wricardo/mongolite/internal/engine"
 	"github.com/wricardo/mongolite/internal/proto"
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -12,32 +15,53 @@ func init() {
 	Register("drop", cmdDrop)
 }
 
-func cmdListCollections(h *Handler, db string, _ bson.D, _ []proto.Section) (bson.D, error) {
+func cmdListCollections(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
 	names := h.Engine.ListCollections(db)
 
-	var colls bson.A
+	var colls []bson.D
 	for _, name := range names {
+		options := bson.D{}
+		if capped := h.Engine.Capped(db, name); capped != nil {
+			options = append(options, bson.E{Key: "capped", Value: true}, bson.E{Key: "size", Value: capped.Size})
+			if capped.Max > 0 {
+				options = append(options, bson.E{Key: "max", Value: capped.Max})
+			}
+		}
 		colls = append(colls, bson.D{
 			{Key: "name", Value: name},
 			{Key: "type", Value: "collection"},
-			{Key: "options", Value: bson.D{}},
+			{Key: "options", Value: options},
 			{Key: "info", Value: bson.D{
 				{Key: "readOnly", Value: false},
 			}},
 		})
 	}
-	if colls == nil {
-		colls = bson.A{}
+
+	views := h.Engine.Views(db)
+	viewNames := make([]string, 0, len(views))
+	for name := range views {
+		viewNames = append(viewNames, name)
+	}
+	sort.Strings(viewNames)
+	for _, name := range viewNames {
+		pipeline := bson.A{}
+		for _, stage := range views[name].Pipeline {
+			pipeline = append(pipeline, stage)
+		}
+		colls = append(colls, bson.D{
+			{Key: "name", Value: name},
+			{Key: "type", Value: "view"},
+			{Key: "options", Value: bson.D{
+				{Key: "viewOn", Value: views[name].ViewOn},
+				{Key: "pipeline", Value: pipeline},
+			}},
+			{Key: "info", Value: bson.D{
+				{Key: "readOnly", Value: true},
+			}},
+		})
 	}
 
-	return bson.D{
-		{Key: "cursor", Value: bson.D{
-			{Key: "firstBatch", Value: colls},
-			{Key: "id", Value: int64(0)},
-			{Key: "ns", Value: db + ".$cmd.listCollections"},
-		}},
-		{Key: "ok", Value: float64(1)},
-	}, nil
+	return h.cursorResp(db+".$cmd.listCollections", colls, cursorBatchSize(getDocField(cmd, "cursor")), false), nil
 }
 
 func cmdCreateCollection(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
@@ -46,12 +70,51 @@ func cmdCreateCollection(h *Handler, db string, cmd bson.D, _ []proto.Section) (
 		return errorResp(2, "BadValue", "create requires a collection name"), nil
 	}
 
+	if viewOn, ok := lookupField(cmd, "viewOn"); ok {
+		return createView(h, db, collName, viewOn, cmd)
+	}
+	if getBoolField(cmd, "capped", false) {
+		opts := engine.CappedOptions{Size: getInt64Field(cmd, "size"), Max: getInt64Field(cmd, "max")}
+		if err := h.Engine.CreateCappedCollection(db, collName, opts); err != nil {
+			return nil, err
+		}
+		return okResp(), nil
+	}
 	if err := h.Engine.CreateCollection(db, collName); err != nil {
 		return nil, err
 	}
 	return okResp(), nil
 }
 
+// createView answers a create command with viewOn.
+func createView(h *Handler, db, name string, viewOn interface{}, cmd bson.D) (bson.D, error) {
+	source, ok := viewOn.(string)
+	if !ok {
+		return errorResp(14, "TypeMismatch", "'viewOn' must be a string"), nil
+	}
+	if getBoolField(cmd, "capped", false) {
+		return errorResp(72, "InvalidOptions", "A view cannot be capped"), nil
+	}
+	var pipeline []bson.D
+	if v, ok := lookupField(cmd, "pipeline"); ok {
+		stages, ok := v.(bson.A)
+		if !ok {
+			return errorResp(14, "TypeMismatch", "'pipeline' must be an array"), nil
+		}
+		for _, stage := range stages {
+			d, ok := stage.(bson.D)
+			if !ok {
+				return errorResp(14, "TypeMismatch", "'pipeline' must be an array of objects"), nil
+			}
+			pipeline = append(pipeline, d)
+		}
+	}
+	if err := h.Engine.CreateView(db, name, source, pipeline); err != nil {
+		return nil, err
+	}
+	return okResp(), nil
+}
+
 func cmdDrop(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
 	collName, _ := cmd[0].Value.(string)
 	if collName == "" {
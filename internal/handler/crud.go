@@ -16,8 +16,6 @@ func init() {
 	Register("findAndModify", cmdFindAndModify)
 	Register("findandmodify", cmdFindAndModify)
 	Register("count", cmdCount)
-	Register("getMore", cmdGetMore)
-	Register("getmore", cmdGetMore)
 	Register("distinct", cmdDistinct)
 }
 
@@ -55,7 +53,7 @@ func cmdInsert(h *Handler, db string, cmd bson.D, sections []proto.Section) (bso
 		return errorResp(2, "BadValue", "no documents to insert"), nil
 	}
 
-	ids, err := h.Engine.Insert(db, collName, docs)
+	ids, err := h.store().Insert(db, collName, docs)
 	if err != nil {
 		return nil, err
 	}
@@ -71,26 +69,24 @@ func cmdFind(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, erro
 	if collName == "" {
 		return errorResp(2, "BadValue", "find requires a collection name"), nil
 	}
+	if getBoolField(cmd, "awaitData", false) && !getBoolField(cmd, "tailable", false) {
+		return errorResp(9, "FailedToParse", "Cannot set 'awaitData' without also setting 'tailable'"), nil
+	}
+	if getBoolField(cmd, "tailable", false) {
+		return findTailable(h, db, collName, cmd)
+	}
 
 	filter := getDocField(cmd, "filter")
 	sort := getDocField(cmd, "sort")
 	projection := getDocField(cmd, "projection")
 	skip := getInt64Field(cmd, "skip")
 	limit := getInt64Field(cmd, "limit")
-
-	// Handle batchSize as limit if limit is 0
-	if limit == 0 {
-		if bs := getInt64Field(cmd, "batchSize"); bs > 0 {
-			limit = bs
-		}
-	}
-
-	// Handle singleBatch
-	if getBoolField(cmd, "singleBatch", false) && limit == 0 {
-		limit = 1
+	collation, err := getCollationField(cmd)
+	if err != nil {
+		return nil, err
 	}
 
-	results, err := h.Engine.Find(db, collName, filter, sort, skip, limit)
+	results, err := h.store().Find(db, collName, filter, sort, skip, limit, collation)
 	if err != nil {
 		return nil, err
 	}
@@ -103,21 +99,8 @@ func cmdFind(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, erro
 		}
 	}
 
-	// Convert to bson.A
-	batch := bson.A{}
-	for _, doc := range results {
-		batch = append(batch, doc)
-	}
-
 	ns := db + "." + collName
-	return bson.D{
-		{Key: "cursor", Value: bson.D{
-			{Key: "firstBatch", Value: batch},
-			{Key: "id", Value: int64(0)},
-			{Key: "ns", Value: ns},
-		}},
-		{Key: "ok", Value: float64(1)},
-	}, nil
+	return h.cursorResp(ns, results, cursorBatchSize(cmd), getBoolField(cmd, "singleBatch", false)), nil
 }
 
 func cmdDistinct(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
@@ -131,8 +114,12 @@ func cmdDistinct(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D,
 		return errorResp(2, "BadValue", "distinct requires a key field"), nil
 	}
 	filter := getDocField(cmd, "query")
+	collation, err := getCollationField(cmd)
+	if err != nil {
+		return nil, err
+	}
 
-	values, err := h.Engine.Distinct(db, collName, field, filter)
+	values, err := h.store().Distinct(db, collName, field, filter, collation)
 	if err != nil {
 		return nil, err
 	}
@@ -181,14 +168,19 @@ func cmdUpdate(h *Handler, db string, cmd bson.D, sections []proto.Section) (bso
 			continue
 		}
 		q := getDocField(spec, "q")
-		upd := getDocField(spec, "u")
+		upd := getUpdateField(spec, "u")
 		multi := getBoolField(spec, "multi", false)
 		upsert := getBoolField(spec, "upsert", false)
+		arrayFilters := getDocArrayField(spec, "arrayFilters")
+		collation, err := getCollationField(spec)
+		if err != nil {
+			return nil, err
+		}
 
-		matched, modified, upsertedID, err := h.Engine.Update(db, collName, q, upd, multi, upsert)
+		matched, modified, upsertedID, err := h.store().Update(db, collName, q, upd, arrayFilters, multi, upsert, collation)
 		if err != nil {
 			if dke, ok := err.(*engine.DuplicateKeyError); ok {
-				return errorResp(11000, "DuplicateKey", dke.Error()), nil
+				return duplicateKeyResp(dke), nil
 			}
 			return nil, err
 		}
@@ -246,8 +238,12 @@ func cmdDelete(h *Handler, db string, cmd bson.D, sections []proto.Section) (bso
 		q := getDocField(spec, "q")
 		limitVal := getInt64Field(spec, "limit")
 		multi := limitVal == 0 // limit=0 means delete all matching
+		collation, err := getCollationField(spec)
+		if err != nil {
+			return nil, err
+		}
 
-		n, err := h.Engine.Delete(db, collName, q, multi)
+		n, err := h.store().Delete(db, collName, q, multi, collation)
 		if err != nil {
 			return nil, err
 		}
@@ -268,12 +264,17 @@ func cmdFindAndModify(h *Handler, db string, cmd bson.D, _ []proto.Section) (bso
 
 	query := getDocField(cmd, "query")
 	sort := getDocField(cmd, "sort")
-	update := getDocField(cmd, "update")
+	update := getUpdateField(cmd, "update")
 	remove := getBoolField(cmd, "remove", false)
 	returnNew := getBoolField(cmd, "new", false)
 	upsert := getBoolField(cmd, "upsert", false)
+	arrayFilters := getDocArrayField(cmd, "arrayFilters")
+	collation, err := getCollationField(cmd)
+	if err != nil {
+		return nil, err
+	}
 
-	result, err := h.Engine.FindAndModify(db, collName, query, sort, update, remove, returnNew, upsert)
+	result, err := h.store().FindAndModify(db, collName, query, sort, update, arrayFilters, remove, returnNew, upsert, collation)
 	if err != nil {
 		return nil, err
 	}
@@ -303,8 +304,12 @@ func cmdCount(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, err
 	if filter == nil {
 		filter = getDocField(cmd, "filter")
 	}
+	collation, err := getCollationField(cmd)
+	if err != nil {
+		return nil, err
+	}
 
-	n, err := h.Engine.Count(db, collName, filter)
+	n, err := h.store().Count(db, collName, filter, collation)
 	if err != nil {
 		return nil, err
 	}
@@ -314,17 +319,3 @@ func cmdCount(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, err
 		{Key: "ok", Value: float64(1)},
 	}, nil
 }
-
-func cmdGetMore(_ *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
-	// We always return cursor ID 0 (all results in firstBatch), so getMore is a no-op.
-	collName := getStringField(cmd, "collection")
-	ns := db + "." + collName
-	return bson.D{
-		{Key: "cursor", Value: bson.D{
-			{Key: "nextBatch", Value: bson.A{}},
-			{Key: "id", Value: int64(0)},
-			{Key: "ns", Value: ns},
-		}},
-		{Key: "ok", Value: float64(1)},
-	}, nil
-}
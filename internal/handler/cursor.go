@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/wricardo/mongolite/internal/proto"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func init() {
+	Register("getMore", cmdGetMore)
+	Register("getmore", cmdGetMore)
+	Register("killCursors", cmdKillCursors)
+	Register("killcursors", cmdKillCursors)
+}
+
+const (
+	// defaultFirstBatch is the number of documents in a first batch when the
+	// client does not set batchSize, as in MongoDB.
+	defaultFirstBatch = 101
+	// maxBatchBytes caps the BSON size of a single batch so replies stay
+	// under the 48MB wire message limit.
+	maxBatchBytes = 16 * 1024 * 1024
+	// defaultCursorTimeout is how long an idle cursor is kept before it is
+	// discarded, matching MongoDB's cursorTimeoutMillis default.
+	defaultCursorTimeout = 10 * time.Minute
+)
+
+// cursor holds the results of a find, aggregate, listCollections or
+// listIndexes command that did not fit in the first batch, or an open
+// change stream or tailable cursor.
+type cursor struct {
+	ns       string
+	docs     []bson.D
+	live     liveCursor
+	lastUsed time.Time
+}
+
+// liveCursor is a cursor whose results are produced as getMore asks for
+// them: a change stream or a tailable cursor on a capped collection.
+type liveCursor interface {
+	getMore(h *Handler, id int64, ns string, cmd bson.D) (bson.D, error)
+	// close releases the cursor once no getMore is using it.
+	close()
+}
+
+// cursorRegistry holds the open cursors of a server. Idle cursors are
+// discarded on the next registry access once the timeout has passed.
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[int64]*cursor
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func newCursorRegistry() *cursorRegistry {
+	return &cursorRegistry{
+		cursors: make(map[int64]*cursor),
+		timeout: defaultCursorTimeout,
+		now:     time.Now,
+	}
+}
+
+// expireLocked drops cursors idle for longer than the timeout. Callers must
+// hold r.mu.
+func (r *cursorRegistry) expireLocked(now time.Time) {
+	for id, c := range r.cursors {
+		if now.Sub(c.lastUsed) > r.timeout {
+			delete(r.cursors, id)
+			if c.live != nil {
+				// Closing waits for a getMore in progress; don't hold r.mu.
+				go c.live.close()
+			}
+		}
+	}
+}
+
+// open registers docs as a cursor on ns and returns its id.
+func (r *cursorRegistry) open(ns string, docs []bson.D) int64 {
+	return r.add(&cursor{ns: ns, docs: docs})
+}
+
+// openLive registers a live cursor on ns and returns its id.
+func (r *cursorRegistry) openLive(ns string, lc liveCursor) int64 {
+	return r.add(&cursor{ns: ns, live: lc})
+}
+
+func (r *cursorRegistry) add(c *cursor) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expireLocked(now)
+	c.lastUsed = now
+	for {
+		id := rand.Int64N(math.MaxInt64-1) + 1
+		if _, taken := r.cursors[id]; !taken {
+			r.cursors[id] = c
+			return id
+		}
+	}
+}
+
+// live returns live cursor id on ns, or nil if there is no such live
+// cursor.
+func (r *cursorRegistry) live(id int64, ns string) liveCursor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expireLocked(now)
+	c, ok := r.cursors[id]
+	if !ok || c.ns != ns || c.live == nil {
+		return nil
+	}
+	c.lastUsed = now
+	return c.live
+}
+
+// next returns the next batch of up to batchSize documents (0 means no
+// limit) from cursor id on ns and whether the cursor is now exhausted.
+// It returns found=false for unknown or expired cursors and nsOK=false when
+// the cursor belongs to another namespace.
+func (r *cursorRegistry) next(id int64, ns string, batchSize int) (batch bson.A, exhausted, found, nsOK bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expireLocked(now)
+	c, ok := r.cursors[id]
+	if !ok {
+		return nil, false, false, false
+	}
+	if c.ns != ns {
+		return nil, false, true, false
+	}
+	batch, c.docs = takeBatch(c.docs, batchSize)
+	c.lastUsed = now
+	if len(c.docs) == 0 {
+		delete(r.cursors, id)
+		return batch, true, true, true
+	}
+	return batch, false, true, true
+}
+
+// kill removes cursor id and reports whether it existed.
+func (r *cursorRegistry) kill(id int64) bool {
+	r.mu.Lock()
+	r.expireLocked(r.now())
+	c, ok := r.cursors[id]
+	delete(r.cursors, id)
+	r.mu.Unlock()
+	if ok && c.live != nil {
+		c.live.close()
+	}
+	return ok
+}
+
+// takeBatch splits off up to batchSize documents (0 means no limit),
+// stopping early once the batch reaches maxBatchBytes. At least one document
+// is always taken when any remain.
+func takeBatch(docs []bson.D, batchSize int) (bson.A, []bson.D) {
+	batch := bson.A{}
+	size := 0
+	for len(docs) > 0 {
+		if batchSize > 0 && len(batch) == batchSize {
+			break
+		}
+		if raw, err := bson.Marshal(docs[0]); err == nil {
+			size += len(raw)
+		}
+		if len(batch) > 0 && size > maxBatchBytes {
+			break
+		}
+		batch = append(batch, docs[0])
+		docs = docs[1:]
+	}
+	return batch, docs
+}
+
+// cursorResp returns the first batch of results and registers a cursor for
+// the rest. batchSize < 0 means the client did not set one; 0 asks for an
+// empty first batch. singleBatch closes the cursor after the first batch.
+func (h *Handler) cursorResp(ns string, docs []bson.D, batchSize int64, singleBatch bool) bson.D {
+	var batch bson.A
+	switch {
+	case batchSize == 0:
+		batch = bson.A{}
+	case batchSize < 0:
+		batch, docs = takeBatch(docs, defaultFirstBatch)
+	default:
+		batch, docs = takeBatch(docs, int(batchSize))
+	}
+	var id int64
+	if len(docs) > 0 && !singleBatch {
+		id = h.cursors.open(ns, docs)
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}
+}
+
+// cursorBatchSize returns the batchSize field of doc, or -1 if it is unset.
+func cursorBatchSize(doc bson.D) int64 {
+	for _, e := range doc {
+		if e.Key == "batchSize" {
+			return getInt64Field(doc, "batchSize")
+		}
+	}
+	return -1
+}
+
+func cmdGetMore(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	id := getInt64Field(cmd, "getMore")
+	if id == 0 {
+		return errorResp(2, "BadValue", "getMore requires a cursor id"), nil
+	}
+	collName := getStringField(cmd, "collection")
+	ns := db + "." + collName
+
+	if lc := h.cursors.live(id, ns); lc != nil {
+		return lc.getMore(h, id, ns, cmd)
+	}
+
+	batch, exhausted, found, nsOK := h.cursors.next(id, ns, int(getInt64Field(cmd, "batchSize")))
+	if !found {
+		return errorResp(43, "CursorNotFound", fmt.Sprintf("cursor id %d not found", id)), nil
+	}
+	if !nsOK {
+		return errorResp(13, "Unauthorized", "Requested getMore on namespace '"+ns+"', but cursor belongs to a different namespace"), nil
+	}
+	if exhausted {
+		id = 0
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
+
+func cmdKillCursors(h *Handler, _ string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	killed, notFound := bson.A{}, bson.A{}
+	for _, v := range getArrayField(cmd, "cursors") {
+		id := getInt64Field(bson.D{{Key: "id", Value: v}}, "id")
+		if h.cursors.kill(id) {
+			killed = append(killed, id)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+	return bson.D{
+		{Key: "cursorsKilled", Value: killed},
+		{Key: "cursorsNotFound", Value: notFound},
+		{Key: "cursorsAlive", Value: bson.A{}},
+		{Key: "cursorsUnknown", Value: bson.A{}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/wricardo/mongolite/internal/engine"
+	"github.com/wricardo/mongolite/internal/proto"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func init() {
+	Register("explain", cmdExplain)
+}
+
+// cmdExplain explains a find, aggregate, count, update or delete command
+// without modifying any data.
+func cmdExplain(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	inner := getDocField(cmd, "explain")
+	if len(inner) == 0 {
+		return errorResp(2, "BadValue", "explain requires a command document"), nil
+	}
+	verbosity := getStringField(cmd, "verbosity")
+	switch verbosity {
+	case "", engine.VerbosityQueryPlanner, engine.VerbosityExecutionStats, engine.VerbosityAllPlansExecution:
+	default:
+		return errorResp(2, "BadValue", "verbosity string must be one of {'queryPlanner', 'executionStats', 'allPlansExecution'}"), nil
+	}
+
+	collName, _ := inner[0].Value.(string)
+	if collName == "" {
+		return errorResp(2, "BadValue", "explain requires a collection name"), nil
+	}
+
+	collation, err := getCollationField(inner)
+	if err != nil {
+		return nil, err
+	}
+	var x *engine.Explain
+	switch name := strings.ToLower(inner[0].Key); name {
+	case "find":
+		x, err = h.Engine.ExplainFind(db, collName, getDocField(inner, "filter"), getDocField(inner, "sort"),
+			getInt64Field(inner, "skip"), getInt64Field(inner, "limit"), collation)
+	case "count":
+		filter := getDocField(inner, "query")
+		if filter == nil {
+			filter = getDocField(inner, "filter")
+		}
+		x, err = h.Engine.ExplainCount(db, collName, filter, collation)
+	case "aggregate":
+		var pipeline []bson.D
+		for _, item := range getArrayField(inner, "pipeline") {
+			if d, ok := item.(bson.D); ok {
+				pipeline = append(pipeline, d)
+			}
+		}
+		x, err = h.Engine.ExplainAggregate(db, collName, pipeline, collation)
+	case "update", "delete":
+		field := name + "s"
+		specs := getArrayField(inner, field)
+		if len(specs) != 1 {
+			return errorResp(2, "BadValue", "explain of "+name+" requires exactly one statement in '"+field+"'"), nil
+		}
+		spec, _ := specs[0].(bson.D)
+		if collation, err = getCollationField(spec); err != nil {
+			return nil, err
+		}
+		if name == "update" {
+			x, err = h.Engine.ExplainUpdate(db, collName, getDocField(spec, "q"), getBoolField(spec, "multi", false), collation)
+		} else {
+			x, err = h.Engine.ExplainDelete(db, collName, getDocField(spec, "q"), getInt64Field(spec, "limit") == 0, collation)
+		}
+	default:
+		return errorResp(2, "BadValue", "explain is not supported for command '"+inner[0].Key+"'"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return explainResp(x, verbosity, inner), nil
+}
+
+func explainResp(x *engine.Explain, verbosity string, command bson.D) bson.D {
+	resp := x.Doc(verbosity)
+	resp = append(resp,
+		bson.E{Key: "command", Value: command},
+		bson.E{Key: "ok", Value: float64(1)},
+	)
+	return resp
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -11,6 +12,13 @@ import (
 
 type Handler struct {
 	Engine *engine.Engine
+
+	cursors  *cursorRegistry
+	sessions *sessionRegistry
+
+	// Set on the per-command copy made for commands inside a transaction.
+	sess *session
+	txn  *engine.Txn
 }
 
 type CommandFunc func(h *Handler, db string, cmd bson.D, sections []proto.Section) (bson.D, error)
@@ -22,7 +30,7 @@ func Register(name string, fn CommandFunc) {
 }
 
 func New(e *engine.Engine) *Handler {
-	return &Handler{Engine: e}
+	return &Handler{Engine: e, cursors: newCursorRegistry(), sessions: newSessionRegistry()}
 }
 
 // Handle dispatches a command from an OP_MSG body.
@@ -54,11 +62,34 @@ func (h *Handler) Handle(body bson.Raw, extraSections []proto.Section) (bson.D,
 		return errorResp(59, "CommandNotFound", fmt.Sprintf("no such command: '%s'", cmdName)), nil
 	}
 
+	h, errResp := h.bind(cmdName, cmd)
+	if errResp != nil {
+		return errResp, nil
+	}
+
 	resp, err := fn(h, db, cmd, extraSections)
 	if err != nil {
 		// Check for duplicate key error
 		if dke, ok := err.(*engine.DuplicateKeyError); ok {
-			return errorResp(11000, "DuplicateKey", dke.Error()), nil
+			return duplicateKeyResp(dke), nil
+		}
+		// A command MongoDB would refuse, with the code it uses.
+		var ce *engine.CommandError
+		if errors.As(err, &ce) {
+			return errorResp(ce.Code, ce.Name, ce.Msg), nil
+		}
+		// An update tried to create a field inside a non-document.
+		var pe *engine.PathError
+		if errors.As(err, &pe) {
+			return errorResp(28, "PathNotViable", pe.Error()), nil
+		}
+		// A transaction used a collection another writer has since changed.
+		if errors.Is(err, engine.ErrWriteConflict) {
+			return withLabels(errorResp(112, "WriteConflict", err.Error()), transientTxnLabel), nil
+		}
+		// An earlier failed write aborted the transaction.
+		if errors.Is(err, engine.ErrTxnDone) {
+			return noSuchTxnResp(getInt64Field(cmd, "txnNumber")), nil
 		}
 		return errorResp(2, "BadValue", err.Error()), nil
 	}
@@ -74,10 +105,31 @@ func errorResp(code int32, codeName, msg string) bson.D {
 	}
 }
 
+// duplicateKeyResp is the error response for a unique index violation. Like
+// MongoDB it carries the index's key pattern and the duplicated value.
+func duplicateKeyResp(dke *engine.DuplicateKeyError) bson.D {
+	resp := errorResp(11000, "DuplicateKey", dke.Error())
+	if dke.KeyPattern != nil {
+		resp = append(resp, bson.E{Key: "keyPattern", Value: dke.KeyPattern}, bson.E{Key: "keyValue", Value: dke.KeyValue})
+	}
+	return resp
+}
+
 func okResp() bson.D {
 	return bson.D{{Key: "ok", Value: float64(1)}}
 }
 
+// lookupField returns the value of a field of any type, and whether it is
+// present.
+func lookupField(cmd bson.D, key string) (interface{}, bool) {
+	for _, e := range cmd {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
 // getDocField extracts a typed field from a bson.D command.
 func getStringField(cmd bson.D, key string) string {
 	for _, e := range cmd {
@@ -112,6 +164,50 @@ func getArrayField(cmd bson.D, key string) bson.A {
 	return nil
 }
 
+// getDocArrayField returns the documents of an array field, such as
+// arrayFilters. Elements that are not documents are skipped.
+func getDocArrayField(cmd bson.D, key string) []bson.D {
+	var docs []bson.D
+	for _, v := range getArrayField(cmd, key) {
+		if d, ok := v.(bson.D); ok {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
+
+// getUpdateField returns an update field as the engine takes it: an update
+// document, or the stages of a pipeline-style update. It returns nil when
+// the field is missing or has another type.
+func getUpdateField(cmd bson.D, key string) interface{} {
+	for _, e := range cmd {
+		if e.Key == key {
+			switch v := e.Value.(type) {
+			case bson.D:
+				return v
+			case bson.A:
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// getCollationField parses the collation of a command or of one of its
+// statements. It returns nil, which compares strings by their bytes, when
+// the field is missing.
+func getCollationField(cmd bson.D) (*engine.Collation, error) {
+	v, ok := lookupField(cmd, "collation")
+	if !ok {
+		return nil, nil
+	}
+	spec, ok := v.(bson.D)
+	if !ok {
+		return nil, errors.New("collation must be an object")
+	}
+	return engine.ParseCollation(spec)
+}
+
 func getInt64Field(cmd bson.D, key string) int64 {
 	for _, e := range cmd {
 		if e.Key == key {
@@ -3,6 +3,7 @@ package handler
 import (
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/wricardo/mongolite/internal/engine"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -158,6 +159,37 @@ func TestCmdFind_WithFilter(t *testing.T) {
 	}
 }
 
+func TestCmdFind_SortMixedTypes(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col",
+		bson.D{{Key: "_id", Value: "date"}, {Key: "v", Value: bson.DateTime(0)}},
+		bson.D{{Key: "_id", Value: "string"}, {Key: "v", Value: "a"}},
+		bson.D{{Key: "_id", Value: "missing"}},
+		bson.D{{Key: "_id", Value: "object"}, {Key: "v", Value: bson.D{{Key: "x", Value: int32(1)}}}},
+		bson.D{{Key: "_id", Value: "number"}, {Key: "v", Value: 2.5}},
+		bson.D{{Key: "_id", Value: "bool"}, {Key: "v", Value: false}},
+	)
+	resp, err := cmdFind(h, "db", bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "sort", Value: bson.D{{Key: "v", Value: int32(1)}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	want := []string{"missing", "number", "string", "object", "bool", "date"}
+	if len(batch) != len(want) {
+		t.Fatalf("firstBatch = %v, want %d documents", batch, len(want))
+	}
+	for i, d := range batch {
+		if id := getField(d.(bson.D), "_id"); id != want[i] {
+			t.Errorf("document %d = %v, want %s", i, id, want[i])
+		}
+	}
+}
+
 func TestCmdFind_Projection(t *testing.T) {
 	h := newHandler(t)
 	seed(t, h, "db", "col", bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(2)}})
@@ -204,7 +236,7 @@ func TestCmdFind_SkipAndLimit(t *testing.T) {
 	}
 }
 
-func TestCmdFind_BatchSizeUsedWhenLimitZero(t *testing.T) {
+func TestCmdFind_BatchSizeDoesNotLimit(t *testing.T) {
 	h := newHandler(t)
 	for i := range 5 {
 		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
@@ -222,6 +254,55 @@ func TestCmdFind_BatchSizeUsedWhenLimitZero(t *testing.T) {
 	if len(batch) != 2 {
 		t.Fatalf("batchSize not applied: expected 2 docs, got %d", len(batch))
 	}
+	id, _ := getField(cursor, "id").(int64)
+	if id == 0 {
+		t.Fatal("expected an open cursor for the remaining docs")
+	}
+	if got := drainCursor(t, h, "db", "col", id, 2); got != 3 {
+		t.Errorf("expected 3 more docs from getMore, got %d", got)
+	}
+}
+
+func TestCmdFind_InvalidRegex(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "name", Value: "a"}})
+	resp := handle(t, h, bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "filter", Value: bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "("}}}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 2 {
+		t.Fatalf("expected code 2, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCmdFind_Collation(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col",
+		bson.D{{Key: "_id", Value: int32(1)}, {Key: "login", Value: "TestLogin"}},
+		bson.D{{Key: "_id", Value: int32(2)}, {Key: "login", Value: "other"}},
+	)
+	find := bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "filter", Value: bson.D{{Key: "login", Value: "testlogin"}}},
+		{Key: "collation", Value: bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(2)}}},
+		{Key: "$db", Value: "db"},
+	}
+	resp := handle(t, h, find)
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	if len(batch) != 1 {
+		t.Fatalf("expected 1 case-insensitive match, got %d", len(batch))
+	}
+
+	find[2].Value = bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(0)}}
+	resp = handle(t, h, find)
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 2 {
+		t.Fatalf("expected code 2, got %v", getField(resp, "code"))
+	}
 }
 
 // ── cmdUpdate ─────────────────────────────────────────────────────────────────
@@ -315,6 +396,84 @@ func TestCmdUpdate_MultiFlag(t *testing.T) {
 	}
 }
 
+func TestCmdUpdate_PathNotViable(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "x", Value: int32(1)}, {Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "A1"}}}}})
+	resp := handle(t, h, bson.D{
+		{Key: "update", Value: "col"},
+		{Key: "updates", Value: bson.A{
+			bson.D{
+				{Key: "q", Value: bson.D{{Key: "x", Value: int32(1)}}},
+				{Key: "u", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "items.sku", Value: "B2"}}}}},
+			},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 28 {
+		t.Fatalf("expected code 28, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCmdUpdate_ArrayFilters(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: int32(1)}, {Key: "grades", Value: bson.A{int32(80), int32(95), int32(100)}}})
+	resp := handle(t, h, bson.D{
+		{Key: "update", Value: "col"},
+		{Key: "updates", Value: bson.A{
+			bson.D{
+				{Key: "q", Value: bson.D{}},
+				{Key: "u", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "grades.$[g]", Value: int32(90)}}}}},
+				{Key: "arrayFilters", Value: bson.A{bson.D{{Key: "g", Value: bson.D{{Key: "$gte", Value: int32(90)}}}}}},
+			},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	docs, _ := h.Engine.Find("db", "col", nil, nil, 0, 0, nil)
+	grades, _ := getField(docs[0], "grades").(bson.A)
+	if len(grades) != 3 || grades[0] != int32(80) || grades[1] != int32(90) || grades[2] != int32(90) {
+		t.Fatalf("grades = %v, want [80 90 90]", grades)
+	}
+
+	resp = handle(t, h, bson.D{
+		{Key: "findAndModify", Value: "col"},
+		{Key: "query", Value: bson.D{}},
+		{Key: "update", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "grades.$[g]", Value: int32(0)}}}}},
+		{Key: "arrayFilters", Value: bson.A{bson.D{{Key: "x", Value: int32(1)}}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 2 {
+		t.Fatalf("expected code 2 for a missing array filter, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCmdUpdate_Pipeline(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(2)}})
+	resp := handle(t, h, bson.D{
+		{Key: "update", Value: "col"},
+		{Key: "updates", Value: bson.A{
+			bson.D{
+				{Key: "q", Value: bson.D{}},
+				{Key: "u", Value: bson.A{
+					bson.D{{Key: "$set", Value: bson.D{{Key: "total", Value: bson.D{{Key: "$add", Value: bson.A{"$a", "$b"}}}}}}},
+				}},
+			},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	if n, _ := getField(resp, "nModified").(int32); n != 1 {
+		t.Fatalf("expected nModified=1, got %v", n)
+	}
+	docs, _ := h.Engine.Find("db", "col", bson.D{{Key: "total", Value: int32(3)}}, nil, 0, 0, nil)
+	if len(docs) != 1 {
+		t.Fatal("pipeline update did not set total")
+	}
+}
+
 // ── cmdDelete ─────────────────────────────────────────────────────────────────
 
 func TestCmdDelete_EmptyCollName(t *testing.T) {
@@ -485,6 +644,193 @@ func TestCmdBulkWrite_UnknownOpSkipped(t *testing.T) {
 	assertOK(t, resp)
 }
 
+func TestCmdBulkWrite_UpsertSetOnInsert(t *testing.T) {
+	h := newHandler(t)
+	upsertOp := func(seen int32) bson.D {
+		return bson.D{{Key: "updateOne", Value: bson.D{
+			{Key: "filter", Value: bson.D{{Key: "_id", Value: "k"}}},
+			{Key: "update", Value: bson.D{
+				{Key: "$set", Value: bson.D{{Key: "seen", Value: seen}}},
+				{Key: "$setOnInsert", Value: bson.D{{Key: "first", Value: seen}}},
+			}},
+			{Key: "upsert", Value: true},
+		}}}
+	}
+	resp, err := cmdBulkWrite(h, "db", bson.D{
+		{Key: "bulkWrite", Value: "col"},
+		{Key: "ops", Value: bson.A{upsertOp(1), upsertOp(2)}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	docs, _ := h.Engine.Find("db", "col", nil, nil, 0, 0, nil)
+	if len(docs) != 1 || getField(docs[0], "first") != int32(1) || getField(docs[0], "seen") != int32(2) {
+		t.Fatalf("expected first=1 seen=2, got %v", docs)
+	}
+}
+
+func TestCmdBulkWrite_ConflictingOperators(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "a", Value: int32(1)}})
+	resp := handle(t, h, bson.D{
+		{Key: "bulkWrite", Value: "col"},
+		{Key: "ops", Value: bson.A{
+			bson.D{{Key: "updateOne", Value: bson.D{
+				{Key: "filter", Value: bson.D{}},
+				{Key: "update", Value: bson.D{
+					{Key: "$set", Value: bson.D{{Key: "a", Value: int32(2)}}},
+					{Key: "$inc", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				}},
+			}}},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 40 {
+		t.Fatalf("expected code 40, got %v", getField(resp, "code"))
+	}
+	if name, _ := getField(resp, "codeName").(string); name != "ConflictingUpdateOperators" {
+		t.Fatalf("expected ConflictingUpdateOperators, got %v", getField(resp, "codeName"))
+	}
+}
+
+func TestCmdBulkWrite_UniqueIndex(t *testing.T) {
+	h := newHandler(t)
+	if err := h.Engine.CreateIndexes("db", "col", []engine.IndexSpec{{Name: "k_1", Keys: bson.D{{Key: "k", Value: int32(1)}}, Unique: true}}); err != nil {
+		t.Fatal(err)
+	}
+	seed(t, h, "db", "col", bson.D{{Key: "k", Value: "a"}}, bson.D{{Key: "k", Value: "b"}})
+	resp := handle(t, h, bson.D{
+		{Key: "bulkWrite", Value: "col"},
+		{Key: "ops", Value: bson.A{
+			bson.D{{Key: "updateOne", Value: bson.D{
+				{Key: "filter", Value: bson.D{{Key: "k", Value: "b"}}},
+				{Key: "update", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "k", Value: "a"}}}}},
+			}}},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 11000 {
+		t.Fatalf("expected code 11000, got %v", getField(resp, "code"))
+	}
+	keyValue, _ := getField(resp, "keyValue").(bson.D)
+	if getField(keyValue, "k") != "a" {
+		t.Fatalf("expected keyValue {k: a}, got %v", getField(resp, "keyValue"))
+	}
+}
+
+func TestCmdCreateIndexes_UniqueOverDuplicates(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "k", Value: "a"}}, bson.D{{Key: "k", Value: "a"}})
+	resp := handle(t, h, bson.D{
+		{Key: "createIndexes", Value: "col"},
+		{Key: "indexes", Value: bson.A{bson.D{
+			{Key: "key", Value: bson.D{{Key: "k", Value: int32(1)}}},
+			{Key: "name", Value: "k_1"},
+			{Key: "unique", Value: true},
+		}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 11000 {
+		t.Fatalf("expected code 11000, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCmdCreateIndexes_Options(t *testing.T) {
+	h := newHandler(t)
+	resp := handle(t, h, bson.D{
+		{Key: "createIndexes", Value: "col"},
+		{Key: "indexes", Value: bson.A{
+			bson.D{
+				{Key: "key", Value: bson.D{{Key: "email", Value: int32(1)}}},
+				{Key: "name", Value: "email_1"},
+				{Key: "unique", Value: true},
+				{Key: "partialFilterExpression", Value: bson.D{{Key: "email", Value: bson.D{{Key: "$exists", Value: true}}}}},
+			},
+			bson.D{
+				{Key: "key", Value: bson.D{{Key: "createdAt", Value: int32(1)}}},
+				{Key: "name", Value: "createdAt_1"},
+				{Key: "expireAfterSeconds", Value: int32(3600)},
+				{Key: "sparse", Value: true},
+			},
+		}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+
+	resp = handle(t, h, bson.D{{Key: "listIndexes", Value: "col"}, {Key: "$db", Value: "db"}})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	if len(batch) != 3 {
+		t.Fatalf("expected 3 indexes, got %d", len(batch))
+	}
+	email, _ := batch[1].(bson.D)
+	if getField(email, "unique") != true || getField(email, "partialFilterExpression") == nil {
+		t.Errorf("email_1 lost its options: %v", email)
+	}
+	created, _ := batch[2].(bson.D)
+	if getField(created, "expireAfterSeconds") != int64(3600) || getField(created, "sparse") != true {
+		t.Errorf("createdAt_1 lost its options: %v", created)
+	}
+
+	resp = handle(t, h, bson.D{
+		{Key: "createIndexes", Value: "col"},
+		{Key: "indexes", Value: bson.A{bson.D{
+			{Key: "key", Value: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(1)}}},
+			{Key: "expireAfterSeconds", Value: int32(60)},
+		}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 67 {
+		t.Fatalf("expected code 67, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCmdCreateIndexes_Collation(t *testing.T) {
+	h := newHandler(t)
+	resp := handle(t, h, bson.D{
+		{Key: "createIndexes", Value: "col"},
+		{Key: "indexes", Value: bson.A{bson.D{
+			{Key: "key", Value: bson.D{{Key: "login", Value: int32(1)}}},
+			{Key: "name", Value: "login_1"},
+			{Key: "collation", Value: bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(2)}}},
+		}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+
+	resp = handle(t, h, bson.D{{Key: "listIndexes", Value: "col"}, {Key: "$db", Value: "db"}})
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	login, _ := batch[1].(bson.D)
+	collation, _ := getField(login, "collation").(bson.D)
+	if getField(collation, "locale") != "en" || getField(collation, "strength") != int32(2) {
+		t.Errorf("login_1 collation = %v", collation)
+	}
+	if first, _ := getField(batch[0].(bson.D), "collation").(bson.D); first != nil {
+		t.Errorf("_id_ has a collation: %v", first)
+	}
+
+	resp = handle(t, h, bson.D{
+		{Key: "createIndexes", Value: "col"},
+		{Key: "indexes", Value: bson.A{bson.D{
+			{Key: "key", Value: bson.D{{Key: "x", Value: int32(1)}}},
+			{Key: "name", Value: "x_1"},
+			{Key: "collation", Value: "en"},
+		}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 14 {
+		t.Fatalf("expected code 14, got %v", getField(resp, "code"))
+	}
+}
+
 // ── cmdAggregate ──────────────────────────────────────────────────────────────
 
 func TestCmdAggregate_EmptyCollName(t *testing.T) {
@@ -527,3 +873,969 @@ func TestCmdAggregate_MatchStage(t *testing.T) {
 		t.Fatalf("expected 1 result, got %d", len(batch))
 	}
 }
+
+func TestCmdAggregate_OutAndMerge(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "runs",
+		bson.D{{Key: "cat", Value: "unit"}, {Key: "ms", Value: int32(10)}},
+		bson.D{{Key: "cat", Value: "unit"}, {Key: "ms", Value: int32(30)}},
+		bson.D{{Key: "cat", Value: "e2e"}, {Key: "ms", Value: int32(500)}},
+	)
+	group := bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$cat"}, {Key: "total", Value: bson.D{{Key: "$sum", Value: "$ms"}}}}}}
+	resp := handle(t, h, bson.D{
+		{Key: "aggregate", Value: "runs"},
+		{Key: "pipeline", Value: bson.A{group, bson.D{{Key: "$out", Value: "rollup"}}}},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	if batch, _ := getField(cursor, "firstBatch").(bson.A); len(batch) != 0 {
+		t.Errorf("$out returned %v, want an empty batch", batch)
+	}
+	if n := countDocs(t, h, bson.D{{Key: "count", Value: "rollup"}, {Key: "$db", Value: "db"}}); n != 2 {
+		t.Errorf("rollup has %d documents, want 2", n)
+	}
+
+	resp = handle(t, h, bson.D{
+		{Key: "aggregate", Value: "runs"},
+		{Key: "pipeline", Value: bson.A{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "_id", Value: "$cat"}}}},
+			bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "lint"}}}},
+			bson.D{{Key: "$merge", Value: bson.D{{Key: "into", Value: "rollup"}, {Key: "whenNotMatched", Value: "fail"}}}},
+		}},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	if code, _ := getField(resp, "code").(int32); code != 13113 {
+		t.Errorf("$merge whenNotMatched fail: code = %d, want 13113", code)
+	}
+}
+
+func TestCmdAggregate_GraphLookupAcrossDatabases(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "graph", "tasks",
+		bson.D{{Key: "_id", Value: "deploy"}, {Key: "after", Value: "test"}},
+		bson.D{{Key: "_id", Value: "test"}, {Key: "after", Value: "build"}},
+		bson.D{{Key: "_id", Value: "build"}},
+	)
+	seed(t, h, "db", "releases", bson.D{{Key: "_id", Value: "v1"}, {Key: "task", Value: "deploy"}})
+	resp := handle(t, h, bson.D{
+		{Key: "aggregate", Value: "releases"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$graphLookup", Value: bson.D{
+			{Key: "from", Value: bson.D{{Key: "db", Value: "graph"}, {Key: "coll", Value: "tasks"}}},
+			{Key: "startWith", Value: "$task"},
+			{Key: "connectFromField", Value: "after"},
+			{Key: "connectToField", Value: "_id"},
+			{Key: "as", Value: "chain"},
+			{Key: "depthField", Value: "depth"},
+		}}}}},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	if len(batch) != 1 {
+		t.Fatalf("firstBatch = %v, want 1 document", batch)
+	}
+	if chain, _ := getField(batch[0].(bson.D), "chain").(bson.A); len(chain) != 3 {
+		t.Errorf("chain = %v, want deploy, test and build", chain)
+	}
+}
+
+func TestCmdAggregate_SetWindowFields(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "runs",
+		bson.D{{Key: "test", Value: "login"}, {Key: "run", Value: int32(2)}, {Key: "ms", Value: int32(30)}},
+		bson.D{{Key: "test", Value: "login"}, {Key: "run", Value: int32(1)}, {Key: "ms", Value: int32(10)}},
+		bson.D{{Key: "test", Value: "search"}, {Key: "run", Value: int32(1)}, {Key: "ms", Value: int32(5)}},
+	)
+	resp := handle(t, h, bson.D{
+		{Key: "aggregate", Value: "runs"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$setWindowFields", Value: bson.D{
+			{Key: "partitionBy", Value: "$test"},
+			{Key: "sortBy", Value: bson.D{{Key: "run", Value: int32(1)}}},
+			{Key: "output", Value: bson.D{{Key: "total", Value: bson.D{
+				{Key: "$sum", Value: "$ms"},
+				{Key: "window", Value: bson.D{{Key: "documents", Value: bson.A{"unbounded", "current"}}}},
+			}}}},
+		}}}}},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	want := []int64{10, 40, 5}
+	if len(batch) != len(want) {
+		t.Fatalf("firstBatch = %v, want %d documents", batch, len(want))
+	}
+	for i, d := range batch {
+		if total := getField(d.(bson.D), "total"); total != want[i] {
+			t.Errorf("document %d total = %v, want %d", i, total, want[i])
+		}
+	}
+}
+
+func TestCmdAggregate_GroupByDay(t *testing.T) {
+	h := newHandler(t)
+	at := func(day, hour int) bson.DateTime {
+		return bson.NewDateTimeFromTime(time.Date(2025, time.June, day, hour, 0, 0, 0, time.UTC))
+	}
+	seed(t, h, "db", "orders",
+		bson.D{{Key: "at", Value: at(1, 9)}, {Key: "total", Value: int32(5)}},
+		bson.D{{Key: "at", Value: at(1, 17)}, {Key: "total", Value: int32(3)}},
+		bson.D{{Key: "at", Value: at(3, 8)}, {Key: "total", Value: int32(4)}},
+		bson.D{{Key: "at", Value: at(9, 8)}, {Key: "total", Value: int32(1)}},
+	)
+	resp := handle(t, h, bson.D{
+		{Key: "aggregate", Value: "orders"},
+		{Key: "pipeline", Value: bson.A{
+			bson.D{{Key: "$match", Value: bson.D{{Key: "at", Value: bson.D{{Key: "$lt", Value: at(8, 0)}}}}}},
+			bson.D{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{{Key: "date", Value: "$at"}, {Key: "unit", Value: "day"}}}}},
+				{Key: "total", Value: bson.D{{Key: "$sum", Value: "$total"}}},
+			}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: int32(1)}}}},
+		}},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	want := []struct {
+		day   bson.DateTime
+		total int64
+	}{{at(1, 0), 8}, {at(3, 0), 4}}
+	if len(batch) != len(want) {
+		t.Fatalf("firstBatch = %v, want %d documents", batch, len(want))
+	}
+	for i, d := range batch {
+		if day, total := getField(d.(bson.D), "_id"), getField(d.(bson.D), "total"); day != want[i].day || total != want[i].total {
+			t.Errorf("document %d = %v, want day %v total %d", i, d, want[i].day, want[i].total)
+		}
+	}
+}
+
+// ── cmdExplain ────────────────────────────────────────────────────────────────
+
+func TestCmdExplain_FindUsesIndex(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col",
+		bson.D{{Key: "x", Value: int32(1)}},
+		bson.D{{Key: "x", Value: int32(2)}},
+		bson.D{{Key: "x", Value: int32(2)}},
+	)
+	h.Engine.CreateIndexes("db", "col", []engine.IndexSpec{{Name: "x_1", Keys: bson.D{{Key: "x", Value: int32(1)}}}})
+
+	resp, err := cmdExplain(h, "db", bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: "col"},
+			{Key: "filter", Value: bson.D{{Key: "x", Value: int32(2)}}},
+		}},
+		{Key: "verbosity", Value: "executionStats"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+
+	planner := getField(resp, "queryPlanner").(bson.D)
+	plan := getField(planner, "winningPlan").(bson.D)
+	if getField(plan, "stage") != "FETCH" {
+		t.Fatalf("expected FETCH, got %v", plan)
+	}
+	ixscan := getField(plan, "inputStage").(bson.D)
+	if getField(ixscan, "stage") != "IXSCAN" || getField(ixscan, "indexName") != "x_1" {
+		t.Fatalf("expected IXSCAN on x_1, got %v", ixscan)
+	}
+
+	stats := getField(resp, "executionStats").(bson.D)
+	if getField(stats, "nReturned") != int64(2) || getField(stats, "totalDocsExamined") != int64(2) ||
+		getField(stats, "totalKeysExamined") != int64(2) {
+		t.Fatalf("unexpected executionStats: %v", stats)
+	}
+}
+
+func TestCmdExplain_QueryPlannerOmitsStats(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "x", Value: int32(1)}})
+
+	resp, err := cmdExplain(h, "db", bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "count", Value: "col"},
+			{Key: "query", Value: bson.D{{Key: "x", Value: int32(1)}}},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	if getField(resp, "executionStats") != nil {
+		t.Fatal("queryPlanner verbosity should not include executionStats")
+	}
+	plan := getField(getField(resp, "queryPlanner").(bson.D), "winningPlan").(bson.D)
+	if getField(plan, "stage") != "COUNT" || getField(getField(plan, "inputStage").(bson.D), "stage") != "COLLSCAN" {
+		t.Fatalf("expected COUNT over COLLSCAN, got %v", plan)
+	}
+}
+
+func TestCmdExplain_DeleteDoesNotModify(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "x", Value: int32(1)}}, bson.D{{Key: "x", Value: int32(1)}})
+
+	resp, err := cmdExplain(h, "db", bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "delete", Value: "col"},
+			{Key: "deletes", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "limit", Value: int32(0)}}}},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	stages := getField(getField(resp, "executionStats").(bson.D), "executionStages").(bson.D)
+	if getField(stages, "stage") != "DELETE" || getField(stages, "nWouldDelete") != int64(2) {
+		t.Fatalf("expected DELETE with nWouldDelete=2, got %v", stages)
+	}
+	if n, _ := h.Engine.Count("db", "col", nil, nil); n != 2 {
+		t.Fatalf("explain must not delete, count=%d", n)
+	}
+}
+
+func TestCmdExplain_AggregateFlag(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: int32(1)}}, bson.D{{Key: "_id", Value: int32(2)}})
+
+	resp, err := cmdAggregate(h, "db", bson.D{
+		{Key: "aggregate", Value: "col"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "_id", Value: int32(2)}}}}}},
+		{Key: "explain", Value: true},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	plan := getField(getField(resp, "queryPlanner").(bson.D), "winningPlan").(bson.D)
+	if getField(getField(plan, "inputStage").(bson.D), "indexName") != "_id_" {
+		t.Fatalf("expected leading $match to use _id_, got %v", plan)
+	}
+}
+
+func TestCmdExplain_Unsupported(t *testing.T) {
+	h := newHandler(t)
+	resp, err := cmdExplain(h, "db", bson.D{{Key: "explain", Value: bson.D{{Key: "insert", Value: "col"}}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertErr(t, resp)
+}
+
+// ── cursors ───────────────────────────────────────────────────────────────────
+
+// drainCursor calls getMore on id until the cursor is exhausted and returns
+// the number of documents received.
+func drainCursor(t *testing.T, h *Handler, db, coll string, id int64, batchSize int32) int {
+	t.Helper()
+	n := 0
+	for id != 0 {
+		resp, err := cmdGetMore(h, db, bson.D{
+			{Key: "getMore", Value: id},
+			{Key: "collection", Value: coll},
+			{Key: "batchSize", Value: batchSize},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOK(t, resp)
+		cursor, _ := getField(resp, "cursor").(bson.D)
+		batch, _ := getField(cursor, "nextBatch").(bson.A)
+		if batchSize > 0 && len(batch) > int(batchSize) {
+			t.Fatalf("nextBatch has %d docs, batchSize is %d", len(batch), batchSize)
+		}
+		n += len(batch)
+		id, _ = getField(cursor, "id").(int64)
+	}
+	return n
+}
+
+func TestCursor_FindDefaultFirstBatch(t *testing.T) {
+	h := newHandler(t)
+	var docs []bson.D
+	for i := range 150 {
+		docs = append(docs, bson.D{{Key: "i", Value: int32(i)}})
+	}
+	if _, err := h.Engine.Insert("db", "col", docs); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cmdFind(h, "db", bson.D{{Key: "find", Value: "col"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	if len(batch) != defaultFirstBatch {
+		t.Fatalf("expected %d docs in firstBatch, got %d", defaultFirstBatch, len(batch))
+	}
+	id, _ := getField(cursor, "id").(int64)
+	if got := drainCursor(t, h, "db", "col", id, 0); got != 150-defaultFirstBatch {
+		t.Errorf("expected %d docs from getMore, got %d", 150-defaultFirstBatch, got)
+	}
+}
+
+func TestCursor_SingleBatchClosesCursor(t *testing.T) {
+	h := newHandler(t)
+	for i := range 5 {
+		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
+	}
+	resp, err := cmdFind(h, "db", bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "batchSize", Value: int32(2)},
+		{Key: "singleBatch", Value: true},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	if id, _ := getField(cursor, "id").(int64); id != 0 {
+		t.Errorf("expected closed cursor, got id %d", id)
+	}
+}
+
+func TestCursor_AggregateBatchSize(t *testing.T) {
+	h := newHandler(t)
+	for i := range 5 {
+		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
+	}
+	resp, err := cmdAggregate(h, "db", bson.D{
+		{Key: "aggregate", Value: "col"},
+		{Key: "pipeline", Value: bson.A{}},
+		{Key: "cursor", Value: bson.D{{Key: "batchSize", Value: int32(0)}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	if len(batch) != 0 {
+		t.Fatalf("expected empty firstBatch, got %d docs", len(batch))
+	}
+	id, _ := getField(cursor, "id").(int64)
+	if got := drainCursor(t, h, "db", "col", id, 2); got != 5 {
+		t.Errorf("expected 5 docs from getMore, got %d", got)
+	}
+}
+
+func TestCursor_ListCollectionsAndIndexes(t *testing.T) {
+	h := newHandler(t)
+	for _, name := range []string{"a", "b", "c"} {
+		seed(t, h, "db", name, bson.D{{Key: "x", Value: int32(1)}})
+	}
+	resp, err := cmdListCollections(h, "db", bson.D{
+		{Key: "listCollections", Value: int32(1)},
+		{Key: "cursor", Value: bson.D{{Key: "batchSize", Value: int32(1)}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	id, _ := getField(cursor, "id").(int64)
+	if got := drainCursor(t, h, "db", "$cmd.listCollections", id, 1); got != 2 {
+		t.Errorf("expected 2 more collections, got %d", got)
+	}
+
+	resp, err = cmdListIndexes(h, "db", bson.D{
+		{Key: "listIndexes", Value: "a"},
+		{Key: "cursor", Value: bson.D{{Key: "batchSize", Value: int32(0)}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, _ = getField(resp, "cursor").(bson.D)
+	id, _ = getField(cursor, "id").(int64)
+	if got := drainCursor(t, h, "db", "a", id, 0); got != 1 {
+		t.Errorf("expected the _id_ index from getMore, got %d", got)
+	}
+}
+
+func TestCursor_GetMoreErrors(t *testing.T) {
+	h := newHandler(t)
+	for i := range 3 {
+		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
+	}
+	resp, _ := cmdFind(h, "db", bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "batchSize", Value: int32(1)},
+	}, nil)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	id, _ := getField(cursor, "id").(int64)
+
+	resp, _ = cmdGetMore(h, "db", bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "other"},
+	}, nil)
+	if code, _ := getField(resp, "code").(int32); code != 13 {
+		t.Errorf("namespace mismatch: expected code 13, got %v", getField(resp, "code"))
+	}
+
+	resp, _ = cmdGetMore(h, "db", bson.D{
+		{Key: "getMore", Value: id + 1},
+		{Key: "collection", Value: "col"},
+	}, nil)
+	if code, _ := getField(resp, "code").(int32); code != 43 {
+		t.Errorf("unknown cursor: expected code 43, got %v", getField(resp, "code"))
+	}
+}
+
+func TestCursor_KillCursors(t *testing.T) {
+	h := newHandler(t)
+	for i := range 3 {
+		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
+	}
+	resp, _ := cmdFind(h, "db", bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "batchSize", Value: int32(1)},
+	}, nil)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	id, _ := getField(cursor, "id").(int64)
+
+	resp, err := cmdKillCursors(h, "db", bson.D{
+		{Key: "killCursors", Value: "col"},
+		{Key: "cursors", Value: bson.A{id, int64(42)}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOK(t, resp)
+	if killed, _ := getField(resp, "cursorsKilled").(bson.A); len(killed) != 1 || killed[0] != id {
+		t.Errorf("cursorsKilled = %v, want [%d]", killed, id)
+	}
+	if notFound, _ := getField(resp, "cursorsNotFound").(bson.A); len(notFound) != 1 {
+		t.Errorf("cursorsNotFound = %v, want [42]", notFound)
+	}
+
+	resp, _ = cmdGetMore(h, "db", bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "col"},
+	}, nil)
+	assertErr(t, resp)
+}
+
+func TestCursor_IdleTimeout(t *testing.T) {
+	h := newHandler(t)
+	now := time.Now()
+	h.cursors.now = func() time.Time { return now }
+	for i := range 3 {
+		seed(t, h, "db", "col", bson.D{{Key: "i", Value: int32(i)}})
+	}
+	resp, _ := cmdFind(h, "db", bson.D{
+		{Key: "find", Value: "col"},
+		{Key: "batchSize", Value: int32(1)},
+	}, nil)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	id, _ := getField(cursor, "id").(int64)
+
+	// Using the cursor keeps it alive.
+	now = now.Add(defaultCursorTimeout - time.Second)
+	resp, _ = cmdGetMore(h, "db", bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "col"},
+		{Key: "batchSize", Value: int32(1)},
+	}, nil)
+	assertOK(t, resp)
+
+	now = now.Add(defaultCursorTimeout + time.Second)
+	resp, _ = cmdGetMore(h, "db", bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "col"},
+	}, nil)
+	if code, _ := getField(resp, "code").(int32); code != 43 {
+		t.Errorf("expired cursor: expected code 43, got %v", getField(resp, "code"))
+	}
+}
+
+// ── change streams ────────────────────────────────────────────────────────────
+
+// openChangeStream runs an aggregate with the given pipeline, which starts
+// with $changeStream, and returns the cursor id and namespace.
+func openChangeStream(t *testing.T, h *Handler, target any, pipeline bson.A) (int64, string) {
+	t.Helper()
+	resp := handle(t, h, bson.D{
+		{Key: "aggregate", Value: target},
+		{Key: "pipeline", Value: pipeline},
+		{Key: "cursor", Value: bson.D{}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	if getField(cursor, "postBatchResumeToken") == nil {
+		t.Fatalf("missing postBatchResumeToken: %v", cursor)
+	}
+	id, _ := getField(cursor, "id").(int64)
+	if id == 0 {
+		t.Fatal("change stream cursor is closed")
+	}
+	ns, _ := getField(cursor, "ns").(string)
+	return id, ns
+}
+
+func streamGetMore(t *testing.T, h *Handler, id int64, coll string) (bson.A, int64) {
+	t.Helper()
+	resp := handle(t, h, bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: coll},
+		{Key: "maxTimeMS", Value: int64(50)},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "nextBatch").(bson.A)
+	next, _ := getField(cursor, "id").(int64)
+	return batch, next
+}
+
+func TestCmdAggregate_ChangeStream(t *testing.T) {
+	h := newHandler(t)
+	id, ns := openChangeStream(t, h, "col", bson.A{
+		bson.D{{Key: "$changeStream", Value: bson.D{{Key: "fullDocument", Value: "updateLookup"}}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{{Key: "$ne", Value: "delete"}}}}}},
+	})
+	if ns != "db.col" {
+		t.Errorf("ns = %q", ns)
+	}
+	if batch, _ := streamGetMore(t, h, id, "col"); len(batch) != 0 {
+		t.Fatalf("expected no events yet, got %v", batch)
+	}
+
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: int32(1)}, {Key: "state", Value: "ready"}})
+	seed(t, h, "db", "other", bson.D{{Key: "_id", Value: int32(1)}})
+	if _, _, _, err := h.Engine.Update("db", "col", bson.D{{Key: "_id", Value: int32(1)}}, bson.D{{Key: "$set", Value: bson.D{{Key: "state", Value: "claimed"}}}}, nil, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Engine.Delete("db", "col", bson.D{}, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	batch, next := streamGetMore(t, h, id, "col")
+	if len(batch) != 2 || next != id {
+		t.Fatalf("expected insert and update on an open cursor, got %v (id %d)", batch, next)
+	}
+	update, _ := batch[1].(bson.D)
+	full, _ := getField(update, "fullDocument").(bson.D)
+	if getField(update, "operationType") != "update" || getField(full, "state") != "claimed" {
+		t.Errorf("unexpected update event: %v", update)
+	}
+
+	// Resuming after the insert replays the update.
+	token, _ := getField(batch[0].(bson.D), "_id").(bson.D)
+	resumed, _ := openChangeStream(t, h, "col", bson.A{bson.D{{Key: "$changeStream", Value: bson.D{{Key: "resumeAfter", Value: token}}}}})
+	if batch, _ := streamGetMore(t, h, resumed, "col"); len(batch) != 2 {
+		t.Errorf("expected update and delete after resuming, got %v", batch)
+	}
+
+	// Dropping the collection invalidates the stream and closes the cursor.
+	if err := h.Engine.DropCollection("db", "col"); err != nil {
+		t.Fatal(err)
+	}
+	batch, next = streamGetMore(t, h, id, "col")
+	if len(batch) != 2 || next != 0 {
+		t.Fatalf("expected drop and invalidate on a closed cursor, got %v (id %d)", batch, next)
+	}
+	if getField(batch[1].(bson.D), "operationType") != "invalidate" {
+		t.Errorf("expected invalidate, got %v", batch[1])
+	}
+}
+
+func TestCmdAggregate_ChangeStreamDatabase(t *testing.T) {
+	h := newHandler(t)
+	id, ns := openChangeStream(t, h, int32(1), bson.A{bson.D{{Key: "$changeStream", Value: bson.D{}}}})
+	if ns != "db.$cmd.aggregate" {
+		t.Errorf("ns = %q", ns)
+	}
+	seed(t, h, "db", "a", bson.D{{Key: "k", Value: int32(1)}})
+	seed(t, h, "db", "b", bson.D{{Key: "k", Value: int32(2)}})
+	seed(t, h, "elsewhere", "a", bson.D{{Key: "k", Value: int32(3)}})
+	if batch, _ := streamGetMore(t, h, id, "$cmd.aggregate"); len(batch) != 2 {
+		t.Errorf("expected 2 events from db, got %v", batch)
+	}
+
+	resp := handle(t, h, bson.D{{Key: "killCursors", Value: "$cmd.aggregate"}, {Key: "cursors", Value: bson.A{id}}, {Key: "$db", Value: "db"}})
+	assertOK(t, resp)
+	if killed, _ := getField(resp, "cursorsKilled").(bson.A); len(killed) != 1 {
+		t.Errorf("expected the stream to be killed, got %v", resp)
+	}
+}
+
+func TestCmdAggregate_ChangeStreamErrors(t *testing.T) {
+	h := newHandler(t)
+	tests := []struct {
+		name     string
+		pipeline bson.A
+		code     int32
+	}{
+		{"stage", bson.A{bson.D{{Key: "$changeStream", Value: bson.D{}}}, bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: nil}}}}}, 2},
+		{"fullDocument", bson.A{bson.D{{Key: "$changeStream", Value: bson.D{{Key: "fullDocument", Value: "nope"}}}}}, 2},
+		{"token", bson.A{bson.D{{Key: "$changeStream", Value: bson.D{{Key: "resumeAfter", Value: bson.D{{Key: "_data", Value: "00000000000000010000000000000001"}}}}}}}, 286},
+	}
+	for _, tt := range tests {
+		resp := handle(t, h, bson.D{{Key: "aggregate", Value: "col"}, {Key: "pipeline", Value: tt.pipeline}, {Key: "$db", Value: "db"}})
+		assertErr(t, resp)
+		if code, _ := getField(resp, "code").(int32); code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, getField(resp, "code"))
+		}
+	}
+}
+
+// ── capped collections ────────────────────────────────────────────────────────
+
+func TestCmdCreate_Capped(t *testing.T) {
+	h := newHandler(t)
+	resp := handle(t, h, bson.D{
+		{Key: "create", Value: "log"},
+		{Key: "capped", Value: true},
+		{Key: "size", Value: int32(4096)},
+		{Key: "max", Value: int32(2)},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	for i := int32(1); i <= 3; i++ {
+		seed(t, h, "db", "log", bson.D{{Key: "_id", Value: i}})
+	}
+	if n := countDocs(t, h, bson.D{{Key: "count", Value: "log"}, {Key: "$db", Value: "db"}}); n != 2 {
+		t.Errorf("expected 2 docs after eviction, got %d", n)
+	}
+
+	resp = handle(t, h, bson.D{{Key: "listCollections", Value: 1}, {Key: "$db", Value: "db"}})
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	info, _ := batch[0].(bson.D)
+	opts, _ := getField(info, "options").(bson.D)
+	if getField(opts, "capped") != true || getField(opts, "size") != int64(4096) || getField(opts, "max") != int64(2) {
+		t.Errorf("options = %v", opts)
+	}
+
+	resp = handle(t, h, bson.D{{Key: "create", Value: "nosize"}, {Key: "capped", Value: true}, {Key: "$db", Value: "db"}})
+	assertErr(t, resp)
+	if code, _ := getField(resp, "code").(int32); code != 72 {
+		t.Errorf("code = %d, want 72", code)
+	}
+	resp = handle(t, h, bson.D{{Key: "create", Value: "log"}, {Key: "capped", Value: true}, {Key: "size", Value: int32(1)}, {Key: "$db", Value: "db"}})
+	if code, _ := getField(resp, "code").(int32); code != 48 {
+		t.Errorf("code = %d, want 48 NamespaceExists", code)
+	}
+}
+
+func TestCmdFind_Tailable(t *testing.T) {
+	h := newHandler(t)
+	if err := h.Engine.CreateCappedCollection("db", "bus", engine.CappedOptions{Size: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	seed(t, h, "db", "bus", bson.D{{Key: "_id", Value: int32(1)}, {Key: "topic", Value: "a"}})
+	resp := handle(t, h, bson.D{
+		{Key: "find", Value: "bus"},
+		{Key: "filter", Value: bson.D{{Key: "topic", Value: "a"}}},
+		{Key: "projection", Value: bson.D{{Key: "topic", Value: 0}}},
+		{Key: "tailable", Value: true},
+		{Key: "awaitData", Value: true},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	first, _ := getField(cursor, "firstBatch").(bson.A)
+	id, _ := getField(cursor, "id").(int64)
+	if len(first) != 1 || id == 0 {
+		t.Fatalf("firstBatch = %v, id = %d", first, id)
+	}
+
+	// getMore waits for the next matching insert.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		h.Engine.Insert("db", "bus", []bson.D{{{Key: "_id", Value: int32(2)}, {Key: "topic", Value: "b"}}})
+		h.Engine.Insert("db", "bus", []bson.D{{{Key: "_id", Value: int32(3)}, {Key: "topic", Value: "a"}}})
+	}()
+	resp = handle(t, h, bson.D{
+		{Key: "getMore", Value: id},
+		{Key: "collection", Value: "bus"},
+		{Key: "maxTimeMS", Value: int64(5000)},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+	cursor, _ = getField(resp, "cursor").(bson.D)
+	next, _ := getField(cursor, "nextBatch").(bson.A)
+	if len(next) != 1 {
+		t.Fatalf("nextBatch = %v", next)
+	}
+	doc, _ := next[0].(bson.D)
+	if getField(doc, "_id") != int32(3) || getField(doc, "topic") != nil {
+		t.Errorf("doc = %v", doc)
+	}
+	if getField(cursor, "id") != id {
+		t.Errorf("tailable cursor closed: %v", cursor)
+	}
+
+	// An empty getMore returns quickly with the cursor still open.
+	batch, next2 := streamGetMore(t, h, id, "bus")
+	if len(batch) != 0 || next2 != id {
+		t.Errorf("idle getMore = %v, id %d", batch, next2)
+	}
+}
+
+func TestCmdFind_TailableErrors(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "plain", bson.D{{Key: "x", Value: 1}})
+	for _, cmd := range []bson.D{
+		{{Key: "find", Value: "plain"}, {Key: "tailable", Value: true}, {Key: "$db", Value: "db"}},
+		{{Key: "find", Value: "plain"}, {Key: "awaitData", Value: true}, {Key: "$db", Value: "db"}},
+	} {
+		assertErr(t, handle(t, h, cmd))
+	}
+
+	if err := h.Engine.CreateCappedCollection("db", "log", engine.CappedOptions{Size: 1 << 20, Max: 1}); err != nil {
+		t.Fatal(err)
+	}
+	assertErr(t, handle(t, h, bson.D{
+		{Key: "find", Value: "log"},
+		{Key: "tailable", Value: true},
+		{Key: "sort", Value: bson.D{{Key: "x", Value: 1}}},
+		{Key: "$db", Value: "db"},
+	}))
+
+	seed(t, h, "db", "log", bson.D{{Key: "_id", Value: int32(1)}})
+	resp := handle(t, h, bson.D{{Key: "find", Value: "log"}, {Key: "tailable", Value: true}, {Key: "$db", Value: "db"}})
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	id, _ := getField(cursor, "id").(int64)
+	seed(t, h, "db", "log", bson.D{{Key: "_id", Value: int32(2)}})
+	resp = handle(t, h, bson.D{{Key: "getMore", Value: id}, {Key: "collection", Value: "log"}, {Key: "$db", Value: "db"}})
+	if code, _ := getField(resp, "code").(int32); code != 136 {
+		t.Errorf("code = %d, want 136 CappedPositionLost", code)
+	}
+}
+
+// ── views ─────────────────────────────────────────────────────────────────────
+
+func TestCmdCreate_View(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "tests",
+		bson.D{{Key: "_id", Value: "TestA"}, {Key: "status", Value: "fail"}, {Key: "pkg", Value: "api"}},
+		bson.D{{Key: "_id", Value: "TestB"}, {Key: "status", Value: "pass"}, {Key: "pkg", Value: "api"}},
+		bson.D{{Key: "_id", Value: "TestC"}, {Key: "status", Value: "fail"}, {Key: "pkg", Value: "db"}},
+	)
+	resp := handle(t, h, bson.D{
+		{Key: "create", Value: "failing"},
+		{Key: "viewOn", Value: "tests"},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "fail"}}}}}},
+		{Key: "$db", Value: "db"},
+	})
+	assertOK(t, resp)
+
+	resp = handle(t, h, bson.D{{Key: "find", Value: "failing"}, {Key: "filter", Value: bson.D{{Key: "pkg", Value: "db"}}}, {Key: "$db", Value: "db"}})
+	cursor, _ := getField(resp, "cursor").(bson.D)
+	if batch, _ := getField(cursor, "firstBatch").(bson.A); len(batch) != 1 {
+		t.Errorf("find on view = %v", batch)
+	}
+	if n := countDocs(t, h, bson.D{{Key: "count", Value: "failing"}, {Key: "$db", Value: "db"}}); n != 2 {
+		t.Errorf("count on view = %d, want 2", n)
+	}
+	resp = handle(t, h, bson.D{{Key: "distinct", Value: "failing"}, {Key: "key", Value: "pkg"}, {Key: "$db", Value: "db"}})
+	if values, _ := getField(resp, "values").(bson.A); len(values) != 2 {
+		t.Errorf("distinct on view = %v", values)
+	}
+
+	resp = handle(t, h, bson.D{{Key: "listCollections", Value: 1}, {Key: "$db", Value: "db"}})
+	cursor, _ = getField(resp, "cursor").(bson.D)
+	batch, _ := getField(cursor, "firstBatch").(bson.A)
+	var view bson.D
+	for _, c := range batch {
+		if d, _ := c.(bson.D); getField(d, "name") == "failing" {
+			view = d
+		}
+	}
+	opts, _ := getField(view, "options").(bson.D)
+	if getField(view, "type") != "view" || getField(opts, "viewOn") != "tests" {
+		t.Errorf("listCollections view entry = %v", view)
+	}
+
+	resp = handle(t, h, bson.D{{Key: "insert", Value: "failing"}, {Key: "documents", Value: bson.A{bson.D{{Key: "x", Value: 1}}}}, {Key: "$db", Value: "db"}})
+	if code, _ := getField(resp, "code").(int32); code != 166 {
+		t.Errorf("insert into view: code = %d, want 166 CommandNotSupportedOnView", code)
+	}
+	resp = handle(t, h, bson.D{{Key: "create", Value: "bad"}, {Key: "viewOn", Value: int32(1)}, {Key: "$db", Value: "db"}})
+	if code, _ := getField(resp, "code").(int32); code != 14 {
+		t.Errorf("non-string viewOn: code = %d, want 14", code)
+	}
+
+	assertOK(t, handle(t, h, bson.D{{Key: "drop", Value: "failing"}, {Key: "$db", Value: "db"}}))
+	if views := h.Engine.Views("db"); len(views) != 0 {
+		t.Errorf("views after drop = %v", views)
+	}
+}
+
+// ── transactions ──────────────────────────────────────────────────────────────
+
+// handle marshals cmd and runs it through Handle, as the server does.
+func handle(t *testing.T, h *Handler, cmd bson.D) bson.D {
+	t.Helper()
+	raw, err := bson.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.Handle(raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// txnCmd appends the session fields a driver sends inside a transaction.
+func txnCmd(cmd bson.D, lsid bson.D, txnNumber int64, start bool) bson.D {
+	cmd = append(cmd, bson.E{Key: "$db", Value: "db"}, bson.E{Key: "lsid", Value: lsid}, bson.E{Key: "txnNumber", Value: txnNumber})
+	if start {
+		cmd = append(cmd, bson.E{Key: "startTransaction", Value: true})
+	}
+	return append(cmd, bson.E{Key: "autocommit", Value: false})
+}
+
+func newLsid() bson.D {
+	return bson.D{{Key: "id", Value: bson.Binary{Subtype: 4, Data: []byte(bson.NewObjectID().Hex()[:16])}}}
+}
+
+func countDocs(t *testing.T, h *Handler, cmd bson.D) int32 {
+	t.Helper()
+	resp := handle(t, h, cmd)
+	assertOK(t, resp)
+	n, _ := getField(resp, "n").(int32)
+	return n
+}
+
+func TestTxn_CommitAndIsolation(t *testing.T) {
+	h := newHandler(t)
+	lsid := newLsid()
+	insert := bson.D{{Key: "insert", Value: "col"}, {Key: "documents", Value: bson.A{bson.D{{Key: "x", Value: int32(1)}}}}}
+	count := bson.D{{Key: "count", Value: "col"}}
+
+	assertOK(t, handle(t, h, txnCmd(insert, lsid, 1, true)))
+	if n := countDocs(t, h, txnCmd(count, lsid, 1, false)); n != 1 {
+		t.Errorf("inside txn: expected 1 doc, got %d", n)
+	}
+	if n := countDocs(t, h, append(count, bson.E{Key: "$db", Value: "db"})); n != 0 {
+		t.Errorf("outside txn: expected 0 docs, got %d", n)
+	}
+
+	commit := bson.D{{Key: "commitTransaction", Value: int32(1)}}
+	assertOK(t, handle(t, h, txnCmd(commit, lsid, 1, false)))
+	// Drivers retry commits; a committed transaction commits again.
+	assertOK(t, handle(t, h, txnCmd(commit, lsid, 1, false)))
+	if n := countDocs(t, h, append(count, bson.E{Key: "$db", Value: "db"})); n != 1 {
+		t.Errorf("after commit: expected 1 doc, got %d", n)
+	}
+
+	resp := handle(t, h, txnCmd(insert, lsid, 1, false))
+	if code, _ := getField(resp, "code").(int32); code != 256 {
+		t.Errorf("write after commit: expected code 256, got %v", resp)
+	}
+}
+
+func TestTxn_Abort(t *testing.T) {
+	h := newHandler(t)
+	lsid := newLsid()
+	insert := bson.D{{Key: "insert", Value: "col"}, {Key: "documents", Value: bson.A{bson.D{{Key: "x", Value: int32(1)}}}}}
+	assertOK(t, handle(t, h, txnCmd(insert, lsid, 1, true)))
+	assertOK(t, handle(t, h, txnCmd(bson.D{{Key: "abortTransaction", Value: int32(1)}}, lsid, 1, false)))
+
+	if n := countDocs(t, h, bson.D{{Key: "count", Value: "col"}, {Key: "$db", Value: "db"}}); n != 0 {
+		t.Errorf("expected 0 docs after abort, got %d", n)
+	}
+	resp := handle(t, h, txnCmd(bson.D{{Key: "commitTransaction", Value: int32(1)}}, lsid, 1, false))
+	if code, _ := getField(resp, "code").(int32); code != 251 {
+		t.Errorf("commit after abort: expected code 251, got %v", resp)
+	}
+}
+
+func TestTxn_WriteConflictIsTransient(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: "a"}, {Key: "n", Value: int32(0)}})
+	lsid := newLsid()
+	inc := bson.D{
+		{Key: "update", Value: "col"},
+		{Key: "updates", Value: bson.A{bson.D{
+			{Key: "q", Value: bson.D{{Key: "_id", Value: "a"}}},
+			{Key: "u", Value: bson.D{{Key: "$inc", Value: bson.D{{Key: "n", Value: int32(1)}}}}},
+		}}},
+	}
+	assertOK(t, handle(t, h, txnCmd(inc, lsid, 1, true)))
+	assertOK(t, handle(t, h, append(inc, bson.E{Key: "$db", Value: "db"})))
+
+	resp := handle(t, h, txnCmd(bson.D{{Key: "commitTransaction", Value: int32(1)}}, lsid, 1, false))
+	if code, _ := getField(resp, "code").(int32); code != 112 {
+		t.Fatalf("expected WriteConflict, got %v", resp)
+	}
+	if labels, _ := getField(resp, "errorLabels").(bson.A); len(labels) != 1 || labels[0] != "TransientTransactionError" {
+		t.Errorf("expected TransientTransactionError label, got %v", labels)
+	}
+}
+
+func TestTxn_ReadConflictIsTransient(t *testing.T) {
+	h := newHandler(t)
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: "a"}})
+	lsid := newLsid()
+	count := bson.D{{Key: "count", Value: "col"}}
+	if n := countDocs(t, h, txnCmd(count, lsid, 1, true)); n != 1 {
+		t.Fatalf("expected 1 doc, got %d", n)
+	}
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: "b"}})
+
+	resp := handle(t, h, txnCmd(count, lsid, 1, false))
+	if code, _ := getField(resp, "code").(int32); code != 112 {
+		t.Fatalf("expected WriteConflict, got %v", resp)
+	}
+	if labels, _ := getField(resp, "errorLabels").(bson.A); len(labels) != 1 || labels[0] != "TransientTransactionError" {
+		t.Errorf("expected TransientTransactionError label, got %v", labels)
+	}
+}
+
+func TestTxn_Errors(t *testing.T) {
+	h := newHandler(t)
+	lsid := newLsid()
+
+	resp := handle(t, h, txnCmd(bson.D{{Key: "count", Value: "col"}}, lsid, 1, false))
+	if code, _ := getField(resp, "code").(int32); code != 251 {
+		t.Errorf("no transaction: expected code 251, got %v", resp)
+	}
+
+	resp = handle(t, h, txnCmd(bson.D{{Key: "drop", Value: "col"}}, lsid, 1, true))
+	if code, _ := getField(resp, "code").(int32); code != 263 {
+		t.Errorf("drop in txn: expected code 263, got %v", resp)
+	}
+
+	assertOK(t, handle(t, h, txnCmd(bson.D{{Key: "find", Value: "col"}}, lsid, 2, true)))
+	resp = handle(t, h, txnCmd(bson.D{{Key: "find", Value: "col"}}, lsid, 1, true))
+	if code, _ := getField(resp, "code").(int32); code != 225 {
+		t.Errorf("old txnNumber: expected code 225, got %v", resp)
+	}
+
+	// A failed write aborts the transaction.
+	seed(t, h, "db", "col", bson.D{{Key: "_id", Value: "a"}})
+	dup := bson.D{{Key: "insert", Value: "col"}, {Key: "documents", Value: bson.A{bson.D{{Key: "_id", Value: "a"}}}}}
+	assertErr(t, handle(t, h, txnCmd(dup, lsid, 3, true)))
+	resp = handle(t, h, txnCmd(bson.D{{Key: "find", Value: "col"}}, lsid, 3, false))
+	if code, _ := getField(resp, "code").(int32); code != 251 {
+		t.Errorf("after failed write: expected code 251, got %v", resp)
+	}
+}
+
+func TestTxn_EndSessionsAborts(t *testing.T) {
+	h := newHandler(t)
+	lsid := newLsid()
+	insert := bson.D{{Key: "insert", Value: "col"}, {Key: "documents", Value: bson.A{bson.D{{Key: "x", Value: int32(1)}}}}}
+	assertOK(t, handle(t, h, txnCmd(insert, lsid, 1, true)))
+	assertOK(t, handle(t, h, bson.D{{Key: "endSessions", Value: bson.A{lsid}}, {Key: "$db", Value: "admin"}}))
+
+	resp := handle(t, h, txnCmd(bson.D{{Key: "commitTransaction", Value: int32(1)}}, lsid, 1, false))
+	assertErr(t, resp)
+	if n := countDocs(t, h, bson.D{{Key: "count", Value: "col"}, {Key: "$db", Value: "db"}}); n != 0 {
+		t.Errorf("expected 0 docs, got %d", n)
+	}
+}
@@ -118,7 +118,12 @@ func cmdGetFreeMonitoring(_ *Handler, _ string, _ bson.D, _ []proto.Section) (bs
 	}, nil
 }
 
-func cmdEndSessions(_ *Handler, _ string, _ bson.D, _ []proto.Section) (bson.D, error) {
+func cmdEndSessions(h *Handler, _ string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	for _, v := range getArrayField(cmd, "endSessions") {
+		if lsid, ok := v.(bson.D); ok {
+			h.sessions.end(lsid)
+		}
+	}
 	return okResp(), nil
 }
 
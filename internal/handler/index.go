@@ -47,6 +47,35 @@ func cmdCreateIndexes(h *Handler, db string, cmd bson.D, _ []proto.Section) (bso
 				if b, ok := e.Value.(bool); ok {
 					spec.Unique = b
 				}
+			case "sparse":
+				if b, ok := e.Value.(bool); ok {
+					spec.Sparse = b
+				}
+			case "partialFilterExpression":
+				d, ok := e.Value.(bson.D)
+				if !ok {
+					return errorResp(14, "TypeMismatch", "partialFilterExpression for an index must be a document"), nil
+				}
+				spec.PartialFilterExpression = d
+			case "collation":
+				d, ok := e.Value.(bson.D)
+				if !ok {
+					return errorResp(14, "TypeMismatch", "collation for an index must be a document"), nil
+				}
+				spec.Collation = d
+			case "expireAfterSeconds":
+				var secs int64
+				switch v := e.Value.(type) {
+				case int32:
+					secs = int64(v)
+				case int64:
+					secs = v
+				case float64:
+					secs = int64(v)
+				default:
+					return errorResp(14, "TypeMismatch", "TTL index 'expireAfterSeconds' option must be numeric"), nil
+				}
+				spec.ExpireAfterSeconds = &secs
 			}
 		}
 		specs = append(specs, spec)
@@ -71,23 +100,32 @@ func cmdListIndexes(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.
 	}
 
 	indexes := h.Engine.ListIndexes(db, collName)
-	batch := bson.A{}
+	var specs []bson.D
 	for _, idx := range indexes {
-		batch = append(batch, bson.D{
+		spec := bson.D{
 			{Key: "v", Value: int32(2)},
 			{Key: "key", Value: idx.Keys},
 			{Key: "name", Value: idx.Name},
-		})
+		}
+		if idx.Unique {
+			spec = append(spec, bson.E{Key: "unique", Value: true})
+		}
+		if idx.Sparse {
+			spec = append(spec, bson.E{Key: "sparse", Value: true})
+		}
+		if idx.PartialFilterExpression != nil {
+			spec = append(spec, bson.E{Key: "partialFilterExpression", Value: idx.PartialFilterExpression})
+		}
+		if idx.ExpireAfterSeconds != nil {
+			spec = append(spec, bson.E{Key: "expireAfterSeconds", Value: *idx.ExpireAfterSeconds})
+		}
+		if idx.Collation != nil {
+			spec = append(spec, bson.E{Key: "collation", Value: idx.Collation})
+		}
+		specs = append(specs, spec)
 	}
 
-	return bson.D{
-		{Key: "cursor", Value: bson.D{
-			{Key: "firstBatch", Value: batch},
-			{Key: "id", Value: int64(0)},
-			{Key: "ns", Value: db + "." + collName},
-		}},
-		{Key: "ok", Value: float64(1)},
-	}, nil
+	return h.cursorResp(db+"."+collName, specs, cursorBatchSize(getDocField(cmd, "cursor")), false), nil
 }
 
 func cmdDropIndexes(h *Handler, db string, cmd bson.D, _ []proto.Section) (bson.D, error) {
@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wricardo/mongolite/internal/engine"
+	"github.com/wricardo/mongolite/internal/proto"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func init() {
+	Register("commitTransaction", cmdCommitTransaction)
+	Register("committransaction", cmdCommitTransaction)
+	Register("abortTransaction", cmdAbortTransaction)
+	Register("aborttransaction", cmdAbortTransaction)
+}
+
+// defaultSessionTimeout matches the logicalSessionTimeoutMinutes reported by
+// hello. Idle sessions are forgotten and their transactions aborted.
+const defaultSessionTimeout = 30 * time.Minute
+
+// transientTxnLabel marks errors after which the driver retries the whole
+// transaction.
+const transientTxnLabel = "TransientTransactionError"
+
+// txnCommands lists the commands allowed inside a transaction.
+var txnCommands = map[string]bool{
+	"find":              true,
+	"insert":            true,
+	"update":            true,
+	"delete":            true,
+	"findandmodify":     true,
+	"aggregate":         true,
+	"count":             true,
+	"distinct":          true,
+	"bulkwrite":         true,
+	"getmore":           true,
+	"killcursors":       true,
+	"committransaction": true,
+	"aborttransaction":  true,
+}
+
+// docStore is the part of the engine API used by the CRUD commands. Inside a
+// transaction it is served by the session's *engine.Txn.
+type docStore interface {
+	Insert(db, coll string, docs []bson.D) ([]interface{}, error)
+	Find(db, coll string, filter bson.D, sort bson.D, skip, limit int64, collation *engine.Collation) ([]bson.D, error)
+	Update(db, coll string, filter bson.D, update interface{}, arrayFilters []bson.D, multi, upsert bool, collation *engine.Collation) (int64, int64, interface{}, error)
+	Delete(db, coll string, filter bson.D, multi bool, collation *engine.Collation) (int64, error)
+	Count(db, coll string, filter bson.D, collation *engine.Collation) (int64, error)
+	FindAndModify(db, coll string, filter bson.D, sort bson.D, update interface{}, arrayFilters []bson.D, remove bool, returnNew bool, upsert bool, collation *engine.Collation) (bson.D, error)
+	Aggregate(db, coll string, pipeline []bson.D, collation *engine.Collation) ([]bson.D, error)
+	Distinct(db, coll, field string, filter bson.D, collation *engine.Collation) ([]interface{}, error)
+}
+
+// store returns the transaction the command runs in, or the engine.
+func (h *Handler) store() docStore {
+	if h.txn != nil {
+		return h.txn
+	}
+	return h.Engine
+}
+
+// session is a logical session and its most recent transaction.
+type session struct {
+	txnNumber int64
+	txn       *engine.Txn
+	committed bool
+	lastUsed  time.Time
+}
+
+// sessionRegistry holds the sessions of a server, keyed by lsid.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	timeout  time.Duration
+	now      func() time.Time
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*session),
+		timeout:  defaultSessionTimeout,
+		now:      time.Now,
+	}
+}
+
+// sessionKey returns the registry key for an lsid document.
+func sessionKey(lsid bson.D) string {
+	for _, e := range lsid {
+		if e.Key != "id" {
+			continue
+		}
+		if b, ok := e.Value.(bson.Binary); ok {
+			return string(b.Data)
+		}
+		return fmt.Sprint(e.Value)
+	}
+	return ""
+}
+
+// expireLocked forgets sessions idle for longer than the timeout, aborting
+// their transactions. Callers must hold r.mu.
+func (r *sessionRegistry) expireLocked(now time.Time) {
+	for key, s := range r.sessions {
+		if now.Sub(s.lastUsed) > r.timeout {
+			if s.txn != nil {
+				_ = s.txn.Abort()
+			}
+			delete(r.sessions, key)
+		}
+	}
+}
+
+// end forgets the session with the given lsid, aborting its transaction.
+func (r *sessionRegistry) end(lsid bson.D) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.sessions[sessionKey(lsid)]; s != nil && s.txn != nil {
+		_ = s.txn.Abort()
+	}
+	delete(r.sessions, sessionKey(lsid))
+}
+
+// bind returns the handler to run cmd with. Commands outside a transaction
+// run on h itself; commands inside one run on a copy bound to the session's
+// transaction, which is started first if cmd carries startTransaction. A
+// non-nil bson.D is an error response to return instead.
+func (h *Handler) bind(name string, cmd bson.D) (*Handler, bson.D) {
+	lsid := getDocField(cmd, "lsid")
+	if lsid == nil || getBoolField(cmd, "autocommit", true) {
+		return h, nil
+	}
+	if !txnCommands[strings.ToLower(name)] {
+		return nil, errorResp(263, "OperationNotSupportedInTransaction",
+			fmt.Sprintf("Cannot run '%s' in a multi-document transaction.", name))
+	}
+	txnNumber := getInt64Field(cmd, "txnNumber")
+
+	r := h.sessions
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.expireLocked(now)
+	key := sessionKey(lsid)
+	s := r.sessions[key]
+	if s == nil {
+		s = &session{txnNumber: -1}
+		r.sessions[key] = s
+	}
+	s.lastUsed = now
+
+	if getBoolField(cmd, "startTransaction", false) {
+		if txnNumber <= s.txnNumber {
+			return nil, errorResp(225, "TransactionTooOld",
+				fmt.Sprintf("Cannot start transaction %d on session because a newer transaction %d has already started", txnNumber, s.txnNumber))
+		}
+		if s.txn != nil {
+			_ = s.txn.Abort()
+		}
+		s.txnNumber, s.txn, s.committed = txnNumber, h.Engine.Begin(), false
+	} else if txnNumber != s.txnNumber || s.txn == nil {
+		return nil, noSuchTxnResp(txnNumber)
+	} else if s.committed && !strings.EqualFold(name, "commitTransaction") {
+		return nil, errorResp(256, "TransactionCommitted",
+			fmt.Sprintf("Transaction %d has been committed.", txnNumber))
+	}
+
+	bound := *h
+	bound.sess, bound.txn = s, s.txn
+	return &bound, nil
+}
+
+func noSuchTxnResp(txnNumber int64) bson.D {
+	return withLabels(errorResp(251, "NoSuchTransaction",
+		fmt.Sprintf("Transaction %d has been aborted.", txnNumber)), transientTxnLabel)
+}
+
+// withLabels adds errorLabels to an error response.
+func withLabels(resp bson.D, labels ...string) bson.D {
+	arr := bson.A{}
+	for _, l := range labels {
+		arr = append(arr, l)
+	}
+	return append(resp, bson.E{Key: "errorLabels", Value: arr})
+}
+
+func cmdCommitTransaction(h *Handler, _ string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	if h.sess == nil {
+		return errorResp(2, "BadValue", "commitTransaction must be run within a transaction"), nil
+	}
+	h.sessions.mu.Lock()
+	committed := h.sess.committed
+	h.sessions.mu.Unlock()
+	if committed {
+		// A retried commit of a committed transaction succeeds again.
+		return okResp(), nil
+	}
+
+	err := h.txn.Commit()
+	switch {
+	case errors.Is(err, engine.ErrWriteConflict):
+		return withLabels(errorResp(112, "WriteConflict", err.Error()), transientTxnLabel), nil
+	case errors.Is(err, engine.ErrTxnDone):
+		return noSuchTxnResp(getInt64Field(cmd, "txnNumber")), nil
+	case err != nil:
+		return nil, err
+	}
+	h.sessions.mu.Lock()
+	h.sess.committed = true
+	h.sessions.mu.Unlock()
+	return okResp(), nil
+}
+
+func cmdAbortTransaction(h *Handler, _ string, cmd bson.D, _ []proto.Section) (bson.D, error) {
+	if h.sess == nil {
+		return errorResp(2, "BadValue", "abortTransaction must be run within a transaction"), nil
+	}
+	if err := h.txn.Abort(); err != nil {
+		return noSuchTxnResp(getInt64Field(cmd, "txnNumber")), nil
+	}
+	return okResp(), nil
+}
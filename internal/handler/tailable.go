@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/wricardo/mongolite/internal/engine"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// tailCursor is the state of an open tailable find cursor on a capped
+// collection. getMore holds mu while it waits for documents.
+type tailCursor struct {
+	mu         sync.Mutex
+	tail       *engine.TailCursor
+	projection bson.D
+	awaitData  bool
+}
+
+// findTailable answers a find with tailable set. The cursor stays open after
+// the documents already in the collection have been returned, and each
+// getMore returns the matching documents inserted since.
+func findTailable(h *Handler, db, collName string, cmd bson.D) (bson.D, error) {
+	sort := getDocField(cmd, "sort")
+	if len(sort) > 0 && !(len(sort) == 1 && sort[0].Key == "$natural" && getInt64Field(sort, "$natural") == 1) {
+		return errorResp(2, "BadValue", "cannot use tailable option with a sort other than {$natural: 1}"), nil
+	}
+	tail, err := h.Engine.Tail(db, collName, getDocField(cmd, "filter"))
+	if err != nil {
+		return nil, err
+	}
+	tc := &tailCursor{tail: tail, projection: getDocField(cmd, "projection"), awaitData: getBoolField(cmd, "awaitData", false)}
+
+	batch := bson.A{}
+	if batchSize := cursorBatchSize(cmd); batchSize != 0 {
+		if batchSize < 0 {
+			batchSize = defaultFirstBatch
+		}
+		batch, err = tc.next(0, int(batchSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+	ns := db + "." + collName
+	var id int64
+	if !getBoolField(cmd, "singleBatch", false) {
+		id = h.cursors.openLive(ns, tc)
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
+
+// next returns up to batchSize documents (0 means no limit), waiting up to
+// wait for one to be inserted.
+func (tc *tailCursor) next(wait time.Duration, batchSize int) (bson.A, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	docs, err := tc.tail.Next(wait, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(tc.projection) > 0 {
+		if docs, err = engine.ProjectDocs(docs, tc.projection); err != nil {
+			return nil, err
+		}
+	}
+	batch := bson.A{}
+	for _, doc := range docs {
+		batch = append(batch, doc)
+	}
+	return batch, nil
+}
+
+func (tc *tailCursor) close() {}
+
+// getMore answers a getMore on a tailable cursor. Without awaitData it
+// returns at once, possibly with an empty batch; with awaitData it waits up
+// to maxTimeMS (the driver's maxAwaitTimeMS) for a new document.
+func (tc *tailCursor) getMore(h *Handler, id int64, ns string, cmd bson.D) (bson.D, error) {
+	var wait time.Duration
+	if tc.awaitData {
+		wait = defaultAwaitTime
+		if ms := getInt64Field(cmd, "maxTimeMS"); ms > 0 {
+			wait = time.Duration(ms) * time.Millisecond
+		}
+	}
+	batch, err := tc.next(wait, int(getInt64Field(cmd, "batchSize")))
+	if errors.Is(err, engine.ErrCappedPositionLost) {
+		h.cursors.kill(id)
+		return errorResp(136, "CappedPositionLost", err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: ns},
+		}},
+		{Key: "ok", Value: float64(1)},
+	}, nil
+}
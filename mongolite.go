@@ -2,6 +2,8 @@ package mongolite
 
 import (
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/wricardo/mongolite/internal/engine"
 	"github.com/wricardo/mongolite/internal/handler"
@@ -11,11 +13,45 @@ import (
 // ListenAndServe starts a MongoDB wire-protocol compatible server on addr,
 // backed by the JSON file at filePath.
 func ListenAndServe(addr, filePath string) error {
-	eng, err := engine.New(filePath)
+	return ListenAndServeWithOptions(addr, filePath, Options{})
+}
+
+// Options configures the storage behind a server.
+type Options struct {
+	// Journal appends writes to <filePath>.journal instead of rewriting the
+	// whole data file on every write. The journal is folded back into the
+	// data file periodically and by "mongolite compact".
+	Journal bool
+}
+
+// ListenAndServeWithOptions is like ListenAndServe with storage options.
+func ListenAndServeWithOptions(addr, filePath string, opts Options) error {
+	eng, err := engine.NewWithOptions(filePath, engine.Options{Journal: opts.Journal})
 	if err != nil {
 		return fmt.Errorf("mongolite: %w", err)
 	}
 	h := handler.New(eng)
 	srv := server.New(addr, h)
+	done := make(chan struct{})
+	defer close(done)
+	go expireTTL(eng, done)
 	return srv.ListenAndServe()
 }
+
+// expireTTL removes documents expired by TTL indexes at startup and then
+// every engine.TTLMonitorInterval until done is closed.
+func expireTTL(eng *engine.Engine, done <-chan struct{}) {
+	ticker := time.NewTicker(engine.TTLMonitorInterval)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		if _, err := eng.ExpireTTL(now); err != nil {
+			log.Printf("TTL monitor: %v", err)
+		}
+		select {
+		case now = <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}